@@ -0,0 +1,309 @@
+package mtproto
+
+import (
+	"fmt"
+
+	"golang.org/x/net/context"
+)
+
+// Takeout sessions for the data export (account.initTakeoutSession, account.finishTakeoutSession,
+// invokeWithTakeout, and the TAKEOUT_INIT_DELAY_X error) are not in layer 71,
+// so they are not available until the schema is upgraded.
+// See https://core.telegram.org/api/takeout
+
+// PushTokenType is the token_type of account.registerDevice.
+// See https://core.telegram.org/api/push-updates
+type PushTokenType int32
+
+const (
+	PushTokenAPNS        PushTokenType = 1
+	PushTokenFCM         PushTokenType = 2 // Firebase Cloud Messaging, formerly GCM
+	PushTokenMPNS        PushTokenType = 3
+	PushTokenSimplePush  PushTokenType = 4
+	PushTokenUbuntuPhone PushTokenType = 5
+	PushTokenBlackberry  PushTokenType = 6
+	PushTokenWNS         PushTokenType = 8
+	PushTokenAPNSVoIP    PushTokenType = 9
+	PushTokenWebPush     PushTokenType = 10
+	PushTokenMPNSVoIP    PushTokenType = 11
+	PushTokenTizen       PushTokenType = 12
+)
+
+// PushOptions describes a device registered for push notifications.
+// Layer 71 takes only the token type and the token. App sandbox and secret
+// arrived in later layers, so they are not part of the request.
+type PushOptions struct {
+	TokenType PushTokenType
+	Token     string
+}
+
+func (opts PushOptions) check() error {
+	if opts.TokenType == 0 || opts.Token == "" {
+		return fmt.Errorf("empty push token type or token")
+	}
+	return nil
+}
+
+// RegisterDevice subscribes the device to Telegram push notifications.
+func (mconn *Conn) RegisterDevice(opts PushOptions) error {
+	return registerDevice(mconn, opts)
+}
+
+// RegisterDeviceContext is RegisterDevice which gives up on ctx done.
+func (mconn *Conn) RegisterDeviceContext(ctx context.Context, opts PushOptions) error {
+	return registerDevice(mconn.contextRPC(ctx), opts)
+}
+
+func registerDevice(rpc RemoteProcedureCall, opts PushOptions) error {
+	if err := opts.check(); err != nil {
+		return err
+	}
+	data, err := rpc.InvokeBlocked(&ReqAccountRegisterDevice{
+		TokenType: int32(opts.TokenType),
+		Token:     opts.Token,
+	})
+	if err != nil {
+		return err
+	}
+	if tl, ok := data.(TL); !ok || !toBool(tl) {
+		return fmt.Errorf("register device failure: %T: %v", data, data)
+	}
+	return nil
+}
+
+// UnregisterDevice stops push notifications to the device registered by RegisterDevice.
+func (mconn *Conn) UnregisterDevice(opts PushOptions) error {
+	return unregisterDevice(mconn, opts)
+}
+
+// UnregisterDeviceContext is UnregisterDevice which gives up on ctx done.
+func (mconn *Conn) UnregisterDeviceContext(ctx context.Context, opts PushOptions) error {
+	return unregisterDevice(mconn.contextRPC(ctx), opts)
+}
+
+func unregisterDevice(rpc RemoteProcedureCall, opts PushOptions) error {
+	if err := opts.check(); err != nil {
+		return err
+	}
+	data, err := rpc.InvokeBlocked(&ReqAccountUnregisterDevice{
+		TokenType: int32(opts.TokenType),
+		Token:     opts.Token,
+	})
+	if err != nil {
+		return err
+	}
+	if tl, ok := data.(TL); !ok || !toBool(tl) {
+		return fmt.Errorf("unregister device failure: %T: %v", data, data)
+	}
+	return nil
+}
+
+// AccountUpdateProfile changes the names and the bio of the signed-in user, and returns the updated user.
+// The nil arguments are unchanged.
+func (mconn *Conn) AccountUpdateProfile(firstName, lastName, about *string) (*PredUser, error) {
+	return updateProfile(mconn, firstName, lastName, about)
+}
+
+// AccountUpdateProfileContext is AccountUpdateProfile which gives up on ctx done.
+func (mconn *Conn) AccountUpdateProfileContext(ctx context.Context, firstName, lastName, about *string) (*PredUser, error) {
+	return updateProfile(mconn.contextRPC(ctx), firstName, lastName, about)
+}
+
+func updateProfile(rpc RemoteProcedureCall, firstName, lastName, about *string) (*PredUser, error) {
+	req := &ReqAccountUpdateProfile{}
+	if firstName != nil {
+		req.Flags |= 1 << 0
+		req.FirstName = *firstName
+	}
+	if lastName != nil {
+		req.Flags |= 1 << 1
+		req.LastName = *lastName
+	}
+	if about != nil {
+		req.Flags |= 1 << 2
+		req.About = *about
+	}
+	user, err := RPCaller{rpc}.AccountUpdateProfile(context.Background(), req)
+	if err != nil {
+		return nil, err
+	}
+	if user.GetUser() == nil {
+		return nil, fmt.Errorf("RPC: %#v", user)
+	}
+	return user.GetUser(), nil
+}
+
+// AccountUpdateUsername changes the username of the signed-in user, and returns the updated user.
+// An empty username removes it.
+// It returns UsernameOccupiedError or UsernameInvalidError if the username cannot be taken.
+func (mconn *Conn) AccountUpdateUsername(username string) (*PredUser, error) {
+	return updateUsername(mconn, username)
+}
+
+// AccountUpdateUsernameContext is AccountUpdateUsername which gives up on ctx done.
+func (mconn *Conn) AccountUpdateUsernameContext(ctx context.Context, username string) (*PredUser, error) {
+	return updateUsername(mconn.contextRPC(ctx), username)
+}
+
+func updateUsername(rpc RemoteProcedureCall, username string) (*PredUser, error) {
+	user, err := RPCaller{rpc}.AccountUpdateUsername(context.Background(), &ReqAccountUpdateUsername{Username: username})
+	if err != nil {
+		return nil, err
+	}
+	if user.GetUser() == nil {
+		return nil, fmt.Errorf("RPC: %#v", user)
+	}
+	return user.GetUser(), nil
+}
+
+// PrivacyKeyStatusTimestamp is the key of the privacy of the last seen time and the online status.
+// Layer 71 has no key of the phone number, which arrived in later layers.
+func PrivacyKeyStatusTimestamp() *TypeInputPrivacyKey {
+	return &TypeInputPrivacyKey{&TypeInputPrivacyKey_InputPrivacyKeyStatusTimestamp{&PredInputPrivacyKeyStatusTimestamp{}}}
+}
+
+// PrivacyKeyChatInvite is the key of the privacy of who may invite the user to chats.
+func PrivacyKeyChatInvite() *TypeInputPrivacyKey {
+	return &TypeInputPrivacyKey{&TypeInputPrivacyKey_InputPrivacyKeyChatInvite{&PredInputPrivacyKeyChatInvite{}}}
+}
+
+// PrivacyKeyPhoneCall is the key of the privacy of who may call the user.
+func PrivacyKeyPhoneCall() *TypeInputPrivacyKey {
+	return &TypeInputPrivacyKey{&TypeInputPrivacyKey_InputPrivacyKeyPhoneCall{&PredInputPrivacyKeyPhoneCall{}}}
+}
+
+// PrivacyValue is the base of a privacy setting, to which the users of PrivacyRules are exceptions.
+type PrivacyValue int
+
+const (
+	PrivacyNobody PrivacyValue = iota
+	PrivacyContacts
+	PrivacyEverybody
+)
+
+func (v PrivacyValue) String() string {
+	switch v {
+	case PrivacyNobody:
+		return "nobody"
+	case PrivacyContacts:
+		return "contacts"
+	case PrivacyEverybody:
+		return "everybody"
+	}
+	return fmt.Sprintf("PrivacyValue(%d)", int(v))
+}
+
+// PrivacyRules is a privacy setting returned by AccountGetPrivacy and AccountSetPrivacy.
+// Allow and Deny are the ids of the users excepted from Value, and Users has the users of them.
+type PrivacyRules struct {
+	Value PrivacyValue
+	Allow []int32
+	Deny  []int32
+	Users map[int32]*PredUser
+}
+
+// PrivacyEverybodyRules are the rules of AccountSetPrivacy allowing everybody but the denied users.
+func PrivacyEverybodyRules(deny ...*TypeInputUser) []*TypeInputPrivacyRule {
+	return privacyRules(nil, deny, &TypeInputPrivacyRule{&TypeInputPrivacyRule_InputPrivacyValueAllowAll{
+		&PredInputPrivacyValueAllowAll{},
+	}})
+}
+
+// PrivacyContactsRules are the rules of AccountSetPrivacy allowing the contacts and the allowed users,
+// but the denied users.
+func PrivacyContactsRules(allow, deny []*TypeInputUser) []*TypeInputPrivacyRule {
+	return privacyRules(allow, deny, &TypeInputPrivacyRule{&TypeInputPrivacyRule_InputPrivacyValueAllowContacts{
+		&PredInputPrivacyValueAllowContacts{},
+	}})
+}
+
+// PrivacyNobodyRules are the rules of AccountSetPrivacy allowing only the allowed users.
+func PrivacyNobodyRules(allow ...*TypeInputUser) []*TypeInputPrivacyRule {
+	return privacyRules(allow, nil, &TypeInputPrivacyRule{&TypeInputPrivacyRule_InputPrivacyValueDisallowAll{
+		&PredInputPrivacyValueDisallowAll{},
+	}})
+}
+
+// privacyRules puts the exceptions before the base rule, because the first rule matching a user applies
+func privacyRules(allow, deny []*TypeInputUser, base *TypeInputPrivacyRule) []*TypeInputPrivacyRule {
+	var rules []*TypeInputPrivacyRule
+	if len(allow) > 0 {
+		rules = append(rules, &TypeInputPrivacyRule{&TypeInputPrivacyRule_InputPrivacyValueAllowUsers{
+			&PredInputPrivacyValueAllowUsers{Users: allow},
+		}})
+	}
+	if len(deny) > 0 {
+		rules = append(rules, &TypeInputPrivacyRule{&TypeInputPrivacyRule_InputPrivacyValueDisallowUsers{
+			&PredInputPrivacyValueDisallowUsers{Users: deny},
+		}})
+	}
+	return append(rules, base)
+}
+
+// AccountGetPrivacy returns the privacy setting of the key, e.g., PrivacyKeyStatusTimestamp.
+func (mconn *Conn) AccountGetPrivacy(key *TypeInputPrivacyKey) (*PrivacyRules, error) {
+	return getPrivacy(mconn, key)
+}
+
+// AccountGetPrivacyContext is AccountGetPrivacy which gives up on ctx done.
+func (mconn *Conn) AccountGetPrivacyContext(ctx context.Context, key *TypeInputPrivacyKey) (*PrivacyRules, error) {
+	return getPrivacy(mconn.contextRPC(ctx), key)
+}
+
+func getPrivacy(rpc RemoteProcedureCall, key *TypeInputPrivacyKey) (*PrivacyRules, error) {
+	rules, err := RPCaller{rpc}.AccountGetPrivacy(context.Background(), &ReqAccountGetPrivacy{Key: key})
+	if err != nil {
+		return nil, err
+	}
+	return privacyRulesOf(rules.GetValue()), nil
+}
+
+// AccountSetPrivacy changes the privacy setting of the key to the rules, e.g., PrivacyContactsRules,
+// and returns the new setting.
+func (mconn *Conn) AccountSetPrivacy(key *TypeInputPrivacyKey, rules []*TypeInputPrivacyRule) (*PrivacyRules, error) {
+	return setPrivacy(mconn, key, rules)
+}
+
+// AccountSetPrivacyContext is AccountSetPrivacy which gives up on ctx done.
+func (mconn *Conn) AccountSetPrivacyContext(ctx context.Context, key *TypeInputPrivacyKey, rules []*TypeInputPrivacyRule) (*PrivacyRules, error) {
+	return setPrivacy(mconn.contextRPC(ctx), key, rules)
+}
+
+func setPrivacy(rpc RemoteProcedureCall, key *TypeInputPrivacyKey, rules []*TypeInputPrivacyRule) (*PrivacyRules, error) {
+	set, err := RPCaller{rpc}.AccountSetPrivacy(context.Background(), &ReqAccountSetPrivacy{Key: key, Rules: rules})
+	if err != nil {
+		return nil, err
+	}
+	return privacyRulesOf(set.GetValue()), nil
+}
+
+// privacyRulesOf decodes the rules in order. The first base rule is the value, and nobody without one.
+func privacyRulesOf(rules *PredAccountPrivacyRules) *PrivacyRules {
+	result := &PrivacyRules{Users: make(map[int32]*PredUser)}
+	hasValue := false
+	setValue := func(v PrivacyValue) {
+		if !hasValue {
+			result.Value, hasValue = v, true
+		}
+	}
+	for _, rule := range rules.GetRules() {
+		switch x := rule.GetValue().(type) {
+		case *TypePrivacyRule_PrivacyValueAllowAll:
+			setValue(PrivacyEverybody)
+		case *TypePrivacyRule_PrivacyValueAllowContacts:
+			setValue(PrivacyContacts)
+		case *TypePrivacyRule_PrivacyValueDisallowAll:
+			setValue(PrivacyNobody)
+		case *TypePrivacyRule_PrivacyValueAllowUsers:
+			result.Allow = append(result.Allow, x.PrivacyValueAllowUsers.Users...)
+		case *TypePrivacyRule_PrivacyValueDisallowUsers:
+			result.Deny = append(result.Deny, x.PrivacyValueDisallowUsers.Users...)
+		}
+	}
+	for _, u := range rules.GetUsers() {
+		if user := u.GetUser(); user != nil {
+			result.Users[user.Id] = user
+		}
+	}
+	return result
+}
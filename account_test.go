@@ -0,0 +1,188 @@
+package mtproto
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func TestUpdateProfileEncoding(t *testing.T) {
+	rpc := &recordRPC{resp: &PredUser{Id: 1, LastName: "Go"}}
+	lastName := "Go"
+	user, err := updateProfile(rpc, nil, &lastName, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.LastName != "Go" {
+		t.Errorf("unexpected user %v", user)
+	}
+
+	// only the last name is changed
+	expected, _ := hex.DecodeString(
+		"75575178" + // account.updateProfile
+			"02000000" + // flags
+			"02476f00") // last_name
+	if encoded := rpc.reqs[0].encode(); !bytes.Equal(encoded, expected) {
+		t.Errorf("expected %x, but %x", expected, encoded)
+	}
+}
+
+// usernameTakenRPC rejects the usernames as the server does
+type usernameTakenRPC struct{}
+
+func (usernameTakenRPC) InvokeBlocked(msg TL) (interface{}, error) {
+	switch username := msg.(*ReqAccountUpdateUsername).Username; username {
+	case "durov":
+		return nil, toError(TL_rpc_error{errorBadRequest, "USERNAME_OCCUPIED"})
+	case "go":
+		return nil, toError(TL_rpc_error{errorBadRequest, "USERNAME_INVALID"})
+	default:
+		return &PredUser{Id: 1, Username: username}, nil
+	}
+}
+
+func TestUpdateUsernameErrors(t *testing.T) {
+	if _, err := updateUsername(usernameTakenRPC{}, "durov"); err != (UsernameOccupiedError{}) || !IsBadRequest(err) {
+		t.Errorf("unexpected error %#v", err)
+	}
+	if _, err := updateUsername(usernameTakenRPC{}, "go"); err != (UsernameInvalidError{}) || !IsBadRequest(err) {
+		t.Errorf("unexpected error %#v", err)
+	}
+	user, err := updateUsername(usernameTakenRPC{}, "gopher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Username != "gopher" {
+		t.Errorf("unexpected user %v", user)
+	}
+}
+
+// privacyRPC keeps the rules set to return them on get
+type privacyRPC struct {
+	reqs  []TL
+	rules []*TypePrivacyRule
+}
+
+func (r *privacyRPC) InvokeBlocked(msg TL) (interface{}, error) {
+	r.reqs = append(r.reqs, msg)
+	if req, ok := msg.(*ReqAccountSetPrivacy); ok {
+		r.rules = nil
+		for _, rule := range req.Rules {
+			switch x := rule.GetValue().(type) {
+			case *TypeInputPrivacyRule_InputPrivacyValueAllowUsers:
+				var ids []int32
+				for _, user := range x.InputPrivacyValueAllowUsers.Users {
+					ids = append(ids, user.GetInputUser().GetUserId())
+				}
+				r.rules = append(r.rules, &TypePrivacyRule{&TypePrivacyRule_PrivacyValueAllowUsers{&PredPrivacyValueAllowUsers{Users: ids}}})
+			case *TypeInputPrivacyRule_InputPrivacyValueDisallowAll:
+				r.rules = append(r.rules, &TypePrivacyRule{&TypePrivacyRule_PrivacyValueDisallowAll{&PredPrivacyValueDisallowAll{}}})
+			}
+		}
+	}
+	return &PredAccountPrivacyRules{
+		Rules: r.rules,
+		Users: []*TypeUser{{&TypeUser_User{&PredUser{Id: 5, FirstName: "Gopher"}}}},
+	}, nil
+}
+
+func TestPrivacyStatusTimestamp(t *testing.T) {
+	rpc := &privacyRPC{}
+	user := &TypeInputUser{&TypeInputUser_InputUser{&PredInputUser{UserId: 5, AccessHash: 6}}}
+	if _, err := setPrivacy(rpc, PrivacyKeyStatusTimestamp(), PrivacyNobodyRules(user)); err != nil {
+		t.Fatal(err)
+	}
+	rules, err := getPrivacy(rpc, PrivacyKeyStatusTimestamp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rules.Value != PrivacyNobody || len(rules.Allow) != 1 || rules.Allow[0] != 5 || len(rules.Deny) != 0 {
+		t.Errorf("unexpected rules %v", rules)
+	}
+	if rules.Users[5].GetFirstName() != "Gopher" {
+		t.Errorf("unexpected users %v", rules.Users)
+	}
+
+	// the allowed users come before nobody
+	expected, _ := hex.DecodeString(
+		"e81cf8c9" + // account.setPrivacy
+			"18cb964f" + // inputPrivacyKeyStatusTimestamp
+			"15c4b51c" + "02000000" + // rules
+			"7fc61c13" + // inputPrivacyValueAllowUsers
+			"15c4b51c" + "01000000" + // users
+			"162829d8" + "05000000" + "0600000000000000" + // inputUser
+			"c9666bd6") // inputPrivacyValueDisallowAll
+	if encoded := rpc.reqs[0].encode(); !bytes.Equal(encoded, expected) {
+		t.Errorf("expected %x, but %x", expected, encoded)
+	}
+}
+
+func TestPrivacyRulesOf(t *testing.T) {
+	for _, tc := range []struct {
+		rules []*TypeInputPrivacyRule
+		value PrivacyValue
+	}{
+		{PrivacyEverybodyRules(), PrivacyEverybody},
+		{PrivacyContactsRules(nil, nil), PrivacyContacts},
+		{PrivacyNobodyRules(), PrivacyNobody},
+		{nil, PrivacyNobody},
+	} {
+		var rules []*TypePrivacyRule
+		for _, rule := range tc.rules {
+			switch rule.GetValue().(type) {
+			case *TypeInputPrivacyRule_InputPrivacyValueAllowAll:
+				rules = append(rules, &TypePrivacyRule{&TypePrivacyRule_PrivacyValueAllowAll{&PredPrivacyValueAllowAll{}}})
+			case *TypeInputPrivacyRule_InputPrivacyValueAllowContacts:
+				rules = append(rules, &TypePrivacyRule{&TypePrivacyRule_PrivacyValueAllowContacts{&PredPrivacyValueAllowContacts{}}})
+			case *TypeInputPrivacyRule_InputPrivacyValueDisallowAll:
+				rules = append(rules, &TypePrivacyRule{&TypePrivacyRule_PrivacyValueDisallowAll{&PredPrivacyValueDisallowAll{}}})
+			}
+		}
+		if value := privacyRulesOf(&PredAccountPrivacyRules{Rules: rules}).Value; value != tc.value {
+			t.Errorf("%v: %v, expected %v", tc.rules, value, tc.value)
+		}
+	}
+}
+
+func TestRegisterDeviceEncoding(t *testing.T) {
+	opts := PushOptions{TokenType: PushTokenFCM, Token: "tok"}
+	rpc := &recordRPC{resp: &PredBoolTrue{}}
+	if err := registerDevice(rpc, opts); err != nil {
+		t.Fatal(err)
+	}
+	if err := unregisterDevice(rpc, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"78a87e63" + // account.registerDevice
+			"02000000" + // token_type
+			"03746f6b", // token
+		"405bc565" + // account.unregisterDevice
+			"02000000" + // token_type
+			"03746f6b", // token
+	}
+	for i, req := range rpc.reqs {
+		if encoded := hex.EncodeToString(req.encode()); encoded != expected[i] {
+			t.Errorf("expected %s, but %s", expected[i], encoded)
+		}
+	}
+
+	if err := registerDevice(rpc, PushOptions{TokenType: PushTokenFCM}); err == nil {
+		t.Error("registered an empty token")
+	}
+	if len(rpc.reqs) != 2 {
+		t.Errorf("invoked %d requests, expected 2", len(rpc.reqs))
+	}
+}
+
+func TestRegisterDeviceFailure(t *testing.T) {
+	opts := PushOptions{TokenType: PushTokenAPNS, Token: "tok"}
+	rpc := &recordRPC{resp: &PredBoolFalse{}}
+	if err := registerDevice(rpc, opts); err == nil {
+		t.Error("boolFalse is not a failure of registerDevice")
+	}
+	if err := unregisterDevice(rpc, opts); err == nil {
+		t.Error("boolFalse is not a failure of unregisterDevice")
+	}
+}
@@ -0,0 +1,388 @@
+package mtproto
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// QR-code login (auth.exportLoginToken, auth.importLoginToken, and the auth.loginToken* results)
+// is not in layer 71, so it is not available until the schema is upgraded.
+// See https://core.telegram.org/api/qr-login
+
+// passwordHash is password_hash of auth.checkPassword, sha256(current_salt + password + current_salt).
+// Layer 71 predates SRP, which replaced the salted hash from layer 82.
+func passwordHash(currentSalt []byte, password string) []byte {
+	h := sha256.New()
+	h.Write(currentSalt)
+	h.Write([]byte(password))
+	h.Write(currentSalt)
+	return h.Sum(nil)
+}
+
+// AuthCheckPassword finishes the sign-in of an account protected by a cloud password.
+// Call it after SignIn fails with PasswordNeededError.
+func (mconn *Conn) AuthCheckPassword(password string) (*PredUser, error) {
+	return mconn.AuthCheckPasswordContext(context.Background(), password)
+}
+
+// AuthCheckPasswordContext is AuthCheckPassword which gives up on ctx done.
+func (mconn *Conn) AuthCheckPasswordContext(ctx context.Context, password string) (*PredUser, error) {
+	data, err := mconn.InvokeBlockedContext(ctx, &ReqAccountGetPassword{})
+	if err != nil {
+		return nil, err
+	}
+	var currentSalt []byte
+	switch x := data.(type) {
+	case *PredAccountPassword:
+		currentSalt = x.CurrentSalt
+	case *PredAccountNoPassword:
+		return nil, fmt.Errorf("no cloud password is set")
+	default:
+		return nil, fmt.Errorf("RPC: %#v", data)
+	}
+
+	data, err = mconn.InvokeBlockedContext(ctx, &ReqAuthCheckPassword{passwordHash(currentSalt, password)})
+	if err != nil {
+		return nil, err
+	}
+	auth, ok := data.(*PredAuthAuthorization)
+	if !ok {
+		return nil, fmt.Errorf("RPC: %#v", data)
+	}
+	return mconn.signedIn(auth)
+}
+
+// AuthResendCode sends the sign-in code again by the next_type of the last sent code.
+// With an empty phoneCodeHash, the hash of the last sent code is used.
+// It returns SendCodeUnavailableError when no more way of the delivery is left.
+func (mconn *Conn) AuthResendCode(phoneCodeHash string) (*TypeAuthSentCode, error) {
+	session, err := mconn.Session()
+	if err != nil {
+		return nil, err
+	}
+	return resendCode(mconn, session, phoneCodeHash)
+}
+
+// AuthResendCodeContext is AuthResendCode which gives up on ctx done.
+func (mconn *Conn) AuthResendCodeContext(ctx context.Context, phoneCodeHash string) (*TypeAuthSentCode, error) {
+	session, err := mconn.Session()
+	if err != nil {
+		return nil, err
+	}
+	return resendCode(mconn.contextRPC(ctx), session, phoneCodeHash)
+}
+
+func resendCode(rpc RemoteProcedureCall, session *Session, phoneCodeHash string) (*TypeAuthSentCode, error) {
+	if phoneCodeHash == "" {
+		phoneCodeHash = session.getPhoneCodeHash()
+	}
+	if session.phonenumber == "" || phoneCodeHash == "" {
+		return nil, fmt.Errorf("no code is sent to resend")
+	}
+	data, err := rpc.InvokeBlocked(&ReqAuthResendCode{
+		PhoneNumber:   session.phonenumber,
+		PhoneCodeHash: phoneCodeHash,
+	})
+	if err != nil {
+		return nil, err
+	}
+	sentCode, ok := data.(*PredAuthSentCode)
+	if !ok {
+		return nil, fmt.Errorf("RPC: %#v", data)
+	}
+	session.setSentCode(sentCode)
+	return &TypeAuthSentCode{sentCode}, nil
+}
+
+// AuthSignUp registers the phone number, after SignIn fails with SignUpRequiredError.
+// The code confirmed by the SignIn is used again, as layer 71 auth.signUp requires it.
+// The user should accept AuthTermsOfService before signing up.
+func (mconn *Conn) AuthSignUp(phoneCodeHash, firstName, lastName string) (*PredUser, error) {
+	return mconn.AuthSignUpContext(context.Background(), phoneCodeHash, firstName, lastName)
+}
+
+// AuthSignUpContext is AuthSignUp which gives up on ctx done.
+func (mconn *Conn) AuthSignUpContext(ctx context.Context, phoneCodeHash, firstName, lastName string) (*PredUser, error) {
+	session, err := mconn.Session()
+	if err != nil {
+		return nil, err
+	}
+	auth, err := signUp(mconn.contextRPC(ctx), session, phoneCodeHash, firstName, lastName)
+	if err != nil {
+		return nil, err
+	}
+	return mconn.signedIn(auth)
+}
+
+func signUp(rpc RemoteProcedureCall, session *Session, phoneCodeHash, firstName, lastName string) (*PredAuthAuthorization, error) {
+	if firstName == "" {
+		return nil, fmt.Errorf("empty first name")
+	}
+	session.codeMutex.Lock()
+	phoneCode := session.signUpCode
+	if phoneCodeHash == "" {
+		phoneCodeHash = session.phoneCodeHash
+	}
+	session.codeMutex.Unlock()
+	if phoneCode == "" || phoneCodeHash == "" {
+		return nil, fmt.Errorf("no code is confirmed for sign-up, SignIn first")
+	}
+
+	data, err := rpc.InvokeBlocked(&ReqAuthSignUp{
+		PhoneNumber:   session.phonenumber,
+		PhoneCodeHash: phoneCodeHash,
+		PhoneCode:     phoneCode,
+		FirstName:     firstName,
+		LastName:      lastName,
+	})
+	if err != nil {
+		return nil, err
+	}
+	auth, ok := data.(*PredAuthAuthorization)
+	if !ok {
+		return nil, fmt.Errorf("RPC: %#v", data)
+	}
+	session.codeMutex.Lock()
+	session.signUpCode = ""
+	session.codeMutex.Unlock()
+	return auth, nil
+}
+
+// AuthTermsOfService returns the terms of service of Telegram, which a new user must accept.
+func (mconn *Conn) AuthTermsOfService() (string, error) {
+	return mconn.AuthTermsOfServiceContext(context.Background())
+}
+
+// AuthTermsOfServiceContext is AuthTermsOfService which gives up on ctx done.
+func (mconn *Conn) AuthTermsOfServiceContext(ctx context.Context) (string, error) {
+	data, err := mconn.InvokeBlockedContext(ctx, &ReqHelpGetTermsOfService{})
+	if err != nil {
+		return "", err
+	}
+	tos, ok := data.(*PredHelpTermsOfService)
+	if !ok {
+		return "", fmt.Errorf("RPC: %#v", data)
+	}
+	return tos.Text, nil
+}
+
+// CodeType is the way of the sign-in code delivery.
+type CodeType int
+
+const (
+	CodeTypeNone CodeType = iota // no more way
+	CodeTypeSms
+	CodeTypeCall
+	CodeTypeFlashCall
+)
+
+// NextCodeType tells how AuthResendCode delivers the code sent by sentCode.
+func NextCodeType(sentCode *TypeAuthSentCode) CodeType {
+	return nextCodeType(sentCode.GetValue())
+}
+
+func nextCodeType(sentCode *PredAuthSentCode) CodeType {
+	nextType := sentCode.GetNextType()
+	switch {
+	case nextType.GetAuthCodeTypeSms() != nil:
+		return CodeTypeSms
+	case nextType.GetAuthCodeTypeCall() != nil:
+		return CodeTypeCall
+	case nextType.GetAuthCodeTypeFlashCall() != nil:
+		return CodeTypeFlashCall
+	}
+	return CodeTypeNone
+}
+
+// SentCodeInfo is auth.sentCode flattened, to prompt for the code by the way it is sent.
+// The types are "app", "sms", "call" and "flash_call", of the auth.sentCodeType and the auth.codeType variants.
+type SentCodeInfo struct {
+	Type string
+	// NextType is the way AuthResendCode sends the code, or empty if the code cannot be resent.
+	NextType string
+	// Length is the number of the digits of the code, or zero for a flash call.
+	Length int
+	// Pattern is the pattern of the number of a flash call, whose last digits are the code.
+	Pattern string
+	// Timeout is the wait before the code can be resent by NextType, or zero if there is none.
+	Timeout  time.Duration
+	CodeHash string
+	// PhoneRegistered is set if the phone number has an account to SignIn, rather than to AuthSignUp.
+	PhoneRegistered bool
+}
+
+// SentCodeInfoOf returns the information of the sent code.
+func SentCodeInfoOf(sentCode *TypeAuthSentCode) SentCodeInfo {
+	x := sentCode.GetValue()
+	info := SentCodeInfo{
+		Timeout:         time.Duration(x.GetTimeout()) * time.Second,
+		CodeHash:        x.GetPhoneCodeHash(),
+		PhoneRegistered: x.GetFlags()&(1<<0) != 0,
+	}
+	switch t := x.GetType().GetValue().(type) {
+	case *TypeAuthSentCodeType_AuthSentCodeTypeApp:
+		info.Type, info.Length = "app", int(t.AuthSentCodeTypeApp.Length)
+	case *TypeAuthSentCodeType_AuthSentCodeTypeSms:
+		info.Type, info.Length = "sms", int(t.AuthSentCodeTypeSms.Length)
+	case *TypeAuthSentCodeType_AuthSentCodeTypeCall:
+		info.Type, info.Length = "call", int(t.AuthSentCodeTypeCall.Length)
+	case *TypeAuthSentCodeType_AuthSentCodeTypeFlashCall:
+		info.Type, info.Pattern = "flash_call", t.AuthSentCodeTypeFlashCall.Pattern
+	}
+	switch nextCodeType(x) {
+	case CodeTypeSms:
+		info.NextType = "sms"
+	case CodeTypeCall:
+		info.NextType = "call"
+	case CodeTypeFlashCall:
+		info.NextType = "flash_call"
+	}
+	return info
+}
+
+// AuthRequestCall asks Telegram to read the sign-in code over a phone call, when SMS is not delivered.
+// Layer 71 auth.resendCode does not take the delivery type, and the call is only the next_type of the sent code,
+// so it fails unless NextCodeType of the last sent code is CodeTypeCall.
+// The call is available only after the timeout of the sent code elapses; before that, it returns FloodWaitError
+// with the seconds left. With an empty phoneCodeHash, the hash of the last sent code is used.
+func (mconn *Conn) AuthRequestCall(phoneCodeHash string) (*TypeAuthSentCode, error) {
+	session, err := mconn.Session()
+	if err != nil {
+		return nil, err
+	}
+	return requestCall(mconn, session, phoneCodeHash, time.Now())
+}
+
+// AuthRequestCallContext is AuthRequestCall which gives up on ctx done.
+func (mconn *Conn) AuthRequestCallContext(ctx context.Context, phoneCodeHash string) (*TypeAuthSentCode, error) {
+	session, err := mconn.Session()
+	if err != nil {
+		return nil, err
+	}
+	return requestCall(mconn.contextRPC(ctx), session, phoneCodeHash, time.Now())
+}
+
+func requestCall(rpc RemoteProcedureCall, session *Session, phoneCodeHash string, now time.Time) (*TypeAuthSentCode, error) {
+	session.codeMutex.Lock()
+	codeType, resendAfter := session.nextCodeType, session.resendAfter
+	session.codeMutex.Unlock()
+	if codeType != CodeTypeCall {
+		return nil, fmt.Errorf("the code cannot be sent by a call, but by code type %d", codeType)
+	}
+	if wait := resendAfter.Sub(now); wait > 0 {
+		return nil, FloodWaitError{int((wait + time.Second - 1) / time.Second)}
+	}
+	return resendCode(rpc, session, phoneCodeHash)
+}
+
+// AuthLogOut logs out of the account, and closes the connection.
+// The key file is removed, so the next Manager.LoadAuthentication fails and the user has to sign in again.
+// Layer 71 auth.logOut returns only a Bool; future_auth_token arrived in a later layer.
+func (mconn *Conn) AuthLogOut() error {
+	return mconn.logOut(mconn)
+}
+
+// AuthLogOutContext is AuthLogOut which gives up auth.logOut on ctx done.
+// The close of the connection after it is waited for regardless of ctx.
+func (mconn *Conn) AuthLogOutContext(ctx context.Context) error {
+	return mconn.logOut(mconn.contextRPC(ctx))
+}
+
+func (mconn *Conn) logOut(rpc RemoteProcedureCall) error {
+	if atomic.LoadInt32(&mconn.loggedOut) == 1 {
+		return ErrLoggedOut
+	}
+	session, err := mconn.Session()
+	if err != nil {
+		return err
+	}
+
+	data, err := rpc.InvokeBlocked(&ReqAuthLogOut{})
+	if err != nil {
+		return err
+	}
+	if tl, ok := data.(TL); !ok || !toBool(tl) {
+		return fmt.Errorf("RPC: %#v", data)
+	}
+	if !atomic.CompareAndSwapInt32(&mconn.loggedOut, 0, 1) {
+		return ErrLoggedOut
+	}
+	infof(mconn, "Logged out")
+
+	// the manager discards the session and closes the connection
+	if err := mconn.requestClose(CloseGraceful); err != nil {
+		return err
+	}
+	if keyPath := session.appConfig.KeyPath; keyPath != "" {
+		if err := os.Remove(keyPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// botIdOf returns the bot id of the token, which is "<bot id>:<secret>".
+// The bot id is the account of the bot, as the phone number is of a user.
+func botIdOf(token string) (string, error) {
+	i := strings.IndexByte(token, ':')
+	if i <= 0 {
+		return "", fmt.Errorf("malformed bot token")
+	}
+	if _, err := strconv.ParseInt(token[:i], 10, 32); err != nil {
+		return "", fmt.Errorf("malformed bot token: %v", err)
+	}
+	return token[:i], nil
+}
+
+func importBotAuthorization(rpc RemoteProcedureCall, session *Session, token string) (*PredAuthAuthorization, error) {
+	data, err := rpc.InvokeBlocked(&ReqAuthImportBotAuthorization{
+		ApiId:        session.appConfig.Id,
+		ApiHash:      session.appConfig.Hash,
+		BotAuthToken: token,
+	})
+	if err != nil {
+		return nil, err
+	}
+	auth, ok := data.(*PredAuthAuthorization)
+	if !ok {
+		return nil, fmt.Errorf("RPC: %#v", data)
+	}
+	return auth, nil
+}
+
+// exportAuthorization exports the authorization of the account on the current DC, to import it on the DC.
+func exportAuthorization(rpc RemoteProcedureCall, dc int32) (*PredAuthExportedAuthorization, error) {
+	data, err := rpc.InvokeBlocked(&ReqAuthExportAuthorization{DcId: dc})
+	if err != nil {
+		return nil, err
+	}
+	exported, ok := data.(*PredAuthExportedAuthorization)
+	if !ok {
+		return nil, fmt.Errorf("RPC: %#v", data)
+	}
+	return exported, nil
+}
+
+// importAuthorization authorizes the session of rpc by the authorization exported on another DC,
+// without signing in again.
+func importAuthorization(rpc RemoteProcedureCall, exported *PredAuthExportedAuthorization) (*PredAuthAuthorization, error) {
+	data, err := rpc.InvokeBlocked(&ReqAuthImportAuthorization{
+		Id:    exported.Id,
+		Bytes: exported.Bytes,
+	})
+	if err != nil {
+		return nil, err
+	}
+	auth, ok := data.(*PredAuthAuthorization)
+	if !ok {
+		return nil, fmt.Errorf("RPC: %#v", data)
+	}
+	return auth, nil
+}
@@ -0,0 +1,246 @@
+package mtproto
+
+import (
+	"encoding/hex"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestPasswordHash(t *testing.T) {
+	salt := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	expected := "4a1d6407dd3cb6cafa0d8fbaf96042f6c955af1e8f82376ace478f137745d2a4"
+	if hash := hex.EncodeToString(passwordHash(salt, "password")); hash != expected {
+		t.Fatalf("password hash %s, expected %s", hash, expected)
+	}
+}
+
+func TestPasswordNeededError(t *testing.T) {
+	err := toError(TL_rpc_error{errorUnauthorized, "SESSION_PASSWORD_NEEDED"})
+	if _, ok := err.(PasswordNeededError); !ok {
+		t.Fatalf("%T: %v, expected PasswordNeededError", err, err)
+	}
+	if !IsUnauthorized(err) {
+		t.Fatalf("%v is not unauthorized", err)
+	}
+}
+
+func TestAuthLogOut(t *testing.T) {
+	mm := newTestManager(t)
+	defer mm.Finish()
+	mconn, f := openTestConn(t, mm)
+	defer os.Remove(f.Name())
+	mconn.boundSession().appConfig.KeyPath = f.Name()
+
+	rpc := &recordRPC{resp: &PredBoolTrue{}}
+	if err := mconn.logOut(rpc); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := rpc.reqs[0].(*ReqAuthLogOut); !ok {
+		t.Errorf("unexpected request %T", rpc.reqs[0])
+	}
+	if _, err := os.Stat(f.Name()); !os.IsNotExist(err) {
+		t.Errorf("key file is not removed: %v", err)
+	}
+	if err := mconn.logOut(rpc); err != ErrLoggedOut {
+		t.Errorf("second logout: %v", err)
+	}
+	if len(rpc.reqs) != 1 {
+		t.Errorf("second logout invoked %d requests", len(rpc.reqs)-1)
+	}
+}
+
+func TestResendCode(t *testing.T) {
+	session := &Session{phonenumber: "+821012345678"}
+	session.setSentCode(&PredAuthSentCode{PhoneCodeHash: "hash1"})
+	rpc := &recordRPC{resp: &PredAuthSentCode{PhoneCodeHash: "hash2"}}
+
+	sentCode, err := resendCode(rpc, session, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := rpc.reqs[0].(*ReqAuthResendCode)
+	if req.PhoneNumber != session.phonenumber || req.PhoneCodeHash != "hash1" {
+		t.Errorf("unexpected request: %v", req)
+	}
+	if sentCode.GetValue().PhoneCodeHash != "hash2" || session.getPhoneCodeHash() != "hash2" {
+		t.Errorf("phone code hash is not updated: %v", sentCode)
+	}
+}
+
+func TestSentCodeInfo(t *testing.T) {
+	for _, c := range []struct {
+		codeType *TypeAuthSentCodeType
+		nextType *TypeAuthCodeType
+		expected SentCodeInfo
+	}{
+		{
+			&TypeAuthSentCodeType{&TypeAuthSentCodeType_AuthSentCodeTypeApp{&PredAuthSentCodeTypeApp{Length: 5}}},
+			&TypeAuthCodeType{&TypeAuthCodeType_AuthCodeTypeSms{&PredAuthCodeTypeSms{}}},
+			SentCodeInfo{Type: "app", NextType: "sms", Length: 5},
+		},
+		{
+			&TypeAuthSentCodeType{&TypeAuthSentCodeType_AuthSentCodeTypeSms{&PredAuthSentCodeTypeSms{Length: 6}}},
+			&TypeAuthCodeType{&TypeAuthCodeType_AuthCodeTypeCall{&PredAuthCodeTypeCall{}}},
+			SentCodeInfo{Type: "sms", NextType: "call", Length: 6},
+		},
+		{
+			&TypeAuthSentCodeType{&TypeAuthSentCodeType_AuthSentCodeTypeCall{&PredAuthSentCodeTypeCall{Length: 5}}},
+			&TypeAuthCodeType{&TypeAuthCodeType_AuthCodeTypeFlashCall{&PredAuthCodeTypeFlashCall{}}},
+			SentCodeInfo{Type: "call", NextType: "flash_call", Length: 5},
+		},
+		{
+			&TypeAuthSentCodeType{&TypeAuthSentCodeType_AuthSentCodeTypeFlashCall{&PredAuthSentCodeTypeFlashCall{Pattern: "+82*"}}},
+			nil,
+			SentCodeInfo{Type: "flash_call", Pattern: "+82*"},
+		},
+	} {
+		sentCode := &TypeAuthSentCode{&PredAuthSentCode{
+			Flags:         1 << 0,
+			Type:          c.codeType,
+			PhoneCodeHash: "hash",
+			NextType:      c.nextType,
+			Timeout:       60,
+		}}
+		c.expected.Timeout = time.Minute
+		c.expected.CodeHash = "hash"
+		c.expected.PhoneRegistered = true
+		if info := SentCodeInfoOf(sentCode); info != c.expected {
+			t.Errorf("expected %+v, but %+v", c.expected, info)
+		}
+	}
+}
+
+func TestSendCodeUnavailableError(t *testing.T) {
+	err := toError(TL_rpc_error{errorBadRequest, "SEND_CODE_UNAVAILABLE"})
+	if _, ok := err.(SendCodeUnavailableError); !ok {
+		t.Fatalf("%T: %v, expected SendCodeUnavailableError", err, err)
+	}
+	if !IsBadRequest(err) {
+		t.Fatalf("%v is not bad request", err)
+	}
+}
+
+func TestRequestCall(t *testing.T) {
+	session := &Session{phonenumber: "+821012345678"}
+	session.setSentCode(&PredAuthSentCode{
+		PhoneCodeHash: "hash1",
+		NextType:      &TypeAuthCodeType{&TypeAuthCodeType_AuthCodeTypeCall{&PredAuthCodeTypeCall{}}},
+		Timeout:       60,
+	})
+	rpc := &recordRPC{resp: &PredAuthSentCode{PhoneCodeHash: "hash2"}}
+
+	_, err := requestCall(rpc, session, "", time.Now())
+	if floodWait, ok := err.(FloodWaitError); !ok || floodWait.Seconds != 60 {
+		t.Fatalf("call before the timeout: %v", err)
+	}
+	if _, err := requestCall(rpc, session, "", time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if req, ok := rpc.reqs[0].(*ReqAuthResendCode); !ok || req.PhoneCodeHash != "hash1" {
+		t.Errorf("unexpected request: %v", rpc.reqs[0])
+	}
+
+	// the call was the last way
+	if _, err := requestCall(rpc, session, "", time.Now().Add(time.Minute)); err == nil {
+		t.Errorf("call is requested by next type %d", session.nextCodeType)
+	}
+}
+
+func TestSignUp(t *testing.T) {
+	err := toError(TL_rpc_error{errorBadRequest, "PHONE_NUMBER_UNOCCUPIED"})
+	if _, ok := err.(SignUpRequiredError); !ok {
+		t.Fatalf("%T: %v, expected SignUpRequiredError", err, err)
+	}
+
+	session := &Session{phonenumber: "+821012345678"}
+	session.setSentCode(&PredAuthSentCode{PhoneCodeHash: "hash"})
+	rpc := &recordRPC{resp: &PredAuthAuthorization{}}
+	if _, err := signUp(rpc, session, "", "John", "Doe"); err == nil {
+		t.Fatalf("signed up without the confirmed code")
+	}
+
+	session.signUpCode = "12345"
+	if _, err := signUp(rpc, session, "", "John", "Doe"); err != nil {
+		t.Fatal(err)
+	}
+	req := rpc.reqs[0].(*ReqAuthSignUp)
+	if req.PhoneNumber != session.phonenumber || req.PhoneCodeHash != "hash" || req.PhoneCode != "12345" ||
+		req.FirstName != "John" || req.LastName != "Doe" {
+		t.Errorf("unexpected request: %v", req)
+	}
+}
+
+func TestMigrateAuthorization(t *testing.T) {
+	dc2 := &recordRPC{resp: &PredAuthExportedAuthorization{Id: 42, Bytes: []byte{1, 2, 3}}}
+	exported, err := exportAuthorization(dc2, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req := dc2.reqs[0].(*ReqAuthExportAuthorization); req.DcId != 4 {
+		t.Errorf("exported to DC %d", req.DcId)
+	}
+
+	dc4 := &recordRPC{resp: &PredAuthAuthorization{User: &TypeUser{&TypeUser_User{&PredUser{Id: 42}}}}}
+	auth, err := importAuthorization(dc4, exported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req := dc4.reqs[0].(*ReqAuthImportAuthorization); req.Id != 42 || string(req.Bytes) != "\x01\x02\x03" {
+		t.Errorf("unexpected import %v", req)
+	}
+	if auth.GetUser().GetUser().GetId() != 42 {
+		t.Errorf("unexpected authorization %v", auth)
+	}
+}
+
+// botTokenRPC authorizes the bot of a known token, and rejects the others
+type botTokenRPC struct {
+	reqs []*ReqAuthImportBotAuthorization
+}
+
+func (r *botTokenRPC) InvokeBlocked(msg TL) (interface{}, error) {
+	req := msg.(*ReqAuthImportBotAuthorization)
+	r.reqs = append(r.reqs, req)
+	if req.BotAuthToken != "123456:secret" {
+		return nil, toError(TL_rpc_error{errorBadRequest, "ACCESS_TOKEN_INVALID"})
+	}
+	return &PredAuthAuthorization{User: &TypeUser{&TypeUser_User{&PredUser{Flags: 1 << 14, Id: 123456}}}}, nil
+}
+
+func TestImportBotAuthorization(t *testing.T) {
+	session := &Session{appConfig: Configuration{Id: 7, Hash: "hash"}}
+	rpc := &botTokenRPC{}
+	auth, err := importBotAuthorization(rpc, session, "123456:secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req := rpc.reqs[0]; req.ApiId != 7 || req.ApiHash != "hash" || req.BotAuthToken != "123456:secret" {
+		t.Errorf("unexpected request %v", req)
+	}
+	if user := auth.GetUser().GetUser(); user.GetId() != 123456 || user.GetFlags()&(1<<14) == 0 {
+		t.Errorf("unexpected authorization %v", auth)
+	}
+
+	_, err = importBotAuthorization(rpc, session, "123456:revoked")
+	if _, ok := err.(AccessTokenInvalidError); !ok {
+		t.Errorf("%T: %v, expected AccessTokenInvalidError", err, err)
+	}
+	if !IsRPCError(err, errorBadRequest) {
+		t.Errorf("%v is not a bad request", err)
+	}
+}
+
+func TestBotIdOf(t *testing.T) {
+	for token, expected := range map[string]string{
+		"123456:secret": "123456",
+		"secret":        "",
+		":secret":       "",
+		"bot:secret":    "",
+	} {
+		botId, err := botIdOf(token)
+		if botId != expected || (err == nil) != (expected != "") {
+			t.Errorf("%q: %q, %v, expected %q", token, botId, err, expected)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package mtproto
+
+import (
+	"fmt"
+
+	"golang.org/x/net/context"
+)
+
+// InlineBotResults is a page of the results of an inline query to a bot.
+type InlineBotResults struct {
+	// QueryId is the queryId of MessagesSendInlineBotResult sending one of the results.
+	QueryId int64
+	Results []*TypeBotInlineResult
+	// Gallery is set if the results are shown as a gallery rather than a list.
+	Gallery bool
+	// NextOffset is the offset of the next page. It is empty on the last page.
+	NextOffset string
+	// SwitchPm is the button switching to the private chat with the bot, or nil.
+	SwitchPm  *TypeInlineBotSwitchPM
+	CacheTime int32
+}
+
+// MessagesGetInlineBotResults queries the inline bot with the query typed in the chat with peer.
+// The first page has an empty offset. Page until NextOffset is empty;
+//
+//	for offset := ""; ; {
+//		results, err := mconn.MessagesGetInlineBotResults(bot, peer, query, offset)
+//		if err != nil {
+//			return err
+//		}
+//		// handle results.Results
+//		if offset = results.NextOffset; offset == "" {
+//			break
+//		}
+//	}
+func (mconn *Conn) MessagesGetInlineBotResults(bot *TypeInputUser, peer *TypeInputPeer, query, offset string) (*InlineBotResults, error) {
+	return getInlineBotResults(mconn, bot, peer, query, offset)
+}
+
+// MessagesGetInlineBotResultsContext is MessagesGetInlineBotResults which gives up on ctx done.
+func (mconn *Conn) MessagesGetInlineBotResultsContext(ctx context.Context, bot *TypeInputUser, peer *TypeInputPeer, query, offset string) (*InlineBotResults, error) {
+	return getInlineBotResults(mconn.contextRPC(ctx), bot, peer, query, offset)
+}
+
+func getInlineBotResults(rpc RemoteProcedureCall, bot *TypeInputUser, peer *TypeInputPeer, query, offset string) (*InlineBotResults, error) {
+	data, err := rpc.InvokeBlocked(&ReqMessagesGetInlineBotResults{
+		Bot:    bot,
+		Peer:   peer,
+		Query:  query,
+		Offset: offset,
+	})
+	if err != nil {
+		return nil, err
+	}
+	x, ok := data.(*PredMessagesBotResults)
+	if !ok {
+		return nil, fmt.Errorf("RPC: %#v", data)
+	}
+	return &InlineBotResults{
+		QueryId:    x.QueryId,
+		Results:    x.Results,
+		Gallery:    x.Flags&(1<<0) != 0,
+		NextOffset: x.NextOffset,
+		SwitchPm:   x.SwitchPm,
+		CacheTime:  x.CacheTime,
+	}, nil
+}
+
+// MessagesSendInlineBotResult sends the result of resultId, of the inline query of queryId, to the peer.
+func (mconn *Conn) MessagesSendInlineBotResult(peer *TypeInputPeer, queryId int64, resultId string) (*TypeUpdates, error) {
+	return sendInlineBotResult(mconn, peer, queryId, resultId)
+}
+
+// MessagesSendInlineBotResultContext is MessagesSendInlineBotResult which gives up on ctx done.
+func (mconn *Conn) MessagesSendInlineBotResultContext(ctx context.Context, peer *TypeInputPeer, queryId int64, resultId string) (*TypeUpdates, error) {
+	return sendInlineBotResult(mconn.contextRPC(ctx), peer, queryId, resultId)
+}
+
+func sendInlineBotResult(rpc RemoteProcedureCall, peer *TypeInputPeer, queryId int64, resultId string) (*TypeUpdates, error) {
+	return RPCaller{rpc}.MessagesSendInlineBotResult(context.Background(), &ReqMessagesSendInlineBotResult{
+		Peer:     peer,
+		RandomId: randInt63(rpcRandSource(rpc)),
+		QueryId:  queryId,
+		Id:       resultId,
+	})
+}
@@ -0,0 +1,57 @@
+package mtproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+)
+
+func TestGetInlineBotResultsEncoding(t *testing.T) {
+	rpc := &recordRPC{resp: &PredMessagesBotResults{Flags: 1 << 0, QueryId: 7, NextOffset: "20"}}
+	bot := &TypeInputUser{&TypeInputUser_InputUserSelf{&PredInputUserSelf{}}}
+	peer := &TypeInputPeer{&TypeInputPeer_InputPeerSelf{&PredInputPeerSelf{}}}
+	results, err := getInlineBotResults(rpc, bot, peer, "cat", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results.QueryId != 7 || !results.Gallery || results.NextOffset != "20" {
+		t.Errorf("unexpected results %v", results)
+	}
+
+	expected, _ := hex.DecodeString(
+		"9d994e51" + // messages.getInlineBotResults
+			"00000000" + // flags
+			"3fb1c1f7" + // inputUserSelf
+			"c97ea07d" + // inputPeerSelf
+			"03636174" + // query
+			"00000000") // offset
+	if encoded := rpc.reqs[0].encode(); !bytes.Equal(encoded, expected) {
+		t.Errorf("expected %x, but %x", expected, encoded)
+	}
+}
+
+func TestSendInlineBotResultEncoding(t *testing.T) {
+	rpc := &recordRPC{resp: &PredUpdates{}}
+	peer := &TypeInputPeer{&TypeInputPeer_InputPeerSelf{&PredInputPeerSelf{}}}
+	if _, err := sendInlineBotResult(rpc, peer, 7, "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	req := rpc.reqs[0].(*ReqMessagesSendInlineBotResult)
+	expected, _ := hex.DecodeString(
+		"fe066eb1" + // messages.sendInlineBotResult
+			"00000000" + // flags
+			"c97ea07d") // inputPeerSelf
+	randomId := make([]byte, 8)
+	binary.LittleEndian.PutUint64(randomId, uint64(req.RandomId))
+	expected = append(expected, randomId...)
+	tail, _ := hex.DecodeString(
+		"0700000000000000" + // query_id
+			"01310000") // id
+	expected = append(expected, tail...)
+
+	if encoded := req.encode(); !bytes.Equal(encoded, expected) {
+		t.Errorf("expected %x, but %x", expected, encoded)
+	}
+}
@@ -0,0 +1,279 @@
+package mtproto
+
+import (
+	"fmt"
+
+	"golang.org/x/net/context"
+)
+
+// ChannelsGetFullChannel returns the full information of the channel, e.g., the participant count and
+// the pinned message, with the users and the chats it refers to.
+// The users and the channels with usernames are cached as ContactsResolveUsername caches them.
+func (mconn *Conn) ChannelsGetFullChannel(channel *TypeInputChannel) (*PredMessagesChatFull, error) {
+	session, err := mconn.Session()
+	if err != nil {
+		return nil, err
+	}
+	return getFullChat(mconn, &session.peers, &ReqChannelsGetFullChannel{Channel: channel})
+}
+
+// ChannelsGetFullChannelContext is ChannelsGetFullChannel which gives up on ctx done.
+func (mconn *Conn) ChannelsGetFullChannelContext(ctx context.Context, channel *TypeInputChannel) (*PredMessagesChatFull, error) {
+	session, err := mconn.Session()
+	if err != nil {
+		return nil, err
+	}
+	return getFullChat(mconn.contextRPC(ctx), &session.peers, &ReqChannelsGetFullChannel{Channel: channel})
+}
+
+// MessagesGetFullChat returns the full information of the basic group of chatId,
+// with the users and the chats it refers to.
+// The users and the channels with usernames are cached as ContactsResolveUsername caches them.
+func (mconn *Conn) MessagesGetFullChat(chatId int32) (*PredMessagesChatFull, error) {
+	session, err := mconn.Session()
+	if err != nil {
+		return nil, err
+	}
+	return getFullChat(mconn, &session.peers, &ReqMessagesGetFullChat{ChatId: chatId})
+}
+
+// MessagesGetFullChatContext is MessagesGetFullChat which gives up on ctx done.
+func (mconn *Conn) MessagesGetFullChatContext(ctx context.Context, chatId int32) (*PredMessagesChatFull, error) {
+	session, err := mconn.Session()
+	if err != nil {
+		return nil, err
+	}
+	return getFullChat(mconn.contextRPC(ctx), &session.peers, &ReqMessagesGetFullChat{ChatId: chatId})
+}
+
+func getFullChat(rpc RemoteProcedureCall, cache *peerCache, req TL) (*PredMessagesChatFull, error) {
+	data, err := rpc.InvokeBlocked(req)
+	if err != nil {
+		return nil, err
+	}
+	full, ok := data.(*PredMessagesChatFull)
+	if !ok {
+		return nil, fmt.Errorf("RPC: %#v", data)
+	}
+	cache.putPeers(full.Chats, full.Users)
+	return full, nil
+}
+
+// CreatedChat is the chat created by MessagesCreateChat or ChannelsCreateChannel.
+type CreatedChat struct {
+	Chat *TypeChat
+	// Peer is the input peer of the chat, to send messages to it right away.
+	Peer    *TypeInputPeer
+	Updates *TypeUpdates
+}
+
+// MessagesCreateChat creates the basic group of title with the users.
+// It fails with UsersTooFewError if none of the users may be added to the group.
+func (mconn *Conn) MessagesCreateChat(users []*TypeInputUser, title string) (*CreatedChat, error) {
+	return createChat(mconn, users, title)
+}
+
+// MessagesCreateChatContext is MessagesCreateChat which gives up on ctx done.
+func (mconn *Conn) MessagesCreateChatContext(ctx context.Context, users []*TypeInputUser, title string) (*CreatedChat, error) {
+	return createChat(mconn.contextRPC(ctx), users, title)
+}
+
+func createChat(rpc RemoteProcedureCall, users []*TypeInputUser, title string) (*CreatedChat, error) {
+	updates, err := RPCaller{rpc}.MessagesCreateChat(context.Background(), &ReqMessagesCreateChat{
+		Users: users,
+		Title: title,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return createdChat(updates)
+}
+
+// ChannelsCreateChannel creates the supergroup of title if megagroup is set, or else the broadcast channel.
+func (mconn *Conn) ChannelsCreateChannel(title, about string, megagroup bool) (*CreatedChat, error) {
+	return createChannel(mconn, title, about, megagroup)
+}
+
+// ChannelsCreateChannelContext is ChannelsCreateChannel which gives up on ctx done.
+func (mconn *Conn) ChannelsCreateChannelContext(ctx context.Context, title, about string, megagroup bool) (*CreatedChat, error) {
+	return createChannel(mconn.contextRPC(ctx), title, about, megagroup)
+}
+
+func createChannel(rpc RemoteProcedureCall, title, about string, megagroup bool) (*CreatedChat, error) {
+	req := &ReqChannelsCreateChannel{Title: title, About: about}
+	if megagroup {
+		req.Flags |= 1 << 1
+	} else {
+		req.Flags |= 1 << 0
+	}
+	updates, err := RPCaller{rpc}.ChannelsCreateChannel(context.Background(), req)
+	if err != nil {
+		return nil, err
+	}
+	return createdChat(updates)
+}
+
+// createdChat finds the created chat in the updates of the creation
+func createdChat(updates *TypeUpdates) (*CreatedChat, error) {
+	chats := updates.GetUpdates().GetChats()
+	if chats == nil {
+		chats = updates.GetUpdatesCombined().GetChats()
+	}
+	for _, chat := range chats {
+		switch x := chat.GetValue().(type) {
+		case *TypeChat_Chat:
+			return &CreatedChat{chat, &TypeInputPeer{&TypeInputPeer_InputPeerChat{&PredInputPeerChat{
+				ChatId: x.Chat.Id,
+			}}}, updates}, nil
+		case *TypeChat_Channel:
+			return &CreatedChat{chat, &TypeInputPeer{&TypeInputPeer_InputPeerChannel{&PredInputPeerChannel{
+				ChannelId:  x.Channel.Id,
+				AccessHash: x.Channel.AccessHash,
+			}}}, updates}, nil
+		}
+	}
+	return nil, fmt.Errorf("no chat created in %v", updates)
+}
+
+// ParticipantsRecent is the filter of ChannelsGetParticipants for the recent participants.
+func ParticipantsRecent() *TypeChannelParticipantsFilter {
+	return &TypeChannelParticipantsFilter{&TypeChannelParticipantsFilter_ChannelParticipantsRecent{&PredChannelParticipantsRecent{}}}
+}
+
+// ParticipantsAdmins is the filter of ChannelsGetParticipants for the creator and the admins.
+func ParticipantsAdmins() *TypeChannelParticipantsFilter {
+	return &TypeChannelParticipantsFilter{&TypeChannelParticipantsFilter_ChannelParticipantsAdmins{&PredChannelParticipantsAdmins{}}}
+}
+
+// ParticipantsKicked is the filter of ChannelsGetParticipants for the kicked users whose names match q.
+// An empty q matches all of them.
+func ParticipantsKicked(q string) *TypeChannelParticipantsFilter {
+	return &TypeChannelParticipantsFilter{&TypeChannelParticipantsFilter_ChannelParticipantsKicked{&PredChannelParticipantsKicked{Q: q}}}
+}
+
+// ParticipantsSearch is the filter of ChannelsGetParticipants for the participants whose names match q.
+func ParticipantsSearch(q string) *TypeChannelParticipantsFilter {
+	return &TypeChannelParticipantsFilter{&TypeChannelParticipantsFilter_ChannelParticipantsSearch{&PredChannelParticipantsSearch{Q: q}}}
+}
+
+// Participant is a participant of a channel with its user.
+type Participant struct {
+	*TypeChannelParticipant
+	// User is nil if the user is not in the response.
+	User *PredUser
+}
+
+// UserId returns the id of the participating user.
+func (p *Participant) UserId() int32 {
+	switch x := p.GetValue().(type) {
+	case *TypeChannelParticipant_ChannelParticipant:
+		return x.ChannelParticipant.UserId
+	case *TypeChannelParticipant_ChannelParticipantSelf:
+		return x.ChannelParticipantSelf.UserId
+	case *TypeChannelParticipant_ChannelParticipantCreator:
+		return x.ChannelParticipantCreator.UserId
+	case *TypeChannelParticipant_ChannelParticipantAdmin:
+		return x.ChannelParticipantAdmin.UserId
+	case *TypeChannelParticipant_ChannelParticipantBanned:
+		return x.ChannelParticipantBanned.UserId
+	}
+	return 0
+}
+
+// Participants is a page of the participants of a channel.
+type Participants struct {
+	Participants []*Participant
+	Users        []*TypeUser
+	// Count is the number of all the participants matching the filter.
+	Count int32
+}
+
+// ChannelsGetParticipants reads limit participants of the channel matching the filter, from offset.
+// A nil filter is ParticipantsRecent. ChannelsGetAllParticipants pages through all of them.
+// It fails with ChannelPrivateError if the channel is not accessible.
+// The users with usernames are cached as ContactsResolveUsername caches them.
+func (mconn *Conn) ChannelsGetParticipants(channel *TypeInputChannel, filter *TypeChannelParticipantsFilter, offset, limit int32) (*Participants, error) {
+	session, err := mconn.Session()
+	if err != nil {
+		return nil, err
+	}
+	return getParticipants(mconn, &session.peers, channel, filter, offset, limit)
+}
+
+// ChannelsGetParticipantsContext is ChannelsGetParticipants which gives up on ctx done.
+func (mconn *Conn) ChannelsGetParticipantsContext(ctx context.Context, channel *TypeInputChannel, filter *TypeChannelParticipantsFilter, offset, limit int32) (*Participants, error) {
+	session, err := mconn.Session()
+	if err != nil {
+		return nil, err
+	}
+	return getParticipants(mconn.contextRPC(ctx), &session.peers, channel, filter, offset, limit)
+}
+
+// ChannelsGetAllParticipants calls handle on every participant matching the filter, reading pageSize participants per request.
+// It stops at the first error of handle, and returns it.
+func (mconn *Conn) ChannelsGetAllParticipants(channel *TypeInputChannel, filter *TypeChannelParticipantsFilter, pageSize int32, handle func(*Participant) error) error {
+	session, err := mconn.Session()
+	if err != nil {
+		return err
+	}
+	return allParticipants(mconn, &session.peers, channel, filter, pageSize, handle)
+}
+
+// ChannelsGetAllParticipantsContext is ChannelsGetAllParticipants which gives up on ctx done.
+func (mconn *Conn) ChannelsGetAllParticipantsContext(ctx context.Context, channel *TypeInputChannel, filter *TypeChannelParticipantsFilter, pageSize int32, handle func(*Participant) error) error {
+	session, err := mconn.Session()
+	if err != nil {
+		return err
+	}
+	return allParticipants(mconn.contextRPC(ctx), &session.peers, channel, filter, pageSize, handle)
+}
+
+func allParticipants(rpc RemoteProcedureCall, cache *peerCache, channel *TypeInputChannel, filter *TypeChannelParticipantsFilter, pageSize int32, handle func(*Participant) error) error {
+	var offset int32
+	for {
+		page, err := getParticipants(rpc, cache, channel, filter, offset, pageSize)
+		if err != nil {
+			return err
+		}
+		for _, p := range page.Participants {
+			if err := handle(p); err != nil {
+				return err
+			}
+		}
+		offset += int32(len(page.Participants))
+		if len(page.Participants) == 0 || offset >= page.Count {
+			return nil
+		}
+	}
+}
+
+func getParticipants(rpc RemoteProcedureCall, cache *peerCache, channel *TypeInputChannel, filter *TypeChannelParticipantsFilter, offset, limit int32) (*Participants, error) {
+	if filter == nil {
+		filter = ParticipantsRecent()
+	}
+	resp, err := RPCaller{rpc}.ChannelsGetParticipants(context.Background(), &ReqChannelsGetParticipants{
+		Channel: channel,
+		Filter:  filter,
+		Offset:  offset,
+		Limit:   limit,
+	})
+	if err != nil {
+		return nil, err
+	}
+	x := resp.GetValue()
+	cache.putPeers(nil, x.Users)
+
+	users := make(map[int32]*PredUser)
+	for _, u := range x.Users {
+		if user := u.GetUser(); user != nil {
+			users[user.Id] = user
+		}
+	}
+	participants := &Participants{Users: x.Users, Count: x.Count}
+	for _, raw := range x.Participants {
+		p := &Participant{TypeChannelParticipant: raw}
+		p.User = users[p.UserId()]
+		participants.Participants = append(participants.Participants, p)
+	}
+	return participants, nil
+}
@@ -0,0 +1,167 @@
+package mtproto
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"testing"
+)
+
+func TestGetFullChannel(t *testing.T) {
+	rpc := &recordRPC{resp: &PredMessagesChatFull{
+		FullChat: &TypeChatFull{&TypeChatFull_ChannelFull{&PredChannelFull{Id: 3, ParticipantsCount: 42, PinnedMsgId: 7}}},
+		Chats:    []*TypeChat{{&TypeChat_Channel{&PredChannel{Id: 3, AccessHash: 4, Username: "News"}}}},
+		Users:    []*TypeUser{{&TypeUser_User{&PredUser{Id: 5, AccessHash: 6, Username: "admin"}}}},
+	}}
+	var cache peerCache
+	channel := &TypeInputChannel{&TypeInputChannel_InputChannel{&PredInputChannel{ChannelId: 3, AccessHash: 4}}}
+	full, err := getFullChat(rpc, &cache, &ReqChannelsGetFullChannel{Channel: channel})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info := full.GetFullChat().GetChannelFull(); info.GetParticipantsCount() != 42 || info.GetPinnedMsgId() != 7 {
+		t.Errorf("unexpected full channel %v", info)
+	}
+
+	if peer := cache.get("news").GetInputPeerChannel(); peer.GetChannelId() != 3 || peer.GetAccessHash() != 4 {
+		t.Errorf("the channel is not cached, %v", peer)
+	}
+	if peer := cache.get("admin").GetInputPeerUser(); peer.GetUserId() != 5 || peer.GetAccessHash() != 6 {
+		t.Errorf("the user is not cached, %v", peer)
+	}
+}
+
+// createChatRPC creates the chats as the server does, rejecting a group of no other users
+type createChatRPC struct {
+	reqs []TL
+}
+
+func (r *createChatRPC) InvokeBlocked(msg TL) (interface{}, error) {
+	r.reqs = append(r.reqs, msg)
+	switch x := msg.(type) {
+	case *ReqMessagesCreateChat:
+		if len(x.Users) == 0 {
+			return nil, toError(TL_rpc_error{errorBadRequest, "USERS_TOO_FEW"})
+		}
+		return &PredUpdates{Chats: []*TypeChat{{&TypeChat_Chat{&PredChat{Id: 8, Title: x.Title}}}}}, nil
+	case *ReqChannelsCreateChannel:
+		return &PredUpdates{Chats: []*TypeChat{{&TypeChat_Channel{&PredChannel{Id: 9, AccessHash: 10, Title: x.Title}}}}}, nil
+	}
+	return nil, nil
+}
+
+func TestCreateChat(t *testing.T) {
+	rpc := &createChatRPC{}
+	users := []*TypeInputUser{{&TypeInputUser_InputUser{&PredInputUser{UserId: 1, AccessHash: 2}}}}
+	created, err := createChat(rpc, users, "dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.Chat.GetChat().GetTitle() != "dev" || created.Peer.GetInputPeerChat().GetChatId() != 8 {
+		t.Errorf("unexpected chat %v", created)
+	}
+	expected, _ := hex.DecodeString(
+		"6e12cb09" + // messages.createChat
+			"15c4b51c" + // vector
+			"01000000" + // count
+			"162829d8" + // inputUser
+			"01000000" + // user_id
+			"0200000000000000" + // access_hash
+			"03646576") // title
+	if encoded := rpc.reqs[0].encode(); !bytes.Equal(encoded, expected) {
+		t.Errorf("expected %x, but %x", expected, encoded)
+	}
+
+	if _, err := createChat(rpc, nil, "alone"); err != (UsersTooFewError{}) {
+		t.Errorf("unexpected error %#v", err)
+	}
+}
+
+func TestCreateChannel(t *testing.T) {
+	rpc := &createChatRPC{}
+	created, err := createChannel(rpc, "team", "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if peer := created.Peer.GetInputPeerChannel(); peer.GetChannelId() != 9 || peer.GetAccessHash() != 10 {
+		t.Errorf("unexpected peer %v", created.Peer)
+	}
+	expected, _ := hex.DecodeString(
+		"7f3d89f4" + // channels.createChannel
+			"02000000" + // flags: megagroup
+			"047465616d000000" + // title
+			"00000000") // about
+	if encoded := rpc.reqs[0].encode(); !bytes.Equal(encoded, expected) {
+		t.Errorf("expected %x, but %x", expected, encoded)
+	}
+
+	if _, err := createChannel(rpc, "news", "", false); err != nil {
+		t.Fatal(err)
+	}
+	if req := rpc.reqs[1].(*ReqChannelsCreateChannel); req.Flags != 1<<0 {
+		t.Errorf("a broadcast channel is created with flags %d", req.Flags)
+	}
+}
+
+// participantsRPC pages the participants of a channel of 3 users, 2 per page,
+// and rejects the other channels as private
+type participantsRPC struct {
+	reqs []*ReqChannelsGetParticipants
+}
+
+func (r *participantsRPC) InvokeBlocked(msg TL) (interface{}, error) {
+	req := msg.(*ReqChannelsGetParticipants)
+	r.reqs = append(r.reqs, req)
+	if req.Channel.GetInputChannel().GetChannelId() != 3 {
+		return nil, toError(TL_rpc_error{errorBadRequest, "CHANNEL_PRIVATE"})
+	}
+	all := []*TypeChannelParticipant{
+		{&TypeChannelParticipant_ChannelParticipantCreator{&PredChannelParticipantCreator{UserId: 10}}},
+		{&TypeChannelParticipant_ChannelParticipant{&PredChannelParticipant{UserId: 11, Date: 100}}},
+		{&TypeChannelParticipant_ChannelParticipantSelf{&PredChannelParticipantSelf{UserId: 12, Date: 200}}},
+	}
+	resp := &PredChannelsChannelParticipants{Count: int32(len(all))}
+	for i := req.Offset; i < req.Offset+req.Limit && int(i) < len(all); i++ {
+		resp.Participants = append(resp.Participants, all[i])
+		resp.Users = append(resp.Users, &TypeUser{&TypeUser_User{&PredUser{Id: 10 + i, Username: fmt.Sprintf("user%d", i), AccessHash: 1}}})
+	}
+	return resp, nil
+}
+
+func TestGetAllParticipants(t *testing.T) {
+	rpc := &participantsRPC{}
+	cache := &peerCache{}
+	channel := &TypeInputChannel{&TypeInputChannel_InputChannel{&PredInputChannel{ChannelId: 3, AccessHash: 4}}}
+	var users []string
+	err := allParticipants(rpc, cache, channel, ParticipantsSearch("user"), 2, func(p *Participant) error {
+		if p.User == nil || p.User.Id != p.UserId() {
+			t.Errorf("participant %v of user %v", p, p.User)
+			return nil
+		}
+		users = append(users, p.User.Username)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(users) != "[user0 user1 user2]" {
+		t.Errorf("unexpected participants %v", users)
+	}
+	if len(rpc.reqs) != 2 || rpc.reqs[0].Offset != 0 || rpc.reqs[1].Offset != 2 || rpc.reqs[1].Limit != 2 {
+		t.Errorf("unexpected pages %v", rpc.reqs)
+	}
+	if q := rpc.reqs[1].Filter.GetChannelParticipantsSearch().GetQ(); q != "user" {
+		t.Errorf("filter of %q", q)
+	}
+	if cache.get("user2") == nil {
+		t.Errorf("the users are not cached")
+	}
+
+	private := &TypeInputChannel{&TypeInputChannel_InputChannel{&PredInputChannel{ChannelId: 5, AccessHash: 6}}}
+	if _, err := getParticipants(rpc, cache, private, nil, 0, 2); err != (ChannelPrivateError{}) {
+		t.Errorf("unexpected error %#v", err)
+	}
+	if rpc.reqs[2].Filter.GetChannelParticipantsRecent() == nil {
+		t.Errorf("the default filter is not recent")
+	}
+}
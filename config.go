@@ -2,14 +2,35 @@ package mtproto
 
 import (
 	"fmt"
+	"io"
+	"net"
 	"runtime"
 	"time"
+
+	"golang.org/x/net/context"
 )
 
 const (
-	appConfigError      = "App configuration error: %s"
-	defaultPingInterval = 1 * time.Minute
-	defaultSendInterval = 500 * time.Millisecond
+	appConfigError        = "App configuration error: %s"
+	defaultPingInterval   = 1 * time.Minute
+	defaultSendInterval   = 500 * time.Millisecond
+	defaultMaxFloodWait   = 1 * time.Minute
+	defaultEventQueueSize = 64
+	defaultAckThreshold   = 16
+	defaultAckInterval    = 1 * time.Second
+	defaultDialTimeout    = 30 * time.Second
+
+	defaultUploadConcurrency   = 1
+	defaultDownloadConcurrency = 1
+
+	defaultReconnectBackoffBase = 1 * time.Second
+	defaultReconnectBackoffMax  = 1 * time.Minute
+	defaultMaxReconnectAttempts = 10
+
+	// the range of Configuration.Layer up to the layer of the generated TL code,
+	// whose decoder does not know the objects of the later layers
+	minLayer = 65
+	maxLayer = layer
 )
 
 type Configuration struct {
@@ -23,6 +44,114 @@ type Configuration struct {
 	PingInterval time.Duration
 	SendInterval time.Duration
 	KeyPath      string
+
+	// Proxy is a SOCKS5 proxy URL, socks5://[user:password@]host:port.
+	// If it is set, all the connections to Telegram servers go through the proxy.
+	Proxy string
+
+	// TransportMode is the framing of the packets, abridged by default.
+	// With an MTProxy secret prefixed by dd or ee, padded intermediate is used regardless of it.
+	TransportMode TransportMode
+
+	// MTProxy is a Telegram proxy. If both Proxy and MTProxy are set,
+	// the connections go to the MTProxy through the SOCKS5 proxy.
+	MTProxy MTProxy
+
+	// Dialer connects to the Telegram servers, or to Proxy or MTProxy if they are set (default net.Dialer).
+	// It supplies the connections of custom transports, e.g., in-memory ones in tests or TLS tunnels.
+	Dialer func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// DialTimeout bounds the dial of a server, with the handshakes of the proxies and the auth key exchange,
+	// which fail with DialTimeoutError rather than blocking on an unreachable DC (default 30 seconds).
+	DialTimeout time.Duration
+
+	// ConnectRetries is the number of the retries of a dial failing by a network error, with small delays,
+	// in DialTimeout. The failures of the auth key exchange, e.g., an unknown server key, are not retried.
+	ConnectRetries int
+
+	// AutoSelectDC makes NewAuthentication with an empty addr connect to a bootstrap DC,
+	// and migrate to the DC nearest to the client by help.getNearestDc.
+	AutoSelectDC bool
+
+	// AutoFloodWait makes Conn wait out FLOOD_WAIT errors and retry the RPCs,
+	// unless the wait is longer than MaxFloodWait (default 1 minute).
+	AutoFloodWait bool
+	MaxFloodWait  time.Duration
+
+	// RequestTimeout fails an RPC with TimeoutError, if no reply arrives in it (default TIMEOUT_RPC).
+	// Conn.WithTimeout overrides it per call.
+	RequestTimeout time.Duration
+
+	// EventQueueSize is the buffer size of the manager's event queue.
+	// Event handlers post events back to the queue, e.g., renewSession posts newsession,
+	// so a zero size queue serializes every handler on the manager and
+	// can deadlock when a handler waits for its reentrant event.
+	EventQueueSize int
+
+	// SessionEncryptionKey is a 32 bytes key to encrypt the key file with AES-256-GCM.
+	// Plaintext key files are still loaded, and they are encrypted on their next save.
+	SessionEncryptionKey []byte
+
+	// Logger receives the logs of the connections and the manager.
+	// If it is nil, the logs go to slog, filtered by SetLogLevel.
+	Logger Logger
+
+	// ReconnectBackoffBase and ReconnectBackoffMax bound the exponential delays between the reconnection
+	// attempts after a connection drop (default 1 second and 1 minute).
+	// After MaxReconnectAttempts consecutive failures (default 10), the connection gives up with ReconnectFailed.
+	ReconnectBackoffBase time.Duration
+	ReconnectBackoffMax  time.Duration
+	MaxReconnectAttempts int
+
+	// MaxRequestsPerSecond paces the RPCs of a connection, which wait client-side rather than hitting FLOOD_WAIT.
+	// RequestWeights counts an RPC by its TL method name, e.g., messages.sendMessage, as several requests.
+	// The RPCs are not limited if MaxRequestsPerSecond is not set.
+	MaxRequestsPerSecond float64
+	RequestWeights       map[string]int
+
+	// AckThreshold and AckInterval batch the acknowledgements of the received messages.
+	// A msgs_ack is sent when AckThreshold messages are pending (default 16), or every AckInterval (default 1 second).
+	AckThreshold int
+	AckInterval  time.Duration
+
+	// IdleTimeout closes the connections which have neither sent an RPC nor received a reply in it.
+	// The pings do not count, and the connections waiting for the replies are kept.
+	// The connections are not closed if it is not set.
+	IdleTimeout time.Duration
+
+	// CatchUpOnLoad makes Manager.LoadAuthenticationWithCatchUp return the updates missed since the state
+	// persisted in the key file. Otherwise they are propagated on binding, before the update callbacks are added.
+	// Loading blocks until updates.getState and updates.getDifference return.
+	CatchUpOnLoad bool
+
+	// RandSource is the source of the session ids, the ping ids, the random ids of the messages, and the file ids
+	// (default crypto/rand). A fixed source makes them reproducible in tests.
+	// The message ids are still by the clock, as MTProto requires. The secrets, i.e., the nonces and
+	// the DH exponent of the auth key exchange, and the obfuscation keys of MTProxy, are always of crypto/rand.
+	RandSource io.Reader
+
+	// MetricsCollector receives the metrics of the RPCs and the reconnections, if it is set.
+	MetricsCollector MetricsCollector
+
+	// OnChannelResync is called when the gap of the updates of the channel is too long to fill by
+	// updates.getChannelDifference. The difference has the latest messages and the pts to resync from,
+	// and the older messages are to be got by the history of the channel.
+	OnChannelResync func(channelId int32, diff *PredUpdatesChannelDifferenceTooLong)
+
+	// Layer overrides the layer of invokeWithLayer (default 71, the layer of the generated TL code).
+	// The server sends the objects of the layer, and the ones changed after layer 71 cannot be decoded,
+	// so it is limited to 65 to 71.
+	Layer int32
+
+	// UploadConcurrency is the number of the parts Conn.UploadFile uploads at once over the session (default 1).
+	UploadConcurrency int
+
+	// DownloadConcurrency is the number of the chunks Conn.DownloadFile fetches at once, if it writes
+	// to an io.WriterAt (default 1). A plain io.Writer is written by a single stream of the chunks.
+	DownloadConcurrency int
+
+	// dcs is the DC addresses shared by the sessions of a manager, set by NewManager
+	dcs *dcConfig
 }
 
 func NewConfiguration(id int32, hash, version, deviceModel, systemVersion, language string, pingInterval time.Duration, sendInterval time.Duration, keyPath string) (Configuration, error) {
@@ -72,12 +201,143 @@ func NewConfiguration(id int32, hash, version, deviceModel, systemVersion, langu
 		appConfig.SendInterval = defaultSendInterval
 	}
 
+	appConfig.EventQueueSize = defaultEventQueueSize
+
 	return appConfig, nil
 }
 
+// requestWeight is the weight of the RPC in RequestWeights, or 1 if it is not set
+func (appConfig Configuration) requestWeight(msg TL) int {
+	if weight, ok := appConfig.RequestWeights[rpcMethodName(msg)]; ok {
+		return weight
+	}
+	return 1
+}
+
+// requestTimeout is RequestTimeout, or TIMEOUT_RPC if it is not set
+func (appConfig Configuration) requestTimeout() time.Duration {
+	if appConfig.RequestTimeout == 0 {
+		return TIMEOUT_RPC
+	}
+	return appConfig.RequestTimeout
+}
+
+// reconnectDelay is the delay before the attempt-th reconnection, doubled on every failure
+func (appConfig Configuration) reconnectDelay(attempt int) time.Duration {
+	base, max := appConfig.ReconnectBackoffBase, appConfig.ReconnectBackoffMax
+	if base == 0 {
+		base = defaultReconnectBackoffBase
+	}
+	if max == 0 {
+		max = defaultReconnectBackoffMax
+	}
+	delay := base
+	for i := 1; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
+
+// ackThreshold is AckThreshold, or 16 if it is not set
+func (appConfig Configuration) ackThreshold() int {
+	if appConfig.AckThreshold <= 0 {
+		return defaultAckThreshold
+	}
+	return appConfig.AckThreshold
+}
+
+// ackInterval is AckInterval, or 1 second if it is not set
+func (appConfig Configuration) ackInterval() time.Duration {
+	if appConfig.AckInterval <= 0 {
+		return defaultAckInterval
+	}
+	return appConfig.AckInterval
+}
+
+// dialer is Dialer, or net.Dialer if it is not set
+func (appConfig Configuration) dialer() func(ctx context.Context, network, addr string) (net.Conn, error) {
+	if appConfig.Dialer == nil {
+		return (&net.Dialer{}).DialContext
+	}
+	return appConfig.Dialer
+}
+
+// dialTimeout is DialTimeout, or 30 seconds if it is not set
+func (appConfig Configuration) dialTimeout() time.Duration {
+	if appConfig.DialTimeout == 0 {
+		return defaultDialTimeout
+	}
+	return appConfig.DialTimeout
+}
+
+// layer is Layer, or the layer of the generated TL code if it is not set
+func (appConfig Configuration) layer() int32 {
+	if appConfig.Layer == 0 {
+		return layer
+	}
+	return appConfig.Layer
+}
+
+// uploadConcurrency is UploadConcurrency, or 1 if it is not set
+func (appConfig Configuration) uploadConcurrency() int {
+	if appConfig.UploadConcurrency <= 0 {
+		return defaultUploadConcurrency
+	}
+	return appConfig.UploadConcurrency
+}
+
+// downloadConcurrency is DownloadConcurrency, or 1 if it is not set
+func (appConfig Configuration) downloadConcurrency() int {
+	if appConfig.DownloadConcurrency <= 0 {
+		return defaultDownloadConcurrency
+	}
+	return appConfig.DownloadConcurrency
+}
+
+// isApiHash reports whether the api_hash is 32 hexadecimal digits, as my.telegram.org issues it
+func isApiHash(hash string) bool {
+	if len(hash) != 32 {
+		return false
+	}
+	for _, c := range hash {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F') {
+			return false
+		}
+	}
+	return true
+}
+
+func (appConfig Configuration) maxReconnectAttempts() int {
+	if appConfig.MaxReconnectAttempts == 0 {
+		return defaultMaxReconnectAttempts
+	}
+	return appConfig.MaxReconnectAttempts
+}
+
 func (appConfig Configuration) Check() error {
-	if appConfig.Id == 0 || appConfig.Hash == "" || appConfig.Version == "" {
-		return fmt.Errorf(appConfigError, "Configuration.Id, Configuration.Hash or Configuration.Version are empty")
+	if appConfig.Id == 0 {
+		return fmt.Errorf(appConfigError, "Configuration.Id (api_id) is not set")
+	}
+	if appConfig.Id < 0 {
+		return fmt.Errorf(appConfigError, "Configuration.Id (api_id) is negative")
+	}
+
+	if appConfig.Hash == "" {
+		return fmt.Errorf(appConfigError, "Configuration.Hash (api_hash) is empty")
+	}
+	if !isApiHash(appConfig.Hash) {
+		return fmt.Errorf(appConfigError, "Configuration.Hash (api_hash) is not 32 hexadecimal digits")
+	}
+
+	if appConfig.Version == "" {
+		return fmt.Errorf(appConfigError, "Configuration.Version is empty")
+	}
+
+	if appConfig.Layer != 0 && (appConfig.Layer < minLayer || appConfig.Layer > maxLayer) {
+		return fmt.Errorf(appConfigError, fmt.Sprintf("Configuration.Layer %d is out of %d to %d", appConfig.Layer, minLayer, maxLayer))
 	}
 
 	if appConfig.DeviceModel == "" {
@@ -92,5 +352,61 @@ func (appConfig Configuration) Check() error {
 		return fmt.Errorf(appConfigError, "Configuration.Language is empty")
 	}
 
+	if appConfig.RequestTimeout < 0 {
+		return fmt.Errorf(appConfigError, "Configuration.RequestTimeout is negative")
+	}
+
+	if appConfig.DialTimeout < 0 {
+		return fmt.Errorf(appConfigError, "Configuration.DialTimeout is negative")
+	}
+
+	if appConfig.ConnectRetries < 0 {
+		return fmt.Errorf(appConfigError, "Configuration.ConnectRetries is negative")
+	}
+
+	if appConfig.ReconnectBackoffBase < 0 || appConfig.ReconnectBackoffMax < 0 || appConfig.MaxReconnectAttempts < 0 {
+		return fmt.Errorf(appConfigError, "Configuration.ReconnectBackoffBase, ReconnectBackoffMax, or MaxReconnectAttempts is negative")
+	}
+
+	if appConfig.MaxRequestsPerSecond < 0 {
+		return fmt.Errorf(appConfigError, "Configuration.MaxRequestsPerSecond is negative")
+	}
+	for method, weight := range appConfig.RequestWeights {
+		if weight < 0 {
+			return fmt.Errorf(appConfigError, fmt.Sprintf("Configuration.RequestWeights of %s is negative", method))
+		}
+	}
+
+	if appConfig.EventQueueSize < 0 {
+		return fmt.Errorf(appConfigError, "Configuration.EventQueueSize is negative")
+	}
+
+	if appConfig.UploadConcurrency < 0 || appConfig.DownloadConcurrency < 0 {
+		return fmt.Errorf(appConfigError, "Configuration.UploadConcurrency or DownloadConcurrency is negative")
+	}
+
+	if appConfig.TransportMode < TransportAbridged || appConfig.TransportMode > TransportFull {
+		return fmt.Errorf(appConfigError, "unknown Configuration.TransportMode")
+	}
+
+	if appConfig.MTProxy.Addr != "" {
+		if _, err := parseMTProxySecret(appConfig.MTProxy.Secret); err != nil {
+			return fmt.Errorf(appConfigError, err)
+		}
+		if appConfig.TransportMode == TransportFull {
+			return fmt.Errorf(appConfigError, "MTProxy does not support the full transport")
+		}
+	}
+
+	if n := len(appConfig.SessionEncryptionKey); n != 0 && n != 32 {
+		return fmt.Errorf(appConfigError, "Configuration.SessionEncryptionKey is not 32 bytes")
+	}
+
+	if appConfig.Proxy != "" {
+		if _, err := socks5Dialer(appConfig.Proxy, contextDialer(appConfig.dialer())); err != nil {
+			return fmt.Errorf(appConfigError, err)
+		}
+	}
+
 	return nil
 }
@@ -1,10 +1,12 @@
 package mtproto
 
 import (
+	"errors"
 	"fmt"
-	"github.com/cjongseok/slog"
-	"math/rand"
+	"golang.org/x/net/context"
+	"io"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -14,6 +16,8 @@ const (
 	TIMEOUT_INVOKE_WITH_LAYER = 10 * time.Second
 	TIMEOUT_UPDATES_GETSTATE  = 7 * time.Second
 	TIMEOUT_SESSION_BINDING   = TIMEOUT_INVOKE_WITH_LAYER + TIMEOUT_UPDATES_GETSTATE
+	TIMEOUT_REFRESH_BINDING   = TIMEOUT_SESSION_BINDING + TIMEOUT_RPC
+	TIMEOUT_FINISH            = 10 * time.Second
 	//DELAY_RETRY_OPEN_SESSION  = 1 * time.Second
 )
 
@@ -22,119 +26,378 @@ const (
 type Conn struct {
 	connId                int32
 	session               *Session
+	sessionMutex          sync.RWMutex // guards session, which the monitor reads on its handlers
 	smonitor              chan Event
 	interrupter           chan struct{}
 	bindWaitGroup         sync.WaitGroup
 	listeners             []chan Event
 	updateCallbacks       []UpdateCallback
 	discardedUpdatesState *PredUpdatesState
+	appLogger             Logger
+	loggedOut             int32 // set atomically by AuthLogOut
+	closing               int32 // set atomically by Close
+	limiterOnce           sync.Once
+	limiter               *rateLimiter
+	closeOnce             sync.Once    // closes once, even if closed by Finish and a user at the same time
+	stateMutex            sync.RWMutex // serializes bind and unbind with close, and the notifications with the close of smonitor
+	closed                bool         // guarded by stateMutex
+	closeRequested        bool         // guarded by stateMutex, set by the manager on closeConnection before the close
+	closeReason           CloseReason  // guarded by stateMutex, of the requested close
+	everBound             bool         // guarded by stateMutex, set by the first binding
+	reconnecting          bool         // guarded by stateMutex, set by the discard of the session on reconnect until a binding
+	useIPv6               bool         // of the bound session, kept by the sessions reloaded on reconnect
+	keyPath               string       // of AuthOptions, kept by the sessions reloaded on reconnect
+
+	// the updates to the update callbacks, in the order of their arrival
+	propagateMutex  sync.Mutex // guards propagateq and updateCallbacks
+	propagateq      []Update
+	propagateSignal chan struct{}
+
+	// the manager of the connection, to request the close
+	managerq    chan Event    // the event queue of the manager
+	managerDone chan struct{} // closed on the finish of the manager, after which no request is answered
+
+	// sessions to the DCs storing files, by DC id
+	mediaMutex    sync.Mutex
+	mediaSessions map[int32]*Session
 }
 
 // open, close, and bind should be done by Manager
-func newConnection(connListener chan Event) *Conn {
+func newConnection(connListener chan Event, managerDone chan struct{}, appConfig Configuration) *Conn {
 	//if connListener == nil {
 	//	return nil, fmt.Errorf("nil listener")
 	//}
 	mconn := new(Conn)
-	rand.Seed(time.Now().UnixNano())
-	mconn.connId = rand.Int31()
+	mconn.connId = randInt31(appConfig.randSource())
+	mconn.appLogger = appConfig.Logger
 	mconn.smonitor = make(chan Event)
 	mconn.interrupter = make(chan struct{})
+	mconn.propagateSignal = make(chan struct{}, 1)
+	mconn.managerq = connListener
+	mconn.managerDone = managerDone
 	mconn.AddConnListener(connListener)
 	mconn.AddConnListener(mconn.smonitor)
 	mconn.bindWaitGroup = sync.WaitGroup{}
 	defer mconn.bindWaitGroup.Add(1) // wait for session binding ...
 
 	go mconn.monitorSession()
+	go mconn.propagateRoutine()
 
 	mconn.notify(ConnectionOpened{mconn})
 	//return mconn, nil
 	return mconn
 }
 
-func (mconn *Conn) bind(session *Session) error {
+// bind returns the updates missed while reconnecting, or since the last run, which are propagated as well.
+func (mconn *Conn) bind(session *Session) ([]Update, error) {
 	if session == nil {
-		return fmt.Errorf("nil ssession")
+		return nil, fmt.Errorf("nil ssession")
+	}
+	mconn.stateMutex.Lock()
+	if mconn.closed || mconn.closeRequested {
+		// close has released the callers waiting for a binding already, or is about to
+		mconn.stateMutex.Unlock()
+		return nil, ErrConnClosed
 	}
 	session.AddSessionListener(mconn.smonitor)
 	session.connId = mconn.connId
-	mconn.session = session
+	mconn.useIPv6 = session.useIPv6
+	session.touchRPC() // a new session is not idle
+	mconn.setSession(session)
+	mconn.everBound = true
+	mconn.reconnecting = false
 	mconn.bindWaitGroup.Done() // stop waiting for new session. Enable querying
-	mconn.notify(sessionBound{mconn})
-
-	//TODO: get updates difference on opening session rather than its binding
-	// req updates, if exists
-	if mconn.discardedUpdatesState != nil {
-		//slog.Logf(mconn, "bind: new session seq:%d, unbound session seq:%d\n", session.updatesState.Seq, mconn.discardedUpdatesState.Seq)
-		//seqDiff := mconn.discardedUpdatesState.Seq - session.updatesState.Seq
-		ptsDiff := session.updatesState.Pts - mconn.discardedUpdatesState.Pts
-		qtsDiff := session.updatesState.Qts - mconn.discardedUpdatesState.Qts
-		seqDiff := session.updatesState.Seq - mconn.discardedUpdatesState.Seq
-		if ptsDiff > 0 || qtsDiff > 0 || seqDiff > 0 {
-			// missed updates exist. Propagate updates to callbacks
-			updatesDiff, err := mconn.InvokeBlocked(&ReqUpdatesGetDifference{
-				Pts:           mconn.discardedUpdatesState.Pts,
-				PtsTotalLimit: 0,
-				Date:          mconn.discardedUpdatesState.Date,
-				Qts:           mconn.discardedUpdatesState.Qts})
-			if err != nil {
-				return fmt.Errorf("failed to get update difference")
-			}
+	mconn.stateMutex.Unlock()
+	mconn.notify(sessionBound{mconn, session.sessionId})
+
+	// catch up the updates missed while reconnecting, or since the last run
+	// unless LoadAuthenticationWithCatchUp returns the latter
+	if mconn.discardedUpdatesState != nil || (session.persistedUpdatesState != nil && !session.appConfig.CatchUpOnLoad) {
+		missed, err := mconn.updatesGetDifference(context.Background())
+		if err != nil {
+			return nil, fmt.Errorf("failed to get update difference: %v", err)
+		}
+		return missed, nil
+	}
+	logln(mconn, "bind: mconn.discardedUpdatesState is nil")
+	return nil, nil
+}
 
-			switch udiff := updatesDiff.(type) {
-			case *PredUpdatesDifferenceEmpty:
-				slog.Logf(mconn, "bind: diff: empty\n")
-			case *PredUpdatesDifference:
-				slog.Logf(mconn, "bind: diff: %v\n", udiff)
-				mconn.propagate(udiff)
-			case *PredUpdatesDifferenceSlice:
-				slog.Logf(mconn, "bind: diff: slice: %v\n", udiff)
-				mconn.propagate(udiff)
-			case *PredUpdatesDifferenceTooLong:
-				slog.Logf(mconn, "bind: diff: too long\n")
-			default:
-				slog.Logf(mconn, "bind: no diff\n")
+func (mconn *Conn) InvokeBlocked(msg TL) (interface{}, error) {
+	return mconn.InvokeBlockedContext(context.Background(), msg)
+}
+
+// InvokeBlockedContext is InvokeBlocked which gives up on ctx done.
+// The cancellation of ctx abandons the message of the call, so the call returns ctx.Err() without waiting for
+// the reply, and the reply arriving later is discarded. The request may be done on the server nevertheless.
+func (mconn *Conn) InvokeBlockedContext(ctx context.Context, msg TL) (interface{}, error) {
+	session, err := mconn.Session()
+	if err != nil {
+		return nil, err
+	}
+	return mconn.invokeRetrying(ctx, msg, session.appConfig, session.appConfig.requestTimeout())
+}
+
+// WithContext returns the RPC caller on the connection, whose calls give up on ctx done as InvokeBlockedContext.
+// The wrappers have their Context variants, e.g., MessagesEditMessageContext, and the RPCs without wrappers
+// are called with ctx by the RPC methods of the caller.
+func (mconn *Conn) WithContext(ctx context.Context) RPCaller {
+	return RPCaller{mconn.contextRPC(ctx)}
+}
+
+// contextRPC returns the RPC of the connection calling InvokeBlockedContext with ctx,
+// for the Context variants of the wrappers
+func (mconn *Conn) contextRPC(ctx context.Context) RemoteProcedureCall {
+	return contextRPC{mconn, ctx}
+}
+
+type contextRPC struct {
+	mconn *Conn
+	ctx   context.Context
+}
+
+func (x contextRPC) InvokeBlocked(msg TL) (interface{}, error) {
+	return x.mconn.InvokeBlockedContext(x.ctx, msg)
+}
+
+// the configuration of the connection is kept by the wrappers called with ctx
+
+func (x contextRPC) uploadConcurrency() int {
+	return x.mconn.uploadConcurrency()
+}
+
+func (x contextRPC) randSource() io.Reader {
+	return x.mconn.randSource()
+}
+
+// WithTimeout returns the RPC caller on the connection, whose calls fail with TimeoutError after timeout,
+// instead of Configuration.RequestTimeout.
+func (mconn *Conn) WithTimeout(timeout time.Duration) RPCaller {
+	return RPCaller{timeoutRPC{mconn, timeout}}
+}
+
+type timeoutRPC struct {
+	mconn   *Conn
+	timeout time.Duration
+}
+
+func (x timeoutRPC) InvokeBlocked(msg TL) (interface{}, error) {
+	session, err := x.mconn.Session()
+	if err != nil {
+		return nil, err
+	}
+	return x.mconn.invokeRetrying(context.Background(), msg, session.appConfig, x.timeout)
+}
+
+// Invoke sends any request of the layer, e.g., of a method the connection has no wrapper of,
+// and returns its decoded response. A vector response comes as TLVector.
+// It fails with TimeoutError after Configuration.RequestTimeout.
+//
+// Unlike InvokeBlocked, it bypasses the typed error mapping: the errors from the server are RPCError as they are,
+// and it retries neither on FLOOD_WAIT nor on X_MIGRATE.
+func (mconn *Conn) Invoke(request TL) (TL, error) {
+	return mconn.InvokeContext(context.Background(), request)
+}
+
+// InvokeContext is Invoke which gives up on ctx done, as InvokeBlockedContext.
+func (mconn *Conn) InvokeContext(ctx context.Context, request TL) (TL, error) {
+	session, err := mconn.Session()
+	if err != nil {
+		return nil, err
+	}
+	data, err := mconn.invokeBlocked(ctx, request, session.appConfig.requestTimeout())
+	if err != nil {
+		var rpcError RPCError
+		if errors.As(err, &rpcError) {
+			return nil, rpcError
+		}
+		return nil, err
+	}
+	switch x := data.(type) {
+	case TL:
+		return x, nil
+	case []TL:
+		return TLVector(x), nil
+	}
+	return nil, fmt.Errorf("RPC: %#v", data)
+}
+
+// TLVector is a vector response of Invoke.
+type TLVector []TL
+
+func (v TLVector) encode() []byte {
+	x := NewEncodeBuf(512)
+	x.Vector(v)
+	return x.buf
+}
+
+// TLResult is the response or the error of a request of InvokeBatch.
+type TLResult struct {
+	Data interface{}
+	Err  error
+}
+
+// InvokeBatch sends the requests in a msg_container, one packet rather than a round trip for each,
+// and returns their results in the order of reqs.
+// A request failing does not fail the others, so check the Err of each result.
+// The results not replied in Configuration.RequestTimeout fail with TimeoutError.
+// Unlike InvokeBlocked, the requests are not retried on FLOOD_WAIT nor on X_MIGRATE.
+func (mconn *Conn) InvokeBatch(reqs []TL) ([]TLResult, error) {
+	if len(reqs) == 0 || len(reqs) > maxContainerMessages {
+		return nil, fmt.Errorf("cannot batch %d requests, 1 to %d", len(reqs), maxContainerMessages)
+	}
+	session, err := mconn.Session()
+	if err != nil {
+		return nil, err
+	}
+	timeout := session.appConfig.requestTimeout()
+	limiter := mconn.rateLimiter(session.appConfig)
+	batch := make([]packetToSend, len(reqs))
+	for i, req := range reqs {
+		if limiter != nil {
+			limiter.wait(context.Background(), session.appConfig.requestWeight(req))
+		}
+		batch[i] = packetToSend{msg: req, resp: make(chan response, 1), timeout: timeout}
+	}
+	session.queueSend <- packetToSend{msg: TL_msg_container{}, batch: batch}
+
+	results := make([]TLResult, len(reqs))
+	expired := time.After(timeout)
+	for i, packet := range batch {
+		select {
+		case x := <-packet.resp:
+			results[i] = TLResult{x.data, x.err}
+		case <-expired:
+			// the rest not replied yet are expired as well
+			for ; i < len(batch); i++ {
+				select {
+				case x := <-batch[i].resp:
+					results[i] = TLResult{x.data, x.err}
+				default:
+					results[i].Err = TimeoutError{timeout}
+				}
 			}
-			//unstripped := (*updatesDiff).(*PredUpdatesDifference).Unstrip().(US_updates_difference)
-			//udiff := (*updatesDiff).(*PredUpdatesDifference)
-			//slog.Logf(mconn, "bind: unstripped diff: %v\n", unstripped)
-			//mconn.propagate(unstripped)
+			return results, nil
 		}
-		mconn.discardedUpdatesState = nil
-	} else {
-		slog.Logln(mconn, "bind: mconn.discardedUpdatesState is nil")
 	}
-	return nil
+	return results, nil
 }
 
-func (mconn *Conn) InvokeBlocked(msg TL) (interface{}, error) {
-	// TODO: timeout the call
+// invokeRetrying invokes the RPC, and retries it on flood waits and migrations
+func (mconn *Conn) invokeRetrying(ctx context.Context, msg TL, appConfig Configuration, timeout time.Duration) (interface{}, error) {
+	return retryOnMigrate(func() (interface{}, error) {
+		return retryOnFloodWait(ctx, appConfig, func() (interface{}, error) {
+			return mconn.invokeBlocked(ctx, msg, timeout)
+		})
+	}, func(dc int) error {
+		return mconn.migrate(ctx, dc)
+	})
+}
+
+// migrate renews the session to the DC, as PHONE_MIGRATE, NETWORK_MIGRATE, and USER_MIGRATE require.
+// The new session overwrites the key file with the DC address, so the next LoadAuthentication goes to the DC directly.
+func (mconn *Conn) migrate(ctx context.Context, dc int) error {
+	session, err := mconn.Session()
+	if err != nil {
+		return err
+	}
+	addr, err := mconn.dcAddr(int32(dc), false)
+	if err != nil {
+		return fmt.Errorf("cannot migrate: %v", err)
+	}
+	infof(mconn, "migrate to DC %d, %s", dc, addr)
+
+	// a signed-in account carries its authorization to the DC
+	var exported *PredAuthExportedAuthorization
+	if session.user != nil {
+		exported, err = exportAuthorization(mconn, int32(dc))
+		if err != nil {
+			return fmt.Errorf("cannot export the authorization to DC %d: %v", dc, err)
+		}
+	}
+
+	respCh := make(chan sessionResponse, 1)
+	mconn.notify(renewSession{
+		session.sessionId,
+		session.phonenumber,
+		addr,
+		session.useIPv6,
+		respCh,
+	})
+	select {
+	case resp := <-respCh:
+		if resp.err != nil || exported == nil {
+			return resp.err
+		}
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	auth, err := importAuthorization(mconn, exported)
+	if err != nil {
+		return fmt.Errorf("cannot import the authorization on DC %d: %v", dc, err)
+	}
+	_, err = mconn.signedIn(auth)
+	return err
+}
+
+func (mconn *Conn) invokeBlocked(ctx context.Context, msg TL, timeout time.Duration) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	// the session fails the call on timeout or on ctx done, and these are for the call not sent yet
 	select {
-	case x := <-mconn.InvokeNonBlocked(msg):
+	case x := <-mconn.invokeNonBlocked(ctx, msg, timeout):
 		if x.err == nil {
 			return x.data, nil
 		}
 		return nil, x.err
 
-	case <-time.After(TIMEOUT_RPC):
-		return nil, fmt.Errorf("RPC Timeout(%f s)", TIMEOUT_RPC.Seconds())
+	case <-time.After(timeout):
+		return nil, TimeoutError{timeout}
+
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	}
 }
 
 func (mconn *Conn) InvokeNonBlocked(msg TL) chan response {
+	return mconn.invokeNonBlocked(context.Background(), msg, 0)
+}
+
+func (mconn *Conn) invokeNonBlocked(ctx context.Context, msg TL, timeout time.Duration) chan response {
 	resp := make(chan response, 1)
 	session, err := mconn.Session()
 	if err != nil {
 		resp <- response{nil, err}
 		return resp
 	}
+	if limiter := mconn.rateLimiter(session.appConfig); limiter != nil {
+		if err := limiter.wait(ctx, session.appConfig.requestWeight(msg)); err != nil {
+			resp <- response{nil, err}
+			return resp
+		}
+	}
 	session.queueSend <- packetToSend{
-		msg:  msg,
-		resp: resp,
+		msg:     msg,
+		resp:    resp,
+		timeout: timeout,
+		ctx:     ctx,
 	}
 	return resp
 }
 
+// Ping checks the connection is alive by a ping, and returns the round-trip time to its pong.
+// It needs no authorization, so it works right after the connection is made.
+// It fails with TimeoutError after Configuration.RequestTimeout.
+func (mconn *Conn) Ping() (time.Duration, error) {
+	session, err := mconn.Session()
+	if err != nil {
+		return 0, err
+	}
+	return session.ping(session.appConfig.requestTimeout())
+}
+
 // CAVEAT:
 // Accessing the session without this method does NOT ensure
 // the session is alive.
@@ -145,38 +408,150 @@ func (mconn *Conn) Session() (*Session, error) {
 	c := make(chan struct{})
 	go func() {
 		defer close(c)
-		//slog.Logln(mconn, "mconn:", mconn)
-		//slog.Logln(mconn, "bindWaitGroup:", mconn.bindWaitGroup)
+		//logln(mconn, "mconn:", mconn)
+		//logln(mconn, "bindWaitGroup:", mconn.bindWaitGroup)
 		mconn.bindWaitGroup.Wait()
 		//TODO: ping to prolong session life? Because session can be aborted
 	}()
 	select {
 	case <-c:
-		return mconn.session, nil
+		// no session is bound after the connection is closed
+		if session := mconn.boundSession(); session != nil {
+			return session, nil
+		}
+		return nil, ErrConnClosed
 	case <-time.After(TIMEOUT_SESSION_BINDING):
-		return nil, fmt.Errorf("No Session: session binding timeout")
+		return nil, fmt.Errorf("%w: session binding timeout", ErrNoSession)
+	}
+}
+
+// Close discards the session of the connection and closes it, waiting for the manager to do so.
+// The other connections of the manager are kept.
+// It returns ErrConnClosed on a connection closed already, by Close or by the manager, and does nothing else.
+// The connection failed to close may be closed again.
+func (mconn *Conn) Close() error {
+	if !atomic.CompareAndSwapInt32(&mconn.closing, 0, 1) {
+		return ErrConnClosed
+	}
+	if mconn.isClosed() {
+		return ErrConnClosed
+	}
+	if err := mconn.requestClose(CloseGraceful); err != nil {
+		atomic.StoreInt32(&mconn.closing, 0)
+		return err
+	}
+	return nil
+}
+
+// requestClose posts closeConnection to the manager, and waits for its reply.
+// It gives up on the finish of the manager, which answers no more.
+func (mconn *Conn) requestClose(reason CloseReason) error {
+	finished := fmt.Errorf("manager finished before closing connection %d", mconn.connId)
+	resp := make(chan error, 1)
+	select {
+	case mconn.managerq <- closeConnection{mconn.connId, resp, reason}:
+	case <-mconn.managerDone:
+		return finished
+	}
+	select {
+	case err := <-resp:
+		return err
+	case <-mconn.managerDone:
+		// the handler may have answered before the finish
+		select {
+		case err := <-resp:
+			return err
+		default:
+			return finished
+		}
 	}
 }
 
 // finish connection's internal resource but bound session.
 // closing/deregistering session occurs through closeConnection event on Manager
 // which is the only caller of this method.
-func (mconn *Conn) close() {
-	close(mconn.interrupter)
-	close(mconn.smonitor)
-	mconn.bindWaitGroup.Done()
+func (mconn *Conn) close(reason CloseReason) {
+	mconn.closeOnce.Do(func() {
+		// notify the connection is closed, while the monitor is still listening
+		mconn.notify(ConnectionClosed{mconn.connId, reason})
+
+		// no notification is sent to smonitor after its close, and no session is bound or unbound after this
+		mconn.stateMutex.Lock()
+		mconn.closed = true
+		close(mconn.interrupter)
+		close(mconn.smonitor)
+		if mconn.boundSession() == nil {
+			mconn.bindWaitGroup.Done() // release the callers waiting for a session binding
+		}
+		mconn.setSession(nil)
+		mconn.stateMutex.Unlock()
+		mconn.closeMediaSessions()
+	})
+}
+
+// bindingState returns the bound session, whether the connection has ever been bound,
+// and whether it is reconnecting, of the same moment.
+// The session is nil unless the connection is bound and not reconnecting.
+func (mconn *Conn) bindingState() (session *Session, everBound, reconnecting bool) {
+	mconn.stateMutex.RLock()
+	defer mconn.stateMutex.RUnlock()
+	return mconn.boundSession(), mconn.everBound, mconn.reconnecting
+}
+
+// setCloseReason records the close requested to the manager, after which the connection is never bound,
+// and the refresh of its session gives up.
+func (mconn *Conn) setCloseReason(reason CloseReason) {
+	mconn.stateMutex.Lock()
+	defer mconn.stateMutex.Unlock()
+	if !mconn.closeRequested {
+		mconn.closeRequested = true
+		mconn.closeReason = reason
+	}
+}
+
+// clearCloseReason drops the record of the close, which the manager failed
+func (mconn *Conn) clearCloseReason() {
+	mconn.stateMutex.Lock()
+	defer mconn.stateMutex.Unlock()
+	mconn.closeRequested = false
+}
 
-	// notify the connection is closed
-	mconn.notify(connectionClosed{mconn.connId})
+// requestedClose returns the reason of the close requested to the manager, if any.
+func (mconn *Conn) requestedClose() (CloseReason, bool) {
+	mconn.stateMutex.RLock()
+	defer mconn.stateMutex.RUnlock()
+	return mconn.closeReason, mconn.closeRequested
+}
+
+// isClosed reports whether the connection is closed, after which it is never bound
+func (mconn *Conn) isClosed() bool {
+	mconn.stateMutex.RLock()
+	defer mconn.stateMutex.RUnlock()
+	return mconn.closed
+}
+
+func (mconn *Conn) boundSession() *Session {
+	mconn.sessionMutex.RLock()
+	defer mconn.sessionMutex.RUnlock()
+	return mconn.session
+}
+
+func (mconn *Conn) setSession(session *Session) {
+	mconn.sessionMutex.Lock()
+	defer mconn.sessionMutex.Unlock()
+	mconn.session = session
 }
 
 func (mconn *Conn) AddConnListener(listener chan Event) {
 	mconn.listeners = append(mconn.listeners, listener)
 }
 
+// AddUpdateCallback adds the callback of the updates of the connection.
+// The callbacks are called one at a time, in the order of the updates, so they should not block.
 func (mconn *Conn) AddUpdateCallback(callback UpdateCallback) {
+	mconn.propagateMutex.Lock()
+	defer mconn.propagateMutex.Unlock()
 	mconn.updateCallbacks = append(mconn.updateCallbacks, callback)
-
 }
 
 func (mconn *Conn) RemoveConnListener(toremove chan Event) error {
@@ -192,6 +567,8 @@ func (mconn *Conn) RemoveConnListener(toremove chan Event) error {
 }
 
 func (mconn *Conn) RemoveUpdateListener(toremove UpdateCallback) error {
+	mconn.propagateMutex.Lock()
+	defer mconn.propagateMutex.Unlock()
 	for index, registered := range mconn.updateCallbacks {
 		if registered == toremove {
 			copy(mconn.updateCallbacks[index:], mconn.updateCallbacks[index+1:])
@@ -203,7 +580,13 @@ func (mconn *Conn) RemoveUpdateListener(toremove UpdateCallback) error {
 	return fmt.Errorf("UpdateCallback (%x) doesn't exist", toremove)
 }
 
+// notify sends the event to the listeners, unless the connection is closed
 func (mconn *Conn) notify(e Event) {
+	mconn.stateMutex.RLock()
+	defer mconn.stateMutex.RUnlock()
+	if mconn.closed {
+		return
+	}
 	for _, listener := range mconn.listeners {
 		// TODO: it doesn't work. think of another solutino to handle a deadlock on channel
 		//go func(){listener <- e}()
@@ -211,18 +594,51 @@ func (mconn *Conn) notify(e Event) {
 	}
 }
 
+// propagate queues the update to the callbacks, without waiting for them
 func (mconn *Conn) propagate(u Update) {
-	for _, callback := range mconn.updateCallbacks {
-		go func() { callback.OnUpdate(u) }()
+	mconn.propagateMutex.Lock()
+	mconn.propagateq = append(mconn.propagateq, u)
+	mconn.propagateMutex.Unlock()
+	select {
+	case mconn.propagateSignal <- struct{}{}:
+	default:
+		// the routine is signaled already
+	}
+}
+
+// propagateRoutine calls the callbacks with the queued updates, one at a time in the order of the queue,
+// until the connection is closed
+func (mconn *Conn) propagateRoutine() {
+	for {
+		select {
+		case <-mconn.interrupter:
+			return
+		case <-mconn.propagateSignal:
+		}
+		for {
+			mconn.propagateMutex.Lock()
+			if len(mconn.propagateq) == 0 {
+				mconn.propagateMutex.Unlock()
+				break
+			}
+			u := mconn.propagateq[0]
+			mconn.propagateq[0] = nil
+			mconn.propagateq = mconn.propagateq[1:]
+			callbacks := append([]UpdateCallback(nil), mconn.updateCallbacks...)
+			mconn.propagateMutex.Unlock()
+			for _, callback := range callbacks {
+				callback.OnUpdate(u)
+			}
+		}
 	}
 }
 
 func (mconn *Conn) monitorSession() {
-	slog.Logln(mconn, "start")
+	logln(mconn, "start")
 	for {
 		select {
 		case <-mconn.interrupter:
-			slog.Logf(mconn, "stop")
+			logf(mconn, "stop")
 			return
 		case e := <-mconn.smonitor:
 			switch e.(type) {
@@ -233,11 +649,18 @@ func (mconn *Conn) monitorSession() {
 			case discardSession: // triggered only on reconnect (either renewSession or refreshSession)
 				go func() {
 					// Unbind the session until the connection has new session
-					slog.Logf(mconn, "session will be discarded%d\n", mconn.session.sessionId)
 					e := e.(discardSession)
+					logf(mconn, "session will be discarded%d\n", e.sessionId)
+					mconn.stateMutex.Lock()
+					if mconn.closed {
+						mconn.stateMutex.Unlock()
+						return
+					}
 					mconn.bindWaitGroup.Add(1)
 					unbound := sessionUnbound{mconn, e.sessionId}
-					mconn.session = nil
+					mconn.setSession(nil)
+					mconn.reconnecting = true
+					mconn.stateMutex.Unlock()
 					// notify that inside selection needs non-blocking handlers
 					mconn.notify(unbound)
 				}()
@@ -248,37 +671,36 @@ func (mconn *Conn) monitorSession() {
 			// Connection Events
 			case ConnectionOpened:
 				go func() {
-					slog.Logf(mconn, "opened.")
-					if mconn.session == nil {
-						slog.Logf(mconn, "wait for a session binding ...\n")
+					logf(mconn, "opened.")
+					if session := mconn.boundSession(); session == nil {
+						logf(mconn, "wait for a session binding ...\n")
 					} else {
-						slog.Logf(mconn, "with session, %d\n", mconn.session.sessionId)
+						logf(mconn, "with session, %d\n", session.sessionId)
 					}
 				}()
 			case sessionBound:
 				go func() {
-					slog.Logf(mconn, "bound to session %d\n", mconn.session.sessionId)
+					logf(mconn, "bound to session %d\n", e.(sessionBound).boundSessionId)
 				}()
 			case sessionUnbound:
 				go func() {
 					e := e.(sessionUnbound)
-					slog.Logf(mconn, "unbound to session %d\n", e.unboundSessionId)
+					logf(mconn, "unbound to session %d\n", e.unboundSessionId)
 				}()
 			case closeConnection:
 				go func() {
-					slog.Logln(mconn, "this connection will close")
+					logln(mconn, "this connection will close")
 				}()
-			case connectionClosed:
+			case ConnectionClosed:
 				go func() {
-					slog.Logln(mconn, "closed")
+					logf(mconn, "closed, %s\n", e.(ConnectionClosed).Reason)
 				}()
 
 				// Update Event
 			case updateReceived:
-				go func() {
-					slog.Logln(mconn, "received an update, ", e.(updateReceived).update)
-					mconn.propagate(e.(updateReceived).update)
-				}()
+				// queued in the order of the arrival, rather than on a goroutine of each
+				logln(mconn, "received an update, ", e.(updateReceived).update)
+				mconn.propagate(e.(updateReceived).update)
 			default:
 			}
 		}
@@ -286,16 +708,34 @@ func (mconn *Conn) monitorSession() {
 }
 
 func (mconn *Conn) SignIn(phoneNumber, phoneCode, phoneCodeHash string) (*TypeAuthAuthorization, error) {
+	return mconn.SignInContext(context.Background(), phoneNumber, phoneCode, phoneCodeHash)
+}
+
+// SignInContext is SignIn which gives up on ctx done.
+func (mconn *Conn) SignInContext(ctx context.Context, phoneNumber, phoneCode, phoneCodeHash string) (*TypeAuthAuthorization, error) {
 	if phoneNumber == "" || phoneCode == "" || phoneCodeHash == "" {
 		return nil, fmt.Errorf("empty sign-in argument")
 	}
 
-	x := <-mconn.InvokeNonBlocked(&ReqAuthSignIn{
+	var x response
+	select {
+	case x = <-mconn.invokeNonBlocked(ctx, &ReqAuthSignIn{
 		PhoneNumber:   phoneNumber,
 		PhoneCodeHash: phoneCodeHash,
 		PhoneCode:     phoneCode,
-	})
+	}, 0):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
 	if x.err != nil {
+		if _, ok := x.err.(SignUpRequiredError); ok {
+			// keep the confirmed code for AuthSignUp
+			if session, err := mconn.Session(); err == nil {
+				session.codeMutex.Lock()
+				session.signUpCode = phoneCode
+				session.codeMutex.Unlock()
+			}
+		}
 		return nil, x.err
 	}
 
@@ -304,27 +744,43 @@ func (mconn *Conn) SignIn(phoneNumber, phoneCode, phoneCodeHash string) (*TypeAu
 		return nil, fmt.Errorf("RPC: %v", x)
 	}
 
+	_, err := mconn.signedIn(auth)
+	return &TypeAuthAuthorization{auth}, err
+}
+
+// signedIn keeps the authorized user on the session
+func (mconn *Conn) signedIn(auth *PredAuthAuthorization) (*PredUser, error) {
 	session, err := mconn.Session()
 	if err != nil {
-		return &TypeAuthAuthorization{auth}, err
+		return nil, err
 	}
 
 	if auth.GetUser().GetUser() != nil {
 		session.user = auth.GetUser().GetUser()
-		slog.Logln(mconn, "Signed in as ", session.user)
+		infof(mconn, "Signed in as %v", session.user)
 	} else if auth.GetUser().GetUserEmpty() != nil {
 		session.user = &PredUser{}
-		slog.Logln(mconn, "Signed in with empty user")
+		logln(mconn, "Signed in with empty user")
 	} else {
 		session.user = &PredUser{}
-		slog.Logln(mconn, "Signed in without user response: neither user nor user empty")
+		logln(mconn, "Signed in without user response: neither user nor user empty")
 	}
-	return &TypeAuthAuthorization{auth}, nil
+	return session.user, nil
 }
 
 func (mconn *Conn) SignOut() (bool, error) {
+	return mconn.SignOutContext(context.Background())
+}
+
+// SignOutContext is SignOut which gives up on ctx done.
+func (mconn *Conn) SignOutContext(ctx context.Context) (bool, error) {
 	var result bool
-	x := <-mconn.InvokeNonBlocked(&ReqAuthLogOut{})
+	var x response
+	select {
+	case x = <-mconn.invokeNonBlocked(ctx, &ReqAuthLogOut{}, 0):
+	case <-ctx.Done():
+		return result, ctx.Err()
+	}
 	if x.err != nil {
 		return result, x.err
 	}
@@ -335,6 +791,10 @@ func (mconn *Conn) SignOut() (bool, error) {
 	return false, fmt.Errorf("invalid rpc return: %T: %v", x.data, x.data)
 }
 
+func (x *Conn) logger() Logger {
+	return x.appLogger
+}
+
 func (x *Conn) LogPrefix() string {
 	return fmt.Sprintf("[mconn %d]", x.connId)
 }
@@ -0,0 +1,171 @@
+package mtproto
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestInvokeNearestDc(t *testing.T) {
+	loopback := make(chan packetToSend)
+	mconn := &Conn{session: &Session{queueSend: loopback, appConfig: Configuration{RequestTimeout: time.Second}}}
+	// answer help.getNearestDc, and flood the others
+	go func() {
+		for x := range loopback {
+			if _, ok := x.msg.(*ReqHelpGetNearestDc); ok {
+				x.resp <- response{&PredNearestDc{Country: "KR", ThisDc: 2, NearestDc: 5}, nil}
+			} else {
+				x.resp <- response{nil, toError(TL_rpc_error{errorFlood, "FLOOD_WAIT_30"})}
+			}
+		}
+	}()
+	defer close(loopback)
+
+	data, err := mconn.Invoke(&ReqHelpGetNearestDc{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	nearest, ok := data.(*PredNearestDc)
+	if !ok || nearest.Country != "KR" || nearest.NearestDc != 5 {
+		t.Errorf("unexpected response %#v", data)
+	}
+
+	// the errors are not typed
+	_, err = mconn.Invoke(&ReqHelpGetConfig{})
+	if rpcError, ok := err.(RPCError); !ok || rpcError.Code != errorFlood || rpcError.Message != "FLOOD_WAIT_30" {
+		t.Errorf("unexpected error %T: %v", err, err)
+	}
+}
+
+func TestInvokeContextCanceled(t *testing.T) {
+	loopback := make(chan packetToSend, 1)
+	mconn := &Conn{session: &Session{queueSend: loopback, appConfig: Configuration{RequestTimeout: time.Hour}}}
+	ctx, cancel := context.WithCancel(context.Background())
+	// the server never answers, and the call is cancelled after it is sent
+	go func() {
+		x := <-loopback
+		if x.ctx != ctx {
+			t.Errorf("the packet is not of the context")
+		}
+		cancel()
+	}()
+
+	start := time.Now()
+	if _, err := mconn.WithContext(ctx).HelpGetConfig(ctx, &ReqHelpGetConfig{}); err != context.Canceled {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("waited %v for the cancelled call", elapsed)
+	}
+
+	// the call of a done context is not sent
+	if _, err := mconn.InvokeBlockedContext(ctx, &ReqHelpGetConfig{}); err != context.Canceled {
+		t.Errorf("unexpected error %v", err)
+	}
+	select {
+	case x := <-loopback:
+		t.Errorf("%T is sent on the done context", x.msg)
+	default:
+	}
+}
+
+func TestInvokeBatch(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go ioutil.ReadAll(server)
+	session := &Session{
+		tcpconn:      client,
+		transport:    abridged{},
+		encrypted:    true,
+		authKey:      bytes.Repeat([]byte{1}, 256),
+		authKeyHash:  []byte{2, 2, 2, 2, 2, 2, 2, 2},
+		serverSalt:   []byte{3, 3, 3, 3, 3, 3, 3, 3},
+		mutex:        &sync.Mutex{},
+		msgsIdToAck:  make(map[int64]packetToSend),
+		msgsIdToResp: make(map[int64]chan response),
+		msgsIdToSent: make(map[int64]sentRPC),
+		queueSend:    make(chan packetToSend),
+		appConfig:    Configuration{RequestTimeout: time.Second},
+	}
+	mconn := &Conn{session: session}
+
+	// send the container in a packet, and reply in the reverse order with an error in the middle
+	go func() {
+		if err := session.sendPacket(<-session.queueSend); err != nil {
+			t.Error(err)
+			return
+		}
+		session.mutex.Lock()
+		var msgIds []int64
+		for id := range session.msgsIdToResp {
+			msgIds = append(msgIds, id)
+		}
+		session.mutex.Unlock()
+		sort.Slice(msgIds, func(i, j int) bool { return msgIds[i] < msgIds[j] })
+		if len(msgIds) != 3 {
+			t.Errorf("%d requests in the container", len(msgIds))
+			return
+		}
+		session.process(GenerateMessageId(), 2, TL_rpc_result{msgIds[2], &PredNearestDc{NearestDc: 5}})
+		session.process(GenerateMessageId(), 4, TL_rpc_result{msgIds[1], TL_rpc_error{errorBadRequest, "PEER_ID_INVALID"}})
+		session.process(GenerateMessageId(), 6, TL_rpc_result{msgIds[0], &PredBoolTrue{}})
+	}()
+
+	results, err := mconn.InvokeBatch([]TL{&ReqHelpGetConfig{}, &ReqMessagesGetDialogs{}, &ReqHelpGetNearestDc{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := results[0].Data.(*PredBoolTrue); !ok || results[0].Err != nil {
+		t.Errorf("unexpected first result %+v", results[0])
+	}
+	if !IsBadRequest(results[1].Err) {
+		t.Errorf("unexpected second result %+v", results[1])
+	}
+	if nearest, ok := results[2].Data.(*PredNearestDc); !ok || nearest.NearestDc != 5 {
+		t.Errorf("unexpected third result %+v", results[2])
+	}
+}
+
+type orderedCallback struct {
+	ids  chan int32
+	busy int32
+}
+
+func (c *orderedCallback) OnUpdate(u Update) {
+	if atomic.AddInt32(&c.busy, 1) != 1 {
+		panic("the callbacks are called at the same time")
+	}
+	time.Sleep(time.Microsecond)
+	atomic.AddInt32(&c.busy, -1)
+	c.ids <- u.(*PredUpdateShort).Date
+}
+
+// Run it with -race. The updates received on the session reach the callbacks one at a time, in the order.
+func TestPropagateInOrder(t *testing.T) {
+	mm := newTestManager(t)
+	defer mm.Finish()
+	mconn := newConnection(mm.eventq, mm.manageInterrupter, Configuration{})
+	callback := &orderedCallback{ids: make(chan int32, 100)}
+	mconn.AddUpdateCallback(callback)
+
+	for i := int32(0); i < 100; i++ {
+		mconn.notify(updateReceived{&PredUpdateShort{Date: i}})
+	}
+	for i := int32(0); i < 100; i++ {
+		select {
+		case id := <-callback.ids:
+			if id != i {
+				t.Fatalf("update %d, expected %d", id, i)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no update %d", i)
+		}
+	}
+}
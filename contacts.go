@@ -0,0 +1,369 @@
+package mtproto
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// peerCache keeps the peers resolved by usernames
+type peerCache struct {
+	mutex sync.Mutex
+	peers map[string]*TypeInputPeer
+}
+
+func (c *peerCache) get(username string) *TypeInputPeer {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.peers[username]
+}
+
+func (c *peerCache) put(username string, peer *TypeInputPeer) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.peers == nil {
+		c.peers = make(map[string]*TypeInputPeer)
+	}
+	c.peers[username] = peer
+}
+
+// putPeers keeps the users and the channels with usernames, with their access hashes
+func (c *peerCache) putPeers(chats []*TypeChat, users []*TypeUser) {
+	for _, u := range users {
+		if user := u.GetUser(); user != nil && user.Username != "" && user.AccessHash != 0 {
+			c.put(strings.ToLower(user.Username), &TypeInputPeer{&TypeInputPeer_InputPeerUser{&PredInputPeerUser{
+				UserId:     user.Id,
+				AccessHash: user.AccessHash,
+			}}})
+		}
+	}
+	for _, ch := range chats {
+		if channel := ch.GetChannel(); channel != nil && channel.Username != "" && channel.AccessHash != 0 {
+			c.put(strings.ToLower(channel.Username), &TypeInputPeer{&TypeInputPeer_InputPeerChannel{&PredInputPeerChannel{
+				ChannelId:  channel.Id,
+				AccessHash: channel.AccessHash,
+			}}})
+		}
+	}
+}
+
+func (c *peerCache) remove(username string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.peers, username)
+}
+
+// ContactsResolveUsername returns the user or the channel of the username, with its access hash.
+// The returned peer can be the peer argument of the other methods, e.g., MessagesSendMessage.
+// Resolved peers are cached on the session.
+func (mconn *Conn) ContactsResolveUsername(username string) (*TypeInputPeer, error) {
+	session, err := mconn.Session()
+	if err != nil {
+		return nil, err
+	}
+	return resolveUsername(mconn, &session.peers, username)
+}
+
+// ContactsResolveUsernameContext is ContactsResolveUsername which gives up on ctx done.
+func (mconn *Conn) ContactsResolveUsernameContext(ctx context.Context, username string) (*TypeInputPeer, error) {
+	session, err := mconn.Session()
+	if err != nil {
+		return nil, err
+	}
+	return resolveUsername(mconn.contextRPC(ctx), &session.peers, username)
+}
+
+func resolveUsername(rpc RemoteProcedureCall, cache *peerCache, username string) (*TypeInputPeer, error) {
+	// usernames are case-insensitive
+	username = strings.ToLower(strings.TrimPrefix(username, "@"))
+	if username == "" {
+		return nil, fmt.Errorf("empty username")
+	}
+	if peer := cache.get(username); peer != nil {
+		return peer, nil
+	}
+
+	data, err := rpc.InvokeBlocked(&ReqContactsResolveUsername{Username: username})
+	if err != nil {
+		if _, ok := err.(UsernameNotOccupiedError); ok {
+			cache.remove(username)
+		}
+		return nil, err
+	}
+	resolved, ok := data.(*PredContactsResolvedPeer)
+	if !ok {
+		return nil, fmt.Errorf("RPC: %#v", data)
+	}
+
+	peer := inputPeer(resolved.GetPeer(), resolved.Chats, resolved.Users)
+	if peer == nil {
+		return nil, fmt.Errorf("username %s is resolved to an unknown peer: %v", username, resolved.GetPeer())
+	}
+	cache.put(username, peer)
+	return peer, nil
+}
+
+// GetFullUserByUsername resolves the username, and returns the full information of the user.
+// It returns UsernameNotOccupiedError if no user has the username, and an error if it is of a channel.
+// The resolved user is cached as ContactsResolveUsername caches it.
+func (mconn *Conn) GetFullUserByUsername(username string) (*PredUserFull, error) {
+	session, err := mconn.Session()
+	if err != nil {
+		return nil, err
+	}
+	return getFullUserByUsername(mconn, &session.peers, username)
+}
+
+// GetFullUserByUsernameContext is GetFullUserByUsername which gives up on ctx done.
+func (mconn *Conn) GetFullUserByUsernameContext(ctx context.Context, username string) (*PredUserFull, error) {
+	session, err := mconn.Session()
+	if err != nil {
+		return nil, err
+	}
+	return getFullUserByUsername(mconn.contextRPC(ctx), &session.peers, username)
+}
+
+func getFullUserByUsername(rpc RemoteProcedureCall, cache *peerCache, username string) (*PredUserFull, error) {
+	peer, err := resolveUsername(rpc, cache, username)
+	if err != nil {
+		return nil, err
+	}
+	user := peer.GetInputPeerUser()
+	if user == nil {
+		return nil, fmt.Errorf("username %s is not of a user: %v", username, peer)
+	}
+	data, err := rpc.InvokeBlocked(&ReqUsersGetFullUser{Id: &TypeInputUser{&TypeInputUser_InputUser{&PredInputUser{
+		UserId:     user.UserId,
+		AccessHash: user.AccessHash,
+	}}}})
+	if err != nil {
+		return nil, err
+	}
+	full, ok := data.(*PredUserFull)
+	if !ok {
+		return nil, fmt.Errorf("RPC: %#v", data)
+	}
+	return full, nil
+}
+
+// getUsersChunkSize is the number of users in a users.getUsers request
+const getUsersChunkSize = 100
+
+// UsersGetUsers returns the users of ids, in the order of ids. A large list is requested in chunks.
+// The users unknown to the server, userEmpty in the response, are nil.
+// The users with usernames are cached as ContactsResolveUsername caches them.
+func (mconn *Conn) UsersGetUsers(ids []*TypeInputUser) ([]*PredUser, error) {
+	session, err := mconn.Session()
+	if err != nil {
+		return nil, err
+	}
+	return getUsers(mconn, &session.peers, ids)
+}
+
+// UsersGetUsersContext is UsersGetUsers which gives up on ctx done.
+func (mconn *Conn) UsersGetUsersContext(ctx context.Context, ids []*TypeInputUser) ([]*PredUser, error) {
+	session, err := mconn.Session()
+	if err != nil {
+		return nil, err
+	}
+	return getUsers(mconn.contextRPC(ctx), &session.peers, ids)
+}
+
+func getUsers(rpc RemoteProcedureCall, cache *peerCache, ids []*TypeInputUser) ([]*PredUser, error) {
+	users := make([]*PredUser, 0, len(ids))
+	for start := 0; start < len(ids); start += getUsersChunkSize {
+		end := start + getUsersChunkSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		found, err := RPCaller{rpc}.UsersGetUsers(context.Background(), &ReqUsersGetUsers{Id: ids[start:end]})
+		if err != nil {
+			return users, err
+		}
+		if len(found.User) != end-start {
+			return users, fmt.Errorf("%d users of %d ids", len(found.User), end-start)
+		}
+		cache.putPeers(nil, found.User)
+		for _, u := range found.User {
+			// nil for userEmpty
+			users = append(users, u.GetUser())
+		}
+	}
+	return users, nil
+}
+
+// importContactsChunkSize is the number of contacts in a contacts.importContacts request
+const importContactsChunkSize = 100
+
+// ImportedContacts is the aggregated result of ContactsImportContacts.
+type ImportedContacts struct {
+	Imported []*PredImportedContact
+	Users    []*PredUser
+	// Peers are the imported users by the client ids of the contacts, with their access hashes.
+	Peers map[int64]*TypeInputPeer
+	// RetryContacts are the client ids of the contacts which are not imported by the flood limit.
+	RetryContacts []int64
+}
+
+// ContactsImportContacts imports the phone contacts, and returns the ones on Telegram.
+// A large list is imported in chunks. If a chunk fails, the results of the previous chunks are returned with the error.
+func (mconn *Conn) ContactsImportContacts(contacts []*PredInputPhoneContact) (*ImportedContacts, error) {
+	return importContacts(mconn, contacts)
+}
+
+// ContactsImportContactsContext is ContactsImportContacts which gives up on ctx done.
+func (mconn *Conn) ContactsImportContactsContext(ctx context.Context, contacts []*PredInputPhoneContact) (*ImportedContacts, error) {
+	return importContacts(mconn.contextRPC(ctx), contacts)
+}
+
+func importContacts(rpc RemoteProcedureCall, contacts []*PredInputPhoneContact) (*ImportedContacts, error) {
+	result := &ImportedContacts{Peers: make(map[int64]*TypeInputPeer)}
+	for start := 0; start < len(contacts); start += importContactsChunkSize {
+		end := start + importContactsChunkSize
+		if end > len(contacts) {
+			end = len(contacts)
+		}
+		req := &ReqContactsImportContacts{}
+		for _, contact := range contacts[start:end] {
+			req.Contacts = append(req.Contacts, &TypeInputContact{contact})
+		}
+		data, err := rpc.InvokeBlocked(req)
+		if err != nil {
+			return result, err
+		}
+		imported, ok := data.(*PredContactsImportedContacts)
+		if !ok {
+			return result, fmt.Errorf("RPC: %#v", data)
+		}
+
+		users := make(map[int32]*PredUser)
+		for _, u := range imported.Users {
+			if user := u.GetUser(); user != nil {
+				users[user.Id] = user
+				result.Users = append(result.Users, user)
+			}
+		}
+		for _, c := range imported.Imported {
+			contact := c.GetValue()
+			if contact == nil {
+				continue
+			}
+			result.Imported = append(result.Imported, contact)
+			if user, ok := users[contact.UserId]; ok {
+				result.Peers[contact.ClientId] = &TypeInputPeer{&TypeInputPeer_InputPeerUser{&PredInputPeerUser{
+					UserId:     user.Id,
+					AccessHash: user.AccessHash,
+				}}}
+			}
+		}
+		result.RetryContacts = append(result.RetryContacts, imported.RetryContacts...)
+	}
+	return result, nil
+}
+
+// inputUserOf converts the peer of a user into the input user
+func inputUserOf(peer *TypeInputPeer) (*TypeInputUser, error) {
+	switch x := peer.GetValue().(type) {
+	case *TypeInputPeer_InputPeerSelf:
+		return &TypeInputUser{&TypeInputUser_InputUserSelf{&PredInputUserSelf{}}}, nil
+	case *TypeInputPeer_InputPeerUser:
+		return &TypeInputUser{&TypeInputUser_InputUser{&PredInputUser{
+			UserId:     x.InputPeerUser.UserId,
+			AccessHash: x.InputPeerUser.AccessHash,
+		}}}, nil
+	}
+	return nil, fmt.Errorf("peer %v is not a user", peer)
+}
+
+// ContactsBlock blocks the user of peer. Only users can be blocked.
+// It returns false without an error, if the user is blocked already.
+func (mconn *Conn) ContactsBlock(peer *TypeInputPeer) (bool, error) {
+	return block(mconn, peer)
+}
+
+// ContactsBlockContext is ContactsBlock which gives up on ctx done.
+func (mconn *Conn) ContactsBlockContext(ctx context.Context, peer *TypeInputPeer) (bool, error) {
+	return block(mconn.contextRPC(ctx), peer)
+}
+
+func block(rpc RemoteProcedureCall, peer *TypeInputPeer) (bool, error) {
+	user, err := inputUserOf(peer)
+	if err != nil {
+		return false, err
+	}
+	blocked, err := RPCaller{rpc}.ContactsBlock(context.Background(), &ReqContactsBlock{Id: user})
+	if err != nil {
+		return false, err
+	}
+	return blocked.GetBoolTrue() != nil, nil
+}
+
+// ContactsUnblock unblocks the user of peer.
+// It returns false without an error, if the user is not blocked.
+func (mconn *Conn) ContactsUnblock(peer *TypeInputPeer) (bool, error) {
+	return unblock(mconn, peer)
+}
+
+// ContactsUnblockContext is ContactsUnblock which gives up on ctx done.
+func (mconn *Conn) ContactsUnblockContext(ctx context.Context, peer *TypeInputPeer) (bool, error) {
+	return unblock(mconn.contextRPC(ctx), peer)
+}
+
+func unblock(rpc RemoteProcedureCall, peer *TypeInputPeer) (bool, error) {
+	user, err := inputUserOf(peer)
+	if err != nil {
+		return false, err
+	}
+	unblocked, err := RPCaller{rpc}.ContactsUnblock(context.Background(), &ReqContactsUnblock{Id: user})
+	if err != nil {
+		return false, err
+	}
+	return unblocked.GetBoolTrue() != nil, nil
+}
+
+// BlockedUsers is a page of the blocked users.
+type BlockedUsers struct {
+	// Count is the number of all the blocked users, more than the ones of the page if it is not the last.
+	Count   int32
+	Blocked []*PredContactBlocked
+	Users   []*PredUser
+}
+
+// ContactsGetBlocked returns limit blocked users from offset.
+func (mconn *Conn) ContactsGetBlocked(offset, limit int32) (*BlockedUsers, error) {
+	return getBlocked(mconn, offset, limit)
+}
+
+// ContactsGetBlockedContext is ContactsGetBlocked which gives up on ctx done.
+func (mconn *Conn) ContactsGetBlockedContext(ctx context.Context, offset, limit int32) (*BlockedUsers, error) {
+	return getBlocked(mconn.contextRPC(ctx), offset, limit)
+}
+
+func getBlocked(rpc RemoteProcedureCall, offset, limit int32) (*BlockedUsers, error) {
+	found, err := RPCaller{rpc}.ContactsGetBlocked(context.Background(), &ReqContactsGetBlocked{Offset: offset, Limit: limit})
+	if err != nil {
+		return nil, err
+	}
+	var blocked []*TypeContactBlocked
+	var users []*TypeUser
+	result := &BlockedUsers{}
+	if x := found.GetContactsBlockedSlice(); x != nil {
+		result.Count, blocked, users = x.Count, x.Blocked, x.Users
+	} else if x := found.GetContactsBlocked(); x != nil {
+		blocked, users = x.Blocked, x.Users
+		result.Count = int32(len(blocked))
+	}
+	for _, b := range blocked {
+		if b.GetValue() != nil {
+			result.Blocked = append(result.Blocked, b.GetValue())
+		}
+	}
+	for _, u := range users {
+		if user := u.GetUser(); user != nil {
+			result.Users = append(result.Users, user)
+		}
+	}
+	return result, nil
+}
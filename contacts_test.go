@@ -0,0 +1,232 @@
+package mtproto
+
+import (
+	"fmt"
+	"testing"
+)
+
+// usernameRPC resolves "gopher" to a user, and gets the full user of it
+type usernameRPC struct {
+	requests int
+	occupied bool
+}
+
+func (r *usernameRPC) InvokeBlocked(msg TL) (interface{}, error) {
+	r.requests++
+	if req, ok := msg.(*ReqUsersGetFullUser); ok {
+		if user := req.Id.GetInputUser(); user == nil || user.UserId != 42 || user.AccessHash != 1234 {
+			return nil, toError(TL_rpc_error{errorBadRequest, "USER_ID_INVALID"})
+		}
+		return &PredUserFull{User: &TypeUser{&TypeUser_User{&PredUser{Id: 42, Username: "gopher"}}}, About: "Go"}, nil
+	}
+	if req := msg.(*ReqContactsResolveUsername); !r.occupied || req.Username != "gopher" {
+		return nil, toError(TL_rpc_error{errorBadRequest, "USERNAME_NOT_OCCUPIED"})
+	}
+	return &PredContactsResolvedPeer{
+		Peer:  &TypePeer{&TypePeer_PeerUser{&PredPeerUser{UserId: 42}}},
+		Users: []*TypeUser{{&TypeUser_User{&PredUser{Id: 42, AccessHash: 1234}}}},
+	}, nil
+}
+
+func TestResolveUsernameCache(t *testing.T) {
+	rpc := &usernameRPC{occupied: true}
+	cache := new(peerCache)
+	for _, username := range []string{"@gopher", "Gopher"} {
+		peer, err := resolveUsername(rpc, cache, username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user := peer.GetInputPeerUser(); user == nil || user.UserId != 42 || user.AccessHash != 1234 {
+			t.Errorf("unexpected peer %v", peer)
+		}
+	}
+	if rpc.requests != 1 {
+		t.Errorf("cached username is resolved %d times", rpc.requests)
+	}
+
+	if _, err := resolveUsername(rpc, cache, "nobody"); !IsBadRequest(err) {
+		t.Errorf("unexpected error %v", err)
+	}
+	if cache.get("nobody") != nil {
+		t.Errorf("unoccupied username is cached")
+	}
+}
+
+func TestGetFullUserByUsername(t *testing.T) {
+	rpc := &usernameRPC{occupied: true}
+	cache := new(peerCache)
+	for i := 0; i < 2; i++ {
+		full, err := getFullUserByUsername(rpc, cache, "@gopher")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if full.About != "Go" || full.User.GetUser().Id != 42 {
+			t.Errorf("unexpected full user %v", full)
+		}
+	}
+	// the username is resolved once, and the user is got twice
+	if rpc.requests != 3 {
+		t.Errorf("%d requests, expected 3", rpc.requests)
+	}
+
+	if _, err := getFullUserByUsername(rpc, cache, "nobody"); err != (UsernameNotOccupiedError{}) {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+// usersRPC knows the users of even ids
+type usersRPC struct {
+	requests int
+}
+
+func (r *usersRPC) InvokeBlocked(msg TL) (interface{}, error) {
+	r.requests++
+	var users []TL
+	for _, id := range msg.(*ReqUsersGetUsers).Id {
+		userId := id.GetInputUser().UserId
+		if userId%2 == 1 {
+			users = append(users, &PredUserEmpty{Id: userId})
+			continue
+		}
+		users = append(users, &PredUser{Id: userId, AccessHash: int64(userId) * 10, Username: fmt.Sprintf("user%d", userId)})
+	}
+	return users, nil
+}
+
+func TestGetUsersChunks(t *testing.T) {
+	var ids []*TypeInputUser
+	for i := 0; i < 2*getUsersChunkSize+10; i++ {
+		ids = append(ids, &TypeInputUser{&TypeInputUser_InputUser{&PredInputUser{UserId: int32(i)}}})
+	}
+	rpc := new(usersRPC)
+	cache := new(peerCache)
+	users, err := getUsers(rpc, cache, ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rpc.requests != 3 || len(users) != len(ids) {
+		t.Fatalf("%d users in %d requests", len(users), rpc.requests)
+	}
+	for i, user := range users {
+		if i%2 == 1 && user != nil {
+			t.Errorf("empty user %d is %v", i, user)
+		}
+		if i%2 == 0 && (user == nil || user.Id != int32(i)) {
+			t.Errorf("user %d is %v", i, user)
+		}
+	}
+	if peer := cache.get("user200").GetInputPeerUser(); peer == nil || peer.AccessHash != 2000 {
+		t.Errorf("user200 is not cached: %v", peer)
+	}
+}
+
+// importRPC imports the contacts of even client ids, and asks to retry the others
+type importRPC struct {
+	requests int
+}
+
+func (r *importRPC) InvokeBlocked(msg TL) (interface{}, error) {
+	r.requests++
+	imported := &PredContactsImportedContacts{}
+	for _, c := range msg.(*ReqContactsImportContacts).Contacts {
+		id := c.GetValue().ClientId
+		if id%2 == 1 {
+			imported.RetryContacts = append(imported.RetryContacts, id)
+			continue
+		}
+		imported.Imported = append(imported.Imported, &TypeImportedContact{&PredImportedContact{UserId: int32(id), ClientId: id}})
+		imported.Users = append(imported.Users, &TypeUser{&TypeUser_User{&PredUser{Id: int32(id), AccessHash: id * 10}}})
+	}
+	return imported, nil
+}
+
+func TestImportContactsChunks(t *testing.T) {
+	var contacts []*PredInputPhoneContact
+	for i := 0; i < 2*importContactsChunkSize+10; i++ {
+		contacts = append(contacts, &PredInputPhoneContact{ClientId: int64(i), Phone: "+8210"})
+	}
+	rpc := new(importRPC)
+	result, err := importContacts(rpc, contacts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rpc.requests != 3 {
+		t.Errorf("%d requests, expected 3", rpc.requests)
+	}
+	if len(result.Imported) != len(contacts)/2 || len(result.Users) != len(contacts)/2 || len(result.RetryContacts) != len(contacts)/2 {
+		t.Errorf("unexpected result: %d imported, %d users, %d retries", len(result.Imported), len(result.Users), len(result.RetryContacts))
+	}
+	peer := result.Peers[200].GetInputPeerUser()
+	if peer == nil || peer.UserId != 200 || peer.AccessHash != 2000 {
+		t.Errorf("unexpected peer of contact 200: %v", result.Peers[200])
+	}
+}
+
+// blockRPC keeps the blocked users as the server does
+type blockRPC struct {
+	blocked map[int32]bool
+}
+
+func (r *blockRPC) InvokeBlocked(msg TL) (interface{}, error) {
+	boolOf := func(b bool) interface{} {
+		if b {
+			return &PredBoolTrue{}
+		}
+		return &PredBoolFalse{}
+	}
+	switch req := msg.(type) {
+	case *ReqContactsBlock:
+		id := req.Id.GetInputUser().UserId
+		changed := !r.blocked[id]
+		r.blocked[id] = true
+		return boolOf(changed), nil
+	case *ReqContactsUnblock:
+		id := req.Id.GetInputUser().UserId
+		changed := r.blocked[id]
+		delete(r.blocked, id)
+		return boolOf(changed), nil
+	case *ReqContactsGetBlocked:
+		found := &PredContactsBlocked{}
+		for id := range r.blocked {
+			found.Blocked = append(found.Blocked, &TypeContactBlocked{&PredContactBlocked{UserId: id}})
+			found.Users = append(found.Users, &TypeUser{&TypeUser_User{&PredUser{Id: id}}})
+		}
+		return found, nil
+	}
+	return nil, fmt.Errorf("unexpected request %T", msg)
+}
+
+func TestBlockCycle(t *testing.T) {
+	rpc := &blockRPC{make(map[int32]bool)}
+	peer := &TypeInputPeer{&TypeInputPeer_InputPeerUser{&PredInputPeerUser{UserId: 42, AccessHash: 1234}}}
+
+	for i, expected := range []bool{true, false} {
+		blocked, err := block(rpc, peer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if blocked != expected {
+			t.Errorf("block %d: %v, expected %v", i, blocked, expected)
+		}
+	}
+
+	list, err := getBlocked(rpc, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list.Count != 1 || list.Blocked[0].UserId != 42 || list.Users[0].Id != 42 {
+		t.Errorf("unexpected blocked users %v", list)
+	}
+
+	if unblocked, err := unblock(rpc, peer); err != nil || !unblocked {
+		t.Errorf("unblock: %v, %v", unblocked, err)
+	}
+	if list, err := getBlocked(rpc, 0, 10); err != nil || list.Count != 0 {
+		t.Errorf("unexpected blocked users %v, %v", list, err)
+	}
+
+	channel := &TypeInputPeer{&TypeInputPeer_InputPeerChannel{&PredInputPeerChannel{ChannelId: 1}}}
+	if _, err := block(rpc, channel); err == nil {
+		t.Errorf("a channel is blocked")
+	}
+}
@@ -3,6 +3,8 @@ package mtproto
 import (
 	"bytes"
 	"crypto/aes"
+	"crypto/cipher"
+	crand "crypto/rand"
 	"crypto/rsa"
 	sha1lib "crypto/sha1"
 	"encoding/binary"
@@ -124,10 +126,9 @@ func splitPQ(pq *big.Int) (p1, p2 *big.Int) {
 	return
 }
 
+// makeGAB makes the secret exponent b of crypto/rand, and g_b and g_ab of it
 func makeGAB(g int32, g_a, dh_prime *big.Int) (b, g_b, g_ab *big.Int) {
-	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
-	rndmax := big.NewInt(0).SetBit(big.NewInt(0), 2048, 1)
-	b = big.NewInt(0).Rand(rnd, rndmax)
+	b = new(big.Int).SetBytes(randBytes(crand.Reader, 256))
 	g_b = big.NewInt(0).Exp(big.NewInt(int64(g)), b, dh_prime)
 	g_ab = big.NewInt(0).Exp(g_a, b, dh_prime)
 
@@ -306,3 +307,55 @@ func decryptMtproto(buf []byte, authKey []byte) (data interface{}, msgId int64,
 
 	return data, msgId, seqNo, nil
 }
+
+// Encrypted key files begin with this magic, followed by the nonce and the AES-256-GCM ciphertext.
+// Plaintext key files begin with the length byte of the auth key, so they never have the magic.
+var encryptedKeyFileMagic = []byte("MTPKEYv1")
+
+func isEncryptedKeyFile(b []byte) bool {
+	return bytes.HasPrefix(b, encryptedKeyFileMagic)
+}
+
+func encryptKeyFile(key, plain []byte) ([]byte, error) {
+	gcm, err := newKeyFileCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := crand.Read(nonce); err != nil {
+		return nil, err
+	}
+	out := append([]byte{}, encryptedKeyFileMagic...)
+	out = append(out, nonce...)
+	return gcm.Seal(out, nonce, plain, encryptedKeyFileMagic), nil
+}
+
+func decryptKeyFile(key, b []byte) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, errors.New("the key file is encrypted, but Configuration.SessionEncryptionKey is empty")
+	}
+	gcm, err := newKeyFileCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	b = b[len(encryptedKeyFileMagic):]
+	if len(b) < gcm.NonceSize() {
+		return nil, errors.New("truncated key file")
+	}
+	plain, err := gcm.Open(nil, b[:gcm.NonceSize()], b[gcm.NonceSize():], encryptedKeyFileMagic)
+	if err != nil {
+		return nil, errors.New("cannot decrypt the key file: wrong Configuration.SessionEncryptionKey or corrupted file")
+	}
+	return plain, nil
+}
+
+func newKeyFileCipher(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("the key file encryption key must be 32 bytes, but %d bytes", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
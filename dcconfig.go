@@ -0,0 +1,191 @@
+package mtproto
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// The country list of the login screens (help.getCountriesList, help.countriesList, and
+// help.countriesListNotModified) is not in layer 71, so it is not available until the schema is upgraded.
+// See https://core.telegram.org/method/help.getCountriesList
+
+// DCOption is an address of a DC in help.getConfig.
+type DCOption struct {
+	Id        int32
+	Addr      string // host:port
+	IPv6      bool
+	MediaOnly bool // only for the file downloads
+	TCPOOnly  bool // only for the obfuscated connections
+	CDN       bool
+	Static    bool
+}
+
+const (
+	dcOptionIPv6 = 1 << iota
+	dcOptionMediaOnly
+	dcOptionTCPOOnly
+	dcOptionCDN
+	dcOptionStatic
+)
+
+// dcConfig is the DC addresses of help.getConfig, shared by the sessions of a manager.
+type dcConfig struct {
+	mutex   sync.RWMutex
+	options map[int32][]DCOption
+	expires time.Time
+}
+
+func newDCConfig() *dcConfig {
+	return &dcConfig{options: make(map[int32][]DCOption)}
+}
+
+// update replaces the DC addresses with the ones of config
+func (dcs *dcConfig) update(config *PredConfig) {
+	options := make(map[int32][]DCOption)
+	for _, v := range config.GetDcOptions() {
+		option := v.GetValue()
+		if option == nil {
+			continue
+		}
+		flags := option.GetFlags()
+		options[option.GetId()] = append(options[option.GetId()], DCOption{
+			Id:        option.GetId(),
+			Addr:      net.JoinHostPort(option.GetIpAddress(), fmt.Sprint(option.GetPort())),
+			IPv6:      flags&dcOptionIPv6 != 0,
+			MediaOnly: flags&dcOptionMediaOnly != 0,
+			TCPOOnly:  flags&dcOptionTCPOOnly != 0,
+			CDN:       flags&dcOptionCDN != 0,
+			Static:    flags&dcOptionStatic != 0,
+		})
+		// MTProxy needs the DC id of an address
+		registerDC(option.GetId(), options[option.GetId()][len(options[option.GetId()])-1].Addr)
+	}
+
+	dcs.mutex.Lock()
+	defer dcs.mutex.Unlock()
+	dcs.options = options
+	dcs.expires = time.Unix(int64(config.GetExpires()), 0)
+}
+
+func (dcs *dcConfig) expired(now time.Time) bool {
+	dcs.mutex.RLock()
+	defer dcs.mutex.RUnlock()
+	return len(dcs.options) == 0 || now.After(dcs.expires)
+}
+
+// addr returns the address of the DC.
+// IPv6 addresses are preferred with useIPv6, and media-only addresses are preferred for media.
+// CDN and obfuscation-only addresses are not used.
+func (dcs *dcConfig) addr(dc int32, useIPv6, media bool) (string, bool) {
+	dcs.mutex.RLock()
+	defer dcs.mutex.RUnlock()
+	best, bestScore := "", -1
+	for _, option := range dcs.options[dc] {
+		if option.CDN || option.TCPOOnly {
+			continue
+		}
+		score := 0
+		if option.IPv6 == useIPv6 {
+			score += 2
+		}
+		if option.MediaOnly == media {
+			score++
+		} else if option.MediaOnly {
+			// media-only addresses do not serve the other requests
+			continue
+		}
+		if score > bestScore {
+			best, bestScore = option.Addr, score
+		}
+	}
+	return best, bestScore >= 0
+}
+
+// HelpGetConfig fetches the configuration of Telegram, and keeps its DC addresses
+// for the migrations and the file downloads.
+func (mconn *Conn) HelpGetConfig() (*PredConfig, error) {
+	return mconn.HelpGetConfigContext(context.Background())
+}
+
+// HelpGetConfigContext is HelpGetConfig which gives up on ctx done.
+func (mconn *Conn) HelpGetConfigContext(ctx context.Context) (*PredConfig, error) {
+	session, err := mconn.Session()
+	if err != nil {
+		return nil, err
+	}
+	data, err := mconn.InvokeBlockedContext(ctx, &ReqHelpGetConfig{})
+	if err != nil {
+		return nil, err
+	}
+	config, ok := data.(*PredConfig)
+	if !ok {
+		return nil, fmt.Errorf("RPC: %#v", data)
+	}
+	session.appConfig.dcs.update(config)
+	return config, nil
+}
+
+// bootstrapAddr is the DC 2 to ask help.getNearestDc, when Configuration.AutoSelectDC picks the DC of a new account
+const bootstrapAddr = "149.154.167.50:443"
+
+// HelpGetNearestDc returns the id of the DC nearest to the client, by its IP address.
+func (mconn *Conn) HelpGetNearestDc() (int32, error) {
+	return mconn.HelpGetNearestDcContext(context.Background())
+}
+
+// HelpGetNearestDcContext is HelpGetNearestDc which gives up on ctx done.
+func (mconn *Conn) HelpGetNearestDcContext(ctx context.Context) (int32, error) {
+	nearest, err := getNearestDc(mconn.contextRPC(ctx))
+	if err != nil {
+		return 0, err
+	}
+	return nearest.NearestDc, nil
+}
+
+func getNearestDc(rpc RemoteProcedureCall) (*PredNearestDc, error) {
+	nearest, err := RPCaller{rpc}.HelpGetNearestDc(context.Background(), &ReqHelpGetNearestDc{})
+	if err != nil {
+		return nil, err
+	}
+	if nearest.GetValue() == nil {
+		return nil, fmt.Errorf("RPC: %#v", nearest)
+	}
+	return nearest.GetValue(), nil
+}
+
+// selectNearestDc migrates to the nearest DC, unless the connection is on it already.
+// The connection stays on its DC if the nearest DC is unknown.
+func selectNearestDc(ctx context.Context, rpc RemoteProcedureCall, migrate func(ctx context.Context, dc int) error) error {
+	nearest, err := getNearestDc(rpc)
+	if err != nil {
+		errorf(rpc, "cannot get the nearest DC: %v", err)
+		return nil
+	}
+	if nearest.NearestDc == 0 || nearest.NearestDc == nearest.ThisDc {
+		return nil
+	}
+	logf(rpc, "migrate to the nearest DC %d from DC %d\n", nearest.NearestDc, nearest.ThisDc)
+	return migrate(ctx, int(nearest.NearestDc))
+}
+
+// dcAddr returns the address of the DC, fetching the configuration again if it is expired.
+func (mconn *Conn) dcAddr(dc int32, media bool) (string, error) {
+	session, err := mconn.Session()
+	if err != nil {
+		return "", err
+	}
+	if session.appConfig.dcs.expired(time.Now()) {
+		if _, err := mconn.HelpGetConfig(); err != nil {
+			errorf(mconn, "cannot refresh the DC configuration: %v", err)
+		}
+	}
+	addr, ok := session.appConfig.dcs.addr(dc, session.useIPv6, media)
+	if !ok {
+		return "", fmt.Errorf("unknown DC %d", dc)
+	}
+	return addr, nil
+}
@@ -0,0 +1,109 @@
+package mtproto
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func dcOption(id int32, ip string, flags int32) *TypeDcOption {
+	return &TypeDcOption{&PredDcOption{Flags: flags, Id: id, IpAddress: ip, Port: 443}}
+}
+
+func TestDCConfigAddr(t *testing.T) {
+	dcs := newDCConfig()
+	if !dcs.expired(time.Now()) {
+		t.Fatalf("empty configuration is not expired")
+	}
+	expires := time.Now().Add(time.Hour)
+	dcs.update(&PredConfig{
+		Expires: int32(expires.Unix()),
+		DcOptions: []*TypeDcOption{
+			dcOption(2, "149.154.167.51", 0),
+			dcOption(2, "2001:67c:4e8:f002::a", dcOptionIPv6),
+			dcOption(2, "149.154.167.151", dcOptionMediaOnly),
+			dcOption(2, "149.154.167.200", dcOptionCDN),
+			dcOption(4, "2001:67c:4e8:f004::a", dcOptionIPv6),
+		},
+	})
+
+	for _, c := range []struct {
+		dc      int32
+		useIPv6 bool
+		media   bool
+		addr    string
+	}{
+		{2, false, false, "149.154.167.51:443"},
+		{2, true, false, "[2001:67c:4e8:f002::a]:443"},
+		{2, false, true, "149.154.167.151:443"},
+		{4, false, false, "[2001:67c:4e8:f004::a]:443"}, // no IPv4 address
+	} {
+		if addr, ok := dcs.addr(c.dc, c.useIPv6, c.media); !ok || addr != c.addr {
+			t.Errorf("DC %d, IPv6 %v, media %v: %s, expected %s", c.dc, c.useIPv6, c.media, addr, c.addr)
+		}
+	}
+	if _, ok := dcs.addr(3, false, false); ok {
+		t.Errorf("unknown DC has an address")
+	}
+
+	if dcs.expired(time.Now()) || !dcs.expired(expires.Add(time.Second)) {
+		t.Errorf("wrong expiry, expected %v", expires)
+	}
+}
+
+func TestMigrateKeepsIPv6(t *testing.T) {
+	dcs := newDCConfig()
+	dcs.update(&PredConfig{
+		Expires: int32(time.Now().Add(time.Hour).Unix()),
+		DcOptions: []*TypeDcOption{
+			dcOption(4, "149.154.167.91", 0),
+			dcOption(4, "2001:67c:4e8:f004::a", dcOptionIPv6),
+		},
+	})
+	events := make(chan Event)
+	mconn := &Conn{listeners: []chan Event{events}}
+	mconn.session = &Session{sessionId: 1, useIPv6: true, appConfig: Configuration{dcs: dcs}}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- mconn.migrate(context.Background(), 4)
+	}()
+	e, ok := (<-events).(renewSession)
+	if !ok {
+		t.Fatalf("unexpected event %T", e)
+	}
+	if e.addr != "[2001:67c:4e8:f004::a]:443" || !e.useIPv6 {
+		t.Errorf("renewed to %s, IPv6 %v", e.addr, e.useIPv6)
+	}
+	e.resp <- sessionResponse{}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSelectNearestDc(t *testing.T) {
+	for _, test := range []struct {
+		nearest  *PredNearestDc
+		migrated int
+	}{
+		{&PredNearestDc{Country: "DE", ThisDc: 2, NearestDc: 4}, 4},
+		{&PredNearestDc{Country: "NL", ThisDc: 2, NearestDc: 2}, 0},
+	} {
+		rpc := &recordRPC{resp: test.nearest}
+		migrated := 0
+		err := selectNearestDc(context.Background(), rpc, func(ctx context.Context, dc int) error {
+			migrated = dc
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := rpc.reqs[0].(*ReqHelpGetNearestDc); !ok {
+			t.Errorf("unexpected request %T", rpc.reqs[0])
+		}
+		if migrated != test.migrated {
+			t.Errorf("%v: migrated to DC %d, expected %d", test.nearest, migrated, test.migrated)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package mtproto
+
+import (
+	"fmt"
+	"golang.org/x/net/context"
+	"golang.org/x/net/proxy"
+	"net"
+	"net/url"
+)
+
+// dial connects to a Telegram server, and starts the transport.
+// The connection goes through the SOCKS5 proxy and the MTProxy in the configuration, if they are set.
+// The deadline of ctx is set on the connection, so that it bounds the handshakes as well as the dial.
+func dial(ctx context.Context, appConfig Configuration, addr string, t transport) (net.Conn, error) {
+	target := addr
+	if appConfig.MTProxy.Addr != "" {
+		target = appConfig.MTProxy.Addr
+	}
+	conn, err := dialTCP(ctx, appConfig, target)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if appConfig.MTProxy.Addr != "" {
+		obfuscated, err := dialMTProxy(appConfig, conn, addr, t)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("MTProxy failure: %v", err)
+		}
+		return obfuscated, nil
+	}
+	if _, err := conn.Write(t.header()); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func dialTCP(ctx context.Context, appConfig Configuration, addr string) (net.Conn, error) {
+	dialer := appConfig.dialer()
+	if appConfig.Proxy == "" {
+		return dialer(ctx, "tcp", addr)
+	}
+
+	// the proxy is dialed in ctx as well
+	forward := func(_ context.Context, network, addr string) (net.Conn, error) {
+		return dialer(ctx, network, addr)
+	}
+	socks, err := socks5Dialer(appConfig.Proxy, contextDialer(forward))
+	if err != nil {
+		return nil, err
+	}
+	return socks.Dial("tcp", addr)
+}
+
+// contextDialer is Configuration.Dialer as a proxy.Dialer, so that the SOCKS5 proxy is dialed through it
+type contextDialer func(ctx context.Context, network, addr string) (net.Conn, error)
+
+func (d contextDialer) Dial(network, addr string) (net.Conn, error) {
+	return d(context.Background(), network, addr)
+}
+
+// socks5Dialer parses a proxy URL in the form of socks5://[user:password@]host:port,
+// and dials the proxy with forward
+func socks5Dialer(rawurl string, forward proxy.Dialer) (proxy.Dialer, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy url: %v", err)
+	}
+	if u.Scheme != "socks5" {
+		return nil, fmt.Errorf("invalid proxy url: unsupported scheme %q", u.Scheme)
+	}
+	if _, _, err := net.SplitHostPort(u.Host); err != nil {
+		return nil, fmt.Errorf("invalid proxy url: %v", err)
+	}
+
+	var auth *proxy.Auth
+	if u.User != nil {
+		password, _ := u.User.Password()
+		auth = &proxy.Auth{User: u.User.Username(), Password: password}
+	}
+	return proxy.SOCKS5("tcp", u.Host, auth, forward)
+}
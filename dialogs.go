@@ -0,0 +1,161 @@
+package mtproto
+
+import (
+	"fmt"
+
+	"golang.org/x/net/context"
+)
+
+// Dialog is a dialog of messages.getDialogs, with the input peer and the last message of it.
+type Dialog struct {
+	*PredDialog
+	// InputPeer is nil if the access hash of the peer is not in the response.
+	InputPeer   *TypeInputPeer
+	LastMessage *TypeMessage
+}
+
+// Pinned reports whether the dialog is pinned on the top.
+func (d *Dialog) Pinned() bool {
+	return d.Flags&(1<<2) != 0
+}
+
+// Dialogs is a page of the dialogs, from the most recent one.
+type Dialogs struct {
+	Dialogs []*Dialog
+	Chats   []*TypeChat
+	Users   []*TypeUser
+
+	// Count is the number of all the dialogs.
+	Count int32
+	// NextOffsetDate, NextOffsetPeer, and NextOffsetId are the offsets of the next page.
+	// NextOffsetPeer is nil once a page has no dialogs or all of Count, so the last page may be followed by an empty one.
+	NextOffsetDate int32
+	NextOffsetPeer *TypeInputPeer
+	NextOffsetId   int32
+}
+
+// DialogsOption sets an optional field of messages.getDialogs.
+type DialogsOption func(req *ReqMessagesGetDialogs)
+
+// WithExcludePinned leaves the pinned dialogs out.
+func WithExcludePinned() DialogsOption {
+	return func(req *ReqMessagesGetDialogs) {
+		req.Flags |= 1 << 0
+	}
+}
+
+// MessagesGetDialogs reads limit dialogs after the offsets of the previous page.
+// The server caps limit at 100, so the page may be shorter. The first page has zero offsets and nil offsetPeer. MessagesGetAllDialogs pages through all of them.
+// Layer 71 has no folders, so the dialogs are of the main list.
+func (mconn *Conn) MessagesGetDialogs(offsetDate, offsetId int32, offsetPeer *TypeInputPeer, limit int32, opts ...DialogsOption) (*Dialogs, error) {
+	return getDialogs(mconn, offsetDate, offsetId, offsetPeer, limit, opts...)
+}
+
+// MessagesGetDialogsContext is MessagesGetDialogs which gives up on ctx done.
+func (mconn *Conn) MessagesGetDialogsContext(ctx context.Context, offsetDate, offsetId int32, offsetPeer *TypeInputPeer, limit int32, opts ...DialogsOption) (*Dialogs, error) {
+	return getDialogs(mconn.contextRPC(ctx), offsetDate, offsetId, offsetPeer, limit, opts...)
+}
+
+// MessagesGetAllDialogs calls handle on every dialog, reading pageSize dialogs per request.
+// It stops at the first error of handle, and returns it.
+func (mconn *Conn) MessagesGetAllDialogs(pageSize int32, handle func(*Dialog) error, opts ...DialogsOption) error {
+	return allDialogs(mconn, pageSize, handle, opts...)
+}
+
+// MessagesGetAllDialogsContext is MessagesGetAllDialogs which gives up on ctx done.
+func (mconn *Conn) MessagesGetAllDialogsContext(ctx context.Context, pageSize int32, handle func(*Dialog) error, opts ...DialogsOption) error {
+	return allDialogs(mconn.contextRPC(ctx), pageSize, handle, opts...)
+}
+
+func allDialogs(rpc RemoteProcedureCall, pageSize int32, handle func(*Dialog) error, opts ...DialogsOption) error {
+	var date, id int32
+	var peer *TypeInputPeer
+	for {
+		dialogs, err := getDialogs(rpc, date, id, peer, pageSize, opts...)
+		if err != nil {
+			return err
+		}
+		for _, d := range dialogs.Dialogs {
+			if err := handle(d); err != nil {
+				return err
+			}
+		}
+		if dialogs.NextOffsetPeer == nil {
+			return nil
+		}
+		date, id, peer = dialogs.NextOffsetDate, dialogs.NextOffsetId, dialogs.NextOffsetPeer
+	}
+}
+
+func getDialogs(rpc RemoteProcedureCall, offsetDate, offsetId int32, offsetPeer *TypeInputPeer, limit int32, opts ...DialogsOption) (*Dialogs, error) {
+	if offsetPeer == nil {
+		offsetPeer = &TypeInputPeer{&TypeInputPeer_InputPeerEmpty{&PredInputPeerEmpty{}}}
+	}
+	req := &ReqMessagesGetDialogs{
+		OffsetDate: offsetDate,
+		OffsetId:   offsetId,
+		OffsetPeer: offsetPeer,
+		Limit:      limit,
+	}
+	for _, opt := range opts {
+		opt(req)
+	}
+	data, err := rpc.InvokeBlocked(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw []*TypeDialog
+	var messages []*TypeMessage
+	dialogs := new(Dialogs)
+	slice := true
+	switch x := data.(type) {
+	case *PredMessagesDialogs:
+		// all the dialogs
+		raw, messages, dialogs.Chats, dialogs.Users = x.Dialogs, x.Messages, x.Chats, x.Users
+		dialogs.Count = int32(len(x.Dialogs))
+		slice = false
+	case *PredMessagesDialogsSlice:
+		raw, messages, dialogs.Chats, dialogs.Users = x.Dialogs, x.Messages, x.Chats, x.Users
+		dialogs.Count = x.Count
+	default:
+		return nil, fmt.Errorf("RPC: %#v", data)
+	}
+
+	for _, v := range raw {
+		pred := v.GetValue()
+		if pred == nil {
+			continue
+		}
+		d := &Dialog{PredDialog: pred, InputPeer: inputPeer(pred.Peer, dialogs.Chats, dialogs.Users)}
+		for _, m := range messages {
+			if peer, _ := messagePeer(m); messageId(m) == pred.TopMessage && samePeer(peer, pred.Peer) {
+				d.LastMessage = m
+				break
+			}
+		}
+		dialogs.Dialogs = append(dialogs.Dialogs, d)
+	}
+
+	if slice && len(dialogs.Dialogs) > 0 && int32(len(dialogs.Dialogs)) < dialogs.Count {
+		last := dialogs.Dialogs[len(dialogs.Dialogs)-1]
+		if last.InputPeer != nil && last.LastMessage != nil {
+			_, dialogs.NextOffsetDate = messagePeer(last.LastMessage)
+			dialogs.NextOffsetPeer = last.InputPeer
+			dialogs.NextOffsetId = last.TopMessage
+		}
+	}
+	return dialogs, nil
+}
+
+func samePeer(a, b *TypePeer) bool {
+	switch x := a.GetValue().(type) {
+	case *TypePeer_PeerUser:
+		return b.GetPeerUser() != nil && b.GetPeerUser().UserId == x.PeerUser.UserId
+	case *TypePeer_PeerChat:
+		return b.GetPeerChat() != nil && b.GetPeerChat().ChatId == x.PeerChat.ChatId
+	case *TypePeer_PeerChannel:
+		return b.GetPeerChannel() != nil && b.GetPeerChannel().ChannelId == x.PeerChannel.ChannelId
+	}
+	return false
+}
@@ -0,0 +1,73 @@
+package mtproto
+
+import (
+	"fmt"
+	"testing"
+)
+
+// dialogsRPC serves the dialogs of the channels with ids from count down to 1, as messages.dialogsSlice pages.
+// The top message of a channel has the same id as the channel, and it is the newer the larger id.
+// It caps the limit at 100, as the server.
+type dialogsRPC struct {
+	count int32
+	reqs  []*ReqMessagesGetDialogs
+}
+
+func (r *dialogsRPC) InvokeBlocked(msg TL) (interface{}, error) {
+	req := msg.(*ReqMessagesGetDialogs)
+	r.reqs = append(r.reqs, req)
+	from := r.count
+	if peer := req.OffsetPeer.GetInputPeerChannel(); peer != nil {
+		from = peer.ChannelId - 1
+	}
+	slice := &PredMessagesDialogsSlice{Count: r.count}
+	for id := from; id > 0 && int32(len(slice.Dialogs)) < req.Limit && len(slice.Dialogs) < 100; id-- {
+		peer := &TypePeer{&TypePeer_PeerChannel{&PredPeerChannel{ChannelId: id}}}
+		slice.Dialogs = append(slice.Dialogs, &TypeDialog{&PredDialog{Peer: peer, TopMessage: id, UnreadCount: id * 10}})
+		slice.Messages = append(slice.Messages, &TypeMessage{&TypeMessage_Message{&PredMessage{Id: id, Date: id * 100, ToId: peer}}})
+		slice.Chats = append(slice.Chats, &TypeChat{&TypeChat_Channel{&PredChannel{Id: id, AccessHash: int64(id)}}})
+	}
+	return slice, nil
+}
+
+func TestGetDialogsPages(t *testing.T) {
+	rpc := &dialogsRPC{count: 5}
+	var ids []int32
+	err := allDialogs(rpc, 3, func(d *Dialog) error {
+		ids = append(ids, d.InputPeer.GetInputPeerChannel().GetChannelId())
+		if d.LastMessage.GetMessage().GetId() != d.TopMessage || d.UnreadCount != d.TopMessage*10 {
+			t.Errorf("unexpected dialog %v, last message %v", d.PredDialog, d.LastMessage)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(ids) != "[5 4 3 2 1]" {
+		t.Errorf("unexpected dialogs %v", ids)
+	}
+	if len(rpc.reqs) != 3 {
+		t.Fatalf("expected 2 pages and an empty one, but %d", len(rpc.reqs))
+	}
+	if req := rpc.reqs[1]; req.OffsetDate != 300 || req.OffsetId != 3 || req.OffsetPeer.GetInputPeerChannel().GetAccessHash() != 3 {
+		t.Errorf("unexpected offsets of the second page %v", req)
+	}
+}
+
+func TestGetDialogsPagesAboveCap(t *testing.T) {
+	rpc := &dialogsRPC{count: 150}
+	n := 0
+	err := allDialogs(rpc, 200, func(d *Dialog) error {
+		n++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 150 {
+		t.Errorf("expected 150 dialogs, but %d", n)
+	}
+	if len(rpc.reqs) != 3 {
+		t.Errorf("expected 2 pages and an empty one, but %d", len(rpc.reqs))
+	}
+}
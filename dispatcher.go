@@ -0,0 +1,357 @@
+package mtproto
+
+import "sync"
+
+// Message is a message of an update, with the users and the chats it refers to.
+type Message struct {
+	*PredMessage
+	// From is the sender, or nil if it is unknown, e.g., of the posts of broadcast channels.
+	From *PredUser
+	// Chat is the group or the channel of the message, or nil in private chats.
+	Chat *TypeChat
+	// Users and Chats are the users and the chats of the updates of the message,
+	// e.g., the senders of the forwarded messages.
+	Users map[int32]*PredUser
+	Chats map[int32]*TypeChat
+}
+
+// UpdateDispatcher is an UpdateCallback unpacking the updates into the callbacks of their kinds.
+// The messages come with their senders and chats, from the users and the chats of the updates,
+// or from the ones of the earlier updates for the short messages which have none.
+// Set the callbacks, and add it by Conn.AddUpdateCallback, which calls it with the updates in the order of their arrival.
+//
+// The updates are dispatched in the order of their pts and qts, one at a time, so the callbacks should not block.
+// A duplicated update is dropped, and on a gap, the missed updates are got by updates.getDifference.
+// The updates of channels have the pts of their channels, whose gaps the session fills by
+// updates.getChannelDifference.
+type UpdateDispatcher struct {
+	OnNewMessage  func(m *Message)
+	OnEditMessage func(m *Message)
+	// OnDeleteMessages receives the ids of the deleted messages, of the channel if channelId is not zero.
+	OnDeleteMessages func(channelId int32, ids []int32)
+	// OnUserStatus receives the status of the user, which has only the id if the user is unknown.
+	OnUserStatus func(user *PredUser, status *TypeUserStatus)
+	// OnOther receives the updates of the other kinds, and the service messages.
+	OnOther func(update *TypeUpdate)
+
+	rpc    RemoteProcedureCall
+	selfId int32
+
+	mutex sync.Mutex
+	state *PredUpdatesState
+	users map[int32]*PredUser
+	chats map[int32]*TypeChat
+}
+
+// NewUpdateDispatcher returns the dispatcher of the updates from the current updates state of the connection.
+func (mconn *Conn) NewUpdateDispatcher() (*UpdateDispatcher, error) {
+	session, err := mconn.Session()
+	if err != nil {
+		return nil, err
+	}
+	state := session.copyUpdatesState()
+	if state == nil {
+		if state, err = getState(mconn); err != nil {
+			return nil, err
+		}
+	}
+	var selfId int32
+	if session.user != nil {
+		selfId = session.user.Id
+	}
+	return newUpdateDispatcher(mconn, state, selfId), nil
+}
+
+func newUpdateDispatcher(rpc RemoteProcedureCall, state *PredUpdatesState, selfId int32) *UpdateDispatcher {
+	return &UpdateDispatcher{
+		rpc:    rpc,
+		selfId: selfId,
+		state:  state,
+		users:  make(map[int32]*PredUser),
+		chats:  make(map[int32]*TypeChat),
+	}
+}
+
+func (d *UpdateDispatcher) OnUpdate(u Update) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	switch x := u.(type) {
+	case *PredUpdates:
+		d.dispatchAll(x.Updates, x.Users, x.Chats)
+	case *PredUpdatesCombined:
+		d.dispatchAll(x.Updates, x.Users, x.Chats)
+	case *PredUpdateShort:
+		d.dispatchAll([]*TypeUpdate{x.Update}, nil, nil)
+	case *PredUpdateShortMessage:
+		if d.acceptPts(x.Pts, x.PtsCount) {
+			d.newMessage(d.shortMessage(x), d.entitiesOf(nil, nil))
+		}
+	case *PredUpdateShortChatMessage:
+		if d.acceptPts(x.Pts, x.PtsCount) {
+			d.newMessage(shortChatMessage(x), d.entitiesOf(nil, nil))
+		}
+	case *PredUpdateShortSentMessage:
+		// the message is the result of the RPC sending it
+		d.acceptPts(x.Pts, x.PtsCount)
+	case *PredUpdatesTooLong:
+		d.fillGap()
+	case *PredUpdatesChannelDifference:
+		// got by the session on a gap of the channel
+		e := d.entitiesOf(x.Users, x.Chats)
+		for _, m := range x.NewMessages {
+			d.dispatch(&TypeUpdate{&TypeUpdate_UpdateNewChannelMessage{&PredUpdateNewChannelMessage{Message: m}}}, e)
+		}
+		for _, update := range x.OtherUpdates {
+			d.dispatch(update, e)
+		}
+	case *PredUpdatesDifference, *PredUpdatesDifferenceSlice:
+		// got by Conn.UpdatesGetDifference. fill the gap up to it rather than dispatching it as is,
+		// since it may overlap the dispatched updates
+		d.fillGap()
+	default:
+		// an update out of an envelope
+		if update, ok := u.ToType().(*TypeUpdate); ok {
+			d.dispatchAll([]*TypeUpdate{update}, nil, nil)
+		}
+	}
+}
+
+// entities are the users and the chats of updates
+type entities struct {
+	users map[int32]*PredUser
+	chats map[int32]*TypeChat
+}
+
+// entitiesOf keeps the users and the chats for the later updates, and returns them
+func (d *UpdateDispatcher) entitiesOf(users []*TypeUser, chats []*TypeChat) entities {
+	e := entities{make(map[int32]*PredUser), make(map[int32]*TypeChat)}
+	for _, u := range users {
+		if user := u.GetUser(); user != nil {
+			e.users[user.Id] = user
+			d.users[user.Id] = user
+		}
+	}
+	for _, chat := range chats {
+		if id := chatId(chat); id != 0 {
+			e.chats[id] = chat
+			d.chats[id] = chat
+		}
+	}
+	return e
+}
+
+func chatId(chat *TypeChat) int32 {
+	switch x := chat.GetValue().(type) {
+	case *TypeChat_Chat:
+		return x.Chat.Id
+	case *TypeChat_ChatForbidden:
+		return x.ChatForbidden.Id
+	case *TypeChat_Channel:
+		return x.Channel.Id
+	case *TypeChat_ChannelForbidden:
+		return x.ChannelForbidden.Id
+	}
+	return 0
+}
+
+func (d *UpdateDispatcher) dispatchAll(updates []*TypeUpdate, users []*TypeUser, chats []*TypeChat) {
+	e := d.entitiesOf(users, chats)
+	for _, update := range updates {
+		if pts, ptsCount, ok := ptsOf(update); ok && !d.acceptPts(pts, ptsCount) {
+			continue
+		}
+		if x := update.GetUpdateNewEncryptedMessage(); x != nil && !d.acceptQts(x.Qts) {
+			continue
+		}
+		d.dispatch(update, e)
+	}
+}
+
+// ptsOf returns the pts of the update, if it is of the common message box
+func ptsOf(update *TypeUpdate) (pts, ptsCount int32, ok bool) {
+	switch x := update.GetValue().(type) {
+	case *TypeUpdate_UpdateNewMessage:
+		return x.UpdateNewMessage.Pts, x.UpdateNewMessage.PtsCount, true
+	case *TypeUpdate_UpdateEditMessage:
+		return x.UpdateEditMessage.Pts, x.UpdateEditMessage.PtsCount, true
+	case *TypeUpdate_UpdateDeleteMessages:
+		return x.UpdateDeleteMessages.Pts, x.UpdateDeleteMessages.PtsCount, true
+	case *TypeUpdate_UpdateReadHistoryInbox:
+		return x.UpdateReadHistoryInbox.Pts, x.UpdateReadHistoryInbox.PtsCount, true
+	case *TypeUpdate_UpdateReadHistoryOutbox:
+		return x.UpdateReadHistoryOutbox.Pts, x.UpdateReadHistoryOutbox.PtsCount, true
+	case *TypeUpdate_UpdateReadMessagesContents:
+		return x.UpdateReadMessagesContents.Pts, x.UpdateReadMessagesContents.PtsCount, true
+	case *TypeUpdate_UpdateWebPage:
+		return x.UpdateWebPage.Pts, x.UpdateWebPage.PtsCount, true
+	}
+	return 0, 0, false
+}
+
+// acceptPts reports whether the update of pts comes next, and advances the state by it.
+// On a gap, the missed updates are dispatched with the update by fillGap, so it is not accepted either.
+func (d *UpdateDispatcher) acceptPts(pts, ptsCount int32) bool {
+	switch {
+	case d.state.Pts+ptsCount == pts:
+		d.state.Pts = pts
+		return true
+	case d.state.Pts+ptsCount > pts:
+		// dispatched already
+		return false
+	}
+	logf(d.rpc, "pts gap, pts %d, pts count %d, state %d\n", pts, ptsCount, d.state.Pts)
+	d.fillGap()
+	return false
+}
+
+// acceptQts is acceptPts of the secret chat updates, each of which advances qts by one
+func (d *UpdateDispatcher) acceptQts(qts int32) bool {
+	switch {
+	case d.state.Qts+1 == qts:
+		d.state.Qts = qts
+		return true
+	case d.state.Qts+1 > qts:
+		return false
+	}
+	logf(d.rpc, "qts gap, qts %d, state %d\n", qts, d.state.Qts)
+	d.fillGap()
+	return false
+}
+
+// fillGap dispatches the updates since the state, and advances the state to the current one
+func (d *UpdateDispatcher) fillGap() {
+	state, err := catchUp(d.rpc, d.state, d.dispatchDifference)
+	if err != nil {
+		errorf(d.rpc, "getDifference failure: %v", err)
+		return
+	}
+	d.state = state
+}
+
+func (d *UpdateDispatcher) dispatchDifference(u Update) {
+	var messages []*TypeMessage
+	var others []*TypeUpdate
+	var e entities
+	switch x := u.(type) {
+	case *PredUpdatesDifference:
+		messages, others, e = x.NewMessages, x.OtherUpdates, d.entitiesOf(x.Users, x.Chats)
+	case *PredUpdatesDifferenceSlice:
+		messages, others, e = x.NewMessages, x.OtherUpdates, d.entitiesOf(x.Users, x.Chats)
+	default:
+		return
+	}
+	for _, m := range messages {
+		d.dispatch(&TypeUpdate{&TypeUpdate_UpdateNewMessage{&PredUpdateNewMessage{Message: m}}}, e)
+	}
+	for _, update := range others {
+		d.dispatch(update, e)
+	}
+}
+
+func (d *UpdateDispatcher) dispatch(update *TypeUpdate, e entities) {
+	switch x := update.GetValue().(type) {
+	case *TypeUpdate_UpdateNewMessage:
+		d.onMessage(d.OnNewMessage, update, x.UpdateNewMessage.Message, e)
+	case *TypeUpdate_UpdateNewChannelMessage:
+		d.onMessage(d.OnNewMessage, update, x.UpdateNewChannelMessage.Message, e)
+	case *TypeUpdate_UpdateEditMessage:
+		d.onMessage(d.OnEditMessage, update, x.UpdateEditMessage.Message, e)
+	case *TypeUpdate_UpdateEditChannelMessage:
+		d.onMessage(d.OnEditMessage, update, x.UpdateEditChannelMessage.Message, e)
+	case *TypeUpdate_UpdateDeleteMessages:
+		if d.OnDeleteMessages != nil {
+			d.OnDeleteMessages(0, x.UpdateDeleteMessages.Messages)
+		}
+	case *TypeUpdate_UpdateDeleteChannelMessages:
+		if d.OnDeleteMessages != nil {
+			d.OnDeleteMessages(x.UpdateDeleteChannelMessages.ChannelId, x.UpdateDeleteChannelMessages.Messages)
+		}
+	case *TypeUpdate_UpdateUserStatus:
+		if d.OnUserStatus != nil {
+			user, ok := d.users[x.UpdateUserStatus.UserId]
+			if !ok {
+				user = &PredUser{Id: x.UpdateUserStatus.UserId}
+			}
+			d.OnUserStatus(user, x.UpdateUserStatus.Status)
+		}
+	default:
+		d.other(update)
+	}
+}
+
+// onMessage calls the callback with the message, or OnOther with the update of a service message
+func (d *UpdateDispatcher) onMessage(callback func(m *Message), update *TypeUpdate, m *TypeMessage, e entities) {
+	if m.GetMessage() == nil {
+		d.other(update)
+		return
+	}
+	if callback != nil {
+		callback(d.message(m.GetMessage(), e))
+	}
+}
+
+func (d *UpdateDispatcher) newMessage(m *PredMessage, e entities) {
+	if d.OnNewMessage != nil {
+		d.OnNewMessage(d.message(m, e))
+	}
+}
+
+func (d *UpdateDispatcher) other(update *TypeUpdate) {
+	if d.OnOther != nil {
+		d.OnOther(update)
+	}
+}
+
+// message resolves the sender and the chat of the message
+func (d *UpdateDispatcher) message(m *PredMessage, e entities) *Message {
+	msg := &Message{PredMessage: m, Users: e.users, Chats: e.chats}
+	if m.FromId != 0 {
+		msg.From = d.users[m.FromId]
+	}
+	switch x := m.ToId.GetValue().(type) {
+	case *TypePeer_PeerChat:
+		msg.Chat = d.chats[x.PeerChat.ChatId]
+	case *TypePeer_PeerChannel:
+		msg.Chat = d.chats[x.PeerChannel.ChannelId]
+	}
+	return msg
+}
+
+// shortMessage is the message of updateShortMessage, between the user and the self
+func (d *UpdateDispatcher) shortMessage(x *PredUpdateShortMessage) *PredMessage {
+	m := &PredMessage{
+		Flags:        x.Flags,
+		Id:           x.Id,
+		FwdFrom:      x.FwdFrom,
+		ViaBotId:     x.ViaBotId,
+		ReplyToMsgId: x.ReplyToMsgId,
+		Date:         x.Date,
+		Message:      x.Message,
+		Entities:     x.Entities,
+	}
+	if x.Flags&(1<<1) != 0 {
+		// outgoing
+		m.FromId = d.selfId
+		m.ToId = &TypePeer{&TypePeer_PeerUser{&PredPeerUser{UserId: x.UserId}}}
+	} else {
+		m.FromId = x.UserId
+		m.ToId = &TypePeer{&TypePeer_PeerUser{&PredPeerUser{UserId: d.selfId}}}
+	}
+	return m
+}
+
+// shortChatMessage is the message of updateShortChatMessage
+func shortChatMessage(x *PredUpdateShortChatMessage) *PredMessage {
+	return &PredMessage{
+		Flags:        x.Flags,
+		Id:           x.Id,
+		FromId:       x.FromId,
+		ToId:         &TypePeer{&TypePeer_PeerChat{&PredPeerChat{ChatId: x.ChatId}}},
+		FwdFrom:      x.FwdFrom,
+		ViaBotId:     x.ViaBotId,
+		ReplyToMsgId: x.ReplyToMsgId,
+		Date:         x.Date,
+		Message:      x.Message,
+		Entities:     x.Entities,
+	}
+}
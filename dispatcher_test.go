@@ -0,0 +1,94 @@
+package mtproto
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestDispatchUpdates(t *testing.T) {
+	d := newUpdateDispatcher(&recordRPC{}, &PredUpdatesState{Pts: 10}, 1)
+	var messages []*Message
+	var statuses []*PredUser
+	d.OnNewMessage = func(m *Message) { messages = append(messages, m) }
+	d.OnUserStatus = func(user *PredUser, status *TypeUserStatus) {
+		if status.GetUserStatusOnline() == nil {
+			t.Errorf("unexpected status %v", status)
+		}
+		statuses = append(statuses, user)
+	}
+
+	d.OnUpdate(&PredUpdates{
+		Updates: []*TypeUpdate{
+			{&TypeUpdate_UpdateNewMessage{&PredUpdateNewMessage{
+				Message: &TypeMessage{&TypeMessage_Message{&PredMessage{
+					Id:      7,
+					FromId:  5,
+					ToId:    &TypePeer{&TypePeer_PeerUser{&PredPeerUser{UserId: 1}}},
+					Message: "hi",
+				}}},
+				Pts:      11,
+				PtsCount: 1,
+			}}},
+			{&TypeUpdate_UpdateUserStatus{&PredUpdateUserStatus{
+				UserId: 5,
+				Status: &TypeUserStatus{&TypeUserStatus_UserStatusOnline{&PredUserStatusOnline{Expires: 100}}},
+			}}},
+		},
+		Users: []*TypeUser{{&TypeUser_User{&PredUser{Id: 5, FirstName: "Gopher"}}}},
+	})
+
+	if len(messages) != 1 || messages[0].Message != "hi" || messages[0].From.GetFirstName() != "Gopher" || messages[0].Chat != nil {
+		t.Fatalf("unexpected messages %v", messages)
+	}
+	if len(statuses) != 1 || statuses[0].FirstName != "Gopher" {
+		t.Errorf("unexpected statuses %v", statuses)
+	}
+	if d.state.Pts != 11 {
+		t.Errorf("pts %d, expected 11", d.state.Pts)
+	}
+
+	// the short message of the same user is resolved by the users of the earlier updates
+	d.OnUpdate(&PredUpdateShortMessage{Id: 8, UserId: 5, Message: "bye", Pts: 12, PtsCount: 1})
+	if len(messages) != 2 || messages[1].From.GetFirstName() != "Gopher" || messages[1].ToId.GetPeerUser().GetUserId() != 1 {
+		t.Errorf("unexpected short message %v", messages[1:])
+	}
+	// a duplicate is dropped
+	d.OnUpdate(&PredUpdateShortMessage{Id: 8, UserId: 5, Message: "bye", Pts: 12, PtsCount: 1})
+	if len(messages) != 2 {
+		t.Errorf("the duplicate is dispatched")
+	}
+}
+
+func TestDispatchGap(t *testing.T) {
+	message := func(id int32) *TypeMessage {
+		return &TypeMessage{&TypeMessage_Message{&PredMessage{
+			Id:   id,
+			ToId: &TypePeer{&TypePeer_PeerChat{&PredPeerChat{ChatId: 3}}},
+		}}}
+	}
+	rpc := &differenceRPC{diffs: []interface{}{
+		&PredUpdatesDifference{
+			NewMessages: []*TypeMessage{message(1), message(2)},
+			Chats:       []*TypeChat{{&TypeChat_Chat{&PredChat{Id: 3, Title: "dev"}}}},
+			State:       &TypeUpdatesState{&PredUpdatesState{Pts: 12}},
+		},
+		&PredUpdatesDifferenceEmpty{},
+	}}
+	d := newUpdateDispatcher(rpc, &PredUpdatesState{Pts: 10}, 1)
+	var ids []int32
+	d.OnNewMessage = func(m *Message) {
+		if m.Chat.GetChat().GetTitle() != "dev" {
+			t.Errorf("unexpected chat %v", m.Chat)
+		}
+		ids = append(ids, m.Id)
+	}
+
+	// pts 12 skips pts 11, so the difference from pts 10 is got
+	d.OnUpdate(&PredUpdateNewMessage{Message: message(2), Pts: 12, PtsCount: 1})
+	if fmt.Sprint(ids) != "[1 2]" {
+		t.Errorf("unexpected messages %v", ids)
+	}
+	if len(rpc.reqs) != 2 || rpc.reqs[0].Pts != 10 || d.state.Pts != 12 {
+		t.Errorf("unexpected getDifference %v, state %v", rpc.reqs, d.state)
+	}
+}
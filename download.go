@@ -0,0 +1,518 @@
+package mtproto
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// upload.getFile returns a file in chunks of this size, but the last chunk.
+const DownloadChunkSize = 1024 * 1024
+
+// DownloadFile writes the file at loc to w.
+// If the file is stored on another DC, it is downloaded through a session to the DC.
+// If w is an io.WriterAt, Configuration.DownloadConcurrency chunks are fetched at once,
+// and each is written at its offset from the beginning of w.
+func (mconn *Conn) DownloadFile(loc *TypeInputFileLocation, w io.Writer) error {
+	return mconn.DownloadFileContext(context.Background(), loc, w)
+}
+
+// DownloadFileContext is DownloadFile which gives up on ctx done, on the session to the DC of the file as well.
+func (mconn *Conn) DownloadFileContext(ctx context.Context, loc *TypeInputFileLocation, w io.Writer) error {
+	d := mconn.newDownloader(ctx)
+	if wa, ok := w.(io.WriterAt); ok {
+		if concurrency := mconn.downloadConcurrency(); concurrency > 1 {
+			return d.downloadAt(loc, wa, concurrency)
+		}
+	}
+	return d.download(loc, w, 0, -1)
+}
+
+// DownloadFileRange reads limit bytes of the file at loc from offset.
+// If limit is negative, it reads to the end of the file.
+func (mconn *Conn) DownloadFileRange(loc *TypeInputFileLocation, offset, limit int64) ([]byte, error) {
+	return mconn.DownloadFileRangeContext(context.Background(), loc, offset, limit)
+}
+
+// DownloadFileRangeContext is DownloadFileRange which gives up on ctx done.
+func (mconn *Conn) DownloadFileRangeContext(ctx context.Context, loc *TypeInputFileLocation, offset, limit int64) ([]byte, error) {
+	d := mconn.newDownloader(ctx)
+	buf := new(bytes.Buffer)
+	err := d.download(loc, buf, offset, limit)
+	return buf.Bytes(), err
+}
+
+// newDownloader returns the downloader on the connection, and on the sessions to the DCs of the files,
+// whose calls give up on ctx done
+func (mconn *Conn) newDownloader(ctx context.Context) *downloader {
+	return &downloader{
+		rpc: mconn.contextRPC(ctx),
+		migrate: func(dc int32) (RemoteProcedureCall, error) {
+			return mconn.mediaSession(ctx, dc)
+		},
+	}
+}
+
+// DownloadProfilePhoto writes the profile photo of the user, the chat or the channel of peer to w,
+// the big one if big is set, or else the small one.
+// It returns ErrNoPhoto if the peer has no photo.
+func (mconn *Conn) DownloadProfilePhoto(peer *TypeInputPeer, big bool, w io.Writer) error {
+	return mconn.DownloadProfilePhotoContext(context.Background(), peer, big, w)
+}
+
+// DownloadProfilePhotoContext is DownloadProfilePhoto which gives up on ctx done.
+func (mconn *Conn) DownloadProfilePhotoContext(ctx context.Context, peer *TypeInputPeer, big bool, w io.Writer) error {
+	loc, err := profilePhotoLocation(ctx, mconn, peer, big)
+	if err != nil {
+		return err
+	}
+	return mconn.DownloadFileContext(ctx, loc, w)
+}
+
+// profilePhotoLocation gets the peer to find the location of its photo
+func profilePhotoLocation(ctx context.Context, rpc RemoteProcedureCall, peer *TypeInputPeer, big bool) (*TypeInputFileLocation, error) {
+	caller := RPCaller{rpc}
+	var chats []*TypeChat
+	switch x := peer.GetValue().(type) {
+	case *TypeInputPeer_InputPeerSelf, *TypeInputPeer_InputPeerUser:
+		user, err := inputUserOf(peer)
+		if err != nil {
+			return nil, err
+		}
+		users, err := caller.UsersGetUsers(ctx, &ReqUsersGetUsers{Id: []*TypeInputUser{user}})
+		if err != nil {
+			return nil, err
+		}
+		if len(users.User) == 0 || users.User[0].GetUser() == nil {
+			return nil, fmt.Errorf("user %v not found", peer)
+		}
+		return userPhotoLocation(users.User[0].GetUser().Photo, big)
+	case *TypeInputPeer_InputPeerChat:
+		found, err := caller.MessagesGetChats(ctx, &ReqMessagesGetChats{Id: []int32{x.InputPeerChat.ChatId}})
+		if err != nil {
+			return nil, err
+		}
+		chats = found.GetMessagesChats().GetChats()
+		if chats == nil {
+			chats = found.GetMessagesChatsSlice().GetChats()
+		}
+	case *TypeInputPeer_InputPeerChannel:
+		channel := &TypeInputChannel{&TypeInputChannel_InputChannel{&PredInputChannel{
+			ChannelId:  x.InputPeerChannel.ChannelId,
+			AccessHash: x.InputPeerChannel.AccessHash,
+		}}}
+		found, err := caller.ChannelsGetChannels(ctx, &ReqChannelsGetChannels{Id: []*TypeInputChannel{channel}})
+		if err != nil {
+			return nil, err
+		}
+		chats = found.GetMessagesChats().GetChats()
+		if chats == nil {
+			chats = found.GetMessagesChatsSlice().GetChats()
+		}
+	default:
+		return nil, fmt.Errorf("no profile photo of peer %v", peer)
+	}
+
+	if len(chats) == 0 {
+		return nil, fmt.Errorf("chat %v not found", peer)
+	}
+	switch x := chats[0].GetValue().(type) {
+	case *TypeChat_Chat:
+		return chatPhotoLocation(x.Chat.Photo, big)
+	case *TypeChat_Channel:
+		return chatPhotoLocation(x.Channel.Photo, big)
+	}
+	// forbidden chats have no photos
+	return nil, ErrNoPhoto
+}
+
+func userPhotoLocation(photo *TypeUserProfilePhoto, big bool) (*TypeInputFileLocation, error) {
+	p := photo.GetUserProfilePhoto()
+	if p == nil {
+		return nil, ErrNoPhoto
+	}
+	return photoLocation(p.PhotoSmall, p.PhotoBig, big)
+}
+
+func chatPhotoLocation(photo *TypeChatPhoto, big bool) (*TypeInputFileLocation, error) {
+	p := photo.GetChatPhoto()
+	if p == nil {
+		return nil, ErrNoPhoto
+	}
+	return photoLocation(p.PhotoSmall, p.PhotoBig, big)
+}
+
+// photoLocation returns the input location of the small or the big photo
+func photoLocation(small, big *TypeFileLocation, wantBig bool) (*TypeInputFileLocation, error) {
+	if wantBig {
+		return inputFileLocation(big)
+	}
+	return inputFileLocation(small)
+}
+
+func inputFileLocation(location *TypeFileLocation) (*TypeInputFileLocation, error) {
+	loc := location.GetFileLocation()
+	if loc == nil {
+		// the photo is unavailable
+		return nil, ErrNoPhoto
+	}
+	return &TypeInputFileLocation{&TypeInputFileLocation_InputFileLocation{&PredInputFileLocation{
+		VolumeId: loc.VolumeId,
+		LocalId:  loc.LocalId,
+		Secret:   loc.Secret,
+	}}}, nil
+}
+
+// DownloadPhotoSize writes the size of sizeType of the photo to w, e.g., "s" for the small thumbnail,
+// or "x" and "y" for the large ones. If the photo has no size of the type, the largest is written.
+// The sizes cached in the photo are written without downloading them.
+// See https://core.telegram.org/api/files#image-thumbnail-types
+func (mconn *Conn) DownloadPhotoSize(photo *PredPhoto, sizeType string, w io.Writer) error {
+	return mconn.DownloadPhotoSizeContext(context.Background(), photo, sizeType, w)
+}
+
+// DownloadPhotoSizeContext is DownloadPhotoSize which gives up on ctx done.
+func (mconn *Conn) DownloadPhotoSizeContext(ctx context.Context, photo *PredPhoto, sizeType string, w io.Writer) error {
+	size := pickPhotoSize(photo.Sizes, sizeType)
+	if cached := size.GetPhotoCachedSize(); cached != nil {
+		_, err := w.Write(cached.Bytes)
+		return err
+	}
+	if size.GetPhotoSize() == nil {
+		return ErrNoPhoto
+	}
+	loc, err := inputFileLocation(size.GetPhotoSize().Location)
+	if err != nil {
+		return err
+	}
+	return mconn.DownloadFileContext(ctx, loc, w)
+}
+
+// pickPhotoSize returns the size of sizeType, or else the largest, or nil if there is none
+func pickPhotoSize(sizes []*TypePhotoSize, sizeType string) *TypePhotoSize {
+	var largest *TypePhotoSize
+	var largestArea, largestLen int64
+	for _, size := range sizes {
+		var typ string
+		var area, n int64 // n is the file size
+		switch x := size.GetValue().(type) {
+		case *TypePhotoSize_PhotoSize:
+			typ, area, n = x.PhotoSize.Type, int64(x.PhotoSize.W)*int64(x.PhotoSize.H), int64(x.PhotoSize.Size)
+		case *TypePhotoSize_PhotoCachedSize:
+			typ, area, n = x.PhotoCachedSize.Type, int64(x.PhotoCachedSize.W)*int64(x.PhotoCachedSize.H), int64(len(x.PhotoCachedSize.Bytes))
+		default:
+			// photoSizeEmpty has nothing to download
+			continue
+		}
+		if typ == sizeType {
+			return size
+		}
+		if largest == nil || area > largestArea || (area == largestArea && n > largestLen) {
+			largest, largestArea, largestLen = size, area, n
+		}
+	}
+	return largest
+}
+
+type downloader struct {
+	rpc     RemoteProcedureCall
+	migrate func(dc int32) (RemoteProcedureCall, error)
+
+	// the workers of downloadAt share the session to the DC of the file
+	mutex      sync.Mutex
+	migratedDC int32
+}
+
+func (d *downloader) download(loc *TypeInputFileLocation, w io.Writer, offset, limit int64) error {
+	// A chunk must not cross the chunk size boundaries, so read the chunks from the aligned offset.
+	chunkOffset := offset - offset%DownloadChunkSize
+	skip := offset - chunkOffset
+	for limit != 0 {
+		chunk, err := d.getFile(loc, int32(chunkOffset))
+		if err != nil {
+			return err
+		}
+		b := chunk
+		if skip < int64(len(b)) {
+			b = b[skip:]
+		} else {
+			b = nil
+		}
+		if limit > 0 && int64(len(b)) > limit {
+			b = b[:limit]
+		}
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+		if limit > 0 {
+			limit -= int64(len(b))
+		}
+
+		// a short chunk is the last one
+		if len(chunk) < DownloadChunkSize {
+			return nil
+		}
+		chunkOffset += DownloadChunkSize
+		skip = 0
+	}
+	return nil
+}
+
+// downloadAt fetches the chunks by concurrency workers, and writes each at its offset of w.
+// The size of the file is unknown, so the chunks are fetched in order of their offsets until a short one,
+// which is the last; the chunks after it, fetched out of order already, are empty or fail, and are dropped.
+func (d *downloader) downloadAt(loc *TypeInputFileLocation, w io.WriterAt, concurrency int) error {
+	var (
+		mutex   sync.Mutex
+		next    int64                 // the index of the chunk to fetch next
+		end     int64 = math.MaxInt64 // the index after the last chunk, once a short chunk is fetched
+		failed  int64 = math.MaxInt64 // the index of the first failed chunk
+		failure error
+	)
+	var workers sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for {
+				mutex.Lock()
+				index := next
+				next++
+				stop := index >= end || index >= failed
+				mutex.Unlock()
+				if stop {
+					return
+				}
+
+				offset := index * DownloadChunkSize
+				chunk, err := d.getFile(loc, int32(offset))
+				if err == nil && len(chunk) > 0 {
+					_, err = w.WriteAt(chunk, offset)
+				}
+
+				mutex.Lock()
+				if err != nil && index < failed {
+					failed, failure = index, err
+				}
+				if err == nil && len(chunk) < DownloadChunkSize && index+1 < end {
+					end = index + 1
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+	workers.Wait()
+
+	// the failures after the last chunk do not matter
+	if failed < end {
+		return failure
+	}
+	return nil
+}
+
+func (d *downloader) getFile(loc *TypeInputFileLocation, offset int32) ([]byte, error) {
+	migrated, reopened := false, false
+	d.mutex.Lock()
+	rpc := d.rpc
+	d.mutex.Unlock()
+	for {
+		data, err := rpc.InvokeBlocked(&ReqUploadGetFile{
+			Location: loc,
+			Offset:   offset,
+			Limit:    DownloadChunkSize,
+		})
+		if migrateErr, ok := err.(MigrateError); ok && migrateErr.Kind == "FILE" && !migrated {
+			// continue the download on the DC of the file
+			rpc, err = d.migrateTo(int32(migrateErr.DC))
+			if err != nil {
+				return nil, err
+			}
+			migrated = true
+			continue
+		}
+		if errors.Is(err, ErrConnClosed) && !reopened {
+			// the session to the DC of the file dropped
+			rpc, err = d.reopen(rpc)
+			if err != nil {
+				return nil, err
+			}
+			reopened = true
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch x := data.(type) {
+		case *PredUploadFile:
+			return x.Bytes, nil
+		case *PredUploadFileCdnRedirect:
+			return nil, fmt.Errorf("file on CDN DC %d is not supported", x.DcId)
+		}
+		return nil, fmt.Errorf("RPC: %#v", data)
+	}
+}
+
+// migrateTo switches to the session to the DC, unless another worker has switched to it already
+func (d *downloader) migrateTo(dc int32) (RemoteProcedureCall, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.migratedDC != dc {
+		rpc, err := d.migrate(dc)
+		if err != nil {
+			return nil, err
+		}
+		d.rpc, d.migratedDC = rpc, dc
+	}
+	return d.rpc, nil
+}
+
+// reopen replaces the dropped session to the DC of the file, unless another worker has replaced it already.
+// It fails with ErrConnClosed if the dropped one is of the connection, which is closed.
+func (d *downloader) reopen(dropped RemoteProcedureCall) (RemoteProcedureCall, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.migratedDC == 0 {
+		return nil, ErrConnClosed
+	}
+	if d.rpc == dropped {
+		rpc, err := d.migrate(d.migratedDC)
+		if err != nil {
+			return nil, err
+		}
+		d.rpc = rpc
+	}
+	return d.rpc, nil
+}
+
+func (mconn *Conn) downloadConcurrency() int {
+	session, err := mconn.Session()
+	if err != nil {
+		return defaultDownloadConcurrency
+	}
+	return session.appConfig.downloadConcurrency()
+}
+
+// mediaSession returns the session to the DC, authorized by the account of the connection.
+// The calls on it, and the authorization of a new one, give up on ctx done.
+func (mconn *Conn) mediaSession(ctx context.Context, dc int32) (RemoteProcedureCall, error) {
+	mconn.mediaMutex.Lock()
+	defer mconn.mediaMutex.Unlock()
+	if media, ok := mconn.mediaSessions[dc]; ok {
+		return sessionRPC{media, ctx}, nil
+	}
+
+	session, err := mconn.Session()
+	if err != nil {
+		return nil, err
+	}
+	addr, err := mconn.dcAddr(dc, true)
+	if err != nil {
+		return nil, err
+	}
+	exported, err := exportAuthorization(mconn.contextRPC(ctx), dc)
+	if err != nil {
+		return nil, err
+	}
+
+	logf(mconn, "open media session to DC %d, %s\n", dc, addr)
+	// the read and the ping routines notify the drop once each, and the close notifies SessionDiscarded,
+	// so that the notifications never block on the buffer
+	events := make(chan Event, 3)
+	media, err := newMediaSession(addr, session.useIPv6, session.appConfig, events)
+	if err != nil {
+		return nil, err
+	}
+	rpc := sessionRPC{media, ctx}
+	if _, err := importAuthorization(rpc, exported); err != nil {
+		media.close()
+		return nil, err
+	}
+	if mconn.mediaSessions == nil {
+		mconn.mediaSessions = make(map[int32]*Session)
+	}
+	mconn.mediaSessions[dc] = media
+	go mconn.watchMediaSession(dc, media, events)
+	return rpc, nil
+}
+
+// watchMediaSession evicts the media session to the DC on its connection drop,
+// so that the next download opens another one rather than timing out on the dead one.
+func (mconn *Conn) watchMediaSession(dc int32, media *Session, events chan Event) {
+	for {
+		select {
+		case e := <-events:
+			switch e.(type) {
+			case refreshSession:
+				logf(mconn, "media session to DC %d dropped\n", dc)
+				if mconn.evictMediaSession(dc, media) {
+					media.close()
+				}
+				return
+			case SessionDiscarded:
+				// closed by closeMediaSessions
+				return
+			}
+		case <-mconn.interrupter:
+			return
+		}
+	}
+}
+
+// evictMediaSession removes the media session to the DC, unless it is closed or replaced already.
+// The caller closes it if it is removed.
+func (mconn *Conn) evictMediaSession(dc int32, media *Session) bool {
+	mconn.mediaMutex.Lock()
+	defer mconn.mediaMutex.Unlock()
+	if mconn.mediaSessions[dc] != media {
+		return false
+	}
+	delete(mconn.mediaSessions, dc)
+	return true
+}
+
+func (mconn *Conn) closeMediaSessions() {
+	mconn.mediaMutex.Lock()
+	defer mconn.mediaMutex.Unlock()
+	for _, media := range mconn.mediaSessions {
+		media.close()
+	}
+	mconn.mediaSessions = nil
+}
+
+// sessionRPC invokes RPCs on a session which no connection is bound to.
+// The RPCs fail with ErrConnClosed once the session is closed.
+type sessionRPC struct {
+	session *Session
+	ctx     context.Context // nil for the calls never given up but on timeout
+}
+
+func (x sessionRPC) InvokeBlocked(msg TL) (interface{}, error) {
+	ctx := x.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	resp := make(chan response, 1)
+	if err := x.session.send(packetToSend{msg: msg, resp: resp, ctx: ctx}); err != nil {
+		return nil, err
+	}
+	timeout := x.session.appConfig.requestTimeout()
+	select {
+	case r := <-resp:
+		return r.data, r.err
+	case <-x.session.sendInterrupter:
+		return nil, ErrConnClosed
+	case <-time.After(timeout):
+		return nil, TimeoutError{timeout}
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
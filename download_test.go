@@ -0,0 +1,286 @@
+package mtproto
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// fileDC serves file, or FILE_MIGRATE to the DC of the file. A request takes latency.
+type fileDC struct {
+	mutex     sync.Mutex
+	file      []byte
+	migrateTo int
+	requests  int
+	latency   time.Duration
+	closed    bool // of a dropped session
+}
+
+func (dc *fileDC) InvokeBlocked(msg TL) (interface{}, error) {
+	req, ok := msg.(*ReqUploadGetFile)
+	if !ok {
+		return nil, fmt.Errorf("unexpected request %T", msg)
+	}
+	time.Sleep(dc.latency)
+	dc.mutex.Lock()
+	defer dc.mutex.Unlock()
+	dc.requests++
+	if dc.closed {
+		return nil, ErrConnClosed
+	}
+	if dc.migrateTo != 0 {
+		return nil, MigrateError{"FILE", dc.migrateTo}
+	}
+	if req.Offset%DownloadChunkSize != 0 || req.Limit != DownloadChunkSize {
+		return nil, RPCError{errorBadRequest, "LIMIT_INVALID"}
+	}
+	end := int(req.Offset) + int(req.Limit)
+	if end > len(dc.file) {
+		end = len(dc.file)
+	}
+	if int(req.Offset) > end {
+		return nil, RPCError{errorBadRequest, "OFFSET_INVALID"}
+	}
+	return &PredUploadFile{Bytes: dc.file[req.Offset:end]}, nil
+}
+
+func TestDownloadAcrossDCMigration(t *testing.T) {
+	file := testFile(2*DownloadChunkSize + 100)
+	home := &fileDC{migrateTo: 4}
+	media := &fileDC{file: file}
+	var migrations []int32
+	d := &downloader{rpc: home, migrate: func(dc int32) (RemoteProcedureCall, error) {
+		migrations = append(migrations, dc)
+		return media, nil
+	}}
+
+	loc := &TypeInputFileLocation{}
+	buf := new(bytes.Buffer)
+	if err := d.download(loc, buf, 0, -1); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), file) {
+		t.Errorf("reassembled file is different, %d bytes", buf.Len())
+	}
+	if fmt.Sprint(migrations) != "[4]" || home.requests != 1 || media.requests != 3 {
+		t.Errorf("migrations %v, %d requests to home, %d requests to media", migrations, home.requests, media.requests)
+	}
+
+	// range across a chunk boundary
+	buf.Reset()
+	offset, limit := int64(DownloadChunkSize-10), int64(30)
+	if err := d.download(loc, buf, offset, limit); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), file[offset:offset+limit]) {
+		t.Errorf("unexpected range %x", buf.Bytes())
+	}
+}
+
+func TestDownloadReopensDroppedSession(t *testing.T) {
+	file := testFile(DownloadChunkSize + 100)
+	home := &fileDC{migrateTo: 4}
+	sessions := []*fileDC{{file: file, closed: true}, {file: file}}
+	var migrations int
+	d := &downloader{rpc: home, migrate: func(dc int32) (RemoteProcedureCall, error) {
+		migrations++
+		return sessions[migrations-1], nil
+	}}
+
+	buf := new(bytes.Buffer)
+	if err := d.download(&TypeInputFileLocation{}, buf, 0, -1); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), file) {
+		t.Errorf("reassembled file is different, %d bytes", buf.Len())
+	}
+	if migrations != 2 || sessions[1].requests != 2 {
+		t.Errorf("%d migrations, %d requests to the reopened session", migrations, sessions[1].requests)
+	}
+
+	// the connection itself is closed
+	d = &downloader{rpc: &fileDC{closed: true}}
+	if err := d.download(&TypeInputFileLocation{}, buf, 0, -1); err != ErrConnClosed {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+// Run it with -race. The RPCs racing with the close of the session fail rather than panic.
+func TestSessionRPCClosed(t *testing.T) {
+	session := &Session{
+		queueSend:       make(chan packetToSend, 64),
+		sendInterrupter: make(chan struct{}),
+		isSending:       true,
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := (sessionRPC{session: session}).InvokeBlocked(&ReqUploadGetFile{}); err != ErrConnClosed {
+				t.Errorf("unexpected error %v", err)
+			}
+		}()
+	}
+	session.stopSend()
+	wg.Wait()
+}
+
+// The call on the session to the DC of the file gives up on ctx done, and the packet carries ctx to be abandoned.
+func TestSessionRPCContext(t *testing.T) {
+	session := &Session{
+		queueSend:       make(chan packetToSend, 64),
+		sendInterrupter: make(chan struct{}),
+		isSending:       true,
+		appConfig:       Configuration{RequestTimeout: time.Minute},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, err := (sessionRPC{session, ctx}).InvokeBlocked(&ReqUploadGetFile{})
+		done <- err
+	}()
+	packet := <-session.queueSend
+	if packet.ctx != ctx {
+		t.Errorf("the packet does not carry ctx")
+	}
+	cancel()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Errorf("unexpected error %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the call does not give up on ctx done")
+	}
+	if _, err := (sessionRPC{session, ctx}).InvokeBlocked(&ReqUploadGetFile{}); err != context.Canceled {
+		t.Errorf("unexpected error %v of the call with ctx done", err)
+	}
+}
+
+// bufferAt is an io.WriterAt in memory
+type bufferAt struct {
+	mutex sync.Mutex
+	b     []byte
+}
+
+func (w *bufferAt) WriteAt(p []byte, off int64) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if end := int(off) + len(p); end > len(w.b) {
+		w.b = append(w.b, make([]byte, end-len(w.b))...)
+	}
+	return copy(w.b[off:], p), nil
+}
+
+func TestDownloadParallel(t *testing.T) {
+	// the last chunk is short, empty, or full and followed by an empty one
+	for _, size := range []int{5*DownloadChunkSize + 100, 5 * DownloadChunkSize, 100} {
+		file := testFile(size)
+		home := &fileDC{migrateTo: 2}
+		var mutex sync.Mutex
+		var migrations int
+		d := &downloader{rpc: home, migrate: func(dc int32) (RemoteProcedureCall, error) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			migrations++
+			return &fileDC{file: file, latency: time.Millisecond}, nil
+		}}
+
+		w := &bufferAt{}
+		if err := d.downloadAt(&TypeInputFileLocation{}, w, 4); err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if !bytes.Equal(w.b, file) {
+			t.Errorf("size %d: reassembled file is different, %d bytes", size, len(w.b))
+		}
+		if migrations != 1 {
+			t.Errorf("size %d: %d migrations", size, migrations)
+		}
+	}
+
+	// a failure before the last chunk fails the download
+	d := &downloader{rpc: &fileDC{file: testFile(3 * DownloadChunkSize), migrateTo: 5}}
+	d.migrate = func(dc int32) (RemoteProcedureCall, error) { return nil, fmt.Errorf("no DC %d", dc) }
+	if err := d.downloadAt(&TypeInputFileLocation{}, &bufferAt{}, 4); err == nil || err.Error() != "no DC 5" {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func benchmarkDownload(b *testing.B, concurrency int) {
+	file := testFile(50 * 1024 * 1024)
+	b.SetBytes(int64(len(file)))
+	for i := 0; i < b.N; i++ {
+		d := &downloader{rpc: &fileDC{file: file, latency: time.Millisecond}}
+		if err := d.downloadAt(&TypeInputFileLocation{}, &bufferAt{}, concurrency); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDownloadSerial(b *testing.B)   { benchmarkDownload(b, 1) }
+func BenchmarkDownloadParallel(b *testing.B) { benchmarkDownload(b, 8) }
+
+func TestUserPhotoLocation(t *testing.T) {
+	photo := &TypeUserProfilePhoto{&TypeUserProfilePhoto_UserProfilePhoto{&PredUserProfilePhoto{
+		PhotoId:    1,
+		PhotoSmall: &TypeFileLocation{&TypeFileLocation_FileLocation{&PredFileLocation{DcId: 2, VolumeId: 10, LocalId: 11, Secret: 12}}},
+		PhotoBig:   &TypeFileLocation{&TypeFileLocation_FileLocation{&PredFileLocation{DcId: 2, VolumeId: 20, LocalId: 21, Secret: 22}}},
+	}}}
+	for _, tc := range []struct {
+		big                       bool
+		volumeId, localId, secret int64
+	}{
+		{false, 10, 11, 12},
+		{true, 20, 21, 22},
+	} {
+		loc, err := userPhotoLocation(photo, tc.big)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l := loc.GetInputFileLocation()
+		if l == nil || l.VolumeId != tc.volumeId || int64(l.LocalId) != tc.localId || l.Secret != tc.secret {
+			t.Errorf("big %v: unexpected location %v", tc.big, loc)
+		}
+	}
+
+	empty := &TypeUserProfilePhoto{&TypeUserProfilePhoto_UserProfilePhotoEmpty{&PredUserProfilePhotoEmpty{}}}
+	if _, err := userPhotoLocation(empty, false); err != ErrNoPhoto {
+		t.Errorf("unexpected error %v of an empty photo", err)
+	}
+	unavailable := &TypeUserProfilePhoto{&TypeUserProfilePhoto_UserProfilePhoto{&PredUserProfilePhoto{
+		PhotoSmall: &TypeFileLocation{&TypeFileLocation_FileLocationUnavailable{&PredFileLocationUnavailable{}}},
+	}}}
+	if _, err := userPhotoLocation(unavailable, false); err != ErrNoPhoto {
+		t.Errorf("unexpected error %v of an unavailable photo", err)
+	}
+}
+
+func TestPickPhotoSize(t *testing.T) {
+	size := func(typ string, w, h int32) *TypePhotoSize {
+		return &TypePhotoSize{&TypePhotoSize_PhotoSize{&PredPhotoSize{Type: typ, W: w, H: h}}}
+	}
+	sizes := []*TypePhotoSize{
+		{&TypePhotoSize_PhotoCachedSize{&PredPhotoCachedSize{Type: "s", W: 90, H: 90, Bytes: []byte{1}}}},
+		size("m", 320, 320),
+		size("x", 800, 800),
+		{&TypePhotoSize_PhotoSizeEmpty{&PredPhotoSizeEmpty{Type: "y"}}},
+	}
+	for sizeType, expected := range map[string]string{"s": "s", "m": "m", "x": "x", "y": "x", "w": "x"} {
+		picked := pickPhotoSize(sizes, sizeType)
+		typ := picked.GetPhotoSize().GetType()
+		if cached := picked.GetPhotoCachedSize(); cached != nil {
+			typ = cached.Type
+		}
+		if typ != expected {
+			t.Errorf("%s: picked %s, expected %s", sizeType, typ, expected)
+		}
+	}
+	if pickPhotoSize(sizes[3:], "s") != nil {
+		t.Errorf("an empty size is picked")
+	}
+}
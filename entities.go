@@ -0,0 +1,219 @@
+package mtproto
+
+import (
+	"fmt"
+	"html"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// The offsets and the lengths of the message entities are in UTF-16 code units, not in bytes or runes.
+// A rune out of the Basic Multilingual Plane, e.g., an emoji, takes two units.
+func utf16Len(s string) int32 {
+	n := int32(0)
+	for _, r := range s {
+		if r >= 0x10000 {
+			n += 2
+		} else {
+			n++
+		}
+	}
+	return n
+}
+
+// entityBuilder collects the plain text and the entities on it
+type entityBuilder struct {
+	plain    strings.Builder
+	offset   int32 // of the end of plain, in UTF-16 code units
+	entities []*TypeMessageEntity
+}
+
+func (b *entityBuilder) text(s string) {
+	b.plain.WriteString(s)
+	b.offset += utf16Len(s)
+}
+
+// entity adds the entity made by newEntity, on the text from offset to the end of plain
+func (b *entityBuilder) entity(offset int32, newEntity func(offset, length int32) *TypeMessageEntity) {
+	if length := b.offset - offset; length > 0 {
+		b.entities = append(b.entities, newEntity(offset, length))
+	}
+}
+
+func (b *entityBuilder) result() (string, []*TypeMessageEntity) {
+	// the inner entities are closed first, but the entities are in the order of their offsets
+	sort.SliceStable(b.entities, func(i, j int) bool {
+		return entityOffset(b.entities[i]) < entityOffset(b.entities[j])
+	})
+	return b.plain.String(), b.entities
+}
+
+func entityOffset(e *TypeMessageEntity) int32 {
+	switch x := e.GetValue().(type) {
+	case *TypeMessageEntity_MessageEntityBold:
+		return x.MessageEntityBold.Offset
+	case *TypeMessageEntity_MessageEntityItalic:
+		return x.MessageEntityItalic.Offset
+	case *TypeMessageEntity_MessageEntityCode:
+		return x.MessageEntityCode.Offset
+	case *TypeMessageEntity_MessageEntityPre:
+		return x.MessageEntityPre.Offset
+	case *TypeMessageEntity_MessageEntityTextUrl:
+		return x.MessageEntityTextUrl.Offset
+	}
+	return 0
+}
+
+func boldEntity(offset, length int32) *TypeMessageEntity {
+	return &TypeMessageEntity{&TypeMessageEntity_MessageEntityBold{&PredMessageEntityBold{Offset: offset, Length: length}}}
+}
+
+func italicEntity(offset, length int32) *TypeMessageEntity {
+	return &TypeMessageEntity{&TypeMessageEntity_MessageEntityItalic{&PredMessageEntityItalic{Offset: offset, Length: length}}}
+}
+
+func codeEntity(offset, length int32) *TypeMessageEntity {
+	return &TypeMessageEntity{&TypeMessageEntity_MessageEntityCode{&PredMessageEntityCode{Offset: offset, Length: length}}}
+}
+
+func preEntity(language string) func(offset, length int32) *TypeMessageEntity {
+	return func(offset, length int32) *TypeMessageEntity {
+		return &TypeMessageEntity{&TypeMessageEntity_MessageEntityPre{
+			&PredMessageEntityPre{Offset: offset, Length: length, Language: language},
+		}}
+	}
+}
+
+func textUrlEntity(url string) func(offset, length int32) *TypeMessageEntity {
+	return func(offset, length int32) *TypeMessageEntity {
+		return &TypeMessageEntity{&TypeMessageEntity_MessageEntityTextUrl{
+			&PredMessageEntityTextUrl{Offset: offset, Length: length, Url: url},
+		}}
+	}
+}
+
+// ParseMarkdown converts the Markdown of Telegram into the plain text and its entities for WithEntities:
+// *bold*, _italic_, `code`, ```pre```, and [text](url). The entities do not nest,
+// a backslash escapes a markup character, and an unclosed markup is kept as the text.
+func ParseMarkdown(text string) (string, []*TypeMessageEntity) {
+	b := &entityBuilder{}
+	for len(text) > 0 {
+		r, size := utf8.DecodeRuneInString(text)
+		switch {
+		case r == '\\' && len(text) > 1 && strings.ContainsRune("*_`[]\\", rune(text[1])):
+			b.text(text[1:2])
+			text = text[2:]
+			continue
+		case strings.HasPrefix(text, "```"):
+			if end := strings.Index(text[3:], "```"); end >= 0 {
+				offset := b.offset
+				b.text(text[3 : 3+end])
+				b.entity(offset, preEntity(""))
+				text = text[3+end+3:]
+				continue
+			}
+		case r == '*' || r == '_' || r == '`':
+			if end := strings.IndexRune(text[1:], r); end >= 0 {
+				newEntity := boldEntity
+				if r == '_' {
+					newEntity = italicEntity
+				} else if r == '`' {
+					newEntity = codeEntity
+				}
+				offset := b.offset
+				b.text(text[1 : 1+end])
+				b.entity(offset, newEntity)
+				text = text[1+end+1:]
+				continue
+			}
+		case r == '[':
+			// [text](url)
+			if mid := strings.Index(text, "]("); mid > 0 {
+				if end := strings.IndexByte(text[mid+2:], ')'); end >= 0 {
+					offset := b.offset
+					b.text(text[1:mid])
+					b.entity(offset, textUrlEntity(text[mid+2:mid+2+end]))
+					text = text[mid+2+end+1:]
+					continue
+				}
+			}
+		}
+		b.text(text[:size])
+		text = text[size:]
+	}
+	return b.result()
+}
+
+// ParseHTML converts the HTML of Telegram into the plain text and its entities for WithEntities:
+// <b> or <strong>, <i> or <em>, <code>, <pre>, and <a href="url">. The entities nest,
+// and the character references, e.g., &lt;, are unescaped.
+// It returns an error on other tags, or on the tags not closed in order.
+func ParseHTML(text string) (string, []*TypeMessageEntity, error) {
+	type openTag struct {
+		name   string
+		offset int32
+		href   string
+	}
+	b := &entityBuilder{}
+	var open []openTag
+	for len(text) > 0 {
+		start := strings.IndexByte(text, '<')
+		if start < 0 {
+			b.text(html.UnescapeString(text))
+			break
+		}
+		b.text(html.UnescapeString(text[:start]))
+		end := strings.IndexByte(text[start:], '>')
+		if end < 0 {
+			return "", nil, fmt.Errorf("unclosed tag at %q", text[start:])
+		}
+		tag := text[start+1 : start+end]
+		text = text[start+end+1:]
+
+		if strings.HasPrefix(tag, "/") {
+			name := strings.ToLower(strings.TrimSpace(tag[1:]))
+			if len(open) == 0 || open[len(open)-1].name != name {
+				return "", nil, fmt.Errorf("unexpected end tag </%s>", name)
+			}
+			t := open[len(open)-1]
+			open = open[:len(open)-1]
+			switch name {
+			case "b", "strong":
+				b.entity(t.offset, boldEntity)
+			case "i", "em":
+				b.entity(t.offset, italicEntity)
+			case "code":
+				b.entity(t.offset, codeEntity)
+			case "pre":
+				b.entity(t.offset, preEntity(""))
+			case "a":
+				b.entity(t.offset, textUrlEntity(t.href))
+			}
+			continue
+		}
+
+		fields := strings.Fields(tag)
+		if len(fields) == 0 {
+			return "", nil, fmt.Errorf("empty tag")
+		}
+		t := openTag{name: strings.ToLower(fields[0]), offset: b.offset}
+		switch t.name {
+		case "b", "strong", "i", "em", "code", "pre":
+		case "a":
+			attr := strings.TrimSpace(tag[len(fields[0]):])
+			if !strings.HasPrefix(attr, "href=") {
+				return "", nil, fmt.Errorf("no href of <%s>", tag)
+			}
+			t.href = html.UnescapeString(strings.Trim(attr[len("href="):], `"'`))
+		default:
+			return "", nil, fmt.Errorf("unsupported tag <%s>", t.name)
+		}
+		open = append(open, t)
+	}
+	if len(open) > 0 {
+		return "", nil, fmt.Errorf("unclosed tag <%s>", open[len(open)-1].name)
+	}
+	plain, entities := b.result()
+	return plain, entities, nil
+}
@@ -0,0 +1,93 @@
+package mtproto
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// entityString describes an entity as its kind, offset and length
+func entityString(e *TypeMessageEntity) string {
+	switch x := e.GetValue().(type) {
+	case *TypeMessageEntity_MessageEntityBold:
+		return fmt.Sprintf("bold %d %d", x.MessageEntityBold.Offset, x.MessageEntityBold.Length)
+	case *TypeMessageEntity_MessageEntityItalic:
+		return fmt.Sprintf("italic %d %d", x.MessageEntityItalic.Offset, x.MessageEntityItalic.Length)
+	case *TypeMessageEntity_MessageEntityCode:
+		return fmt.Sprintf("code %d %d", x.MessageEntityCode.Offset, x.MessageEntityCode.Length)
+	case *TypeMessageEntity_MessageEntityPre:
+		return fmt.Sprintf("pre %d %d", x.MessageEntityPre.Offset, x.MessageEntityPre.Length)
+	case *TypeMessageEntity_MessageEntityTextUrl:
+		return fmt.Sprintf("url %d %d %s", x.MessageEntityTextUrl.Offset, x.MessageEntityTextUrl.Length, x.MessageEntityTextUrl.Url)
+	}
+	return fmt.Sprintf("%T", e.GetValue())
+}
+
+func entityStrings(entities []*TypeMessageEntity) string {
+	var s []string
+	for _, e := range entities {
+		s = append(s, entityString(e))
+	}
+	return strings.Join(s, ", ")
+}
+
+func TestParseMarkdown(t *testing.T) {
+	for _, test := range []struct {
+		markdown, plain, entities string
+	}{
+		{"plain", "plain", ""},
+		// é and ö are 2 bytes, but a UTF-16 unit each
+		{"héllo *wörld*", "héllo wörld", "bold 6 5"},
+		// 😀 is 4 bytes, and 2 UTF-16 units
+		{"😀 _hi_ `x`", "😀 hi x", "italic 3 2, code 6 1"},
+		{"你好 [世界](https://telegram.org)", "你好 世界", "url 3 2 https://telegram.org"},
+		{"```go\n😀```!", "go\n😀!", "pre 0 5"},
+		{`\*not bold\* *unclosed`, "*not bold* *unclosed", ""},
+		{"**", "", ""},
+	} {
+		plain, entities := ParseMarkdown(test.markdown)
+		if plain != test.plain || entityStrings(entities) != test.entities {
+			t.Errorf("%q: %q [%s], expected %q [%s]", test.markdown, plain, entityStrings(entities), test.plain, test.entities)
+		}
+	}
+}
+
+func TestParseHTML(t *testing.T) {
+	for _, test := range []struct {
+		html, plain, entities string
+	}{
+		{"a &lt;b&gt;", "a <b>", ""},
+		// the inner italic closes first, but comes after the bold
+		{"<b>😀 <i>a&amp;b</i></b>", "😀 a&b", "bold 0 6, italic 3 3"},
+		{`<a href="https://t.me/?a=1&amp;b=2">日本</a> <code>x</code>`, "日本 x", "url 0 2 https://t.me/?a=1&b=2, code 3 1"},
+		{"<strong>é</strong><em>𝄞</em><pre>p</pre>", "é𝄞p", "bold 0 1, italic 1 2, pre 3 1"},
+	} {
+		plain, entities, err := ParseHTML(test.html)
+		if err != nil {
+			t.Errorf("%q: %v", test.html, err)
+			continue
+		}
+		if plain != test.plain || entityStrings(entities) != test.entities {
+			t.Errorf("%q: %q [%s], expected %q [%s]", test.html, plain, entityStrings(entities), test.plain, test.entities)
+		}
+	}
+
+	for _, malformed := range []string{"<b>x", "<b>x</i>", "<u>x</u>", "<a>x</a>", "x <b"} {
+		if _, _, err := ParseHTML(malformed); err == nil {
+			t.Errorf("%q is parsed", malformed)
+		}
+	}
+}
+
+func TestSendMessageEntities(t *testing.T) {
+	rpc := &recordRPC{resp: &PredUpdateShortSentMessage{Id: 10}}
+	peer := &TypeInputPeer{&TypeInputPeer_InputPeerSelf{&PredInputPeerSelf{}}}
+	plain, entities := ParseMarkdown("*hi*")
+	if _, err := sendMessage(rpc, peer, plain, WithEntities(entities)); err != nil {
+		t.Fatal(err)
+	}
+	req := rpc.reqs[0].(*ReqMessagesSendMessage)
+	if req.Flags&(1<<3) == 0 || req.Message != "hi" || entityStrings(req.Entities) != "bold 0 2" {
+		t.Errorf("unexpected request %v", req)
+	}
+}
@@ -0,0 +1,363 @@
+package mtproto
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// RPCError is an error returned by Telegram.
+// The well-known ones come in their own types, FloodWaitError and MigrateError, which unwrap to RPCError.
+// See https://core.telegram.org/api/errors
+type RPCError struct {
+	Code    int
+	Message string
+}
+
+func (e RPCError) Error() string {
+	switch e.Code {
+	case errorSeeOther, errorBadRequest, errorUnauthorized, errorForbidden, errorNotFound, errorFlood, errorInternal:
+		return fmt.Sprintf("mtproto RPC error: %d %s", e.Code, e.Message)
+	default:
+		return fmt.Sprintf("mtproto unknown RPC error: %d %s", e.Code, e.Message)
+	}
+}
+
+// FloodWaitError is the 420 FLOOD_WAIT_X error, which requires to wait for Seconds before the next call.
+type FloodWaitError struct {
+	Seconds int
+}
+
+func (e FloodWaitError) Error() string {
+	return e.Unwrap().Error()
+}
+
+func (e FloodWaitError) Unwrap() error {
+	return RPCError{errorFlood, fmt.Sprintf("FLOOD_WAIT_%d", e.Seconds)}
+}
+
+func (e FloodWaitError) Duration() time.Duration {
+	return time.Duration(e.Seconds) * time.Second
+}
+
+// MigrateError is the 303 X_MIGRATE_DC error, which requires to repeat the query to the DC.
+// Kind is one of PHONE, NETWORK, USER, and FILE.
+type MigrateError struct {
+	Kind string
+	DC   int
+}
+
+func (e MigrateError) Error() string {
+	return e.Unwrap().Error()
+}
+
+func (e MigrateError) Unwrap() error {
+	return RPCError{errorSeeOther, fmt.Sprintf("%s_MIGRATE_%d", e.Kind, e.DC)}
+}
+
+// PasswordNeededError is the 401 SESSION_PASSWORD_NEEDED error of SignIn.
+// The account is protected by a cloud password, so sign in with AuthCheckPassword.
+type PasswordNeededError struct{}
+
+func (e PasswordNeededError) Error() string {
+	return e.Unwrap().Error()
+}
+
+func (e PasswordNeededError) Unwrap() error {
+	return RPCError{errorUnauthorized, "SESSION_PASSWORD_NEEDED"}
+}
+
+// SignUpRequiredError is the 400 PHONE_NUMBER_UNOCCUPIED error of SignIn.
+// The phone number has no account, so sign up with AuthSignUp after accepting AuthTermsOfService.
+type SignUpRequiredError struct{}
+
+func (e SignUpRequiredError) Error() string {
+	return e.Unwrap().Error()
+}
+
+func (e SignUpRequiredError) Unwrap() error {
+	return RPCError{errorBadRequest, "PHONE_NUMBER_UNOCCUPIED"}
+}
+
+// SendCodeUnavailableError is the 400 SEND_CODE_UNAVAILABLE error of AuthResendCode.
+// All the ways of the code delivery are used, so the code cannot be sent again.
+type SendCodeUnavailableError struct{}
+
+func (e SendCodeUnavailableError) Error() string {
+	return e.Unwrap().Error()
+}
+
+func (e SendCodeUnavailableError) Unwrap() error {
+	return RPCError{errorBadRequest, "SEND_CODE_UNAVAILABLE"}
+}
+
+// UsernameNotOccupiedError is the 400 USERNAME_NOT_OCCUPIED error of ContactsResolveUsername.
+// No user or channel has the username.
+type UsernameNotOccupiedError struct{}
+
+func (e UsernameNotOccupiedError) Error() string {
+	return e.Unwrap().Error()
+}
+
+func (e UsernameNotOccupiedError) Unwrap() error {
+	return RPCError{errorBadRequest, "USERNAME_NOT_OCCUPIED"}
+}
+
+// UsernameOccupiedError is the 400 USERNAME_OCCUPIED error of AccountUpdateUsername.
+// Another user or channel has the username.
+type UsernameOccupiedError struct{}
+
+func (e UsernameOccupiedError) Error() string {
+	return e.Unwrap().Error()
+}
+
+func (e UsernameOccupiedError) Unwrap() error {
+	return RPCError{errorBadRequest, "USERNAME_OCCUPIED"}
+}
+
+// UsernameInvalidError is the 400 USERNAME_INVALID error of AccountUpdateUsername.
+// A username is 5 to 32 characters of a-z, 0-9 and underscores, starting with a letter.
+type UsernameInvalidError struct{}
+
+func (e UsernameInvalidError) Error() string {
+	return e.Unwrap().Error()
+}
+
+func (e UsernameInvalidError) Unwrap() error {
+	return RPCError{errorBadRequest, "USERNAME_INVALID"}
+}
+
+// ChatAdminRequiredError is the 400 CHAT_ADMIN_REQUIRED error of the RPCs which only the admins of the chat may call,
+// e.g., MessagesUpdatePinnedMessage.
+type ChatAdminRequiredError struct{}
+
+func (e ChatAdminRequiredError) Error() string {
+	return e.Unwrap().Error()
+}
+
+func (e ChatAdminRequiredError) Unwrap() error {
+	return RPCError{errorBadRequest, "CHAT_ADMIN_REQUIRED"}
+}
+
+// UsersTooFewError is the 400 USERS_TOO_FEW error of MessagesCreateChat.
+// A basic group needs another member than the creator.
+type UsersTooFewError struct{}
+
+func (e UsersTooFewError) Error() string {
+	return e.Unwrap().Error()
+}
+
+func (e UsersTooFewError) Unwrap() error {
+	return RPCError{errorBadRequest, "USERS_TOO_FEW"}
+}
+
+// AuthKeyUnregisteredError is the 401 AUTH_KEY_UNREGISTERED error of a key revoked by the server,
+// e.g., as the account logged out the session from another device.
+// The key file is removed and SessionRevoked is notified, so the account needs a fresh sign-in.
+type AuthKeyUnregisteredError struct{}
+
+func (e AuthKeyUnregisteredError) Error() string {
+	return e.Unwrap().Error()
+}
+
+func (e AuthKeyUnregisteredError) Unwrap() error {
+	return RPCError{errorUnauthorized, "AUTH_KEY_UNREGISTERED"}
+}
+
+// ChannelPrivateError is the 400 CHANNEL_PRIVATE error of the channel not accessible,
+// e.g., as the account is not a participant of the private channel or is banned from it.
+type ChannelPrivateError struct{}
+
+func (e ChannelPrivateError) Error() string {
+	return e.Unwrap().Error()
+}
+
+func (e ChannelPrivateError) Unwrap() error {
+	return RPCError{errorBadRequest, "CHANNEL_PRIVATE"}
+}
+
+// AccessTokenInvalidError is the 400 ACCESS_TOKEN_INVALID error of NewBotAuthentication.
+// The bot token is revoked or mistyped.
+type AccessTokenInvalidError struct{}
+
+func (e AccessTokenInvalidError) Error() string {
+	return e.Unwrap().Error()
+}
+
+func (e AccessTokenInvalidError) Unwrap() error {
+	return RPCError{errorBadRequest, "ACCESS_TOKEN_INVALID"}
+}
+
+// MessageNotModifiedError is the 400 MESSAGE_NOT_MODIFIED error of MessagesEditMessage.
+// The edit is the same as the message.
+type MessageNotModifiedError struct{}
+
+func (e MessageNotModifiedError) Error() string {
+	return e.Unwrap().Error()
+}
+
+func (e MessageNotModifiedError) Unwrap() error {
+	return RPCError{errorBadRequest, "MESSAGE_NOT_MODIFIED"}
+}
+
+// MessageEditTimeExpiredError is the 400 MESSAGE_EDIT_TIME_EXPIRED error of MessagesEditMessage.
+// The message is too old to edit.
+type MessageEditTimeExpiredError struct{}
+
+func (e MessageEditTimeExpiredError) Error() string {
+	return e.Unwrap().Error()
+}
+
+func (e MessageEditTimeExpiredError) Unwrap() error {
+	return RPCError{errorBadRequest, "MESSAGE_EDIT_TIME_EXPIRED"}
+}
+
+// TimeoutError is returned when no reply of an RPC arrives in Timeout.
+// The reply arriving later is discarded.
+type TimeoutError struct {
+	Timeout time.Duration
+}
+
+func (e TimeoutError) Error() string {
+	return fmt.Sprintf("RPC Timeout(%f s)", e.Timeout.Seconds())
+}
+
+// DialTimeoutError is returned when the connection to the server at Addr is not established in Timeout,
+// Configuration.DialTimeout. Unlike TimeoutError, no RPC has been sent.
+type DialTimeoutError struct {
+	Addr    string
+	Timeout time.Duration
+}
+
+func (e DialTimeoutError) Error() string {
+	return fmt.Sprintf("Dial %s Timeout(%f s)", e.Addr, e.Timeout.Seconds())
+}
+
+// ErrLoggedOut is returned by AuthLogOut on a connection logged out already.
+var ErrLoggedOut = errors.New("mtproto: already logged out")
+
+// ErrConnClosed is returned by Conn.Close on a connection closed already, and by the RPCs of a closed connection.
+var ErrConnClosed = errors.New("mtproto: connection closed")
+
+// ErrNoSession is returned by Conn.Session, and so by the RPCs, if no session is bound to the connection
+// in the binding timeout.
+var ErrNoSession = errors.New("mtproto: no session")
+
+// ErrNoPhoto is returned by DownloadProfilePhoto for a peer without a profile photo.
+var ErrNoPhoto = errors.New("mtproto: no profile photo")
+
+// toError converts an RPC error from the server into its typed error
+func toError(rpcError TL_rpc_error) error {
+	code := int(rpcError.error_code)
+	msg := rpcError.error_message
+	switch code {
+	case errorFlood:
+		var seconds int
+		if n, _ := fmt.Sscanf(msg, "FLOOD_WAIT_%d", &seconds); n == 1 {
+			return FloodWaitError{seconds}
+		}
+	case errorUnauthorized:
+		switch msg {
+		case "SESSION_PASSWORD_NEEDED":
+			return PasswordNeededError{}
+		case "AUTH_KEY_UNREGISTERED":
+			return AuthKeyUnregisteredError{}
+		}
+	case errorBadRequest:
+		switch msg {
+		case "SEND_CODE_UNAVAILABLE":
+			return SendCodeUnavailableError{}
+		case "PHONE_NUMBER_UNOCCUPIED":
+			return SignUpRequiredError{}
+		case "MESSAGE_NOT_MODIFIED":
+			return MessageNotModifiedError{}
+		case "MESSAGE_EDIT_TIME_EXPIRED":
+			return MessageEditTimeExpiredError{}
+		case "USERNAME_NOT_OCCUPIED":
+			return UsernameNotOccupiedError{}
+		case "USERNAME_OCCUPIED":
+			return UsernameOccupiedError{}
+		case "USERNAME_INVALID":
+			return UsernameInvalidError{}
+		case "CHAT_ADMIN_REQUIRED":
+			return ChatAdminRequiredError{}
+		case "USERS_TOO_FEW":
+			return UsersTooFewError{}
+		case "CHANNEL_PRIVATE":
+			return ChannelPrivateError{}
+		case "ACCESS_TOKEN_INVALID":
+			return AccessTokenInvalidError{}
+		}
+	case errorSeeOther:
+		for _, kind := range []string{"PHONE", "NETWORK", "USER", "FILE"} {
+			var dc int
+			if n, _ := fmt.Sscanf(msg, kind+"_MIGRATE_%d", &dc); n == 1 {
+				return MigrateError{kind, dc}
+			}
+		}
+	}
+	return RPCError{code, msg}
+}
+
+// IsRPCError reports whether err is an RPC error with the code
+func IsRPCError(err error, code int) bool {
+	var rpcError RPCError
+	return errors.As(err, &rpcError) && rpcError.Code == code
+}
+
+func IsFloodWait(err error) bool {
+	var floodWait FloodWaitError
+	return errors.As(err, &floodWait)
+}
+
+func IsMigrate(err error) bool {
+	var migrate MigrateError
+	return errors.As(err, &migrate)
+}
+
+func IsBadRequest(err error) bool   { return IsRPCError(err, errorBadRequest) }
+func IsUnauthorized(err error) bool { return IsRPCError(err, errorUnauthorized) }
+func IsForbidden(err error) bool    { return IsRPCError(err, errorForbidden) }
+func IsNotFound(err error) bool     { return IsRPCError(err, errorNotFound) }
+func IsInternal(err error) bool     { return IsRPCError(err, errorInternal) }
+
+// maxMigrations bounds the migrations of an RPC, against the DCs redirecting to each other
+const maxMigrations = 2
+
+// retryOnMigrate invokes the RPC again after migrating to the DC, which a MigrateError requires.
+// FILE_MIGRATE is not retried, because a file is downloaded from a media session to its DC.
+func retryOnMigrate(invoke func() (interface{}, error), migrate func(dc int) error) (interface{}, error) {
+	for i := 0; ; i++ {
+		data, err := invoke()
+		m, ok := err.(MigrateError)
+		if !ok || m.Kind == "FILE" || i >= maxMigrations {
+			return data, err
+		}
+		if err := migrate(m.DC); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// retryOnFloodWait invokes the RPC again after the flood wait, if the configuration allows it.
+// The wait is cut short by the cancellation of ctx.
+func retryOnFloodWait(ctx context.Context, appConfig Configuration, invoke func() (interface{}, error)) (interface{}, error) {
+	maxWait := appConfig.MaxFloodWait
+	if maxWait == 0 {
+		maxWait = defaultMaxFloodWait
+	}
+	for {
+		data, err := invoke()
+		floodWait, ok := err.(FloodWaitError)
+		if !ok || !appConfig.AutoFloodWait || floodWait.Duration() > maxWait {
+			return data, err
+		}
+		select {
+		case <-time.After(floodWait.Duration()):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package mtproto
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestFloodWaitError(t *testing.T) {
+	err := toError(TL_rpc_error{errorFlood, "FLOOD_WAIT_30"})
+	floodWait, ok := err.(FloodWaitError)
+	if !ok {
+		t.Fatalf("%T: %v, expected FloodWaitError", err, err)
+	}
+	if floodWait.Seconds != 30 || floodWait.Duration() != 30*time.Second {
+		t.Fatalf("wrong flood wait: %v", floodWait)
+	}
+}
+
+func TestRetryOnFloodWait(t *testing.T) {
+	config := Configuration{AutoFloodWait: true}
+	calls := 0
+	data, err := retryOnFloodWait(context.Background(), config, func() (interface{}, error) {
+		calls++
+		if calls == 1 {
+			return nil, toError(TL_rpc_error{errorFlood, "FLOOD_WAIT_0"})
+		}
+		return &PredBoolTrue{}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := data.(*PredBoolTrue); !ok {
+		t.Fatalf("unexpected return: %T", data)
+	}
+	if calls != 2 {
+		t.Fatalf("%d calls, expected a single retry", calls)
+	}
+}
+
+func TestNoRetryOnFloodWait(t *testing.T) {
+	for _, config := range []Configuration{
+		{AutoFloodWait: false},
+		{AutoFloodWait: true, MaxFloodWait: time.Second},
+	} {
+		calls := 0
+		_, err := retryOnFloodWait(context.Background(), config, func() (interface{}, error) {
+			calls++
+			return nil, toError(TL_rpc_error{errorFlood, "FLOOD_WAIT_60"})
+		})
+		if _, ok := err.(FloodWaitError); !ok || calls != 1 {
+			t.Fatalf("%+v: %d calls, err %v", config, calls, err)
+		}
+	}
+}
+
+func TestRPCErrorHierarchy(t *testing.T) {
+	err := toError(TL_rpc_error{errorSeeOther, "PHONE_MIGRATE_4"})
+	migrate, ok := err.(MigrateError)
+	if !ok || migrate.Kind != "PHONE" || migrate.DC != 4 {
+		t.Fatalf("%T: %v, expected PHONE_MIGRATE_4", err, err)
+	}
+	if !IsMigrate(err) || !IsRPCError(err, errorSeeOther) {
+		t.Fatalf("%v is not a 303 migrate error", err)
+	}
+
+	err = toError(TL_rpc_error{errorUnauthorized, "AUTH_KEY_UNREGISTERED"})
+	var rpcError RPCError
+	if !errors.As(err, &rpcError) || rpcError.Code != errorUnauthorized || rpcError.Message != "AUTH_KEY_UNREGISTERED" {
+		t.Fatalf("%T: %v, expected 401 AUTH_KEY_UNREGISTERED", err, err)
+	}
+	if !IsUnauthorized(err) || IsFloodWait(err) || IsMigrate(err) {
+		t.Fatalf("%v is misclassified", err)
+	}
+
+	if err := toError(TL_rpc_error{errorFlood, "FLOOD_WAIT_3"}); !IsFloodWait(err) || !IsRPCError(err, errorFlood) {
+		t.Fatalf("%v is not a flood wait", err)
+	}
+}
+
+func TestRetryOnMigrate(t *testing.T) {
+	var calls int
+	var migrated []int
+	data, err := retryOnMigrate(func() (interface{}, error) {
+		calls++
+		if calls == 1 {
+			return nil, toError(TL_rpc_error{errorSeeOther, "PHONE_MIGRATE_2"})
+		}
+		return &PredBoolTrue{}, nil
+	}, func(dc int) error {
+		migrated = append(migrated, dc)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := data.(*PredBoolTrue); !ok {
+		t.Fatalf("unexpected return: %T", data)
+	}
+	if len(migrated) != 1 || migrated[0] != 2 || calls != 2 {
+		t.Fatalf("migrated to %v in %d calls, expected DC 2 in 2 calls", migrated, calls)
+	}
+
+	// a file is not migrated
+	_, err = retryOnMigrate(func() (interface{}, error) {
+		return nil, MigrateError{"FILE", 4}
+	}, func(dc int) error {
+		t.Errorf("migrated to DC %d for a file", dc)
+		return nil
+	})
+	if !IsMigrate(err) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestEditErrors(t *testing.T) {
+	if _, ok := toError(TL_rpc_error{400, "MESSAGE_NOT_MODIFIED"}).(MessageNotModifiedError); !ok {
+		t.Errorf("MESSAGE_NOT_MODIFIED is not typed")
+	}
+	err := toError(TL_rpc_error{400, "MESSAGE_EDIT_TIME_EXPIRED"})
+	if _, ok := err.(MessageEditTimeExpiredError); !ok || !IsRPCError(err, 400) {
+		t.Errorf("unexpected error %#v", err)
+	}
+}
@@ -0,0 +1,273 @@
+package mtproto
+
+import (
+	"encoding/hex"
+	"fmt"
+	"github.com/cjongseok/slog"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Logger receives the log messages of the package.
+// prefix is the source of a message, such as "[mconn 1234]", and structured loggers can keep it as a field.
+type Logger interface {
+	Debugf(prefix, format string, args ...interface{})
+	Infof(prefix, format string, args ...interface{})
+	Errorf(prefix, format string, args ...interface{})
+}
+
+type LogLevel int32
+
+const (
+	LogLevelDebug LogLevel = iota
+	LogLevelInfo
+	LogLevelError
+	LogLevelOff
+)
+
+// slogLogger is the default Logger, which writes to slog
+type slogLogger struct {
+	level int32
+}
+
+var defaultLogger = &slogLogger{int32(LogLevelDebug)}
+
+func (l *slogLogger) enabled(level LogLevel) bool {
+	return LogLevel(atomic.LoadInt32(&l.level)) <= level
+}
+
+func (l *slogLogger) Debugf(prefix, format string, args ...interface{}) {
+	if l.enabled(LogLevelDebug) {
+		slog.Logln(prefix, fmt.Sprintf(format, args...))
+	}
+}
+
+func (l *slogLogger) Infof(prefix, format string, args ...interface{}) {
+	if l.enabled(LogLevelInfo) {
+		slog.Logln(prefix, fmt.Sprintf(format, args...))
+	}
+}
+
+func (l *slogLogger) Errorf(prefix, format string, args ...interface{}) {
+	if l.enabled(LogLevelError) {
+		slog.Logln(prefix, fmt.Sprintf(format, args...))
+	}
+}
+
+// SetLogLevel filters the messages of the default logger
+func SetLogLevel(level LogLevel) {
+	atomic.StoreInt32(&defaultLogger.level, int32(level))
+}
+
+func EnableLogging() {
+	SetLogLevel(LogLevelDebug)
+}
+
+func DisableLogging() {
+	SetLogLevel(LogLevelOff)
+}
+
+// A log source is either a prefix string or an object with LogPrefix().
+// The object can have its own logger by logger().
+func logSource(src interface{}) (Logger, string) {
+	var logger Logger = defaultLogger
+	if x, ok := src.(interface{ logger() Logger }); ok && x.logger() != nil {
+		logger = x.logger()
+	}
+	switch x := src.(type) {
+	case interface{ LogPrefix() string }:
+		return logger, x.LogPrefix()
+	case string:
+		return logger, x
+	}
+	return logger, fmt.Sprint(src)
+}
+
+func logf(src interface{}, format string, args ...interface{}) {
+	logger, prefix := logSource(src)
+	logger.Debugf(prefix, strings.TrimSuffix(format, "\n"), args...)
+}
+
+func logln(src interface{}, args ...interface{}) {
+	logger, prefix := logSource(src)
+	logger.Debugf(prefix, "%s", strings.TrimSuffix(fmt.Sprintln(args...), "\n"))
+}
+
+func infof(src interface{}, format string, args ...interface{}) {
+	logger, prefix := logSource(src)
+	logger.Infof(prefix, strings.TrimSuffix(format, "\n"), args...)
+}
+
+func errorf(src interface{}, format string, args ...interface{}) {
+	logger, prefix := logSource(src)
+	logger.Errorf(prefix, strings.TrimSuffix(format, "\n"), args...)
+}
+
+const (
+	// maxStringifyLen caps the output of Stringify
+	maxStringifyLen = 4096
+	// maxStringifyBytes is the length of a byte slice over which Stringify shows its length and prefix
+	maxStringifyBytes = 32
+	// maxStringifyDepth stops Stringify in the objects nested deeper
+	maxStringifyDepth = 16
+)
+
+// the byte slices and the strings of the fields of these names, in lower case, are redacted by Stringify,
+// e.g., the bot tokens, and the phone codes and their hashes
+var secretFieldNames = []string{"authkey", "password", "secret", "token", "code"}
+
+// the fields of these types are redacted by Stringify as well, for their names are not of secrets,
+// e.g., the authorizations exported to the other DCs
+var secretTypeFields = map[string]string{
+	"ReqAuthImportAuthorization":    "Bytes",
+	"PredAuthExportedAuthorization": "Bytes",
+}
+
+// Stringify formats a TL object for the logs, in the JSON form with the unexported fields.
+// The auth keys, the passwords, the secrets, the tokens and the codes are redacted, the long byte slices are shown by their length
+// and prefix, and the output is cut at 4096 bytes. It keeps no state, so it is safe to call concurrently.
+func Stringify(v interface{}) string {
+	var b strings.Builder
+	stringifyValue(&b, reflect.ValueOf(v), false, 0)
+	if b.Len() > maxStringifyLen {
+		return b.String()[:maxStringifyLen] + fmt.Sprintf("...(%d bytes)", b.Len())
+	}
+	return b.String()
+}
+
+// stringified is the Stringify of v formatted by %s, which is not made if the log is filtered
+type stringified struct {
+	v interface{}
+}
+
+func (s stringified) String() string {
+	return Stringify(s.v)
+}
+
+func isSecretField(t reflect.Type, name string) bool {
+	if secretTypeFields[t.Name()] == name {
+		return true
+	}
+	name = strings.ToLower(name)
+	for _, secret := range secretFieldNames {
+		if strings.Contains(name, secret) {
+			return true
+		}
+	}
+	return false
+}
+
+func stringifyValue(b *strings.Builder, v reflect.Value, secret bool, depth int) {
+	if b.Len() > maxStringifyLen {
+		return
+	}
+	if !v.IsValid() {
+		b.WriteString("null")
+		return
+	}
+	if depth > maxStringifyDepth {
+		fmt.Fprintf(b, "%q", v.Type().String())
+		return
+	}
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			b.WriteString("null")
+			return
+		}
+		stringifyValue(b, v.Elem(), secret, depth+1)
+	case reflect.Struct:
+		// the unexported fields are of the service messages, TL_*, but not of the sessions and the connections,
+		// whose maps are not to be read concurrently
+		t := v.Type()
+		unexported := strings.HasPrefix(t.Name(), "TL_")
+		b.WriteString("{")
+		first := true
+		for i := 0; i < v.NumField(); i++ {
+			if t.Field(i).PkgPath != "" && !unexported {
+				continue
+			}
+			if !first {
+				b.WriteString(",")
+			}
+			first = false
+			b.WriteString(strconv.Quote(t.Field(i).Name))
+			b.WriteString(":")
+			stringifyValue(b, v.Field(i), isSecretField(t, t.Field(i).Name), depth+1)
+		}
+		b.WriteString("}")
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			stringifyBytes(b, v, secret)
+			return
+		}
+		b.WriteString("[")
+		for i := 0; i < v.Len() && b.Len() <= maxStringifyLen; i++ {
+			if i > 0 {
+				b.WriteString(",")
+			}
+			stringifyValue(b, v.Index(i), secret, depth+1)
+		}
+		b.WriteString("]")
+	case reflect.Map:
+		b.WriteString("{")
+		for i, key := range v.MapKeys() {
+			if i > 0 {
+				b.WriteString(",")
+			}
+			b.WriteString(strconv.Quote(fmt.Sprint(stringifyScalar(key))))
+			b.WriteString(":")
+			stringifyValue(b, v.MapIndex(key), secret, depth+1)
+		}
+		b.WriteString("}")
+	case reflect.String:
+		if secret {
+			fmt.Fprintf(b, "\"[redacted %d bytes]\"", v.Len())
+			return
+		}
+		b.WriteString(strconv.Quote(v.String()))
+	case reflect.Chan, reflect.Func, reflect.UnsafePointer:
+		fmt.Fprintf(b, "%q", v.Type().String())
+	default:
+		fmt.Fprint(b, stringifyScalar(v))
+	}
+}
+
+// stringifyScalar returns the number or the bool of v, which may be an unexported field
+func stringifyScalar(v reflect.Value) interface{} {
+	switch v.Kind() {
+	case reflect.Bool:
+		return v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint()
+	case reflect.Float32, reflect.Float64:
+		return v.Float()
+	case reflect.String:
+		return v.String()
+	}
+	return v.Type().String()
+}
+
+func stringifyBytes(b *strings.Builder, v reflect.Value, secret bool) {
+	if secret {
+		fmt.Fprintf(b, "\"[redacted %d bytes]\"", v.Len())
+		return
+	}
+	n := v.Len()
+	if n > maxStringifyBytes {
+		n = maxStringifyBytes / 2
+	}
+	prefix := make([]byte, n)
+	for i := range prefix {
+		prefix[i] = byte(v.Index(i).Uint())
+	}
+	if n < v.Len() {
+		fmt.Fprintf(b, "\"[%d bytes] %s...\"", v.Len(), hex.EncodeToString(prefix))
+		return
+	}
+	fmt.Fprintf(b, "%q", hex.EncodeToString(prefix))
+}
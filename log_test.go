@@ -0,0 +1,95 @@
+package mtproto
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+type recordLogger struct {
+	lines []string
+}
+
+func (l *recordLogger) Debugf(prefix, format string, args ...interface{}) {
+	l.lines = append(l.lines, "D "+prefix+" "+fmt.Sprintf(format, args...))
+}
+
+func (l *recordLogger) Infof(prefix, format string, args ...interface{}) {
+	l.lines = append(l.lines, "I "+prefix+" "+fmt.Sprintf(format, args...))
+}
+
+func (l *recordLogger) Errorf(prefix, format string, args ...interface{}) {
+	l.lines = append(l.lines, "E "+prefix+" "+fmt.Sprintf(format, args...))
+}
+
+func TestConfiguredLogger(t *testing.T) {
+	rec := &recordLogger{}
+	mconn := &Conn{connId: 7, appLogger: rec}
+	logln(mconn, "hello", 1)
+	logf(mconn, "value %d\n", 2)
+	errorf(mconn, "failure: %v", "boom")
+
+	expected := []string{
+		"D " + mconn.LogPrefix() + " hello 1",
+		"D " + mconn.LogPrefix() + " value 2",
+		"E " + mconn.LogPrefix() + " failure: boom",
+	}
+	if fmt.Sprint(rec.lines) != fmt.Sprint(expected) {
+		t.Errorf("expected %q, but %q", expected, rec.lines)
+	}
+}
+
+func TestStringify(t *testing.T) {
+	key := bytes.Repeat([]byte{0xab}, 256)
+	s := Stringify(struct {
+		AuthKey []byte
+		DC      int32
+	}{key, 2})
+	if s != `{"AuthKey":"[redacted 256 bytes]","DC":2}` {
+		t.Errorf("unexpected %s", s)
+	}
+
+	s = Stringify(&ReqAuthCheckPassword{PasswordHash: []byte{1, 2, 3}})
+	if strings.Contains(s, "010203") || !strings.Contains(s, "redacted") {
+		t.Errorf("the password hash is not redacted: %s", s)
+	}
+
+	// the strings are redacted as well
+	s = Stringify(&ReqAuthSignIn{PhoneNumber: "+821012345678", PhoneCodeHash: "abcdef", PhoneCode: "12345"})
+	if strings.Contains(s, "abcdef") || strings.Contains(s, "12345\"") || !strings.Contains(s, "+821012345678") {
+		t.Errorf("the phone code is not redacted: %s", s)
+	}
+	s = Stringify(&ReqAuthImportBotAuthorization{ApiId: 1, BotAuthToken: "123:secret"})
+	if strings.Contains(s, "123:secret") {
+		t.Errorf("the bot token is not redacted: %s", s)
+	}
+
+	// the exported authorizations are redacted by their types, but the other bytes are not
+	for _, x := range []interface{}{&ReqAuthImportAuthorization{Id: 1, Bytes: []byte{1, 2, 3}}, &PredAuthExportedAuthorization{Id: 1, Bytes: []byte{1, 2, 3}}} {
+		if s = Stringify(x); s != `{"Id":1,"Bytes":"[redacted 3 bytes]"}` {
+			t.Errorf("the authorization is not redacted: %s", s)
+		}
+	}
+	if s = Stringify(&PredUploadFile{Bytes: []byte{1, 2, 3}}); !strings.Contains(s, `"Bytes":"010203"`) {
+		t.Errorf("unexpected %s", s)
+	}
+
+	// a long byte slice is shown by its length and prefix
+	s = Stringify(&PredUploadFile{Bytes: key})
+	if !strings.Contains(s, `"[256 bytes] abababababababababababababababab..."`) || len(s) > 100 {
+		t.Errorf("unexpected %s", s)
+	}
+
+	// the unexported fields of the service messages are shown
+	s = Stringify(TL_bad_server_salt{bad_msg_id: 5, bad_msg_seqno: 1, error_code: 48, new_server_salt: []byte{4}})
+	if s != `{"bad_msg_id":5,"bad_msg_seqno":1,"error_code":48,"new_server_salt":"04"}` {
+		t.Errorf("unexpected %s", s)
+	}
+
+	// the output is capped
+	ids := make([]int64, 4000)
+	if s = Stringify(TL_msgs_ack{ids}); len(s) > maxStringifyLen+32 || !strings.HasSuffix(s, "bytes)") {
+		t.Errorf("the output of %d bytes is not capped", len(s))
+	}
+}
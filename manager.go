@@ -2,10 +2,14 @@ package mtproto
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"github.com/cjongseok/slog"
-	"math/rand"
+	"golang.org/x/net/context"
+	"os"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -19,6 +23,10 @@ const (
 
 var (
 	__debug = 0
+
+	// ErrNeedsAuth means there is no usable MTProto key for the account,
+	// and the caller has to sign in through NewAuthentication.
+	ErrNeedsAuth = errors.New("mtproto: authentication needed")
 )
 
 type Manager struct {
@@ -28,13 +36,36 @@ type Manager struct {
 	sessions      map[int64]*Session
 	stuckSessions map[int64]int32
 	eventq        chan Event
+
+	// connMutex guards conns, which the event handlers register and deregister concurrently.
+	connMutex sync.RWMutex
+
+	// sessionCond wakes up the refreshSession handlers waiting for session binding.
+	// It guards sessions, stuckSessions, boundSessions,
+	// and unboundDiscards.
+	sessionMutex    sync.Mutex
+	sessionCond     *sync.Cond
+	boundSessions   map[int64]int32     // session id -> conn id
+	unboundDiscards map[int64]time.Time // sessions discarded before binding -> when
 	//refreshSessionThrottle map[int64]int
 	//queueSend chan packetToSend
 
 	manageInterrupter chan struct{}
 	manageWaitGroup   sync.WaitGroup
+
+	// updates are delivered to the handlers one by one, in the received order
+	updateq        chan Update
+	handlerMutex   sync.RWMutex
+	updateHandlers []UpdateHandler
+
+	// the channels of Subscribe
+	subscriberMutex sync.Mutex
+	subscribers     []chan Event
 }
 
+// UpdateHandler handles the updates from Telegram.
+type UpdateHandler func(update Update)
+
 func NewManager(appConfig Configuration) (*Manager, error) {
 	var err error
 
@@ -44,28 +75,56 @@ func NewManager(appConfig Configuration) (*Manager, error) {
 	}
 
 	mm := new(Manager)
-	rand.Seed(time.Now().UnixNano())
-	mm.managerId = rand.Int31()
+	mm.managerId = randInt31(appConfig.randSource())
+	appConfig.dcs = newDCConfig()
 	mm.appConfig = appConfig
-	//TODO: set proper buf size to channels
 	mm.conns = make(map[int32]*Conn)
 	mm.sessions = make(map[int64]*Session)
 	mm.stuckSessions = make(map[int64]int32)
-	mm.eventq = make(chan Event)
+	mm.sessionCond = sync.NewCond(&mm.sessionMutex)
+	mm.boundSessions = make(map[int64]int32)
+	mm.unboundDiscards = make(map[int64]time.Time)
+	mm.eventq = make(chan Event, appConfig.EventQueueSize)
 	//mm.refreshSessionThrottle = make(map[int64]int)
 	//mm.queueSend = make(chan packetToSend, 64)
 	mm.manageInterrupter = make(chan struct{})
 	mm.manageWaitGroup = sync.WaitGroup{}
+	mm.updateq = make(chan Update, appConfig.EventQueueSize)
 
+	mm.manageWaitGroup.Add(2)
 	go mm.manageRoutine()
+	go mm.dispatchRoutine()
 
 	return mm, nil
 }
 
-func (mm *Manager) Finish() {
+// Finish closes all the connections and stops the manager.
+// It waits up to TIMEOUT_FINISH for the connections to discard their sessions,
+// and returns an error if any of them failed.
+func (mm *Manager) Finish() error {
+	connIds := mm.connIds()
+
 	// close all connections
-	for id, _ := range mm.conns {
-		mm.eventq <- closeConnection{id, nil}
+	resps := make([]chan error, len(connIds))
+	for i, id := range connIds {
+		resps[i] = make(chan error, 1)
+		mm.eventq <- closeConnection{id, resps[i], CloseGraceful}
+	}
+
+	// wait for the close ACKs
+	var errs []string
+	timeout := time.After(TIMEOUT_FINISH)
+wait:
+	for i, resp := range resps {
+		select {
+		case err := <-resp:
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("mconn %d: %v", connIds[i], err))
+			}
+		case <-timeout:
+			errs = append(errs, fmt.Sprintf("timeout(%f s) on closing %d connections", TIMEOUT_FINISH.Seconds(), len(resps)-i))
+			break wait
+		}
 	}
 
 	// Send stop signal to manage routine
@@ -73,6 +132,12 @@ func (mm *Manager) Finish() {
 
 	// Wait for event routines + manage routine
 	mm.manageWaitGroup.Wait()
+	mm.closeSubscribers()
+
+	if len(errs) > 0 {
+		return fmt.Errorf("Finish failure: %s", strings.Join(errs, ", "))
+	}
+	return nil
 }
 
 //func (mm *Manager) IsAuthenticated(phonenumber string) bool {
@@ -84,29 +149,84 @@ func (mm *Manager) Finish() {
 //	return true
 //}
 
+// AuthOptions are the options of an account, e.g., for the accounts of tenants isolated from each other.
+type AuthOptions struct {
+	// KeyPath is the key file of the account, overriding Configuration.KeyPath.
+	// The reconnections of the account keep loading and saving the key there.
+	KeyPath string
+	// PreferredAddr overrides the server address stored with the key, on loading it.
+	PreferredAddr string
+}
+
 func (mm *Manager) LoadAuthentication(phonenumber string) (*Conn, error) {
+	return mm.LoadAuthenticationContext(context.Background(), phonenumber, "")
+}
+
+// LoadAuthenticationWithCatchUp is LoadAuthentication which also returns the updates missed while offline,
+// the differences since the updates state persisted in the key file.
+// Without Configuration.CatchUpOnLoad, the missed updates are propagated on binding and none is returned.
+func (mm *Manager) LoadAuthenticationWithCatchUp(phonenumber string) (*Conn, []Update, error) {
+	mconn, err := mm.LoadAuthenticationContext(context.Background(), phonenumber, "")
+	if err != nil {
+		return mconn, nil, err
+	}
+	if !mm.appConfig.CatchUpOnLoad {
+		return mconn, nil, nil
+	}
+	missed, err := mconn.catchUpPersisted()
+	if err != nil {
+		return mconn, nil, err
+	}
+	return mconn, missed, nil
+}
+
+// LoadAuthenticationContext is LoadAuthentication which gives up on ctx done.
+// Non-empty preferredAddr overrides the server address stored with the key.
+func (mm *Manager) LoadAuthenticationContext(ctx context.Context, phonenumber, preferredAddr string) (*Conn, error) {
+	return mm.LoadAuthenticationWithOptions(ctx, phonenumber, AuthOptions{PreferredAddr: preferredAddr})
+}
+
+// LoadAuthenticationWithOptions is LoadAuthenticationContext of the account with the options.
+func (mm *Manager) LoadAuthenticationWithOptions(ctx context.Context, phonenumber string, opts AuthOptions) (*Conn, error) {
 	// req connect
 	respCh := make(chan sessionResponse, 1)
-	mm.eventq <- loadsession{0, phonenumber, respCh}
+	select {
+	case mm.eventq <- loadsession{0, phonenumber, opts.PreferredAddr, respCh, opts.KeyPath}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
 
 	// Wait for connection built
-	resp := <-respCh
-	if resp.err != nil {
-		return nil, resp.err
+	resp, err := mm.waitSessionResponse(ctx, respCh)
+	if err != nil {
+		return nil, err
 	}
 
-	// Check user authentication by user info
-	mconn := mm.conns[resp.connId]
-	//state, err := mconn.UpdatesGetState()
-	//if err != nil {
-	//	return nil, err
-	//}
+	// the updates state is the baseline of getDifference.
+	// It fails with 401 if the key is not authorized, e.g., by AuthSignIn or after AuthLogOut.
+	mconn := mm.conn(resp.connId)
+	session, err := mconn.Session()
+	if err != nil {
+		mm.closeConnectionAsync(mconn.connId, CloseGraceful)
+		return nil, err
+	}
+	if err := loadUpdatesState(mconn, session); err != nil {
+		mm.closeConnectionAsync(mconn.connId, CloseGraceful)
+		return nil, err
+	}
 
-	// Request full user
+	// Check user authentication by user info
 	inputUser := &TypeInputUser{&TypeInputUser_InputUserSelf{&PredInputUserSelf{}}}
 	var userFull *TypeUserFull
-	x := <-mconn.InvokeNonBlocked(&ReqUsersGetFullUser{inputUser})
+	var x response
+	select {
+	case x = <-mconn.InvokeNonBlocked(&ReqUsersGetFullUser{inputUser}):
+	case <-ctx.Done():
+		mm.closeConnectionAsync(mconn.connId, CloseGraceful)
+		return nil, ctx.Err()
+	}
 	if x.err != nil {
+		mm.closeConnectionAsync(mconn.connId, CloseGraceful)
 		return nil, x.err
 	}
 
@@ -114,484 +234,1059 @@ func (mm *Manager) LoadAuthentication(phonenumber string) (*Conn, error) {
 	case *PredUserFull:
 		userFull = &TypeUserFull{casted}
 	default:
+		mm.closeConnectionAsync(mconn.connId, CloseGraceful)
 		return nil, fmt.Errorf("no full user: %T: %v", x, x)
 	}
 
 	// Already authenticated
 	typeUser := userFull.GetValue().GetUser()
-	session, err := mconn.Session()
-	if err != nil {
-		return mconn, err
-	}
 	if typeUser.GetUser() != nil {
 		user := typeUser.GetUser()
 		session.user = user
-		slog.Logln(mm, "Auth as ", user)
+		infof(mm, "Auth as %v", user)
 	} else if typeUser.GetUserEmpty() != nil {
 		session.user = &PredUser{}
-		slog.Logln(mm, "Authenticated, but failed to get user")
+		logln(mm, "Authenticated, but failed to get user")
 	}
-	return mm.conns[resp.connId], nil
+	return mm.conn(resp.connId), nil
 }
 
 func (mm *Manager) NewAuthentication(phonenumber string, addr string, useIPv6 bool) (*Conn, *TypeAuthSentCode, error) {
+	return mm.NewAuthenticationContext(context.Background(), phonenumber, addr, useIPv6)
+}
+
+// NewAuthenticationContext is NewAuthentication which gives up on ctx done.
+func (mm *Manager) NewAuthenticationContext(ctx context.Context, phonenumber string, addr string, useIPv6 bool) (*Conn, *TypeAuthSentCode, error) {
+	return mm.NewAuthenticationWithOptions(ctx, phonenumber, addr, useIPv6, AuthOptions{})
+}
+
+// NewAuthenticationWithOptions is NewAuthenticationContext of the account with the options.
+// AuthOptions.PreferredAddr does not apply, for addr is the server to authenticate on.
+// If addr is empty and Configuration.AutoSelectDC is set, the account is authenticated on the nearest DC.
+func (mm *Manager) NewAuthenticationWithOptions(ctx context.Context, phonenumber string, addr string, useIPv6 bool, opts AuthOptions) (*Conn, *TypeAuthSentCode, error) {
+	autoSelect := addr == "" && mm.appConfig.AutoSelectDC
+	if autoSelect {
+		addr = bootstrapAddr
+	}
+
 	// req connect
 	respCh := make(chan sessionResponse, 1)
-	mm.eventq <- newsession{0, phonenumber, addr, useIPv6, respCh}
+	select {
+	case mm.eventq <- newsession{0, phonenumber, addr, useIPv6, respCh, nil, opts.KeyPath}:
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	}
 
 	// Wait for connection
-	resp := <-respCh
-	if resp.err != nil {
-		return nil, nil, resp.err
+	resp, err := mm.waitSessionResponse(ctx, respCh)
+	if err != nil {
+		return nil, nil, err
 	}
 
 	// sendAuthCode
-	mconn := mm.conns[resp.connId]
-	for {
+	// The connection is closed on the failures, so that no socket dangles.
+	mconn := mm.conn(resp.connId)
+	if autoSelect {
+		if err := selectNearestDc(ctx, mconn, mconn.migrate); err != nil {
+			mm.closeConnectionAsync(mconn.connId, CloseGraceful)
+			return nil, nil, err
+		}
+	}
+	// the send code request is retried on the DC of the phone number, up to maxMigrations times
+	data, err := retryOnMigrate(func() (interface{}, error) {
 		//sentCode, err := mconn.authSendCode(phonenumber)
 		session, err := mconn.Session()
 		if err != nil {
-			return nil, nil, err
+			return nil, err
 		}
 
 		// request to send code
-		data, err := mconn.InvokeBlocked(&ReqAuthSendCode{
+		var x response
+		select {
+		case x = <-mconn.InvokeNonBlocked(&ReqAuthSendCode{
 			//Allow_flashcall: false,
 			Flags:         0x00000001,
 			PhoneNumber:   phonenumber,
 			CurrentNumber: &TypeBool{&TypeBool_BoolTrue{&PredBoolTrue{}}},
 			ApiId:         session.appConfig.Id,
 			ApiHash:       session.appConfig.Hash,
-		})
-		switch x := data.(type) {
-		case *PredAuthSentCode:
-			return mconn, &TypeAuthSentCode{x}, nil
-			//default:
-			//	return nil, nil, fmt.Errorf("authSendCode: Got: %T", data)
+		}):
+		case <-time.After(session.appConfig.requestTimeout()):
+			x = response{nil, TimeoutError{session.appConfig.requestTimeout()}}
+		case <-ctx.Done():
+			return nil, ctx.Err()
 		}
+		if sentCode, ok := x.data.(*PredAuthSentCode); ok {
+			session.setSentCode(sentCode)
+		}
+		return x.data, x.err
+	}, func(dc int) error {
+		return mconn.migrate(ctx, dc)
+	})
+	if err == nil {
+		if sentCode, ok := data.(*PredAuthSentCode); ok {
+			return mconn, &TypeAuthSentCode{sentCode}, nil
+		}
+		err = fmt.Errorf("RPC: %#v", data)
+	}
+	mm.closeConnectionAsync(mconn.connId, CloseGraceful)
+	return nil, nil, err
+}
+
+// NewBotAuthentication signs in the bot of the token on a new session, and returns the authenticated connection.
+// The account of the bot is its id, the part of the token before the colon, and its key file is BotKeyPath of it,
+// e.g., to load the authentication later by LoadAuthenticationWithOptions with the id and the key file.
+// It returns AccessTokenInvalidError if the token is revoked.
+func (mm *Manager) NewBotAuthentication(token, addr string, useIPv6 bool) (*Conn, error) {
+	return mm.NewBotAuthenticationWithOptions(context.Background(), token, addr, useIPv6, AuthOptions{})
+}
+
+// NewBotAuthenticationWithOptions is NewBotAuthentication which gives up on ctx done, with the options.
+// AuthOptions.KeyPath overrides BotKeyPath, and AuthOptions.PreferredAddr does not apply.
+func (mm *Manager) NewBotAuthenticationWithOptions(ctx context.Context, token, addr string, useIPv6 bool, opts AuthOptions) (*Conn, error) {
+	botId, err := botIdOf(token)
+	if err != nil {
+		return nil, err
+	}
+	keyPath := opts.KeyPath
+	if keyPath == "" {
+		keyPath = mm.BotKeyPath(botId)
+	}
 
-		// retry the send code request to another server
+	// req connect
+	respCh := make(chan sessionResponse, 1)
+	select {
+	case mm.eventq <- newsession{0, botId, addr, useIPv6, respCh, nil, keyPath}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	resp, err := mm.waitSessionResponse(ctx, respCh)
+	if err != nil {
+		return nil, err
+	}
+
+	// the bot is signed in on its DC, and the connection is closed on the failures
+	mconn := mm.conn(resp.connId)
+	data, err := retryOnMigrate(func() (interface{}, error) {
+		session, err := mconn.Session()
 		if err != nil {
-			rpcError, ok := err.(TL_rpc_error)
-			if !ok {
-				return nil, nil, err
-			}
-			if rpcError.error_code != errorSeeOther {
-				return nil, nil, err
-			}
+			return nil, err
+		}
+		return importBotAuthorization(mconn, session, token)
+	}, func(dc int) error {
+		return mconn.migrate(ctx, dc)
+	})
+	if err == nil {
+		_, err = mconn.signedIn(data.(*PredAuthAuthorization))
+	}
+	if err != nil {
+		mm.closeConnectionAsync(mconn.connId, CloseGraceful)
+		return nil, err
+	}
+	return mconn, nil
+}
 
-			var newdc int32
-			n, _ := fmt.Sscanf(rpcError.error_message, "PHONE_MIGRATE_%d", &newdc)
-			if n != 1 {
-				n, _ = fmt.Sscanf(rpcError.error_message, "NETWORK_MIGRATE_%d", &newdc)
-			}
-			if n != 1 {
-				return nil, nil, err
-			} else {
-				// Reconnect to the new datacenter
-				session, err := mconn.Session()
-				if err != nil {
-					return nil, nil, err
-				}
-				respch := make(chan sessionResponse, 1)
-
-				//TODO: Check if renewSession event works with mconn.notify()
-				mconn.notify(renewSession{
-					session.sessionId,
-					phonenumber,
-					session.dclist[newdc],
-					session.useIPv6,
-					respch,
-				})
-
-				// Wait for binding with new session
-				resp := <-respch
-				if resp.err != nil {
-					return nil, nil, resp.err
-				}
+// BotKeyPath is the key file of the bot of the id, Configuration.KeyPath suffixed by the id,
+// so that the key of a bot never overwrites the key of a user. It is empty if Configuration.KeyPath is.
+func (mm *Manager) BotKeyPath(botId string) string {
+	if mm.appConfig.KeyPath == "" {
+		return ""
+	}
+	return mm.appConfig.KeyPath + ".bot" + botId
+}
+
+// Account is a phone number of a manager with its connection, whose methods it has.
+type Account struct {
+	PhoneNumber string
+	*Conn
+}
+
+// User returns the user signed in on the account, or nil if it is not known yet, e.g., while reconnecting.
+func (a *Account) User() *PredUser {
+	if session := a.Conn.boundSession(); session != nil {
+		return session.user
+	}
+	return nil
+}
+
+// LoadAccount is LoadAuthentication returning the account of the phone number.
+func (mm *Manager) LoadAccount(phonenumber string) (*Account, error) {
+	mconn, err := mm.LoadAuthentication(phonenumber)
+	if err != nil {
+		return nil, err
+	}
+	return &Account{phonenumber, mconn}, nil
+}
+
+// NewAccount is NewAuthentication returning the account of the phone number, to sign in with the sent code.
+func (mm *Manager) NewAccount(phonenumber string, addr string, useIPv6 bool) (*Account, *TypeAuthSentCode, error) {
+	mconn, sentCode, err := mm.NewAuthentication(phonenumber, addr, useIPv6)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &Account{phonenumber, mconn}, sentCode, nil
+}
+
+// Accounts returns the accounts of the connections bound to sessions, ordered by the phone numbers.
+// The connections reconnecting at the moment are not listed.
+func (mm *Manager) Accounts() []*Account {
+	var accounts []*Account
+	for _, connId := range mm.connIds() {
+		mconn := mm.conn(connId)
+		if mconn == nil {
+			continue
+		}
+		if session := mconn.boundSession(); session != nil {
+			accounts = append(accounts, &Account{session.phonenumber, mconn})
+		}
+	}
+	sort.Slice(accounts, func(i, j int) bool { return accounts[i].PhoneNumber < accounts[j].PhoneNumber })
+	return accounts
+}
+
+// EnsureReady returns a connection ready for RPCs, loading the stored authentication of the phone number.
+// It returns ErrNeedsAuth when there is no stored key, the key is not authorized any more,
+// or the key is of another account.
+func (mm *Manager) EnsureReady(ctx context.Context, phonenumber string) (*Conn, error) {
+	return mm.EnsureReadyWithOptions(ctx, phonenumber, AuthOptions{})
+}
+
+// EnsureReadyWithOptions is EnsureReady of the account with the options, e.g., its own key file.
+func (mm *Manager) EnsureReadyWithOptions(ctx context.Context, phonenumber string, opts AuthOptions) (*Conn, error) {
+	return mm.ensureReady(ctx, phonenumber, opts, mm.LoadAuthenticationWithOptions)
+}
+
+func (mm *Manager) ensureReady(ctx context.Context, phonenumber string, opts AuthOptions,
+	load func(ctx context.Context, phonenumber string, opts AuthOptions) (*Conn, error)) (*Conn, error) {
+	if !hasAuthKey(mm.accountConfig(0, opts.KeyPath).KeyPath) {
+		return nil, ErrNeedsAuth
+	}
+	mconn, err := load(ctx, phonenumber, opts)
+	if err != nil {
+		if IsUnauthorized(err) {
+			return nil, ErrNeedsAuth
+		}
+		return nil, err
+	}
+	// the key file may be of another account, e.g., the default one
+	if session := mconn.boundSession(); session != nil && session.user != nil && session.user.Phone != "" &&
+		phoneDigits(session.user.Phone) != phoneDigits(phonenumber) {
+		infof(mm, "the key of %s is of another account, %s", phonenumber, session.user.Phone)
+		mm.closeConnectionAsync(mconn.connId, CloseGraceful)
+		return nil, ErrNeedsAuth
+	}
+	return mconn, nil
+}
+
+// hasAuthKey checks if loadSession could find a key either from the key file or env
+func hasAuthKey(keyPath string) bool {
+	if keyPath == "" {
+		return os.Getenv(ENV_AUTHKEY) != ""
+	}
+	info, err := os.Stat(keyPath)
+	if err != nil {
+		return false
+	}
+	return info.Size() > 0
+}
+
+// phoneDigits is the digits of the phone number, as the server has no plus sign or separators in it
+func phoneDigits(phonenumber string) string {
+	return strings.Map(func(r rune) rune {
+		if '0' <= r && r <= '9' {
+			return r
+		}
+		return -1
+	}, phonenumber)
+}
+
+// waitSessionResponse waits for the response of a session event.
+// When ctx is done first, the connection built later is closed, so that no socket dangles.
+func (mm *Manager) waitSessionResponse(ctx context.Context, respCh chan sessionResponse) (sessionResponse, error) {
+	select {
+	case resp := <-respCh:
+		return resp, resp.err
+	case <-ctx.Done():
+		go func() {
+			if resp := <-respCh; resp.err == nil && resp.connId != 0 {
+				mm.eventq <- closeConnection{resp.connId, nil, CloseGraceful}
 			}
+		}()
+		return sessionResponse{}, ctx.Err()
+	}
+}
+
+func (mm *Manager) closeConnectionAsync(connId int32, reason CloseReason) {
+	go func() {
+		mm.eventq <- closeConnection{connId, nil, reason}
+	}()
+}
+
+// reapIdleConns closes the connections idle longer than Configuration.IdleTimeout,
+// but the ones waiting for RPC replies.
+func (mm *Manager) reapIdleConns(now time.Time) {
+	for _, connId := range mm.connIds() {
+		mconn := mm.conn(connId)
+		if mconn == nil {
+			continue
+		}
+		session := mconn.boundSession()
+		if session == nil || session.pendingRPCs() > 0 {
+			continue
+		}
+		if idle := session.idle(now); idle > mm.appConfig.IdleTimeout {
+			infof(mm, "close connection %d idle for %v", connId, idle)
+			mm.closeConnectionAsync(connId, CloseGraceful)
 		}
 	}
 }
 
+// manageRoutine reads the events. Its caller adds it to manageWaitGroup.
 func (mm *Manager) manageRoutine() {
-	slog.Logln(mm, "start")
-	mm.manageWaitGroup.Add(1)
+	logln(mm, "start")
 	defer mm.manageWaitGroup.Done()
 
+	var reap <-chan time.Time
+	if mm.appConfig.IdleTimeout > 0 {
+		ticker := time.NewTicker(mm.appConfig.IdleTimeout / 2)
+		defer ticker.Stop()
+		reap = ticker.C
+	}
+
 	for {
 		select {
 		case <-mm.manageInterrupter:
 			// Default interrupt is STOP
-			slog.Logln(mm, "stop")
+			logln(mm, "stop")
 			return
 
+		case now := <-reap:
+			mm.reapIdleConns(now)
+
 		case e := <-mm.eventq:
-			// Delegate event handlings to go routines
-			switch e.(type) {
-			// Session Event Handlers
-			// In normal case, three resp events,
-			// SessionEstablished, ConnectionOpened, sessionBound,
-			// are generated and propagated.
-			case newsession:
+			mm.publish(e)
+			switch x := e.(type) {
+			case inlineEvent:
+				x.handleInline(mm)
+			case managedEvent:
+				// Delegate event handlings to go routines.
+				// Add before spawning, so that Finish never waits without the handler counted.
+				mm.manageWaitGroup.Add(1)
 				go func() {
-					mm.manageWaitGroup.Add(1)
 					defer mm.manageWaitGroup.Done()
-					e := e.(newsession)
-					slog.Logln(mm, "newsession to ", e.addr)
-					session, err := newSession(e.phonenumber, e.addr, e.useIPv6, mm.appConfig /*mm.queueSend,*/, mm.eventq)
-					var resp sessionResponse
-					if err != nil {
-						slog.Logln(mm, "connect failure:", err)
-						//TODO: need to handle nil resp channel?
-						//e.resp <- sessionResponse{0, nil, err}
-						resp = sessionResponse{0, nil, err}
-					} else {
-						// Bind the session with mconn and mmanager
-						mm.sessions[session.sessionId] = session // Immediate registration
-						var mconn *Conn
-						if e.connId != 0 {
-							mconn = mm.conns[e.connId]
-						} else {
-							// Create new connection, if not exist
-							mconn = newConnection(mm.eventq)
-							if err != nil {
-								//e.resp <- sessionResponse{0, nil, err}
-								if e.resp != nil {
-									e.resp <- sessionResponse{0, nil, err}
-								}
-								return
-							}
-							mm.conns[mconn.connId] = mconn // Immediate registration
-						}
-						mconn.bind(session)
-						//TODO: need to handle nil resp channel?
-						//e.resp <- sessionResponse{mconn.connId, session, nil}
-						resp = sessionResponse{mconn.connId, session, nil}
-					}
-					if e.resp != nil {
-						e.resp <- resp
-					}
+					x.handle(mm)
 				}()
+			}
+		}
+	}
+	logln(mm, "done")
+}
 
-				// In normal case, three resp events,
-				// SessionEstablished, ConnectionOpened, sessionBound,
-				// are generated and propagated.
-			case loadsession:
-				go func() {
-					mm.manageWaitGroup.Add(1)
-					defer mm.manageWaitGroup.Done()
-					e := e.(loadsession)
-					slog.Logln(mm, "loadsession of ", e.phonenumber)
-					session, err := loadSession(e.phonenumber, mm.appConfig /*mm.queueSend,*/, mm.eventq)
-					var resp sessionResponse
-					if err != nil {
-						//log.Fatalln("ManageRoutine: Connect Failure", err)
-						//slog.Fatalln(mm, "connect failure", err)
-						slog.Logln(mm, "connect failure:", err)
-						switch err.(type) {
-						case handshakingFailure:
-							mm.stuckSessions[session.sessionId] = e.connId // register the stuck session
-							// usually TCP resets causes stuck sessions, and the sessions are refreshed in the cases.
-							// Sometimes TCP t/o makes stuck sessions, and the sessions are refreshed as well,
-							// however it takes too long to be identified.
-							// So trigger the refresh session by closing the TCP connection
-							//mm.eventq <- refreshSession{session.sessionId, session.phonenumber, nil}
-							session.close()
-						}
-						//TODO: separate the handshaking error into two cases and trigger refreshSession on tcp dialing
-						// failure
-						resp = sessionResponse{0, session, err}
-					} else {
-						// Bind the session with mconn and mmanager
-						mm.sessions[session.sessionId] = session // Immediate registration
-						var mconn *Conn
-						if e.connId != 0 {
-							mconn = mm.conns[e.connId]
-						} else {
-							//mconn, err = newConnection(mm.eventq)
-							//if err != nil {
-							//	e.resp <- sessionResponse{0, nil, err}
-							//	return
-							//}
-							mconn = newConnection(mm.eventq)
-							mm.conns[mconn.connId] = mconn // Immediate registration
-						}
-						mconn.bind(session)
-						//TODO: need to handle nil resp channel?
-						resp = sessionResponse{mconn.connId, session, nil}
-					}
-					if e.resp != nil {
-						e.resp <- resp
-					}
-				}()
+// accountConfig is the configuration of the session of the account, with the key file of the event,
+// or of the connection reconnecting, if either is set
+func (mm *Manager) accountConfig(connId int32, keyPath string) Configuration {
+	appConfig := mm.appConfig
+	if keyPath == "" && connId != 0 {
+		if mconn := mm.conn(connId); mconn != nil {
+			keyPath = mconn.keyPath
+		}
+	}
+	if keyPath != "" {
+		appConfig.KeyPath = keyPath
+	}
+	return appConfig
+}
 
-			case SessionEstablished:
-				go func() {
-					mm.manageWaitGroup.Add(1)
-					defer mm.manageWaitGroup.Done()
-					e := e.(SessionEstablished)
-					slog.Logf(mm, "session established %d\n", e.session.sessionId)
-				}()
+// In normal case, three resp events,
+// SessionEstablished, ConnectionOpened, sessionBound,
+// are generated and propagated.
+func (e newsession) handle(mm *Manager) {
+	logln(mm, "newsession to ", e.addr)
+	appConfig := mm.accountConfig(e.connId, e.keyPath)
+	session, err := newSession(e.phonenumber, e.addr, e.useIPv6, e.dcKeys, appConfig /*mm.queueSend,*/, mm.eventq)
+	var resp sessionResponse
+	if err != nil {
+		errorf(mm, "connect failure: %v", err)
+		resp = sessionResponse{0, nil, err, nil}
+	} else {
+		// Bind the session with mconn and mmanager
+		var mconn *Conn
+		if e.connId != 0 {
+			mconn, err = mm.openConn(e.connId)
+			if err != nil {
+				session.close()
+				respond(e.resp, sessionResponse{0, nil, err, nil})
+				return
+			}
+		} else {
+			// Create new connection, if not exist
+			mconn = newConnection(mm.eventq, mm.manageInterrupter, mm.appConfig)
+			mconn.keyPath = e.keyPath
+			mm.registerConn(mconn) // Immediate registration
+		}
+		mm.registerSession(session) // Immediate registration
+		missed, err := mm.bind(mconn, session)
+		if errors.Is(err, ErrConnClosed) {
+			respond(e.resp, sessionResponse{0, nil, err, nil})
+			return
+		}
+		resp = sessionResponse{mconn.connId, session, nil, missed}
+	}
+	respond(e.resp, resp)
+}
 
-				// In normal case, an event,
-				// SessionDiscarded,
-				// is generated and propagated.
-			case discardSession:
-				go func() {
-					mm.manageWaitGroup.Add(1)
-					defer mm.manageWaitGroup.Done()
-					e := e.(discardSession)
-					slog.Logln(mm, "discard session ", e.sessionId)
-					session := mm.sessions[e.sessionId]
-					session.close()
-
-					// Immediate assignment of discarded session's updates state
-					// The assignment on handling SessionDiscarded event is sometimes slower than new sessionBound
-					// event, so that it results in either nil discardedUpdateState or a lot of duplicated updates.
-					marshaled, err := json.Marshal(session.updatesState)
-					if err == nil {
-						slog.Logf(mm, "session is discarded. keep its updates state, (json): %s\n", marshaled)
-					} else {
-						slog.Logf(mm, "session is discarded. keep its updates state, %v\n", session.updatesState)
-					}
-					if e.connId != 0 {
-						mconn := mm.conns[e.connId]
-						mconn.discardedUpdatesState = &PredUpdatesState{}
-						*mconn.discardedUpdatesState = *session.updatesState
-					}
-					if e.resp != nil {
-						e.resp <- sessionResponse{e.connId, session, nil}
-					}
-				}()
+// In normal case, three resp events,
+// SessionEstablished, ConnectionOpened, sessionBound,
+// are generated and propagated.
+func (e loadsession) handle(mm *Manager) {
+	logln(mm, "loadsession of ", e.phonenumber)
+	appConfig := mm.accountConfig(e.connId, e.keyPath)
+	session, err := loadSession(e.phonenumber, e.preferredAddr, appConfig /*mm.queueSend,*/, mm.eventq)
+	var resp sessionResponse
+	if err != nil {
+		//log.Fatalln("ManageRoutine: Connect Failure", err)
+		//slog.Fatalln(mm, "connect failure", err)
+		errorf(mm, "connect failure: %v", err)
+		switch err.(type) {
+		case handshakingFailure:
+			mm.sessionMutex.Lock()
+			mm.stuckSessions[session.sessionId] = e.connId // register the stuck session
+			mm.sessionCond.Broadcast()
+			mm.sessionMutex.Unlock()
+			// usually TCP resets causes stuck sessions, and the sessions are refreshed in the cases.
+			// Sometimes TCP t/o makes stuck sessions, and the sessions are refreshed as well,
+			// however it takes too long to be identified.
+			// So trigger the refresh session by closing the TCP connection
+			//mm.eventq <- refreshSession{session.sessionId, session.phonenumber, nil}
+			session.close()
+		}
+		//TODO: separate the handshaking error into two cases and trigger refreshSession on tcp dialing
+		// failure
+		resp = sessionResponse{0, session, err, nil}
+	} else {
+		// Bind the session with mconn and mmanager
+		var mconn *Conn
+		if e.connId != 0 {
+			mconn, err = mm.openConn(e.connId)
+			if err != nil {
+				session.close()
+				respond(e.resp, sessionResponse{0, nil, err, nil})
+				return
+			}
+			// the reloaded key, e.g., of the env, may not know the IPv6 preference of the migrated session
+			if e.preferredAddr == "" {
+				session.useIPv6 = mconn.useIPv6
+			}
+		} else {
+			//mconn, err = newConnection(mm.eventq, mm.manageInterrupter, mm.appConfig)
+			//if err != nil {
+			//	e.resp <- sessionResponse{0, nil, err}
+			//	return
+			//}
+			mconn = newConnection(mm.eventq, mm.manageInterrupter, mm.appConfig)
+			mconn.keyPath = e.keyPath
+			mm.registerConn(mconn) // Immediate registration
+		}
+		mm.registerSession(session) // Immediate registration
+		missed, err := mm.bind(mconn, session)
+		if errors.Is(err, ErrConnClosed) {
+			respond(e.resp, sessionResponse{0, nil, err, nil})
+			return
+		}
+		resp = sessionResponse{mconn.connId, session, nil, missed}
+	}
+	respond(e.resp, resp)
+}
 
-			case SessionDiscarded:
-				go func() {
-					mm.manageWaitGroup.Add(1)
-					defer mm.manageWaitGroup.Done()
-					e := e.(SessionDiscarded)
-					slog.Logln(mm, "session discarded ", e.discardedSessionId)
-					delete(mm.sessions, e.discardedSessionId) // Late deregistration
-				}()
+// openConn returns the registered connection of the id to bind a new session to,
+// or ErrConnClosed if the connection is closed or requested to close meanwhile, e.g., while reconnecting.
+func (mm *Manager) openConn(connId int32) (*Conn, error) {
+	mconn := mm.conn(connId)
+	if mconn == nil || mconn.isClosed() {
+		return nil, fmt.Errorf("%w: connection %d to bind", ErrConnClosed, connId)
+	}
+	if reason, ok := mconn.requestedClose(); ok {
+		return nil, fmt.Errorf("%w: connection %d to bind is closing, %s", ErrConnClosed, connId, reason)
+	}
+	return mconn, nil
+}
 
-				// In normal case, five events,
-				// discardSesseion, (SessionDiscarded), newsession, (SessionEstablished, ConnectionOpened, sessionBound),
-				// are generated and propagated.
-			case renewSession:
-				go func() {
-					mm.manageWaitGroup.Add(1)
-					defer mm.manageWaitGroup.Done()
-					e := e.(renewSession)
-					slog.Logln(mm, "renewSession to ", e.addr)
-					connId := mm.sessions[e.sessionId].connId
-
-					// Req discardSession
-					disconnectRespCh := make(chan sessionResponse, 1)
-					//mm.eventq <- discardSession{e.SessionId(), disconnectRespCh}
-					mm.sessions[e.sessionId].notify(discardSession{connId, e.sessionId, disconnectRespCh})
-
-					// Wait for disconnection
-					disconnectResp := <-disconnectRespCh
-					if disconnectResp.err != nil {
-						slog.Logf(mm, "renewSession failure: cannot discardSession %d. %v\n", e.sessionId, disconnectResp.err)
-						if e.resp != nil {
-							e.resp <- sessionResponse{0, nil, fmt.Errorf("cannot discardSession %d. %v", e.sessionId, disconnectResp.err)}
-						}
-						return
-					}
-
-					// Req newsession
-					slog.Logln(mm, "renewRoutine: req newsession")
-					connectRespCh := make(chan sessionResponse, 1)
-					mm.eventq <- newsession{connId, e.phonenumber, e.addr, e.useIPv6, connectRespCh}
-					connectResp := <-connectRespCh
-					if connectResp.err != nil {
-						slog.Logf(mm, "renewSession failure: cannot connect to %s. %v\n", e.addr, connectResp.err)
-						if e.resp != nil {
-							e.resp <- sessionResponse{0, nil, fmt.Errorf("cannot connect to %s. %v", e.addr, connectResp.err)}
-						}
-						return
-					}
-					slog.Logln(mm, "renewSession done")
-					//TODO: need to handle nil resp channel?
-					if e.resp != nil {
-						e.resp <- sessionResponse{connectResp.connId, connectResp.session, nil}
-					}
-					//TODO: figure out missed updates
-				}()
+// bind binds the registered session to the connection.
+// The session is closed on ErrConnClosed, as the connection is closed before the binding.
+func (mm *Manager) bind(mconn *Conn, session *Session) ([]Update, error) {
+	missed, err := mconn.bind(session)
+	if errors.Is(err, ErrConnClosed) {
+		errorf(mm, "binding failure: connection %d is closed", mconn.connId)
+		session.close()
+		return nil, err
+	}
+	if err != nil {
+		errorf(mm, "binding failure: %v", err)
+	}
+	mm.sessionBound(session.sessionId, mconn.connId)
+	return missed, nil
+}
 
-				// In normal case, five events,
-				// discardSesseion, (SessionDiscarded), newsession, (SessionEstablished, ConnectionOpened, sessionBound),
-				// are generated and propagated.
-			case refreshSession:
-				// throttle the refreshSession
-				//if mm.refreshSessionThrottle[e.(refreshSession).sessionId] > 0 {
-				//	continue
-				//}
-				//mm.refreshSessionThrottle[e.(refreshSession).sessionId] = 1
+func (e SessionEstablished) handle(mm *Manager) {
+	logf(mm, "session established %d\n", e.session.sessionId)
+}
 
-				go func() {
-					mm.manageWaitGroup.Add(1)
-					defer mm.manageWaitGroup.Done()
-					e := e.(refreshSession)
-					slog.Logln(mm, "refreshSession ", e.sessionId)
-					//TODO: alternate the spin lock
-					// Wait for session registration and binding for graceful refreshing
-					var connId int32
-					spinLock := true
-					skipDiscardSession := false
-					if mm.sessions[e.sessionId] != nil {
-						connId = mm.sessions[e.sessionId].connId
-						spinLock = false
-					}
-					for spinLock {
-						select {
-						// sleep timer
-						case <-time.After(1 * time.Second):
-							if mm.sessions[e.sessionId] != nil {
-								// session is registered
-								if mm.sessions[e.sessionId].connId != 0 {
-									// session is bound to a connection
-									spinLock = false
-									connId = mm.sessions[e.sessionId].connId
-									slog.Logln(mm, "spinlocked. session(%d) is bound. Release the lock now.", e.sessionId)
-								} else {
-									// session is not bound to a connection yet
-									slog.Logf(mm, "spinlocked. wait for the session(%d) binding.\n", e.sessionId)
-								}
-							} else if stuckSessionConnId, ok := mm.stuckSessions[e.sessionId]; ok {
-								// session is not registered yet,
-								// even the session would not be registered forever,
-								// because either invokeWithLayer or updatesGetState does not respond.
-								spinLock = false
-								skipDiscardSession = true
-								connId = stuckSessionConnId
-								delete(mm.stuckSessions, e.sessionId)
-								slog.Logf(mm, "spinlocked. Session(%d) is stuck on either invokeWithLayer or "+
-									"updatesGetState. Release the lock now and skip discardSession.\n", e.sessionId)
-							} else {
-								// session is not registered yet. wait for the registration.
-								slog.Logf(mm, "spinlocked. Session(%d) is waiting for a response from either "+
-									"invokeWithLayer or updatesGetState.\n", e.sessionId)
-							}
-						}
-					}
-
-					if !skipDiscardSession {
-						// Req discardSession
-						disconnectRespCh := make(chan sessionResponse, 1)
-						mm.sessions[e.sessionId].notify(discardSession{connId, e.sessionId, disconnectRespCh})
-
-						// Wait for disconnected event
-						disconnectResp := <-disconnectRespCh
-						if disconnectResp.err != nil {
-							slog.Logf(mm, "refreshSession failure: cannot discardSession %d. %v\n", e.sessionId, disconnectResp.err)
-							return
-						}
-					}
-
-					// Req loadsession
-					connectRespCh := make(chan sessionResponse, 1)
-					var connectResp sessionResponse
-					slog.Logln(mm, "req loadsession")
-					mm.eventq <- loadsession{connId, "", connectRespCh}
-					connectResp = <-connectRespCh
-					var sessionResp sessionResponse
-					if connectResp.err != nil {
-						slog.Logln(mm, "loadsession failure on refreshSession: ", connectResp.err)
-						sessionResp = sessionResponse{0, nil, connectResp.err}
-					} else {
-						//TODO: need to handle nil resp channel?
-						sessionResp = sessionResponse{connectResp.connId, connectResp.session, nil}
-					}
-					if sessionResp.err != nil && e.policy == untilSuccess {
-						slog.Logln(mm, "retry refreshSession")
-						mm.eventq <- refreshSession{
-							sessionResp.session.sessionId,
-							e.phonenumber,
-							untilSuccess,
-							make(chan sessionResponse),
-						}
-					} else {
-						slog.Logln(mm, "refreshSession is done.")
-						//mm.refreshSessionThrottle[e.sessionId] = 0
-					}
-					if e.resp != nil {
-						e.resp <- sessionResp
-					}
-				}()
+// In normal case, an event,
+// SessionDiscarded,
+// is generated and propagated.
+func (e discardSession) handle(mm *Manager) {
+	logln(mm, "discard session ", e.sessionId)
+	session := mm.session(e.sessionId)
+	if session == nil {
+		errorf(mm, "discardSession failure: unknown session %d", e.sessionId)
+		respond(e.resp, sessionResponse{0, nil, fmt.Errorf("unknown session %d", e.sessionId), nil})
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&session.discarded, 0, 1) {
+		errorf(mm, "discardSession failure: session %d is already discarded", e.sessionId)
+		respond(e.resp, sessionResponse{0, nil, fmt.Errorf("session %d is already discarded", e.sessionId), nil})
+		return
+	}
+	session.close()
 
-				// Connection Event Handlers
-			case ConnectionOpened:
-				go func() {
-					mm.manageWaitGroup.Add(1)
-					defer mm.manageWaitGroup.Done()
-					e := e.(ConnectionOpened)
-					slog.Logln(mm, "connectionOpened ", e.mconn.connId)
-				}()
+	// Immediate assignment of discarded session's updates state
+	// The assignment on handling SessionDiscarded event is sometimes slower than new sessionBound
+	// event, so that it results in either nil discardedUpdateState or a lot of duplicated updates.
+	state := session.copyUpdatesState()
+	marshaled, err := json.Marshal(state)
+	if err == nil {
+		logf(mm, "session is discarded. keep its updates state, (json): %s\n", marshaled)
+	} else {
+		logf(mm, "session is discarded. keep its updates state, %v\n", state)
+	}
+	if mconn := mm.conn(e.connId); mconn != nil && state != nil {
+		mconn.discardedUpdatesState = state
+	}
+	respond(e.resp, sessionResponse{e.connId, session, nil, nil})
+}
 
-			case sessionBound:
-				go func() {
-					mm.manageWaitGroup.Add(1)
-					defer mm.manageWaitGroup.Done()
-					e := e.(sessionBound)
-					connId := e.mconn.connId
-					sessionId := e.mconn.session.sessionId
-					slog.Logf(mm, "sessionBound: session %d is bound to mconn %d\n", sessionId, connId)
-				}()
-			case sessionUnbound:
-				go func() {
-					mm.manageWaitGroup.Add(1)
-					defer mm.manageWaitGroup.Done()
-					e := e.(sessionUnbound)
-					slog.Logf(mm, "sessionUnbound: session %d is unbound from mconn %d\n", e.unboundSessionId, e.mconn.connId)
-				}()
-			case closeConnection:
-				go func() {
-					mm.manageWaitGroup.Add(1)
-					defer mm.manageWaitGroup.Done()
-					e := e.(closeConnection)
-					slog.Logln(mm, "closeConnection ", e.connId)
-
-					// close, unbound, and deregister session
-					mconn := mm.conns[e.connId]
-					session, err := mconn.Session()
-					if err != nil {
-						if e.resp != nil {
-							e.resp <- err
-						}
-						return
-					}
-					discardSessionRespCh := make(chan sessionResponse, 1)
-					//mm.eventq <- discardSession{closeE.connId, session.sessionId, discardSessionRespCh}
-					mconn.notify(discardSession{e.connId, session.sessionId, discardSessionRespCh})
-
-					// close and deregister connection
-					discardSessionResp := <-discardSessionRespCh
-					if discardSessionResp.err == nil {
-						mconn.close()
-						if e.resp != nil {
-							e.resp <- nil
-						}
-						return
-					}
-					slog.Logln(mm, "closeConnection failure: cannot discard its session ", session.sessionId)
-					e.resp <- fmt.Errorf("Failed to discard its session %d", session.sessionId)
-				}()
-			case connectionClosed:
-				go func() {
-					mm.manageWaitGroup.Add(1)
-					defer mm.manageWaitGroup.Done()
-					e := e.(connectionClosed)
-					slog.Logln(mm, "connectionClosed ", e.closedConnId)
-					delete(mm.conns, e.closedConnId) // Late deregistration
-				}()
-			case updateReceived:
-			default:
+func (e SessionDiscarded) handle(mm *Manager) {
+	logln(mm, "session discarded ", e.discardedSessionId)
+	mm.deregisterSession(e.discardedSessionId) // Late deregistration
+}
+
+// The revoked key cannot reconnect, so the connection is closed rather than refreshed.
+func (e SessionRevoked) handle(mm *Manager) {
+	infof(mm, "session %d of connection %d is revoked", e.SessionId, e.ConnId)
+	mm.closeConnectionAsync(e.ConnId, CloseAuthRevoked)
+}
+
+// In normal case, five events,
+// discardSesseion, (SessionDiscarded), newsession, (SessionEstablished, ConnectionOpened, sessionBound),
+// are generated and propagated.
+func (e renewSession) handle(mm *Manager) {
+	logln(mm, "renewSession to ", e.addr)
+	mm.appConfig.metrics().IncReconnect()
+	session := mm.session(e.sessionId)
+	if session == nil {
+		errorf(mm, "renewSession failure: unknown session %d", e.sessionId)
+		respond(e.resp, sessionResponse{0, nil, fmt.Errorf("unknown session %d", e.sessionId), nil})
+		return
+	}
+	connId := session.connId
+	// the keys of the DCs are kept, to come back to them without handshakes
+	dcKeys := session.authKeys()
+
+	// Req discardSession
+	disconnectRespCh := make(chan sessionResponse, 1)
+	//mm.eventq <- discardSession{e.SessionId(), disconnectRespCh}
+	session.notify(discardSession{connId, e.sessionId, disconnectRespCh})
+
+	// Wait for disconnection
+	disconnectResp := <-disconnectRespCh
+	if disconnectResp.err != nil {
+		errorf(mm, "renewSession failure: cannot discardSession %d. %v\n", e.sessionId, disconnectResp.err)
+		respond(e.resp, sessionResponse{0, nil, fmt.Errorf("cannot discardSession %d. %v", e.sessionId, disconnectResp.err), nil})
+		return
+	}
+
+	// Req newsession
+	logln(mm, "renewRoutine: req newsession")
+	connectRespCh := make(chan sessionResponse, 1)
+	mm.eventq <- newsession{connId, e.phonenumber, e.addr, e.useIPv6, connectRespCh, dcKeys, ""}
+	var connectResp sessionResponse
+	select {
+	case connectResp = <-connectRespCh:
+	case <-mm.manageInterrupter:
+		// the manager finished before handling newsession
+		return
+	}
+	if connectResp.err != nil {
+		errorf(mm, "renewSession failure: cannot connect to %s. %v\n", e.addr, connectResp.err)
+		respond(e.resp, sessionResponse{0, nil, fmt.Errorf("cannot connect to %s. %v", e.addr, connectResp.err), nil})
+		return
+	}
+	logln(mm, "renewSession done")
+	// the updates missed while reconnecting are propagated on binding the new session, and returned as well
+	respond(e.resp, sessionResponse{connectResp.connId, connectResp.session, nil, connectResp.missed})
+}
+
+func (e refreshSession) handle(mm *Manager) {
+	// throttle the refreshSession
+	//if mm.refreshSessionThrottle[e.sessionId] > 0 {
+	//	return
+	//}
+	//mm.refreshSessionThrottle[e.sessionId] = 1
+
+	logln(mm, "refreshSession ", e.sessionId)
+	mm.appConfig.metrics().IncReconnect()
+	// the caller waiting for resp is answered even if the manager finishes meanwhile
+	finished := func() {
+		respond(e.resp, sessionResponse{0, nil, fmt.Errorf("manager finished before refreshing session %d", e.sessionId), nil})
+	}
+	// Wait for session registration and binding for graceful refreshing
+	connId, skipDiscardSession, err := mm.waitSessionBinding(e.sessionId, TIMEOUT_REFRESH_BINDING)
+	if err != nil {
+		errorf(mm, "refreshSession failure: %v\n", err)
+		respond(e.resp, sessionResponse{0, nil, err, nil})
+		return
+	}
+
+	if !skipDiscardSession {
+		// Req discardSession
+		disconnectRespCh := make(chan sessionResponse, 1)
+		session := mm.session(e.sessionId)
+		if session == nil {
+			errorf(mm, "refreshSession failure: session %d is already discarded\n", e.sessionId)
+			respond(e.resp, sessionResponse{0, nil, fmt.Errorf("session %d is already discarded", e.sessionId), nil})
+			return
+		}
+		session.notify(discardSession{connId, e.sessionId, disconnectRespCh})
+
+		// Wait for disconnected event
+		var disconnectResp sessionResponse
+		select {
+		case disconnectResp = <-disconnectRespCh:
+		case <-mm.manageInterrupter:
+			finished()
+			return
+		}
+		if disconnectResp.err != nil {
+			errorf(mm, "refreshSession failure: cannot discardSession %d. %v\n", e.sessionId, disconnectResp.err)
+			respond(e.resp, sessionResponse{0, nil, fmt.Errorf("cannot discardSession %d. %v", e.sessionId, disconnectResp.err), nil})
+			return
+		}
+	}
+
+	// Req loadsession.
+	// untilSuccess is on a connection drop, which retries with exponential backoff.
+	// The key is loaded again rather than renewed, so the reconnection keeps the authorization.
+	// The notifications to the connection closed meanwhile are dropped.
+	mconn := mm.conn(connId)
+	notify := func(e Event) {
+		if mconn != nil {
+			mconn.notify(e)
+		}
+	}
+	// the close of the connection cuts the delay short, and the check after it gives up the refresh
+	var closed chan struct{}
+	if mconn != nil {
+		closed = mconn.interrupter
+	}
+	var sessionResp sessionResponse
+	for attempt := 1; ; attempt++ {
+		var delay time.Duration
+		if attempt > 1 {
+			delay = mm.appConfig.reconnectDelay(attempt - 1)
+		}
+		if e.policy == untilSuccess {
+			notify(Reconnecting{connId, attempt, delay})
+		}
+		select {
+		case <-time.After(delay):
+		case <-closed:
+		case <-mm.manageInterrupter:
+			finished()
+			return
+		}
+		// the connection closed, or requested to close, while reconnecting is not reconnected any more
+		if connId != 0 {
+			if _, err := mm.openConn(connId); err != nil {
+				errorf(mm, "refreshSession failure: %v", err)
+				respond(e.resp, sessionResponse{0, nil, err, nil})
+				return
 			}
 		}
+
+		connectRespCh := make(chan sessionResponse, 1)
+		logln(mm, "req loadsession")
+		select {
+		case mm.eventq <- loadsession{connId, "", "", connectRespCh, ""}:
+		case <-mm.manageInterrupter:
+			finished()
+			return
+		}
+		var connectResp sessionResponse
+		select {
+		case connectResp = <-connectRespCh:
+		case <-mm.manageInterrupter:
+			// the manager finished before handling loadsession
+			finished()
+			return
+		}
+		if connectResp.err == nil {
+			sessionResp = sessionResponse{connectResp.connId, connectResp.session, nil, connectResp.missed}
+			if e.policy == untilSuccess {
+				notify(Reconnected{connId, attempt})
+			}
+			logln(mm, "refreshSession is done.")
+			break
+		}
+		errorf(mm, "loadsession failure on refreshSession: %v", connectResp.err)
+		sessionResp = sessionResponse{0, nil, connectResp.err, nil}
+		if e.policy != untilSuccess {
+			break
+		}
+		if attempt >= mm.appConfig.maxReconnectAttempts() {
+			errorf(mm, "refreshSession failure: give up reconnecting after %d attempts", attempt)
+			notify(ReconnectFailed{connId, connectResp.err})
+			if mconn != nil {
+				// the session is discarded already
+				mconn.close(e.reason)
+			}
+			break
+		}
+		logln(mm, "retry refreshSession")
 	}
-	slog.Logln(mm, "done")
+	respond(e.resp, sessionResp)
+}
+
+func (e ConnectionOpened) handle(mm *Manager) {
+	logln(mm, "connectionOpened ", e.mconn.connId)
+}
+
+func (e sessionBound) handle(mm *Manager) {
+	connId := e.mconn.connId
+	logf(mm, "sessionBound: session %d is bound to mconn %d\n", e.boundSessionId, connId)
+}
+
+func (e sessionUnbound) handle(mm *Manager) {
+	logf(mm, "sessionUnbound: session %d is unbound from mconn %d\n", e.unboundSessionId, e.mconn.connId)
+}
+
+func (e closeConnection) handle(mm *Manager) {
+	logln(mm, "closeConnection ", e.connId)
+
+	// close, unbound, and deregister session
+	mconn := mm.conn(e.connId)
+	if mconn == nil || mconn.isClosed() {
+		// the connection is closed already
+		respondErr(e.resp, nil)
+		return
+	}
+	// no session is bound to the connection from now on, e.g., by a refresh
+	mconn.setCloseReason(e.reason)
+	// no wait for a binding, which may take longer than TIMEOUT_FINISH
+	session, everBound, reconnecting := mconn.bindingState()
+	if !everBound || reconnecting || session == nil {
+		// The connection has never been bound, or its session is discarded on reconnect,
+		// so it has no session to discard. The refresh checks the connection before each attempt,
+		// so the close cancels it, and the session bound meanwhile is closed by the failed binding.
+		mconn.close(e.reason)
+		respondErr(e.resp, nil)
+		return
+	}
+	// The connection is closing, so it doesn't need to wait for a new session.
+	// discard the session on the manager only.
+	// The manager may finish meanwhile, then nobody handles the discardSession.
+	discardSessionRespCh := make(chan sessionResponse, 1)
+	select {
+	case mm.eventq <- discardSession{e.connId, session.sessionId, discardSessionRespCh}:
+	case <-mm.manageInterrupter:
+		respondErr(e.resp, fmt.Errorf("manager finished before closing connection %d", e.connId))
+		return
+	}
+
+	// close and deregister connection
+	var discardSessionResp sessionResponse
+	select {
+	case discardSessionResp = <-discardSessionRespCh:
+	case <-mm.manageInterrupter:
+		respondErr(e.resp, fmt.Errorf("manager finished before closing connection %d", e.connId))
+		return
+	}
+	if discardSessionResp.err == nil {
+		mconn.close(e.reason)
+		respondErr(e.resp, nil)
+		return
+	}
+	logln(mm, "closeConnection failure: cannot discard its session ", session.sessionId)
+	// the connection kept open may be bound again, e.g., by the refresh discarding the session
+	mconn.clearCloseReason()
+	respondErr(e.resp, fmt.Errorf("Failed to discard its session %d", session.sessionId))
+}
+
+func (e ConnectionClosed) handle(mm *Manager) {
+	logln(mm, "ConnectionClosed ", e.ConnId)
+	mm.deregisterConn(e.ConnId) // Late deregistration
+}
+
+func (e statsQuery) handleInline(mm *Manager) {
+	// on the manage routine, so the counts are of the same moment
+	e.resp <- mm.stats()
+}
+
+func (e updateReceived) handleInline(mm *Manager) {
+	// deliver in order, without waiting for the handlers
+	select {
+	case mm.updateq <- e.update:
+	case <-mm.manageInterrupter:
+	}
+}
+
+// Stats is a snapshot of the connections and the sessions of a manager.
+type Stats struct {
+	Conns           int // open connections
+	BoundSessions   int // sessions bound to the connections
+	EventQueueDepth int // pending events; a growing depth means the handlers are behind
+	Connections     []ConnStats
+}
+
+// ConnStats is the state of a connection.
+type ConnStats struct {
+	ConnId       int32
+	SessionId    int64         // zero if no session is bound
+	DC           int           // zero if unknown
+	LastActivity time.Time     // of the bound session
+	Idle         time.Duration // since the last RPC or reply of the bound session, as Configuration.IdleTimeout
+	Latency      time.Duration // of the last Conn.Ping, zero if not measured
+}
+
+// Stats returns the state of the manager, collected on its manage routine.
+// It returns zero Stats after Finish.
+func (mm *Manager) Stats() Stats {
+	resp := make(chan Stats, 1)
+	select {
+	case mm.eventq <- statsQuery{resp}:
+	case <-mm.manageInterrupter:
+		return Stats{}
+	}
+	select {
+	case stats := <-resp:
+		return stats
+	case <-mm.manageInterrupter:
+		return Stats{}
+	}
+}
+
+func (mm *Manager) stats() Stats {
+	stats := Stats{EventQueueDepth: len(mm.eventq)}
+	for _, connId := range mm.connIds() {
+		mconn := mm.conn(connId)
+		if mconn == nil {
+			continue
+		}
+		stats.Conns++
+		connStats := ConnStats{ConnId: connId}
+		if session := mconn.boundSession(); session != nil {
+			stats.BoundSessions++
+			connStats.SessionId = session.sessionId
+			connStats.LastActivity = session.lastActive()
+			connStats.Idle = session.idle(time.Now())
+			connStats.Latency = session.pingLatency()
+			if dc, err := dcIdOf(session.addr); err == nil {
+				connStats.DC = int(dc)
+			}
+		}
+		stats.Connections = append(stats.Connections, connStats)
+	}
+	return stats
+}
+
+// OnUpdate adds the handler of the updates of all the connections.
+// Handlers are called one by one, so a slow handler delays the other updates.
+func (mm *Manager) OnUpdate(handler UpdateHandler) {
+	mm.handlerMutex.Lock()
+	defer mm.handlerMutex.Unlock()
+	mm.updateHandlers = append(mm.updateHandlers, handler)
+}
+
+// subscriberQueueSize is the buffer size of a channel of Subscribe
+const subscriberQueueSize = 64
+
+// Subscribe returns a channel receiving the lifecycle events of the connections and their sessions:
+// ConnectionOpened, ConnectionClosed, SessionEstablished, SessionDiscarded,
+// Reconnecting, Reconnected, and ReconnectFailed.
+// The manager never waits for a subscriber, so the events are dropped while its channel is full.
+// The channel is closed by Unsubscribe or Finish.
+func (mm *Manager) Subscribe() <-chan Event {
+	mm.subscriberMutex.Lock()
+	defer mm.subscriberMutex.Unlock()
+	ch := make(chan Event, subscriberQueueSize)
+	mm.subscribers = append(mm.subscribers, ch)
+	return ch
+}
+
+// Unsubscribe stops the events to the channel of Subscribe, and closes it.
+func (mm *Manager) Unsubscribe(sub <-chan Event) {
+	mm.subscriberMutex.Lock()
+	defer mm.subscriberMutex.Unlock()
+	for i, ch := range mm.subscribers {
+		if ch == sub {
+			mm.subscribers = append(mm.subscribers[:i], mm.subscribers[i+1:]...)
+			close(ch)
+			return
+		}
+	}
+}
+
+// publish sends a copy of the lifecycle event to the subscribers, without blocking the manage routine
+func (mm *Manager) publish(e Event) {
+	switch e.(type) {
+	case ConnectionOpened, ConnectionClosed, SessionEstablished, SessionDiscarded, Reconnecting, Reconnected, ReconnectFailed:
+	default:
+		return
+	}
+	mm.subscriberMutex.Lock()
+	defer mm.subscriberMutex.Unlock()
+	for _, ch := range mm.subscribers {
+		select {
+		case ch <- e:
+		default:
+			logf(mm, "a subscriber is full. drop %T\n", e)
+		}
+	}
+}
+
+// closeSubscribers closes the channels of Subscribe, after the manage routine stops
+func (mm *Manager) closeSubscribers() {
+	mm.subscriberMutex.Lock()
+	defer mm.subscriberMutex.Unlock()
+	for _, ch := range mm.subscribers {
+		close(ch)
+	}
+	mm.subscribers = nil
+}
+
+// dispatchRoutine calls the update handlers. Its caller adds it to manageWaitGroup.
+func (mm *Manager) dispatchRoutine() {
+	defer mm.manageWaitGroup.Done()
+	for {
+		select {
+		case <-mm.manageInterrupter:
+			return
+		case u := <-mm.updateq:
+			mm.handlerMutex.RLock()
+			handlers := mm.updateHandlers
+			mm.handlerMutex.RUnlock()
+			for _, handler := range handlers {
+				handler(u)
+			}
+		}
+	}
+}
+
+func (mm *Manager) conn(connId int32) *Conn {
+	mm.connMutex.RLock()
+	defer mm.connMutex.RUnlock()
+	return mm.conns[connId]
+}
+
+func (mm *Manager) connIds() []int32 {
+	mm.connMutex.RLock()
+	defer mm.connMutex.RUnlock()
+	ids := make([]int32, 0, len(mm.conns))
+	for id := range mm.conns {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func (mm *Manager) registerConn(mconn *Conn) {
+	mm.connMutex.Lock()
+	defer mm.connMutex.Unlock()
+	mm.conns[mconn.connId] = mconn
+}
+
+func (mm *Manager) deregisterConn(connId int32) {
+	mm.connMutex.Lock()
+	defer mm.connMutex.Unlock()
+	delete(mm.conns, connId)
+}
+
+func (mm *Manager) session(sessionId int64) *Session {
+	mm.sessionMutex.Lock()
+	defer mm.sessionMutex.Unlock()
+	return mm.sessions[sessionId]
+}
+
+func (mm *Manager) registerSession(session *Session) {
+	mm.sessionMutex.Lock()
+	defer mm.sessionMutex.Unlock()
+	mm.sessions[session.sessionId] = session
+	mm.sessionCond.Broadcast()
+}
+
+func (mm *Manager) sessionBound(sessionId int64, connId int32) {
+	mm.sessionMutex.Lock()
+	defer mm.sessionMutex.Unlock()
+	mm.boundSessions[sessionId] = connId
+	mm.sessionCond.Broadcast()
+}
+
+func (mm *Manager) deregisterSession(sessionId int64) {
+	mm.sessionMutex.Lock()
+	defer mm.sessionMutex.Unlock()
+	// The discard is kept for a refresh racing with it, which consumes it.
+	// The ones without refreshes expire, as no refresh waits for a binding longer than TIMEOUT_REFRESH_BINDING.
+	now := time.Now()
+	for id, discarded := range mm.unboundDiscards {
+		if now.Sub(discarded) > TIMEOUT_REFRESH_BINDING {
+			delete(mm.unboundDiscards, id)
+		}
+	}
+	if _, ok := mm.boundSessions[sessionId]; !ok {
+		mm.unboundDiscards[sessionId] = now
+	}
+	delete(mm.sessions, sessionId)
+	delete(mm.boundSessions, sessionId)
+	mm.sessionCond.Broadcast()
+}
+
+// waitSessionBinding blocks until the session is bound to a connection, or it turns out to be stuck.
+// Stuck sessions are never registered, because either invokeWithLayer or updatesGetState does not respond,
+// so their refresh has to skip discardSession.
+func (mm *Manager) waitSessionBinding(sessionId int64, timeout time.Duration) (connId int32, stuck bool, err error) {
+	timedOut := false
+	timer := time.AfterFunc(timeout, func() {
+		mm.sessionMutex.Lock()
+		timedOut = true
+		mm.sessionCond.Broadcast()
+		mm.sessionMutex.Unlock()
+	})
+	defer timer.Stop()
+
+	mm.sessionMutex.Lock()
+	defer mm.sessionMutex.Unlock()
+	for {
+		if connId, ok := mm.boundSessions[sessionId]; ok {
+			return connId, false, nil
+		}
+		if connId, ok := mm.stuckSessions[sessionId]; ok {
+			delete(mm.stuckSessions, sessionId)
+			logf(mm, "session(%d) is stuck on either invokeWithLayer or updatesGetState. "+
+				"skip discardSession.\n", sessionId)
+			return connId, true, nil
+		}
+		if _, ok := mm.unboundDiscards[sessionId]; ok {
+			delete(mm.unboundDiscards, sessionId)
+			return 0, false, fmt.Errorf("session(%d) is discarded before its binding", sessionId)
+		}
+		if timedOut {
+			delete(mm.unboundDiscards, sessionId)
+			return 0, false, fmt.Errorf("session(%d) binding timeout(%f s)", sessionId, timeout.Seconds())
+		}
+		mm.sessionCond.Wait()
+	}
+}
+
+func (x *Manager) logger() Logger {
+	return x.appConfig.Logger
 }
 
 func (x *Manager) LogPrefix() string {
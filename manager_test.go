@@ -0,0 +1,940 @@
+package mtproto
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// testApiHash is an api_hash passing Configuration.Check
+const testApiHash = "0123456789abcdef0123456789abcdef"
+
+func newTestManager(t *testing.T) *Manager {
+	config, err := NewConfiguration(1, testApiHash, "0.0.1", "", "", "", 0, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mm, err := NewManager(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mm
+}
+
+type bindingResult struct {
+	connId int32
+	stuck  bool
+	err    error
+}
+
+func waitBindingAsync(mm *Manager, sessionId int64, timeout time.Duration) chan bindingResult {
+	ch := make(chan bindingResult, 1)
+	go func() {
+		connId, stuck, err := mm.waitSessionBinding(sessionId, timeout)
+		ch <- bindingResult{connId, stuck, err}
+	}()
+	return ch
+}
+
+func TestRefreshBeforeSessionBound(t *testing.T) {
+	mm := newTestManager(t)
+	defer mm.Finish()
+
+	session := &Session{sessionId: 1}
+	resCh := waitBindingAsync(mm, session.sessionId, time.Minute)
+	mm.registerSession(session)
+	mm.sessionBound(session.sessionId, 7)
+
+	res := <-resCh
+	if res.err != nil || res.stuck || res.connId != 7 {
+		t.Fatalf("unexpected binding: %+v", res)
+	}
+}
+
+// The refreshSession event is fired before the binding of its session, so the handler waits for the binding.
+func TestRefreshSessionEventBeforeBound(t *testing.T) {
+	mm := newTestManager(t)
+	defer mm.Finish()
+
+	resp := make(chan sessionResponse, 1)
+	mm.eventq <- refreshSession{11, "", noRetry, resp, CloseNetworkError}
+
+	// the handler discards the bound session through the session listeners
+	events := make(chan Event, 1)
+	session := &Session{sessionId: 11}
+	session.AddSessionListener(events)
+	mm.registerSession(session)
+	mm.sessionBound(session.sessionId, 7)
+
+	var discard discardSession
+	select {
+	case e := <-events:
+		discard = e.(discardSession)
+	case <-time.After(time.Second):
+		t.Fatal("the refresh did not wake up on the binding")
+	}
+	if discard.connId != 7 || discard.sessionId != 11 {
+		t.Fatalf("unexpected discard %+v", discard)
+	}
+
+	// a failure of the discard fails the refresh, rather than leaving resp unanswered
+	discard.resp <- sessionResponse{0, nil, errors.New("discard failure"), nil}
+	select {
+	case r := <-resp:
+		if r.err == nil {
+			t.Fatalf("unexpected refresh %+v", r)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the refresh did not respond")
+	}
+}
+
+// The refreshSession event is fired, and its session is discarded before it is bound.
+func TestRefreshSessionEventDiscardedBeforeBound(t *testing.T) {
+	mm := newTestManager(t)
+	defer mm.Finish()
+
+	resp := make(chan sessionResponse, 1)
+	mm.eventq <- refreshSession{12, "", noRetry, resp, CloseNetworkError}
+	mm.registerSession(&Session{sessionId: 12})
+	mm.deregisterSession(12)
+
+	select {
+	case r := <-resp:
+		if r.err == nil {
+			t.Fatalf("discarded session is refreshed: %+v", r)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the refresh did not respond")
+	}
+}
+
+func TestRefreshStuckSession(t *testing.T) {
+	mm := newTestManager(t)
+	defer mm.Finish()
+
+	resCh := waitBindingAsync(mm, 2, time.Minute)
+	mm.sessionMutex.Lock()
+	mm.stuckSessions[2] = 9
+	mm.sessionCond.Broadcast()
+	mm.sessionMutex.Unlock()
+
+	res := <-resCh
+	if res.err != nil || !res.stuck || res.connId != 9 {
+		t.Fatalf("unexpected binding: %+v", res)
+	}
+}
+
+func TestRefreshSessionDiscardedBeforeBound(t *testing.T) {
+	mm := newTestManager(t)
+	defer mm.Finish()
+
+	session := &Session{sessionId: 3}
+	resCh := waitBindingAsync(mm, session.sessionId, time.Minute)
+	mm.registerSession(session)
+	mm.deregisterSession(session.sessionId)
+
+	if res := <-resCh; res.err == nil {
+		t.Fatalf("discarded session is bound: %+v", res)
+	}
+
+	// the discard without a refresh expires
+	mm.registerSession(&Session{sessionId: 4})
+	mm.deregisterSession(4)
+	mm.sessionMutex.Lock()
+	mm.unboundDiscards[4] = time.Now().Add(-TIMEOUT_REFRESH_BINDING - time.Second)
+	mm.sessionMutex.Unlock()
+	mm.deregisterSession(5)
+	mm.sessionMutex.Lock()
+	defer mm.sessionMutex.Unlock()
+	if _, ok := mm.unboundDiscards[4]; ok || len(mm.unboundDiscards) != 1 {
+		t.Errorf("unexpected discards %v", mm.unboundDiscards)
+	}
+}
+
+func TestRefreshSessionBindingTimeout(t *testing.T) {
+	mm := newTestManager(t)
+	defer mm.Finish()
+
+	if res := <-waitBindingAsync(mm, 4, 10*time.Millisecond); res.err == nil {
+		t.Fatalf("binding did not time out: %+v", res)
+	}
+}
+
+// openTestConn binds a connection to a session over an in-memory pipe, as newsession does.
+// It returns the session file, which the caller removes.
+func openTestConn(t *testing.T, mm *Manager) (*Conn, *os.File) {
+	f, err := ioutil.TempFile("", "mtproto_conn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, server := net.Pipe()
+	go ioutil.ReadAll(server)
+	session := &Session{
+		sessionId:    rand.Int63(),
+		tcpconn:      client,
+		f:            f,
+		updatesState: &PredUpdatesState{},
+		appConfig:    mm.appConfig,
+		mutex:        &sync.Mutex{},
+		msgsIdToResp: make(map[int64]chan response),
+	}
+	session.AddSessionListener(mm.eventq)
+	mm.registerSession(session)
+
+	mconn := newConnection(mm.eventq, mm.manageInterrupter, Configuration{})
+	mm.registerConn(mconn)
+	if _, err := mconn.bind(session); err != nil {
+		t.Fatal(err)
+	}
+	mm.sessionBound(session.sessionId, mconn.connId)
+	return mconn, f
+}
+
+func TestFinishFlushesSessions(t *testing.T) {
+	mm := newTestManager(t)
+
+	var files []*os.File
+	for i := 0; i < 2; i++ {
+		_, f := openTestConn(t, mm)
+		defer os.Remove(f.Name())
+		files = append(files, f)
+	}
+
+	if err := mm.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		if _, err := f.Write([]byte{0}); err == nil {
+			t.Errorf("session file %s is not closed", f.Name())
+		}
+	}
+}
+
+// Run it with -race
+func TestOpenCloseConnsConcurrently(t *testing.T) {
+	mm := newTestManager(t)
+	defer mm.Finish()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				mconn, f := openTestConn(t, mm)
+				resp := make(chan error, 1)
+				mm.eventq <- closeConnection{mconn.connId, resp, CloseGraceful}
+				if err := <-resp; err != nil {
+					t.Error(err)
+				}
+				os.Remove(f.Name())
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// Run it with -race. The handlers spawned while Finish waits must be waited for.
+func TestFinishWhileClosingConns(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		mm := newTestManager(t)
+		var mconns []*Conn
+		for j := 0; j < 8; j++ {
+			mconn, f := openTestConn(t, mm)
+			defer os.Remove(f.Name())
+			mconns = append(mconns, mconn)
+		}
+
+		var wg sync.WaitGroup
+		for _, mconn := range mconns {
+			wg.Add(1)
+			go func(connId int32) {
+				defer wg.Done()
+				resp := make(chan error, 1)
+				select {
+				case mm.eventq <- closeConnection{connId, resp, CloseGraceful}:
+				case <-mm.manageInterrupter:
+					return
+				}
+				select {
+				case <-resp:
+				case <-mm.manageInterrupter:
+				}
+			}(mconn.connId)
+		}
+		mm.Finish()
+		wg.Wait()
+	}
+}
+
+func TestCloseUnboundConn(t *testing.T) {
+	mm := newTestManager(t)
+	defer mm.Finish()
+	// the close does not wait for the binding of TIMEOUT_SESSION_BINDING
+	mconn := newConnection(mm.eventq, mm.manageInterrupter, Configuration{})
+	mm.registerConn(mconn)
+
+	resp := make(chan error, 1)
+	mm.eventq <- closeConnection{mconn.connId, resp, CloseGraceful}
+	select {
+	case err := <-resp:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the unbound connection is not closed")
+	}
+	for start := time.Now(); mm.conn(mconn.connId) != nil; time.Sleep(time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatal("the closed connection is not deregistered")
+		}
+	}
+}
+
+func TestConnClose(t *testing.T) {
+	mm := newTestManager(t)
+	defer mm.Finish()
+	mconn, f := openTestConn(t, mm)
+	defer os.Remove(f.Name())
+	other, g := openTestConn(t, mm)
+	defer os.Remove(g.Name())
+
+	if err := mconn.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for start := time.Now(); mm.conn(mconn.connId) != nil; time.Sleep(time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatal("the closed connection is not deregistered")
+		}
+	}
+	if mm.conn(other.connId) == nil || other.boundSession() == nil {
+		t.Errorf("the other connection is closed")
+	}
+
+	// the second Close posts no event to the closed connection
+	if err := mconn.Close(); err != ErrConnClosed {
+		t.Errorf("second close: %v", err)
+	}
+	// the RPCs of the closed connection fail rather than dereferencing no session
+	if _, err := mconn.InvokeBlocked(&ReqHelpGetConfig{}); err != ErrConnClosed {
+		t.Errorf("RPC of the closed connection: %v", err)
+	}
+	if x := <-mconn.InvokeNonBlocked(&ReqHelpGetConfig{}); x.err != ErrConnClosed {
+		t.Errorf("non-blocked RPC of the closed connection: %v", x.err)
+	}
+}
+
+// The close of a connection left by the finished manager gives up rather than blocking, and may be tried again.
+func TestConnCloseAfterFinish(t *testing.T) {
+	mm := newTestManager(t)
+	mconn := newConnection(mm.eventq, mm.manageInterrupter, Configuration{})
+	mm.Finish()
+
+	for i := 0; i < 2; i++ {
+		done := make(chan error, 1)
+		go func() { done <- mconn.Close() }()
+		select {
+		case err := <-done:
+			if err == nil || errors.Is(err, ErrConnClosed) {
+				t.Errorf("unexpected close %v, expected the failure of the finished manager", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("the close blocks on the finished manager")
+		}
+	}
+}
+
+func TestAccounts(t *testing.T) {
+	mm := newTestManager(t)
+	defer mm.Finish()
+	phones := []string{"+821000000002", "+821000000001"}
+	var accounts []*Account
+	for _, phone := range phones {
+		mconn, f := openTestConn(t, mm)
+		defer os.Remove(f.Name())
+		session := mconn.boundSession()
+		session.phonenumber = phone
+		session.user = &PredUser{Phone: phone}
+		// each account answers with its phone number
+		loopback := make(chan packetToSend)
+		session.queueSend = loopback
+		go func(phone string) {
+			for x := range loopback {
+				x.resp <- response{&PredUser{Phone: phone}, nil}
+			}
+		}(phone)
+		defer close(loopback)
+		accounts = append(accounts, &Account{phone, mconn})
+	}
+
+	var wg sync.WaitGroup
+	for _, account := range accounts {
+		wg.Add(1)
+		go func(account *Account) {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				data, err := account.InvokeBlocked(&ReqUsersGetUsers{})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if user, ok := data.(*PredUser); !ok || user.Phone != account.PhoneNumber {
+					t.Errorf("%s: unexpected response %v", account.PhoneNumber, data)
+					return
+				}
+			}
+		}(account)
+	}
+	wg.Wait()
+
+	listed := mm.Accounts()
+	if len(listed) != 2 || listed[0].PhoneNumber != phones[1] || listed[1].PhoneNumber != phones[0] {
+		t.Fatalf("unexpected accounts %v", listed)
+	}
+	for _, account := range listed {
+		if account.User().Phone != account.PhoneNumber {
+			t.Errorf("%s: unexpected user %v", account.PhoneNumber, account.User())
+		}
+	}
+}
+
+func TestEnsureReady(t *testing.T) {
+	mm := newTestManager(t)
+	defer mm.Finish()
+	key, err := ioutil.TempFile("", "mtproto_key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key.Write(make([]byte, 8))
+	key.Close()
+	defer os.Remove(key.Name())
+	mconn, f := openTestConn(t, mm)
+	defer os.Remove(f.Name())
+	mconn.boundSession().user = &PredUser{Phone: "821000000001"}
+
+	var loaded []string
+	load := func(err error) func(ctx context.Context, phonenumber string, opts AuthOptions) (*Conn, error) {
+		return func(ctx context.Context, phonenumber string, opts AuthOptions) (*Conn, error) {
+			loaded = append(loaded, opts.KeyPath)
+			if err != nil {
+				return nil, err
+			}
+			return mconn, nil
+		}
+	}
+	// the default key is of another account than the one of its own missing key
+	mm.appConfig.KeyPath = key.Name()
+	missing := key.Name() + ".missing"
+	for _, tc := range []struct {
+		phonenumber string
+		opts        AuthOptions
+		loadErr     error
+		ready       bool
+	}{
+		{"+821000000001", AuthOptions{KeyPath: missing}, nil, false},
+		{"+821000000001", AuthOptions{}, RPCError{errorUnauthorized, "AUTH_KEY_INVALID"}, false},
+		{"+82 10 0000 0001", AuthOptions{KeyPath: key.Name()}, nil, true},
+		{"+821000000001", AuthOptions{}, nil, true},
+	} {
+		loaded = nil
+		ready, err := mm.ensureReady(context.Background(), tc.phonenumber, tc.opts, load(tc.loadErr))
+		if tc.ready && (ready != mconn || err != nil) {
+			t.Errorf("%s %v: not ready, %v", tc.phonenumber, tc.opts, err)
+		}
+		if !tc.ready && (ready != nil || err != ErrNeedsAuth) {
+			t.Errorf("%s %v: %v, expected ErrNeedsAuth", tc.phonenumber, tc.opts, err)
+		}
+		if tc.opts.KeyPath == missing && len(loaded) != 0 {
+			t.Errorf("the missing key is loaded")
+		}
+	}
+
+	// the key of another account is not ready, and its connection is closed
+	if _, err := mm.ensureReady(context.Background(), "+821000000002", AuthOptions{}, load(nil)); err != ErrNeedsAuth {
+		t.Errorf("the key of another account: %v, expected ErrNeedsAuth", err)
+	}
+	for start := time.Now(); mm.conn(mconn.connId) != nil; time.Sleep(time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatal("the connection of another account is not closed")
+		}
+	}
+}
+
+func TestBotKeyPath(t *testing.T) {
+	mm := newTestManager(t)
+	defer mm.Finish()
+	if path := mm.BotKeyPath("123456"); path != "" {
+		t.Errorf("bot key path %q without the key path", path)
+	}
+	mm.appConfig.KeyPath = "/var/lib/mtproto/key"
+	if path := mm.BotKeyPath("123456"); path != "/var/lib/mtproto/key.bot123456" {
+		t.Errorf("unexpected bot key path %q", path)
+	}
+}
+
+func TestAccountKeyPaths(t *testing.T) {
+	mm := newTestManager(t)
+	defer mm.Finish()
+	dir, err := ioutil.TempDir("", "mtproto_accounts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// the dials to the closed port are refused, after the keys are loaded
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	// each tenant has its key in its own directory
+	keys := make(map[string][]byte)
+	for _, tenant := range []string{"a", "b"} {
+		if err := os.Mkdir(filepath.Join(dir, tenant), 0700); err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(dir, tenant, "key")
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[path] = bytes.Repeat([]byte(tenant), 256)
+		session := &Session{f: f, addr: addr, authKey: keys[path], authKeyHash: make([]byte, 8), serverSalt: make([]byte, 8)}
+		if err := session.saveSession(); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+	}
+
+	for path, key := range keys {
+		resp := make(chan sessionResponse, 1)
+		mm.eventq <- loadsession{0, "", "", resp, path}
+		r := <-resp
+		if r.err == nil || r.session == nil {
+			t.Fatalf("%s: unexpected response %+v", path, r)
+		}
+		if !bytes.Equal(r.session.authKey, key) || r.session.appConfig.KeyPath != path {
+			t.Errorf("%s: the key of another account is loaded", path)
+		}
+	}
+
+	// a new account creates its key file in its directory
+	path := filepath.Join(dir, "c")
+	resp := make(chan sessionResponse, 1)
+	mm.eventq <- newsession{0, "", addr, false, resp, nil, path}
+	if r := <-resp; r.err == nil {
+		t.Fatalf("unexpected response %+v", r)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("no key file of the new account, %v", err)
+	}
+
+	// the reconnections keep the key file of the connection
+	mconn := newConnection(mm.eventq, mm.manageInterrupter, Configuration{})
+	mconn.keyPath = path
+	mm.registerConn(mconn)
+	defer mm.deregisterConn(mconn.connId)
+	if keyPath := mm.accountConfig(mconn.connId, "").KeyPath; keyPath != path {
+		t.Errorf("reconnection to key file %q", keyPath)
+	}
+}
+
+// benchmarkNewSession posts concurrent newsession events whose dials are refused,
+// so it measures the event handling rather than the network.
+func benchmarkNewSession(b *testing.B, queueSize int) {
+	SetLogLevel(LogLevelOff)
+	defer SetLogLevel(LogLevelDebug)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	f, err := ioutil.TempFile("", "mtproto_bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	config, err := NewConfiguration(1, testApiHash, "0.0.1", "", "", "", 0, 0, f.Name())
+	if err != nil {
+		b.Fatal(err)
+	}
+	config.EventQueueSize = queueSize
+	mm, err := NewManager(config)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer mm.Finish()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			resp := make(chan sessionResponse, 1)
+			mm.eventq <- newsession{0, "", addr, false, resp, nil, ""}
+			<-resp
+		}
+	})
+}
+
+func BenchmarkNewSessionUnbufferedQueue(b *testing.B) { benchmarkNewSession(b, 0) }
+func BenchmarkNewSessionDefaultQueue(b *testing.B)    { benchmarkNewSession(b, defaultEventQueueSize) }
+
+func TestOnUpdate(t *testing.T) {
+	mm := newTestManager(t)
+	defer mm.Finish()
+
+	received := make(chan int32, 10)
+	mm.OnUpdate(func(u Update) {
+		received <- u.(*PredUpdateNewMessage).Pts
+	})
+	for pts := int32(1); pts <= 3; pts++ {
+		mm.eventq <- updateReceived{&PredUpdateNewMessage{Pts: pts}}
+	}
+	for pts := int32(1); pts <= 3; pts++ {
+		select {
+		case got := <-received:
+			if got != pts {
+				t.Fatalf("expected update of pts %d, but %d", pts, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("update is not handled")
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	mm := newTestManager(t)
+	defer mm.Finish()
+	for i := 0; i < 2; i++ {
+		mconn, f := openTestConn(t, mm)
+		defer os.Remove(f.Name())
+		session := mconn.boundSession()
+		session.addr = "149.154.167.50:443"
+		session.touch()
+	}
+
+	stats := mm.Stats()
+	if stats.Conns != 2 || stats.BoundSessions != 2 || len(stats.Connections) != 2 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+	for _, c := range stats.Connections {
+		if c.DC != 2 || c.LastActivity.IsZero() {
+			t.Errorf("unexpected connection stats: %+v", c)
+		}
+	}
+}
+
+func TestReapIdleConns(t *testing.T) {
+	config, err := NewConfiguration(1, testApiHash, "0.0.1", "", "", "", 0, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.IdleTimeout = 50 * time.Millisecond
+	mm, err := NewManager(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mm.Finish()
+
+	idle, f := openTestConn(t, mm)
+	defer os.Remove(f.Name())
+	waiting, f := openTestConn(t, mm)
+	defer os.Remove(f.Name())
+	// an RPC waits for its reply
+	session := waiting.boundSession()
+	session.mutex.Lock()
+	session.msgsIdToResp[1] = make(chan response, 1)
+	session.mutex.Unlock()
+
+	if stats := mm.Stats(); len(stats.Connections) != 2 || stats.Connections[0].Idle >= config.IdleTimeout {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+	deadline := time.Now().Add(time.Second)
+	for mm.conn(idle.connId) != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("the idle connection is not closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if mm.conn(waiting.connId) == nil {
+		t.Errorf("the connection waiting for a reply is closed")
+	}
+}
+
+func TestReconnectDelay(t *testing.T) {
+	config := Configuration{ReconnectBackoffBase: time.Second, ReconnectBackoffMax: 5 * time.Second}
+	for attempt, expected := range []time.Duration{0, 1, 2, 4, 5, 5} {
+		if attempt == 0 {
+			continue
+		}
+		if delay := config.reconnectDelay(attempt); delay != expected*time.Second {
+			t.Errorf("attempt %d: %v, expected %v", attempt, delay, expected*time.Second)
+		}
+	}
+}
+
+func TestReconnectGivesUp(t *testing.T) {
+	mm := newTestManager(t)
+	defer mm.Finish()
+	mm.appConfig.ReconnectBackoffBase = time.Millisecond
+	mm.appConfig.MaxReconnectAttempts = 3
+	mconn, f := openTestConn(t, mm)
+	defer os.Remove(f.Name())
+	events := make(chan Event, 16)
+	mconn.AddConnListener(events)
+
+	// the key cannot be loaded, as the test manager has no key file
+	session := mconn.boundSession()
+	mm.eventq <- refreshSession{session.sessionId, "", untilSuccess, nil, CloseNetworkError}
+
+	var attempts int
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case e := <-events:
+			switch e := e.(type) {
+			case Reconnecting:
+				attempts++
+				if e.Attempt != attempts {
+					t.Errorf("attempt %d, expected %d", e.Attempt, attempts)
+				}
+			case Reconnected:
+				t.Fatalf("reconnected without a key")
+			case ReconnectFailed:
+				if attempts != 3 {
+					t.Errorf("gave up after %d attempts, expected 3", attempts)
+				}
+			case ConnectionClosed:
+				// closed by the reason of the drop
+				if e.Reason != CloseNetworkError {
+					t.Errorf("closed by %s, expected %s", e.Reason, CloseNetworkError)
+				}
+				return
+			}
+		case <-timeout:
+			t.Fatalf("reconnection did not give up after %d attempts", attempts)
+		}
+	}
+}
+
+// Run it with -race. The connection closed while reconnecting is neither reconnected nor notified any more.
+func TestReconnectClosedConn(t *testing.T) {
+	mm := newTestManager(t)
+	defer mm.Finish()
+	mm.appConfig.ReconnectBackoffBase = 20 * time.Millisecond
+	mconn, f := openTestConn(t, mm)
+	defer os.Remove(f.Name())
+	events := make(chan Event, 16)
+	mconn.AddConnListener(events)
+
+	// the key cannot be loaded, as the test manager has no key file
+	resp := make(chan sessionResponse, 1)
+	mm.eventq <- refreshSession{mconn.boundSession().sessionId, "", untilSuccess, resp, CloseNetworkError}
+	timeout := time.After(5 * time.Second)
+	for attempt := 0; attempt < 2; {
+		select {
+		case e := <-events:
+			if r, ok := e.(Reconnecting); ok {
+				attempt = r.Attempt
+			}
+		case <-timeout:
+			t.Fatal("no reconnection attempt")
+		}
+	}
+	mconn.close(CloseGraceful)
+
+	select {
+	case r := <-resp:
+		if !errors.Is(r.err, ErrConnClosed) {
+			t.Errorf("unexpected refresh %+v", r)
+		}
+	case <-timeout:
+		t.Fatal("the refresh of the closed connection did not stop")
+	}
+}
+
+// The connection closed while reconnecting is closed at once, rather than waiting for the binding of the refresh.
+func TestCloseReconnectingConn(t *testing.T) {
+	mm := newTestManager(t)
+	defer mm.Finish()
+	mm.appConfig.ReconnectBackoffBase = 20 * time.Millisecond
+	mconn, f := openTestConn(t, mm)
+	defer os.Remove(f.Name())
+	events := make(chan Event, 16)
+	mconn.AddConnListener(events)
+
+	// the key cannot be loaded, as the test manager has no key file
+	resp := make(chan sessionResponse, 1)
+	mm.eventq <- refreshSession{mconn.boundSession().sessionId, "", untilSuccess, resp, CloseNetworkError}
+	timeout := time.After(5 * time.Second)
+	for reconnecting := false; !reconnecting; {
+		select {
+		case e := <-events:
+			_, reconnecting = e.(Reconnecting)
+		case <-timeout:
+			t.Fatal("no reconnection attempt")
+		}
+	}
+
+	closed := make(chan error, 1)
+	mm.eventq <- closeConnection{mconn.connId, closed, CloseGraceful}
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the reconnecting connection is not closed")
+	}
+	select {
+	case r := <-resp:
+		if !errors.Is(r.err, ErrConnClosed) {
+			t.Errorf("unexpected refresh %+v", r)
+		}
+	case <-timeout:
+		t.Fatal("the refresh of the closed connection did not stop")
+	}
+}
+
+// Run it with -race. The graceful close of the connection waiting for the next reconnection gives up the refresh at once.
+func TestCloseGracefulWhileReconnecting(t *testing.T) {
+	mm := newTestManager(t)
+	defer mm.Finish()
+	mm.appConfig.ReconnectBackoffBase = time.Minute
+	mconn, f := openTestConn(t, mm)
+	defer os.Remove(f.Name())
+	events := make(chan Event, 16)
+	mconn.AddConnListener(events)
+
+	// the key cannot be loaded, as the test manager has no key file, so the second attempt waits a minute
+	resp := make(chan sessionResponse, 1)
+	mm.eventq <- refreshSession{mconn.boundSession().sessionId, "", untilSuccess, resp, CloseNetworkError}
+	timeout := time.After(5 * time.Second)
+	for attempt := 0; attempt < 2; {
+		select {
+		case e := <-events:
+			if r, ok := e.(Reconnecting); ok {
+				attempt = r.Attempt
+			}
+		case <-timeout:
+			t.Fatal("no reconnection attempt")
+		}
+	}
+	if err := mconn.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case r := <-resp:
+		if !errors.Is(r.err, ErrConnClosed) {
+			t.Errorf("unexpected refresh %+v", r)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the refresh of the closed connection waits for the next attempt")
+	}
+	for {
+		select {
+		case e := <-events:
+			if e, ok := e.(ConnectionClosed); ok {
+				if e.Reason != CloseGraceful {
+					t.Errorf("closed by %s, expected %s", e.Reason, CloseGraceful)
+				}
+				return
+			}
+		case <-timeout:
+			t.Fatal("no ConnectionClosed")
+		}
+	}
+}
+
+func TestNilResponseChannels(t *testing.T) {
+	mm := newTestManager(t)
+	defer mm.Finish()
+	// the refresh of a stuck session loads the session without waiting for its binding.
+	// A stuck session is refreshed once, so the refreshes are of different sessions.
+	mm.sessionMutex.Lock()
+	mm.stuckSessions[5] = 0
+	mm.stuckSessions[7] = 0
+	mm.sessionMutex.Unlock()
+
+	events := []func(resp chan sessionResponse) Event{
+		func(resp chan sessionResponse) Event { return newsession{0, "", "127.0.0.1:1", false, resp, nil, ""} },
+		func(resp chan sessionResponse) Event { return loadsession{0, "", "", resp, ""} },
+		func(resp chan sessionResponse) Event { return renewSession{6, "", "127.0.0.1:1", false, resp} },
+		func(resp chan sessionResponse) Event {
+			if resp == nil {
+				return refreshSession{7, "", noRetry, resp, CloseNetworkError}
+			}
+			return refreshSession{5, "", noRetry, resp, CloseNetworkError}
+		},
+		func(resp chan sessionResponse) Event { return discardSession{0, 6, resp} },
+	}
+	for _, event := range events {
+		mm.eventq <- event(nil)
+		// the same handling with a channel tells the handler of the nil channel is done as well
+		resp := make(chan sessionResponse, 1)
+		mm.eventq <- event(resp)
+		select {
+		case r := <-resp:
+			if r.err == nil {
+				t.Errorf("%T succeeds: %+v", event(nil), r)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%T is not handled", event(nil))
+		}
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	mm := newTestManager(t)
+	defer mm.Finish()
+
+	sub := mm.Subscribe()
+	mconn, f := openTestConn(t, mm)
+	defer os.Remove(f.Name())
+	timeout := time.After(5 * time.Second)
+wait:
+	for {
+		select {
+		case e := <-sub:
+			if opened, ok := e.(ConnectionOpened); ok && opened.ConnId() == mconn.connId {
+				break wait
+			}
+		case <-timeout:
+			t.Fatal("no ConnectionOpened")
+		}
+	}
+
+	// a subscriber not reading does not block the manager, and misses the events over its buffer
+	for i := 0; i < subscriberQueueSize*2; i++ {
+		mm.publish(Reconnecting{ConnId: mconn.connId, Attempt: i})
+	}
+	if n := len(sub); n != subscriberQueueSize {
+		t.Errorf("%d events are buffered", n)
+	}
+	// the internal events are not published
+	mm.Unsubscribe(sub)
+	sub = mm.Subscribe()
+	mm.publish(closeConnection{connId: mconn.connId})
+	if n := len(sub); n != 0 {
+		t.Errorf("%d internal events are published", n)
+	}
+
+	mm.Unsubscribe(sub)
+	for range sub {
+	}
+}
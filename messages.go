@@ -0,0 +1,790 @@
+package mtproto
+
+import (
+	"fmt"
+	"golang.org/x/net/context"
+)
+
+// SendOption sets an optional field of messages.sendMessage.
+type SendOption func(req *ReqMessagesSendMessage)
+
+// WithReplyTo sends the message as a reply to the message of msgId.
+func WithReplyTo(msgId int32) SendOption {
+	return func(req *ReqMessagesSendMessage) {
+		req.Flags |= 1 << 0
+		req.ReplyToMsgId = msgId
+	}
+}
+
+// WithNoWebpage disables the link preview of the message.
+func WithNoWebpage() SendOption {
+	return func(req *ReqMessagesSendMessage) {
+		req.Flags |= 1 << 1
+	}
+}
+
+// WithSilent sends the message without notification.
+func WithSilent() SendOption {
+	return func(req *ReqMessagesSendMessage) {
+		req.Flags |= 1 << 5
+	}
+}
+
+// WithEntities sets the formatting of the message, e.g., by ParseMarkdown or ParseHTML.
+func WithEntities(entities []*TypeMessageEntity) SendOption {
+	return func(req *ReqMessagesSendMessage) {
+		if len(entities) > 0 {
+			req.Flags |= 1 << 3
+			req.Entities = entities
+		}
+	}
+}
+
+// MessagesSendMessage sends a text message to the peer.
+func (mconn *Conn) MessagesSendMessage(peer *TypeInputPeer, message string, opts ...SendOption) (*TypeUpdates, error) {
+	return sendMessage(mconn, peer, message, opts...)
+}
+
+// MessagesSendMessageContext is MessagesSendMessage which gives up on ctx done.
+func (mconn *Conn) MessagesSendMessageContext(ctx context.Context, peer *TypeInputPeer, message string, opts ...SendOption) (*TypeUpdates, error) {
+	return sendMessage(mconn.contextRPC(ctx), peer, message, opts...)
+}
+
+func sendMessage(rpc RemoteProcedureCall, peer *TypeInputPeer, message string, opts ...SendOption) (*TypeUpdates, error) {
+	req := &ReqMessagesSendMessage{
+		Peer:     peer,
+		Message:  message,
+		RandomId: randInt63(rpcRandSource(rpc)),
+	}
+	for _, opt := range opts {
+		opt(req)
+	}
+	return RPCaller{rpc}.MessagesSendMessage(context.Background(), req)
+}
+
+// EditOption sets an optional field of messages.editMessage.
+type EditOption func(req *ReqMessagesEditMessage)
+
+// WithEditReplyMarkup replaces the reply markup of the message.
+func WithEditReplyMarkup(markup *TypeReplyMarkup) EditOption {
+	return func(req *ReqMessagesEditMessage) {
+		req.Flags |= 1 << 2
+		req.ReplyMarkup = markup
+	}
+}
+
+// WithEditEntities sets the entities of the new text.
+func WithEditEntities(entities []*TypeMessageEntity) EditOption {
+	return func(req *ReqMessagesEditMessage) {
+		req.Flags |= 1 << 3
+		req.Entities = entities
+	}
+}
+
+// WithEditNoWebpage disables the link preview of the new text.
+func WithEditNoWebpage() EditOption {
+	return func(req *ReqMessagesEditMessage) {
+		req.Flags |= 1 << 1
+	}
+}
+
+// MessagesEditMessage replaces the text of the message of msgId in the peer.
+// It fails with MessageNotModifiedError if nothing changes, and with MessageEditTimeExpiredError
+// if the message is too old to edit.
+func (mconn *Conn) MessagesEditMessage(peer *TypeInputPeer, msgId int32, newText string, opts ...EditOption) (*TypeUpdates, error) {
+	return editMessage(mconn, peer, msgId, newText, opts...)
+}
+
+// MessagesEditMessageContext is MessagesEditMessage which gives up on ctx done.
+func (mconn *Conn) MessagesEditMessageContext(ctx context.Context, peer *TypeInputPeer, msgId int32, newText string, opts ...EditOption) (*TypeUpdates, error) {
+	return editMessage(mconn.contextRPC(ctx), peer, msgId, newText, opts...)
+}
+
+func editMessage(rpc RemoteProcedureCall, peer *TypeInputPeer, msgId int32, newText string, opts ...EditOption) (*TypeUpdates, error) {
+	req := &ReqMessagesEditMessage{
+		Flags:   1 << 11,
+		Peer:    peer,
+		Id:      msgId,
+		Message: newText,
+	}
+	for _, opt := range opts {
+		opt(req)
+	}
+	return RPCaller{rpc}.MessagesEditMessage(context.Background(), req)
+}
+
+// maxForwardMessages is the number of messages messages.forwardMessages takes at most
+const maxForwardMessages = 100
+
+// ForwardOption sets an optional field of messages.forwardMessages.
+type ForwardOption func(req *ReqMessagesForwardMessages)
+
+// WithForwardSilent forwards the messages without notification.
+func WithForwardSilent() ForwardOption {
+	return func(req *ReqMessagesForwardMessages) {
+		req.Flags |= 1 << 5
+	}
+}
+
+// WithForwardBackground forwards the messages in the background.
+func WithForwardBackground() ForwardOption {
+	return func(req *ReqMessagesForwardMessages) {
+		req.Flags |= 1 << 6
+	}
+}
+
+// MessagesForwardMessages forwards the messages of ids in fromPeer to toPeer.
+// It takes 100 messages at most, and fails on more rather than forwarding a part of them.
+// Layer 71 has no drop_author, so the forwarded messages keep their authors.
+func (mconn *Conn) MessagesForwardMessages(fromPeer *TypeInputPeer, ids []int32, toPeer *TypeInputPeer, opts ...ForwardOption) (*TypeUpdates, error) {
+	return forwardMessages(mconn, fromPeer, ids, toPeer, opts...)
+}
+
+// MessagesForwardMessagesContext is MessagesForwardMessages which gives up on ctx done.
+func (mconn *Conn) MessagesForwardMessagesContext(ctx context.Context, fromPeer *TypeInputPeer, ids []int32, toPeer *TypeInputPeer, opts ...ForwardOption) (*TypeUpdates, error) {
+	return forwardMessages(mconn.contextRPC(ctx), fromPeer, ids, toPeer, opts...)
+}
+
+func forwardMessages(rpc RemoteProcedureCall, fromPeer *TypeInputPeer, ids []int32, toPeer *TypeInputPeer, opts ...ForwardOption) (*TypeUpdates, error) {
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("no message to forward")
+	}
+	if len(ids) > maxForwardMessages {
+		return nil, fmt.Errorf("cannot forward %d messages at once, %d at most", len(ids), maxForwardMessages)
+	}
+	source := rpcRandSource(rpc)
+	randomIds := make([]int64, len(ids))
+	for i := range randomIds {
+		randomIds[i] = randInt63(source)
+	}
+	req := &ReqMessagesForwardMessages{
+		FromPeer: fromPeer,
+		Id:       ids,
+		RandomId: randomIds,
+		ToPeer:   toPeer,
+	}
+	for _, opt := range opts {
+		opt(req)
+	}
+	return RPCaller{rpc}.MessagesForwardMessages(context.Background(), req)
+}
+
+// InputMediaUploadedPhoto is the photo uploaded by UploadFile, to send by MessagesSendMedia.
+func InputMediaUploadedPhoto(file *TypeInputFile) *TypeInputMedia {
+	return &TypeInputMedia{&TypeInputMedia_InputMediaUploadedPhoto{&PredInputMediaUploadedPhoto{
+		File: file,
+	}}}
+}
+
+// InputMediaUploadedDocument is the file uploaded by UploadFile, to send by MessagesSendMedia.
+// The file name is the name given to UploadFile.
+func InputMediaUploadedDocument(file *TypeInputFile, mimeType string, attributes ...*TypeDocumentAttribute) *TypeInputMedia {
+	var filename string
+	switch x := file.GetValue().(type) {
+	case *TypeInputFile_InputFile:
+		filename = x.InputFile.GetName()
+	case *TypeInputFile_InputFileBig:
+		filename = x.InputFileBig.GetName()
+	}
+	if filename != "" {
+		attributes = append(attributes, &TypeDocumentAttribute{&TypeDocumentAttribute_DocumentAttributeFilename{
+			&PredDocumentAttributeFilename{FileName: filename},
+		}})
+	}
+	return &TypeInputMedia{&TypeInputMedia_InputMediaUploadedDocument{&PredInputMediaUploadedDocument{
+		File:       file,
+		MimeType:   mimeType,
+		Attributes: attributes,
+	}}}
+}
+
+// MessagesSendMedia sends the media to the peer with the caption.
+// Of the SendOptions, WithReplyTo and WithSilent apply to the media.
+// In layer 71, the caption is a field of the uploaded photo or document, and it has no entities.
+func (mconn *Conn) MessagesSendMedia(peer *TypeInputPeer, media *TypeInputMedia, caption string, opts ...SendOption) (*TypeUpdates, error) {
+	return sendMedia(mconn, peer, media, caption, opts...)
+}
+
+// MessagesSendMediaContext is MessagesSendMedia which gives up on ctx done.
+func (mconn *Conn) MessagesSendMediaContext(ctx context.Context, peer *TypeInputPeer, media *TypeInputMedia, caption string, opts ...SendOption) (*TypeUpdates, error) {
+	return sendMedia(mconn.contextRPC(ctx), peer, media, caption, opts...)
+}
+
+func sendMedia(rpc RemoteProcedureCall, peer *TypeInputPeer, media *TypeInputMedia, caption string, opts ...SendOption) (*TypeUpdates, error) {
+	switch x := media.GetValue().(type) {
+	case *TypeInputMedia_InputMediaUploadedPhoto:
+		x.InputMediaUploadedPhoto.Caption = caption
+	case *TypeInputMedia_InputMediaUploadedDocument:
+		x.InputMediaUploadedDocument.Caption = caption
+	case *TypeInputMedia_InputMediaPhoto:
+		x.InputMediaPhoto.Caption = caption
+	case *TypeInputMedia_InputMediaDocument:
+		x.InputMediaDocument.Caption = caption
+	default:
+		if caption != "" {
+			return nil, fmt.Errorf("the media of %T has no caption", x)
+		}
+	}
+
+	// the options of messages.sendMessage share the flags of reply_to_msg_id and silent
+	options := &ReqMessagesSendMessage{}
+	for _, opt := range opts {
+		opt(options)
+	}
+	req := &ReqMessagesSendMedia{
+		Flags:        options.Flags & (1<<0 | 1<<5),
+		Peer:         peer,
+		ReplyToMsgId: options.ReplyToMsgId,
+		Media:        media,
+		RandomId:     randInt63(rpcRandSource(rpc)),
+	}
+	return RPCaller{rpc}.MessagesSendMedia(context.Background(), req)
+}
+
+// MessagesReadHistory marks the messages up to maxId in the dialog as read.
+// Zero maxId marks all the messages. A channel peer is read by ChannelsReadHistory, and the result is nil for it.
+// For the other peers, the pts of the session advances by the result.
+func (mconn *Conn) MessagesReadHistory(peer *TypeInputPeer, maxId int32) (*PredMessagesAffectedMessages, error) {
+	return mconn.MessagesReadHistoryContext(context.Background(), peer, maxId)
+}
+
+// MessagesReadHistoryContext is MessagesReadHistory which gives up on ctx done.
+func (mconn *Conn) MessagesReadHistoryContext(ctx context.Context, peer *TypeInputPeer, maxId int32) (*PredMessagesAffectedMessages, error) {
+	affected, err := readHistory(mconn.contextRPC(ctx), peer, maxId)
+	if err != nil || affected == nil {
+		return affected, err
+	}
+	return affected, mconn.advancePts(affected)
+}
+
+// advancePts advances the pts of the session by the affected messages
+func (mconn *Conn) advancePts(affected *PredMessagesAffectedMessages) error {
+	session, err := mconn.Session()
+	if err != nil {
+		return err
+	}
+	session.withUpdatesState(func(state *PredUpdatesState) {
+		if !advancePts(state, affected.Pts, affected.PtsCount) {
+			logf(mconn, "pts gap, pts %d, pts count %d, state %d\n", affected.Pts, affected.PtsCount, state.Pts)
+		}
+	})
+	return nil
+}
+
+// ChannelsReadHistory marks the messages up to maxId in the channel as read.
+func (mconn *Conn) ChannelsReadHistory(channel *TypeInputChannel, maxId int32) error {
+	return channelsReadHistory(mconn, channel, maxId)
+}
+
+// ChannelsReadHistoryContext is ChannelsReadHistory which gives up on ctx done.
+func (mconn *Conn) ChannelsReadHistoryContext(ctx context.Context, channel *TypeInputChannel, maxId int32) error {
+	return channelsReadHistory(mconn.contextRPC(ctx), channel, maxId)
+}
+
+func readHistory(rpc RemoteProcedureCall, peer *TypeInputPeer, maxId int32) (*PredMessagesAffectedMessages, error) {
+	if x, ok := peer.GetValue().(*TypeInputPeer_InputPeerChannel); ok {
+		channel := &TypeInputChannel{&TypeInputChannel_InputChannel{&PredInputChannel{
+			ChannelId:  x.InputPeerChannel.ChannelId,
+			AccessHash: x.InputPeerChannel.AccessHash,
+		}}}
+		return nil, channelsReadHistory(rpc, channel, maxId)
+	}
+	return affectedMessages(rpc.InvokeBlocked(&ReqMessagesReadHistory{
+		Peer:  peer,
+		MaxId: maxId,
+	}))
+}
+
+func affectedMessages(data interface{}, err error) (*PredMessagesAffectedMessages, error) {
+	if err != nil {
+		return nil, err
+	}
+	affected, ok := data.(*PredMessagesAffectedMessages)
+	if !ok {
+		return nil, fmt.Errorf("RPC: %#v", data)
+	}
+	return affected, nil
+}
+
+// MessagesDeleteMessages deletes the messages of ids in the private chats and the groups.
+// With revoke, the messages are deleted for everyone. The pts of the session advances by the result.
+func (mconn *Conn) MessagesDeleteMessages(ids []int32, revoke bool) (*PredMessagesAffectedMessages, error) {
+	return mconn.MessagesDeleteMessagesContext(context.Background(), ids, revoke)
+}
+
+// MessagesDeleteMessagesContext is MessagesDeleteMessages which gives up on ctx done.
+func (mconn *Conn) MessagesDeleteMessagesContext(ctx context.Context, ids []int32, revoke bool) (*PredMessagesAffectedMessages, error) {
+	affected, err := deleteMessages(mconn.contextRPC(ctx), ids, revoke)
+	if err != nil {
+		return nil, err
+	}
+	return affected, mconn.advancePts(affected)
+}
+
+// ChannelsDeleteMessages deletes the messages of ids in the channel.
+// The result is of the pts of the channel, which the session does not keep.
+func (mconn *Conn) ChannelsDeleteMessages(channel *TypeInputChannel, ids []int32) (*PredMessagesAffectedMessages, error) {
+	return channelsDeleteMessages(mconn, channel, ids)
+}
+
+// ChannelsDeleteMessagesContext is ChannelsDeleteMessages which gives up on ctx done.
+func (mconn *Conn) ChannelsDeleteMessagesContext(ctx context.Context, channel *TypeInputChannel, ids []int32) (*PredMessagesAffectedMessages, error) {
+	return channelsDeleteMessages(mconn.contextRPC(ctx), channel, ids)
+}
+
+func deleteMessages(rpc RemoteProcedureCall, ids []int32, revoke bool) (*PredMessagesAffectedMessages, error) {
+	req := &ReqMessagesDeleteMessages{Id: ids}
+	if revoke {
+		req.Flags |= 1 << 0
+	}
+	return affectedMessages(rpc.InvokeBlocked(req))
+}
+
+func channelsDeleteMessages(rpc RemoteProcedureCall, channel *TypeInputChannel, ids []int32) (*PredMessagesAffectedMessages, error) {
+	return affectedMessages(rpc.InvokeBlocked(&ReqChannelsDeleteMessages{
+		Channel: channel,
+		Id:      ids,
+	}))
+}
+
+func channelsReadHistory(rpc RemoteProcedureCall, channel *TypeInputChannel, maxId int32) error {
+	data, err := rpc.InvokeBlocked(&ReqChannelsReadHistory{
+		Channel: channel,
+		MaxId:   maxId,
+	})
+	if err != nil {
+		return err
+	}
+	if tl, ok := data.(TL); !ok || !toBool(tl) {
+		return fmt.Errorf("RPC: %#v", data)
+	}
+	return nil
+}
+
+// MessagesUpdatePinnedMessage pins the message of msgId in the peer, or unpins the pinned message if unpin is set.
+// With silent, the members are not notified of the pin. It fails with ChatAdminRequiredError if the user may not pin.
+// Layer 71 pins the messages only in channels and supergroups, so the peer must be a channel.
+func (mconn *Conn) MessagesUpdatePinnedMessage(peer *TypeInputPeer, msgId int32, unpin, silent bool) (*TypeUpdates, error) {
+	return updatePinnedMessage(mconn, peer, msgId, unpin, silent)
+}
+
+// MessagesUpdatePinnedMessageContext is MessagesUpdatePinnedMessage which gives up on ctx done.
+func (mconn *Conn) MessagesUpdatePinnedMessageContext(ctx context.Context, peer *TypeInputPeer, msgId int32, unpin, silent bool) (*TypeUpdates, error) {
+	return updatePinnedMessage(mconn.contextRPC(ctx), peer, msgId, unpin, silent)
+}
+
+func updatePinnedMessage(rpc RemoteProcedureCall, peer *TypeInputPeer, msgId int32, unpin, silent bool) (*TypeUpdates, error) {
+	x, ok := peer.GetValue().(*TypeInputPeer_InputPeerChannel)
+	if !ok {
+		return nil, fmt.Errorf("no pinned message in peer %v", peer)
+	}
+	req := &ReqChannelsUpdatePinnedMessage{
+		Channel: &TypeInputChannel{&TypeInputChannel_InputChannel{&PredInputChannel{
+			ChannelId:  x.InputPeerChannel.ChannelId,
+			AccessHash: x.InputPeerChannel.AccessHash,
+		}}},
+		Id: msgId,
+	}
+	if unpin {
+		// the pinned message is replaced with none
+		req.Id = 0
+	}
+	if silent {
+		req.Flags |= 1 << 0
+	}
+	return RPCaller{rpc}.ChannelsUpdatePinnedMessage(context.Background(), req)
+}
+
+// TypingAction is the action of MessagesSetTyping while typing a message.
+func TypingAction() *TypeSendMessageAction {
+	return &TypeSendMessageAction{&TypeSendMessageAction_SendMessageTypingAction{&PredSendMessageTypingAction{}}}
+}
+
+// UploadPhotoAction is the action of MessagesSetTyping while uploading a photo, with the progress in percent.
+func UploadPhotoAction(progress int32) *TypeSendMessageAction {
+	return &TypeSendMessageAction{&TypeSendMessageAction_SendMessageUploadPhotoAction{
+		&PredSendMessageUploadPhotoAction{Progress: progress},
+	}}
+}
+
+// CancelAction is the action of MessagesSetTyping to clear the indicator.
+func CancelAction() *TypeSendMessageAction {
+	return &TypeSendMessageAction{&TypeSendMessageAction_SendMessageCancelAction{&PredSendMessageCancelAction{}}}
+}
+
+// MessagesSetTyping shows the action, e.g., TypingAction, to the peer.
+// The indicator disappears in about 5 seconds, so send it again every 5 seconds while the action goes on,
+// and send CancelAction at the end. To not wait for the reply, call it in a goroutine.
+func (mconn *Conn) MessagesSetTyping(peer *TypeInputPeer, action *TypeSendMessageAction) error {
+	return setTyping(mconn, peer, action)
+}
+
+// MessagesSetTypingContext is MessagesSetTyping which gives up on ctx done.
+func (mconn *Conn) MessagesSetTypingContext(ctx context.Context, peer *TypeInputPeer, action *TypeSendMessageAction) error {
+	return setTyping(mconn.contextRPC(ctx), peer, action)
+}
+
+func setTyping(rpc RemoteProcedureCall, peer *TypeInputPeer, action *TypeSendMessageAction) error {
+	data, err := rpc.InvokeBlocked(&ReqMessagesSetTyping{
+		Peer:   peer,
+		Action: action,
+	})
+	if err != nil {
+		return err
+	}
+	if tl, ok := data.(TL); !ok || !toBool(tl) {
+		return fmt.Errorf("RPC: %#v", data)
+	}
+	return nil
+}
+
+// History is a page of the messages in a dialog, from the newest to the oldest.
+type History struct {
+	Messages []*TypeMessage
+	Chats    []*TypeChat
+	Users    []*TypeUser
+
+	// Count is the number of all the messages in the dialog.
+	Count int32
+	// Pts is the pts of the channel, if the dialog is a channel.
+	Pts int32
+	// NextOffsetId is the offsetId of the older page. It is zero once a page has no messages or all of Count,
+	// so the oldest page may be followed by an empty one.
+	NextOffsetId int32
+}
+
+// MessagesGetHistory reads limit messages older than the message of offsetId.
+// Zero offsetId reads from the newest message. The server caps limit at 100, so the page may be shorter.
+// To read the whole dialog, page backward until NextOffsetId is zero;
+//
+//	for offsetId := int32(0); ; {
+//		history, err := mconn.MessagesGetHistory(peer, offsetId, 100)
+//		if err != nil {
+//			return err
+//		}
+//		// handle history.Messages
+//		if offsetId = history.NextOffsetId; offsetId == 0 {
+//			break
+//		}
+//	}
+//
+// Layer 71 has no offset_id_offset, so the position of the page is not known but the total Count.
+func (mconn *Conn) MessagesGetHistory(peer *TypeInputPeer, offsetId int32, limit int32) (*History, error) {
+	return getHistory(mconn, peer, offsetId, limit)
+}
+
+// MessagesGetHistoryContext is MessagesGetHistory which gives up on ctx done.
+func (mconn *Conn) MessagesGetHistoryContext(ctx context.Context, peer *TypeInputPeer, offsetId int32, limit int32) (*History, error) {
+	return getHistory(mconn.contextRPC(ctx), peer, offsetId, limit)
+}
+
+func getHistory(rpc RemoteProcedureCall, peer *TypeInputPeer, offsetId int32, limit int32) (*History, error) {
+	data, err := rpc.InvokeBlocked(&ReqMessagesGetHistory{
+		Peer:     peer,
+		OffsetId: offsetId,
+		Limit:    limit,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return toHistory(data)
+}
+
+// toHistory makes a page from messages.Messages.
+// A page shorter than the limit is not the last, because the server caps the limit.
+func toHistory(data interface{}) (*History, error) {
+	history := new(History)
+	slice := true
+	switch x := data.(type) {
+	case *PredMessagesMessages:
+		// all the messages
+		history.Messages, history.Chats, history.Users = x.Messages, x.Chats, x.Users
+		history.Count = int32(len(x.Messages))
+		slice = false
+	case *PredMessagesMessagesSlice:
+		history.Messages, history.Chats, history.Users = x.Messages, x.Chats, x.Users
+		history.Count = x.Count
+	case *PredMessagesChannelMessages:
+		history.Messages, history.Chats, history.Users = x.Messages, x.Chats, x.Users
+		history.Count = x.Count
+		history.Pts = x.Pts
+	default:
+		return nil, fmt.Errorf("RPC: %#v", data)
+	}
+
+	if slice && len(history.Messages) > 0 && int32(len(history.Messages)) < history.Count {
+		for _, m := range history.Messages {
+			if id := messageId(m); id > 0 && (history.NextOffsetId == 0 || id < history.NextOffsetId) {
+				history.NextOffsetId = id
+			}
+		}
+	}
+	return history, nil
+}
+
+// Messages are the messages got by their ids, with the chats and the users they refer to.
+type Messages struct {
+	// Messages are in the order of the ids.
+	// The message of an id deleted, or never sent, is nil, for the server returns messageEmpty for it.
+	Messages []*TypeMessage
+	Chats    []*TypeChat
+	Users    []*TypeUser
+}
+
+// MessagesGetMessages returns the messages of the ids in the private chats and the basic groups.
+// The messages of a channel are got by ChannelsGetMessages.
+func (mconn *Conn) MessagesGetMessages(ids []int32) (*Messages, error) {
+	return getMessages(mconn, ids)
+}
+
+// MessagesGetMessagesContext is MessagesGetMessages which gives up on ctx done.
+func (mconn *Conn) MessagesGetMessagesContext(ctx context.Context, ids []int32) (*Messages, error) {
+	return getMessages(mconn.contextRPC(ctx), ids)
+}
+
+// ChannelsGetMessages returns the messages of the ids in the channel.
+// The channel needs its access hash, e.g., of ContactsResolveUsername or of the chats of a response.
+func (mconn *Conn) ChannelsGetMessages(channel *TypeInputChannel, ids []int32) (*Messages, error) {
+	return channelsGetMessages(mconn, channel, ids)
+}
+
+// ChannelsGetMessagesContext is ChannelsGetMessages which gives up on ctx done.
+func (mconn *Conn) ChannelsGetMessagesContext(ctx context.Context, channel *TypeInputChannel, ids []int32) (*Messages, error) {
+	return channelsGetMessages(mconn.contextRPC(ctx), channel, ids)
+}
+
+func getMessages(rpc RemoteProcedureCall, ids []int32) (*Messages, error) {
+	resp, err := RPCaller{rpc}.MessagesGetMessages(context.Background(), &ReqMessagesGetMessages{Id: ids})
+	if err != nil {
+		return nil, err
+	}
+	return messagesOf(resp, ids), nil
+}
+
+func channelsGetMessages(rpc RemoteProcedureCall, channel *TypeInputChannel, ids []int32) (*Messages, error) {
+	if c := channel.GetInputChannel(); c == nil || c.AccessHash == 0 {
+		return nil, fmt.Errorf("no access hash of the channel %v", channel)
+	}
+	resp, err := RPCaller{rpc}.ChannelsGetMessages(context.Background(), &ReqChannelsGetMessages{Channel: channel, Id: ids})
+	if err != nil {
+		return nil, err
+	}
+	return messagesOf(resp, ids), nil
+}
+
+// messagesOf orders the messages of messages.Messages by the ids, leaving out the empty ones
+func messagesOf(resp *TypeMessagesMessages, ids []int32) *Messages {
+	var raw []*TypeMessage
+	messages := new(Messages)
+	switch x := resp.GetValue().(type) {
+	case *TypeMessagesMessages_MessagesMessages:
+		raw, messages.Chats, messages.Users = x.MessagesMessages.Messages, x.MessagesMessages.Chats, x.MessagesMessages.Users
+	case *TypeMessagesMessages_MessagesMessagesSlice:
+		raw, messages.Chats, messages.Users = x.MessagesMessagesSlice.Messages, x.MessagesMessagesSlice.Chats, x.MessagesMessagesSlice.Users
+	case *TypeMessagesMessages_MessagesChannelMessages:
+		raw, messages.Chats, messages.Users = x.MessagesChannelMessages.Messages, x.MessagesChannelMessages.Chats, x.MessagesChannelMessages.Users
+	}
+
+	byId := make(map[int32]*TypeMessage)
+	for _, m := range raw {
+		if m.GetMessageEmpty() == nil {
+			byId[messageId(m)] = m
+		}
+	}
+	messages.Messages = make([]*TypeMessage, len(ids))
+	for i, id := range ids {
+		messages.Messages[i] = byId[id]
+	}
+	return messages
+}
+
+// FilterPhotos is the filter of MessagesSearch for the photos.
+func FilterPhotos() *TypeMessagesFilter {
+	return &TypeMessagesFilter{&TypeMessagesFilter_InputMessagesFilterPhotos{&PredInputMessagesFilterPhotos{}}}
+}
+
+// FilterDocuments is the filter of MessagesSearch for the documents.
+func FilterDocuments() *TypeMessagesFilter {
+	return &TypeMessagesFilter{&TypeMessagesFilter_InputMessagesFilterDocument{&PredInputMessagesFilterDocument{}}}
+}
+
+// FilterLinks is the filter of MessagesSearch for the messages with links.
+func FilterLinks() *TypeMessagesFilter {
+	return &TypeMessagesFilter{&TypeMessagesFilter_InputMessagesFilterUrl{&PredInputMessagesFilterUrl{}}}
+}
+
+// MessagesSearch reads limit messages matching the query and the filter, older than the message of offsetId.
+// A nil filter matches all the messages. Page backward until NextOffsetId is zero, as MessagesGetHistory.
+func (mconn *Conn) MessagesSearch(peer *TypeInputPeer, query string, filter *TypeMessagesFilter, offsetId, limit int32) (*History, error) {
+	return search(mconn, peer, query, filter, offsetId, limit)
+}
+
+// MessagesSearchContext is MessagesSearch which gives up on ctx done.
+func (mconn *Conn) MessagesSearchContext(ctx context.Context, peer *TypeInputPeer, query string, filter *TypeMessagesFilter, offsetId, limit int32) (*History, error) {
+	return search(mconn.contextRPC(ctx), peer, query, filter, offsetId, limit)
+}
+
+func search(rpc RemoteProcedureCall, peer *TypeInputPeer, query string, filter *TypeMessagesFilter, offsetId, limit int32) (*History, error) {
+	if filter == nil {
+		filter = &TypeMessagesFilter{&TypeMessagesFilter_InputMessagesFilterEmpty{&PredInputMessagesFilterEmpty{}}}
+	}
+	data, err := rpc.InvokeBlocked(&ReqMessagesSearch{
+		Peer:     peer,
+		Q:        query,
+		Filter:   filter,
+		OffsetId: offsetId,
+		Limit:    limit,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return toHistory(data)
+}
+
+// GlobalSearch is a page of the messages found in all the dialogs, from the newest to the oldest.
+// The slices are empty, not nil, when nothing is found.
+type GlobalSearch struct {
+	Messages []*TypeMessage
+	Chats    []*TypeChat
+	Users    []*TypeUser
+
+	// Count is the number of all the found messages.
+	Count int32
+	// NextOffsetDate, NextOffsetPeer, and NextOffsetId are the offsets of the older page.
+	// NextOffsetPeer is nil once a page has no messages or all of Count, as History.NextOffsetId.
+	NextOffsetDate int32
+	NextOffsetPeer *TypeInputPeer
+	NextOffsetId   int32
+}
+
+// MessagesSearchGlobal reads limit messages matching the query in all the dialogs,
+// older than the offsets of the previous page. The first page has zero offsets and nil offsetPeer;
+//
+//	var date, id int32
+//	var peer *TypeInputPeer
+//	for {
+//		found, err := mconn.MessagesSearchGlobal(query, date, peer, id, 100)
+//		if err != nil {
+//			return err
+//		}
+//		// handle found.Messages
+//		if found.NextOffsetPeer == nil {
+//			break
+//		}
+//		date, peer, id = found.NextOffsetDate, found.NextOffsetPeer, found.NextOffsetId
+//	}
+//
+// Layer 71 pages by the date, the peer, and the id of the last message, rather than by next_rate.
+func (mconn *Conn) MessagesSearchGlobal(query string, offsetDate int32, offsetPeer *TypeInputPeer, offsetId, limit int32) (*GlobalSearch, error) {
+	return searchGlobal(mconn, query, offsetDate, offsetPeer, offsetId, limit)
+}
+
+// MessagesSearchGlobalContext is MessagesSearchGlobal which gives up on ctx done.
+func (mconn *Conn) MessagesSearchGlobalContext(ctx context.Context, query string, offsetDate int32, offsetPeer *TypeInputPeer, offsetId, limit int32) (*GlobalSearch, error) {
+	return searchGlobal(mconn.contextRPC(ctx), query, offsetDate, offsetPeer, offsetId, limit)
+}
+
+func searchGlobal(rpc RemoteProcedureCall, query string, offsetDate int32, offsetPeer *TypeInputPeer, offsetId, limit int32) (*GlobalSearch, error) {
+	if offsetPeer == nil {
+		offsetPeer = &TypeInputPeer{&TypeInputPeer_InputPeerEmpty{&PredInputPeerEmpty{}}}
+	}
+	data, err := rpc.InvokeBlocked(&ReqMessagesSearchGlobal{
+		Q:          query,
+		OffsetDate: offsetDate,
+		OffsetPeer: offsetPeer,
+		OffsetId:   offsetId,
+		Limit:      limit,
+	})
+	if err != nil {
+		return nil, err
+	}
+	history, err := toHistory(data)
+	if err != nil {
+		return nil, err
+	}
+
+	found := &GlobalSearch{
+		Messages: history.Messages,
+		Chats:    history.Chats,
+		Users:    history.Users,
+		Count:    history.Count,
+	}
+	if found.Messages == nil {
+		found.Messages = []*TypeMessage{}
+	}
+	if found.Chats == nil {
+		found.Chats = []*TypeChat{}
+	}
+	if found.Users == nil {
+		found.Users = []*TypeUser{}
+	}
+	if history.NextOffsetId != 0 {
+		last := found.Messages[len(found.Messages)-1]
+		peer, date := messagePeer(last)
+		if found.NextOffsetPeer = inputPeer(peer, found.Chats, found.Users); found.NextOffsetPeer != nil {
+			found.NextOffsetDate = date
+			found.NextOffsetId = messageId(last)
+		}
+	}
+	return found, nil
+}
+
+// messagePeer returns the dialog and the date of the message
+func messagePeer(m *TypeMessage) (*TypePeer, int32) {
+	var out bool
+	var fromId, date int32
+	var to *TypePeer
+	switch x := m.GetValue().(type) {
+	case *TypeMessage_Message:
+		out, fromId, date, to = x.Message.Flags&(1<<1) != 0, x.Message.FromId, x.Message.Date, x.Message.ToId
+	case *TypeMessage_MessageService:
+		out, fromId, date, to = x.MessageService.Flags&(1<<1) != 0, x.MessageService.FromId, x.MessageService.Date, x.MessageService.ToId
+	default:
+		return nil, 0
+	}
+	// the dialog of an incoming private message is of the sender
+	if to.GetPeerUser() != nil && !out {
+		return &TypePeer{&TypePeer_PeerUser{&PredPeerUser{UserId: fromId}}}, date
+	}
+	return to, date
+}
+
+// inputPeer finds the access hash of the peer in the chats and the users, and returns the input peer.
+// It returns nil if the peer is not found.
+func inputPeer(peer *TypePeer, chats []*TypeChat, users []*TypeUser) *TypeInputPeer {
+	switch x := peer.GetValue().(type) {
+	case *TypePeer_PeerUser:
+		for _, u := range users {
+			if user := u.GetUser(); user != nil && user.Id == x.PeerUser.UserId {
+				return &TypeInputPeer{&TypeInputPeer_InputPeerUser{&PredInputPeerUser{
+					UserId:     user.Id,
+					AccessHash: user.AccessHash,
+				}}}
+			}
+		}
+	case *TypePeer_PeerChat:
+		return &TypeInputPeer{&TypeInputPeer_InputPeerChat{&PredInputPeerChat{ChatId: x.PeerChat.ChatId}}}
+	case *TypePeer_PeerChannel:
+		for _, c := range chats {
+			if channel := c.GetChannel(); channel != nil && channel.Id == x.PeerChannel.ChannelId {
+				return &TypeInputPeer{&TypeInputPeer_InputPeerChannel{&PredInputPeerChannel{
+					ChannelId:  channel.Id,
+					AccessHash: channel.AccessHash,
+				}}}
+			}
+		}
+	}
+	return nil
+}
+
+func messageId(m *TypeMessage) int32 {
+	switch x := m.GetValue().(type) {
+	case *TypeMessage_Message:
+		return x.Message.GetId()
+	case *TypeMessage_MessageService:
+		return x.MessageService.GetId()
+	case *TypeMessage_MessageEmpty:
+		return x.MessageEmpty.GetId()
+	}
+	return 0
+}
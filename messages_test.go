@@ -0,0 +1,516 @@
+package mtproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"testing"
+)
+
+// recordRPC keeps the requests, and responds with resp
+type recordRPC struct {
+	reqs []TL
+	resp interface{}
+}
+
+func (r *recordRPC) InvokeBlocked(msg TL) (interface{}, error) {
+	r.reqs = append(r.reqs, msg)
+	return r.resp, nil
+}
+
+func TestSendMessageEncoding(t *testing.T) {
+	rpc := &recordRPC{resp: &PredUpdateShortSentMessage{Id: 10}}
+	peer := &TypeInputPeer{&TypeInputPeer_InputPeerSelf{&PredInputPeerSelf{}}}
+	updates, err := sendMessage(rpc, peer, "hi", WithReplyTo(5), WithNoWebpage(), WithSilent())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updates.GetUpdateShortSentMessage().GetId() != 10 {
+		t.Errorf("unexpected updates: %v", updates)
+	}
+
+	req := rpc.reqs[0].(*ReqMessagesSendMessage)
+	expected, _ := hex.DecodeString(
+		"7a4288fa" + // messages.sendMessage
+			"23000000" + // flags: reply_to_msg_id, no_webpage, silent
+			"c97ea07d" + // inputPeerSelf
+			"05000000" + // reply_to_msg_id
+			"02686900") // message
+	randomId := make([]byte, 8)
+	binary.LittleEndian.PutUint64(randomId, uint64(req.RandomId))
+	expected = append(expected, randomId...)
+
+	if encoded := req.encode(); !bytes.Equal(encoded, expected) {
+		t.Errorf("expected %x, but %x", expected, encoded)
+	}
+}
+
+// historyRPC serves the messages with ids from count down to 1, as messages.messagesSlice pages
+// of up to 100 messages, as the server caps the limit.
+type historyRPC struct {
+	count   int32
+	offsets []int32
+}
+
+func (r *historyRPC) InvokeBlocked(msg TL) (interface{}, error) {
+	req := msg.(*ReqMessagesGetHistory)
+	r.offsets = append(r.offsets, req.OffsetId)
+	from := r.count
+	if req.OffsetId != 0 {
+		from = req.OffsetId - 1
+	}
+	var messages []*TypeMessage
+	for id := from; id > 0 && int32(len(messages)) < req.Limit && len(messages) < 100; id-- {
+		messages = append(messages, &TypeMessage{&TypeMessage_Message{&PredMessage{Id: id}}})
+	}
+	return &PredMessagesMessagesSlice{Count: r.count, Messages: messages}, nil
+}
+
+// pageHistory pages backward the whole history of limit messages, and returns the ids of the messages
+func pageHistory(t *testing.T, rpc RemoteProcedureCall, limit int32) []int32 {
+	peer := &TypeInputPeer{&TypeInputPeer_InputPeerSelf{&PredInputPeerSelf{}}}
+	var ids []int32
+	for offsetId := int32(0); ; {
+		history, err := getHistory(rpc, peer, offsetId, limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range history.Messages {
+			ids = append(ids, messageId(m))
+		}
+		if offsetId = history.NextOffsetId; offsetId == 0 {
+			return ids
+		}
+	}
+}
+
+func TestGetHistoryPages(t *testing.T) {
+	rpc := &historyRPC{count: 5}
+	ids := pageHistory(t, rpc, 3)
+	// the last page is not known to be the last until the empty one
+	if fmt.Sprint(ids) != "[5 4 3 2 1]" || fmt.Sprint(rpc.offsets) != "[0 3 1]" {
+		t.Errorf("unexpected pages: ids %v, offsets %v", ids, rpc.offsets)
+	}
+
+	// the limit over the cap of the server
+	rpc = &historyRPC{count: 250}
+	if ids := pageHistory(t, rpc, 200); len(ids) != 250 || ids[249] != 1 {
+		t.Errorf("read %d messages", len(ids))
+	}
+	if fmt.Sprint(rpc.offsets) != "[0 151 51 1]" {
+		t.Errorf("unexpected offsets %v", rpc.offsets)
+	}
+
+	// all the messages in a page
+	rpc = &historyRPC{count: 2}
+	if ids := pageHistory(t, rpc, 3); fmt.Sprint(ids) != "[2 1]" || len(rpc.offsets) != 1 {
+		t.Errorf("unexpected pages: ids %v, offsets %v", ids, rpc.offsets)
+	}
+}
+
+// mediaRPC accepts the uploaded parts, and responds to messages.sendMedia with the id of the new message
+type mediaRPC struct {
+	parts int
+	req   *ReqMessagesSendMedia
+}
+
+func (r *mediaRPC) InvokeBlocked(msg TL) (interface{}, error) {
+	switch x := msg.(type) {
+	case *ReqUploadSaveFilePart:
+		r.parts++
+		return &PredBoolTrue{}, nil
+	case *ReqMessagesSendMedia:
+		r.req = x
+		return &PredUpdates{Updates: []*TypeUpdate{
+			{&TypeUpdate_UpdateMessageID{&PredUpdateMessageID{Id: 42, RandomId: x.RandomId}}},
+		}}, nil
+	}
+	return nil, fmt.Errorf("unexpected request %T", msg)
+}
+
+func TestUploadAndSendMedia(t *testing.T) {
+	rpc := &mediaRPC{}
+	file, err := uploadFile(rpc, bytes.NewReader(make([]byte, UploadPartSize+1)), "report.pdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := &TypeInputPeer{&TypeInputPeer_InputPeerSelf{&PredInputPeerSelf{}}}
+	media := InputMediaUploadedDocument(file, "application/pdf")
+	updates, err := sendMedia(rpc, peer, media, "monthly report", WithReplyTo(7), WithNoWebpage())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rpc.parts != 2 {
+		t.Errorf("expected 2 uploaded parts, but %d", rpc.parts)
+	}
+	if id := updates.GetUpdates().GetUpdates()[0].GetUpdateMessageID(); id.GetId() != 42 || id.GetRandomId() != rpc.req.RandomId {
+		t.Errorf("unexpected updates %v", updates)
+	}
+	if rpc.req.Flags != 1 || rpc.req.ReplyToMsgId != 7 {
+		t.Errorf("unexpected flags %b, reply to %d", rpc.req.Flags, rpc.req.ReplyToMsgId)
+	}
+	document := rpc.req.Media.GetInputMediaUploadedDocument()
+	if document.GetCaption() != "monthly report" || document.GetMimeType() != "application/pdf" ||
+		document.GetAttributes()[0].GetDocumentAttributeFilename().GetFileName() != "report.pdf" {
+		t.Errorf("unexpected media %v", document)
+	}
+	if document.GetFile() != file {
+		t.Errorf("the uploaded file is not attached")
+	}
+
+	if _, err := sendMedia(rpc, peer, &TypeInputMedia{&TypeInputMedia_InputMediaEmpty{&PredInputMediaEmpty{}}}, "caption"); err == nil {
+		t.Errorf("a caption is sent with the empty media")
+	}
+}
+
+func TestReadHistoryByPeer(t *testing.T) {
+	rpc := &recordRPC{resp: &PredMessagesAffectedMessages{Pts: 11, PtsCount: 1}}
+	user := &TypeInputPeer{&TypeInputPeer_InputPeerUser{&PredInputPeerUser{UserId: 1, AccessHash: 2}}}
+	affected, err := readHistory(rpc, user, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req, ok := rpc.reqs[0].(*ReqMessagesReadHistory); !ok || req.MaxId != 100 || affected.Pts != 11 {
+		t.Errorf("unexpected request %#v, result %v", rpc.reqs[0], affected)
+	}
+
+	rpc = &recordRPC{resp: &PredBoolTrue{}}
+	channel := &TypeInputPeer{&TypeInputPeer_InputPeerChannel{&PredInputPeerChannel{ChannelId: 3, AccessHash: 4}}}
+	if affected, err := readHistory(rpc, channel, 200); err != nil || affected != nil {
+		t.Fatalf("unexpected result %v, %v", affected, err)
+	}
+	req, ok := rpc.reqs[0].(*ReqChannelsReadHistory)
+	if !ok {
+		t.Fatalf("unexpected request %#v", rpc.reqs[0])
+	}
+	if c := req.Channel.GetInputChannel(); c.GetChannelId() != 3 || c.GetAccessHash() != 4 || req.MaxId != 200 {
+		t.Errorf("unexpected channel %v", req)
+	}
+}
+
+// Run it with -race. The pts advanced by the callers races with the updates of the read routine.
+func TestAdvancePtsConcurrently(t *testing.T) {
+	mm := newTestManager(t)
+	defer mm.Finish()
+	mconn, f := openTestConn(t, mm)
+	defer os.Remove(f.Name())
+	session := mconn.boundSession()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for pts := int32(1); pts <= 100; pts++ {
+			session.process(GenerateMessageId(), 2, &PredUpdateShortMessage{Pts: pts, PtsCount: 1, Date: pts})
+		}
+	}()
+	for pts := int32(1); pts <= 100; pts++ {
+		if err := mconn.advancePts(&PredMessagesAffectedMessages{Pts: pts, PtsCount: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+	if state := session.copyUpdatesState(); state.Pts != 100 {
+		t.Errorf("unexpected pts %d", state.Pts)
+	}
+}
+
+func TestDeleteMessages(t *testing.T) {
+	rpc := &recordRPC{resp: &PredMessagesAffectedMessages{Pts: 12, PtsCount: 2}}
+	affected, err := deleteMessages(rpc, []int32{5, 6}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if affected.Pts != 12 || affected.PtsCount != 2 {
+		t.Errorf("unexpected result %v", affected)
+	}
+	expected, _ := hex.DecodeString(
+		"d2958ee5" + // messages.deleteMessages
+			"01000000" + // flags: revoke
+			"15c4b51c" + "02000000" + "05000000" + "06000000") // id
+	if encoded := rpc.reqs[0].encode(); !bytes.Equal(encoded, expected) {
+		t.Errorf("expected %x, but %x", expected, encoded)
+	}
+
+	rpc = &recordRPC{resp: &PredMessagesAffectedMessages{Pts: 3, PtsCount: 1}}
+	channel := &TypeInputChannel{&TypeInputChannel_InputChannel{&PredInputChannel{ChannelId: 3, AccessHash: 4}}}
+	if _, err := channelsDeleteMessages(rpc, channel, []int32{7}); err != nil {
+		t.Fatal(err)
+	}
+	if req, ok := rpc.reqs[0].(*ReqChannelsDeleteMessages); !ok || req.Channel != channel || fmt.Sprint(req.Id) != "[7]" {
+		t.Errorf("unexpected request %#v", rpc.reqs[0])
+	}
+}
+
+func TestEditMessageEncoding(t *testing.T) {
+	rpc := &recordRPC{resp: &PredUpdates{}}
+	peer := &TypeInputPeer{&TypeInputPeer_InputPeerSelf{&PredInputPeerSelf{}}}
+	if _, err := editMessage(rpc, peer, 9, "done", WithEditNoWebpage()); err != nil {
+		t.Fatal(err)
+	}
+	expected, _ := hex.DecodeString(
+		"cae491ce" + // messages.editMessage
+			"02080000" + // flags: no_webpage, message
+			"c97ea07d" + // inputPeerSelf
+			"09000000" + // id
+			"04646f6e65000000") // message
+	if encoded := rpc.reqs[0].encode(); !bytes.Equal(encoded, expected) {
+		t.Errorf("expected %x, but %x", expected, encoded)
+	}
+}
+
+func TestUpdatePinnedMessageEncoding(t *testing.T) {
+	peer := &TypeInputPeer{&TypeInputPeer_InputPeerChannel{&PredInputPeerChannel{ChannelId: 1, AccessHash: 2}}}
+	for _, c := range []struct {
+		unpin, silent bool
+		expected      string
+	}{
+		{false, true,
+			"52ed2da7" + // channels.updatePinnedMessage
+				"01000000" + // flags: silent
+				"2e71ebaf" + // inputChannel
+				"01000000" + // channel_id
+				"0200000000000000" + // access_hash
+				"09000000"}, // id
+		{true, false,
+			"52ed2da7" + // channels.updatePinnedMessage
+				"00000000" + // flags
+				"2e71ebaf" + // inputChannel
+				"01000000" + // channel_id
+				"0200000000000000" + // access_hash
+				"00000000"}, // id: none
+	} {
+		rpc := &recordRPC{resp: &PredUpdates{}}
+		if _, err := updatePinnedMessage(rpc, peer, 9, c.unpin, c.silent); err != nil {
+			t.Fatal(err)
+		}
+		expected, _ := hex.DecodeString(c.expected)
+		if encoded := rpc.reqs[0].encode(); !bytes.Equal(encoded, expected) {
+			t.Errorf("unpin %v: expected %x, but %x", c.unpin, expected, encoded)
+		}
+	}
+
+	rpc := &recordRPC{}
+	self := &TypeInputPeer{&TypeInputPeer_InputPeerSelf{&PredInputPeerSelf{}}}
+	if _, err := updatePinnedMessage(rpc, self, 9, false, false); err == nil || len(rpc.reqs) != 0 {
+		t.Errorf("a message is pinned in a private chat")
+	}
+	if _, ok := toError(TL_rpc_error{errorBadRequest, "CHAT_ADMIN_REQUIRED"}).(ChatAdminRequiredError); !ok {
+		t.Errorf("CHAT_ADMIN_REQUIRED is not a ChatAdminRequiredError")
+	}
+}
+
+func TestForwardMessages(t *testing.T) {
+	rpc := &recordRPC{resp: &PredUpdates{}}
+	from := &TypeInputPeer{&TypeInputPeer_InputPeerSelf{&PredInputPeerSelf{}}}
+	to := &TypeInputPeer{&TypeInputPeer_InputPeerUser{&PredInputPeerUser{UserId: 1, AccessHash: 2}}}
+	if _, err := forwardMessages(rpc, from, []int32{3, 4, 5}, to, WithForwardSilent()); err != nil {
+		t.Fatal(err)
+	}
+	req := rpc.reqs[0].(*ReqMessagesForwardMessages)
+	if len(req.RandomId) != len(req.Id) {
+		t.Fatalf("%d random ids for %d messages", len(req.RandomId), len(req.Id))
+	}
+	seen := make(map[int64]bool)
+	for _, id := range req.RandomId {
+		if seen[id] {
+			t.Errorf("duplicated random id %d", id)
+		}
+		seen[id] = true
+	}
+	if req.Flags != 1<<5 || req.FromPeer != from || req.ToPeer != to {
+		t.Errorf("unexpected request %v", req)
+	}
+
+	if _, err := forwardMessages(rpc, from, make([]int32, maxForwardMessages+1), to); err == nil {
+		t.Errorf("too many messages are forwarded")
+	}
+	if len(rpc.reqs) != 1 {
+		t.Errorf("a part of the messages is forwarded")
+	}
+}
+
+func TestSetTypingCancel(t *testing.T) {
+	rpc := &recordRPC{resp: &PredBoolTrue{}}
+	peer := &TypeInputPeer{&TypeInputPeer_InputPeerSelf{&PredInputPeerSelf{}}}
+	if err := setTyping(rpc, peer, CancelAction()); err != nil {
+		t.Fatal(err)
+	}
+	expected, _ := hex.DecodeString(
+		"505e82a3" + // messages.setTyping
+			"c97ea07d" + // inputPeerSelf
+			"f5c85efd") // sendMessageCancelAction
+	if encoded := rpc.reqs[0].encode(); !bytes.Equal(encoded, expected) {
+		t.Errorf("expected %x, but %x", expected, encoded)
+	}
+}
+
+// searchRPC serves the found messages of a channel, ids from count down to 1
+type searchRPC struct {
+	count int32
+	reqs  []*ReqMessagesSearch
+}
+
+func (r *searchRPC) InvokeBlocked(msg TL) (interface{}, error) {
+	req := msg.(*ReqMessagesSearch)
+	r.reqs = append(r.reqs, req)
+	from := r.count
+	if req.OffsetId != 0 {
+		from = req.OffsetId - 1
+	}
+	var messages []*TypeMessage
+	for id := from; id > 0 && int32(len(messages)) < req.Limit; id-- {
+		messages = append(messages, &TypeMessage{&TypeMessage_Message{&PredMessage{Id: id}}})
+	}
+	return &PredMessagesChannelMessages{Count: r.count, Pts: 77, Messages: messages}, nil
+}
+
+func TestSearchPages(t *testing.T) {
+	rpc := &searchRPC{count: 5}
+	peer := &TypeInputPeer{&TypeInputPeer_InputPeerChannel{&PredInputPeerChannel{ChannelId: 1, AccessHash: 2}}}
+
+	first, err := search(rpc, peer, "report", FilterDocuments(), 0, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := search(rpc, peer, "report", FilterDocuments(), first.NextOffsetId, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(first.Messages) != 3 || first.NextOffsetId != 3 || len(second.Messages) != 2 || second.NextOffsetId != 1 {
+		t.Errorf("unexpected pages, %d messages to %d, %d messages to %d",
+			len(first.Messages), first.NextOffsetId, len(second.Messages), second.NextOffsetId)
+	}
+	if last, err := search(rpc, peer, "report", FilterDocuments(), second.NextOffsetId, 3); err != nil ||
+		len(last.Messages) != 0 || last.NextOffsetId != 0 {
+		t.Errorf("unexpected last page %v, %v", last, err)
+	}
+	if first.Pts != 77 || first.Count != 5 {
+		t.Errorf("unexpected channel page, pts %d, count %d", first.Pts, first.Count)
+	}
+	for _, req := range rpc.reqs {
+		if req.Q != "report" || req.Filter.GetInputMessagesFilterDocument() == nil {
+			t.Errorf("unexpected request %v", req)
+		}
+	}
+}
+
+// globalSearchRPC serves the found messages in pages of the offsets
+type globalSearchRPC struct {
+	reqs []*ReqMessagesSearchGlobal
+}
+
+func (r *globalSearchRPC) InvokeBlocked(msg TL) (interface{}, error) {
+	req := msg.(*ReqMessagesSearchGlobal)
+	r.reqs = append(r.reqs, req)
+	message := func(id, date int32, to *TypePeer) *TypeMessage {
+		return &TypeMessage{&TypeMessage_Message{&PredMessage{Id: id, Date: date, FromId: 9, ToId: to}}}
+	}
+	channel := &TypePeer{&TypePeer_PeerChannel{&PredPeerChannel{ChannelId: 3}}}
+	self := &TypePeer{&TypePeer_PeerUser{&PredPeerUser{UserId: 1}}}
+	if req.OffsetId == 0 {
+		return &PredMessagesMessagesSlice{
+			Count:    3,
+			Messages: []*TypeMessage{message(30, 300, channel), message(20, 200, self)},
+			Chats:    []*TypeChat{{&TypeChat_Channel{&PredChannel{Id: 3, AccessHash: 4}}}},
+			Users:    []*TypeUser{{&TypeUser_User{&PredUser{Id: 9, AccessHash: 10}}}},
+		}, nil
+	}
+	if req.OffsetId == 20 {
+		return &PredMessagesMessagesSlice{
+			Count:    3,
+			Messages: []*TypeMessage{message(10, 100, channel)},
+			Chats:    []*TypeChat{{&TypeChat_Channel{&PredChannel{Id: 3, AccessHash: 4}}}},
+		}, nil
+	}
+	return &PredMessagesMessagesSlice{Count: 3}, nil
+}
+
+func TestSearchGlobalPages(t *testing.T) {
+	rpc := &globalSearchRPC{}
+	first, err := searchGlobal(rpc, "report", 0, nil, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the last message is an incoming private message, so the next page is of its sender
+	if peer := first.NextOffsetPeer.GetInputPeerUser(); peer.GetUserId() != 9 || peer.GetAccessHash() != 10 ||
+		first.NextOffsetDate != 200 || first.NextOffsetId != 20 {
+		t.Fatalf("unexpected offsets %d, %v, %d", first.NextOffsetDate, first.NextOffsetPeer, first.NextOffsetId)
+	}
+
+	second, err := searchGlobal(rpc, "report", first.NextOffsetDate, first.NextOffsetPeer, first.NextOffsetId, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(second.Messages) != 1 || second.NextOffsetId != 10 {
+		t.Errorf("unexpected second page %v", second)
+	}
+	last, err := searchGlobal(rpc, "report", second.NextOffsetDate, second.NextOffsetPeer, second.NextOffsetId, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(last.Messages) != 0 || last.NextOffsetPeer != nil {
+		t.Errorf("unexpected last page %v", last)
+	}
+	if last.Chats == nil || last.Users == nil {
+		t.Errorf("nil slices of the empty results")
+	}
+	if req := rpc.reqs[1]; req.OffsetDate != 200 || req.OffsetId != 20 || req.OffsetPeer != first.NextOffsetPeer {
+		t.Errorf("unexpected request of the second page %v", req)
+	}
+	if rpc.reqs[0].OffsetPeer.GetInputPeerEmpty() == nil {
+		t.Errorf("the first page is not from the empty peer")
+	}
+}
+
+func TestGetMessages(t *testing.T) {
+	rpc := &recordRPC{resp: &PredMessagesMessages{
+		Messages: []*TypeMessage{
+			// out of the order of the ids
+			{&TypeMessage_MessageService{&PredMessageService{Id: 3}}},
+			{&TypeMessage_Message{&PredMessage{Id: 1, FromId: 5, Message: "hi"}}},
+			// deleted
+			{&TypeMessage_MessageEmpty{&PredMessageEmpty{Id: 2}}},
+		},
+		Users: []*TypeUser{{&TypeUser_User{&PredUser{Id: 5}}}},
+	}}
+	messages, err := getMessages(rpc, []int32{1, 2, 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req := rpc.reqs[0].(*ReqMessagesGetMessages); fmt.Sprint(req.Id) != "[1 2 3]" {
+		t.Errorf("unexpected request %v", req)
+	}
+	m := messages.Messages
+	if len(m) != 3 || m[0].GetMessage().GetMessage() != "hi" || m[1] != nil || m[2].GetMessageService().GetId() != 3 {
+		t.Errorf("unexpected messages %v", m)
+	}
+	if len(messages.Users) != 1 {
+		t.Errorf("unexpected users %v", messages.Users)
+	}
+}
+
+func TestChannelsGetMessages(t *testing.T) {
+	rpc := &recordRPC{resp: &PredMessagesChannelMessages{
+		Messages: []*TypeMessage{{&TypeMessage_Message{&PredMessage{Id: 7}}}},
+		Chats:    []*TypeChat{{&TypeChat_Channel{&PredChannel{Id: 3, AccessHash: 4}}}},
+	}}
+	noHash := &TypeInputChannel{&TypeInputChannel_InputChannel{&PredInputChannel{ChannelId: 3}}}
+	if _, err := channelsGetMessages(rpc, noHash, []int32{7}); err == nil || len(rpc.reqs) != 0 {
+		t.Errorf("got the messages without the access hash")
+	}
+
+	channel := &TypeInputChannel{&TypeInputChannel_InputChannel{&PredInputChannel{ChannelId: 3, AccessHash: 4}}}
+	messages, err := channelsGetMessages(rpc, channel, []int32{7, 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req := rpc.reqs[0].(*ReqChannelsGetMessages); req.Channel != channel || fmt.Sprint(req.Id) != "[7 8]" {
+		t.Errorf("unexpected request %v", req)
+	}
+	if m := messages.Messages; len(m) != 2 || m[0].GetMessage().GetId() != 7 || m[1] != nil || len(messages.Chats) != 1 {
+		t.Errorf("unexpected messages %v", messages)
+	}
+}
@@ -0,0 +1,83 @@
+package mtproto
+
+import (
+	"reflect"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// MetricsCollector receives the metrics of the RPCs and the reconnections.
+// Its methods are called on the send and the receive routines, so they should not block.
+// See the prommetrics package for a Prometheus collector.
+type MetricsCollector interface {
+	// IncRPC counts an RPC by its TL method name, e.g., messages.sendMessage.
+	// The code is 0 on success, -1 on timeout, -2 on the cancellation of its context,
+	// and the error code of an RPC error otherwise.
+	IncRPC(method string, code int)
+	// ObserveRPCLatency observes the time from the send of an RPC to its reply.
+	ObserveRPCLatency(method string, d time.Duration)
+	// IncReconnect counts the renewals and the refreshes of the sessions.
+	IncReconnect()
+}
+
+const (
+	rpcCodeTimeout  = -1
+	rpcCodeCanceled = -2
+)
+
+type noopMetrics struct{}
+
+func (noopMetrics) IncRPC(method string, code int)                   {}
+func (noopMetrics) ObserveRPCLatency(method string, d time.Duration) {}
+func (noopMetrics) IncReconnect()                                    {}
+
+// metrics is MetricsCollector, or the no-op collector if it is not set
+func (appConfig Configuration) metrics() MetricsCollector {
+	if appConfig.MetricsCollector == nil {
+		return noopMetrics{}
+	}
+	return appConfig.MetricsCollector
+}
+
+// sentRPC is an RPC waiting for its reply
+type sentRPC struct {
+	method string
+	sentAt time.Time
+}
+
+// tlNamespaces are the namespaces of the layer 71 methods
+var tlNamespaces = []string{
+	"account", "auth", "bots", "channels", "contacts", "help", "langpack", "messages",
+	"payments", "phone", "photos", "stickers", "updates", "upload", "users",
+}
+
+// rpcMethodName returns the TL name of the request, e.g., messages.sendMessage of ReqMessagesSendMessage.
+func rpcMethodName(msg TL) string {
+	t := reflect.TypeOf(msg)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	name := t.Name()
+	if strings.HasPrefix(name, "TL_") {
+		// the service messages, e.g., TL_ping
+		return name[len("TL_"):]
+	}
+	name = strings.TrimPrefix(name, "Req")
+	for _, ns := range tlNamespaces {
+		rest := strings.TrimPrefix(name, strings.Title(ns))
+		if rest == name || rest == "" {
+			continue
+		}
+		if r, _ := utf8.DecodeRuneInString(rest); unicode.IsUpper(r) {
+			return ns + "." + lowerFirst(rest)
+		}
+	}
+	return lowerFirst(name)
+}
+
+func lowerFirst(s string) string {
+	r, n := utf8.DecodeRuneInString(s)
+	return string(unicode.ToLower(r)) + s[n:]
+}
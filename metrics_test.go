@@ -0,0 +1,20 @@
+package mtproto
+
+import "testing"
+
+func TestRPCMethodName(t *testing.T) {
+	for _, c := range []struct {
+		msg  TL
+		name string
+	}{
+		{&ReqMessagesSendMessage{}, "messages.sendMessage"},
+		{&ReqHelpGetConfig{}, "help.getConfig"},
+		{&ReqUploadSaveBigFilePart{}, "upload.saveBigFilePart"},
+		{&ReqInvokeWithLayer{}, "invokeWithLayer"},
+		{TL_ping{}, "ping"},
+	} {
+		if name := rpcMethodName(c.msg); name != c.name {
+			t.Errorf("%T: %s, expected %s", c.msg, name, c.name)
+		}
+	}
+}
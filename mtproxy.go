@@ -0,0 +1,378 @@
+package mtproto
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MTProxy is a Telegram proxy server.
+// See https://core.telegram.org/mtproto/mtproto-transports#transport-obfuscation
+type MTProxy struct {
+	Addr string
+
+	// Secret is either the 16 bytes hex secret, the secure secret prefixed by dd,
+	// or the fake-TLS secret prefixed by ee and followed by the hex of the domain.
+	// Base64 encoded secrets are accepted as well.
+	Secret string
+}
+
+type mtproxySecret struct {
+	key     []byte // 16 bytes
+	padded  bool   // requires the padded intermediate transport
+	fakeTLS bool
+	domain  string
+}
+
+func parseMTProxySecret(s string) (*mtproxySecret, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		b, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+		if err != nil {
+			return nil, fmt.Errorf("invalid MTProxy secret: neither hex nor base64")
+		}
+	}
+	switch {
+	case len(b) == 16:
+		return &mtproxySecret{key: b}, nil
+	case len(b) == 17 && b[0] == 0xdd:
+		return &mtproxySecret{key: b[1:], padded: true}, nil
+	case len(b) > 17 && b[0] == 0xee:
+		return &mtproxySecret{key: b[1:17], padded: true, fakeTLS: true, domain: string(b[17:])}, nil
+	}
+	return nil, fmt.Errorf("invalid MTProxy secret: unknown form of %d bytes", len(b))
+}
+
+// The DCs of the well-known addresses. The addresses in help.getConfig are added on the config.
+var (
+	dcMutex sync.Mutex
+	dcIds   = map[string]int16{
+		"149.154.175.50":  1,
+		"149.154.175.53":  1,
+		"149.154.167.50":  2,
+		"149.154.167.51":  2,
+		"149.154.175.100": 3,
+		"149.154.167.91":  4,
+		"149.154.167.92":  4,
+		"149.154.171.5":   5,
+		"91.108.56.100":   5,
+		"91.108.56.130":   5,
+		"149.154.175.10":  -1, // test DCs
+		"149.154.167.40":  -2,
+		"149.154.175.117": -3,
+	}
+)
+
+func registerDC(id int32, addr string) {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		dcMutex.Lock()
+		dcIds[host] = int16(id)
+		dcMutex.Unlock()
+	}
+}
+
+func dcIdOf(addr string) (int16, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return 0, err
+	}
+	dcMutex.Lock()
+	defer dcMutex.Unlock()
+	id, ok := dcIds[host]
+	if !ok {
+		return 0, fmt.Errorf("unknown DC of %s", addr)
+	}
+	return id, nil
+}
+
+// dialMTProxy connects to the DC of addr through the proxy
+func dialMTProxy(appConfig Configuration, conn net.Conn, addr string, t transport) (net.Conn, error) {
+	secret, err := parseMTProxySecret(appConfig.MTProxy.Secret)
+	if err != nil {
+		return nil, err
+	}
+	dc, err := dcIdOf(addr)
+	if err != nil {
+		return nil, err
+	}
+	if secret.fakeTLS {
+		conn, err = fakeTLSHandshake(conn, secret)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// the random has the obfuscation keys, so it is of crypto/rand rather than Configuration.RandSource
+	random := make([]byte, 64)
+	for {
+		if _, err := io.ReadFull(crand.Reader, random); err != nil {
+			return nil, err
+		}
+		if validObfuscatedRandom(random) {
+			break
+		}
+	}
+	init, encryptor, decryptor, err := obfuscatedInit(random, t.protocolTag(), dc, secret.key)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(init); err != nil {
+		return nil, err
+	}
+	return &obfuscatedConn{conn, encryptor, decryptor}, nil
+}
+
+// The random of the init packet must not look like the other protocols
+func validObfuscatedRandom(random []byte) bool {
+	if random[0] == 0xef {
+		return false
+	}
+	switch binary.LittleEndian.Uint32(random) {
+	case 0x44414548, 0x54534f50, 0x20544547, 0x4954504f, 0xdddddddd, 0xeeeeeeee, 0x02010316:
+		// HEAD, POST, GET, OPTI, padded intermediate, intermediate, TLS
+		return false
+	}
+	return binary.LittleEndian.Uint32(random[4:]) != 0
+}
+
+// obfuscatedInit makes the 64 bytes init packet of obfuscated2 from random,
+// and returns the ciphers of the connection.
+func obfuscatedInit(random []byte, tag uint32, dc int16, secret []byte) ([]byte, cipher.Stream, cipher.Stream, error) {
+	init := make([]byte, 64)
+	copy(init, random)
+	binary.LittleEndian.PutUint32(init[56:], tag)
+	binary.LittleEndian.PutUint16(init[60:], uint16(dc))
+
+	reversed := make([]byte, 48)
+	for i := range reversed {
+		reversed[i] = init[55-i]
+	}
+	encryptor, err := obfuscatedCipher(init[8:40], init[40:56], secret)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	decryptor, err := obfuscatedCipher(reversed[:32], reversed[32:], secret)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	// only the tail of the init packet is encrypted
+	encrypted := make([]byte, 64)
+	encryptor.XORKeyStream(encrypted, init)
+	copy(init[56:], encrypted[56:])
+	return init, encryptor, decryptor, nil
+}
+
+func obfuscatedCipher(key, iv, secret []byte) (cipher.Stream, error) {
+	if secret != nil {
+		h := sha256.Sum256(append(append([]byte{}, key...), secret...))
+		key = h[:]
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewCTR(block, iv), nil
+}
+
+// obfuscatedConn encrypts all the bytes after the init packet with AES-256-CTR
+type obfuscatedConn struct {
+	net.Conn
+	encryptor cipher.Stream
+	decryptor cipher.Stream
+}
+
+func (c *obfuscatedConn) Write(b []byte) (int, error) {
+	encrypted := make([]byte, len(b))
+	c.encryptor.XORKeyStream(encrypted, b)
+	return c.Conn.Write(encrypted)
+}
+
+func (c *obfuscatedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.decryptor.XORKeyStream(b[:n], b[:n])
+	return n, err
+}
+
+const (
+	tlsRecordHandshake        = 0x16
+	tlsRecordChangeCipherSpec = 0x14
+	tlsRecordApplicationData  = 0x17
+	tlsMaxRecordSize          = 16384
+)
+
+// fakeTLSHandshake sends the ClientHello signed by the secret, and verifies the response of the proxy.
+func fakeTLSHandshake(conn net.Conn, secret *mtproxySecret) (net.Conn, error) {
+	hello, err := fakeTLSClientHello(secret, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(hello); err != nil {
+		return nil, err
+	}
+
+	// ServerHello, ChangeCipherSpec, and ApplicationData
+	var response []byte
+	for _, recordType := range []byte{tlsRecordHandshake, tlsRecordChangeCipherSpec, tlsRecordApplicationData} {
+		record, err := readTLSRecord(conn)
+		if err != nil {
+			return nil, err
+		}
+		if record[0] != recordType {
+			return nil, fmt.Errorf("fake-TLS: unexpected record type 0x%x", record[0])
+		}
+		response = append(response, record...)
+	}
+	if len(response) < 43 {
+		return nil, errors.New("fake-TLS: short ServerHello")
+	}
+
+	// server random = HMAC(secret, client random + response with zero server random)
+	serverRandom := append([]byte{}, response[11:43]...)
+	for i := 11; i < 43; i++ {
+		response[i] = 0
+	}
+	mac := hmac.New(sha256.New, secret.key)
+	mac.Write(hello[11:43])
+	mac.Write(response)
+	if !hmac.Equal(mac.Sum(nil), serverRandom) {
+		return nil, errors.New("fake-TLS: wrong server digest")
+	}
+	return &fakeTLSConn{Conn: conn}, nil
+}
+
+// fakeTLSClientHello makes a ClientHello to the domain of the secret.
+// Its random is the HMAC of the hello by the secret, whose last 4 bytes are XORed by the timestamp.
+func fakeTLSClientHello(secret *mtproxySecret, now time.Time) ([]byte, error) {
+	random := func(n int) []byte {
+		b := make([]byte, n)
+		crand.Read(b)
+		return b
+	}
+	u16 := func(n int) []byte { return []byte{byte(n >> 8), byte(n)} }
+	ext := func(typ int, data []byte) []byte {
+		return append(append(u16(typ), u16(len(data))...), data...)
+	}
+
+	var extensions []byte
+	serverName := append(append([]byte{0}, u16(len(secret.domain))...), secret.domain...)
+	extensions = append(extensions, ext(0x0000, append(u16(len(serverName)), serverName...))...) // server_name
+	extensions = append(extensions, ext(0x0017, nil)...)                                         // extended_master_secret
+	extensions = append(extensions, ext(0xff01, []byte{0})...)                                   // renegotiation_info
+	extensions = append(extensions, ext(0x000a, []byte{0, 6, 0, 0x1d, 0, 0x17, 0, 0x18})...)     // supported_groups
+	extensions = append(extensions, ext(0x000b, []byte{1, 0})...)                                // ec_point_formats
+	extensions = append(extensions, ext(0x0023, nil)...)                                         // session_ticket
+	alpn := []byte{2, 'h', '2', 8, 'h', 't', 't', 'p', '/', '1', '.', '1'}
+	extensions = append(extensions, ext(0x0010, append(u16(len(alpn)), alpn...))...)      // ALPN
+	extensions = append(extensions, ext(0x000d, []byte{0, 8, 4, 3, 8, 4, 4, 1, 5, 1})...) // signature_algorithms
+	keyShare := append([]byte{0, 0x1d, 0, 32}, random(32)...)
+	extensions = append(extensions, ext(0x0033, append(u16(len(keyShare)), keyShare...))...) // key_share
+	extensions = append(extensions, ext(0x002d, []byte{1, 1})...)                            // psk_key_exchange_modes
+	extensions = append(extensions, ext(0x002b, []byte{4, 3, 4, 3, 3})...)                   // supported_versions
+
+	body := []byte{3, 3}                                          // TLS 1.2
+	body = append(body, make([]byte, 32)...)                      // random
+	body = append(body, 32)                                       // session id
+	body = append(body, random(32)...)                            //
+	body = append(body, 0, 6, 0x13, 0x01, 0x13, 0x02, 0x13, 0x03) // cipher suites
+	body = append(body, 1, 0)                                     // compression methods
+
+	// pad the hello to 517 bytes, as browsers do
+	padding := 512 - 4 - len(body) - 2 - len(extensions) - 4
+	if padding < 0 {
+		return nil, fmt.Errorf("fake-TLS: too long domain %s", secret.domain)
+	}
+	extensions = append(extensions, ext(0x0015, make([]byte, padding))...) // padding
+	body = append(append(body, u16(len(extensions))...), extensions...)
+
+	hello := []byte{tlsRecordHandshake, 3, 1}
+	hello = append(hello, u16(4+len(body))...)
+	hello = append(hello, 1, 0) // ClientHello
+	hello = append(hello, u16(len(body))...)
+	hello = append(hello, body...)
+
+	mac := hmac.New(sha256.New, secret.key)
+	mac.Write(hello)
+	digest := mac.Sum(nil)
+	timestamp := make([]byte, 4)
+	binary.LittleEndian.PutUint32(timestamp, uint32(now.Unix()))
+	for i := range timestamp {
+		digest[28+i] ^= timestamp[i]
+	}
+	copy(hello[11:43], digest)
+	return hello, nil
+}
+
+func readTLSRecord(r io.Reader) ([]byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[1] != 3 || header[2] != 3 {
+		return nil, fmt.Errorf("fake-TLS: unexpected version 0x%x%x", header[1], header[2])
+	}
+	record := make([]byte, 5+int(binary.BigEndian.Uint16(header[3:])))
+	copy(record, header)
+	if _, err := io.ReadFull(r, record[5:]); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// fakeTLSConn carries the bytes in TLS application data records
+type fakeTLSConn struct {
+	net.Conn
+	started bool
+	unread  []byte
+}
+
+func (c *fakeTLSConn) Write(b []byte) (int, error) {
+	var out bytes.Buffer
+	if !c.started {
+		// the client starts with ChangeCipherSpec, as TLS 1.3 compatibility mode
+		out.Write([]byte{tlsRecordChangeCipherSpec, 3, 3, 0, 1, 1})
+		c.started = true
+	}
+	for rest := b; len(rest) > 0; {
+		n := len(rest)
+		if n > tlsMaxRecordSize {
+			n = tlsMaxRecordSize
+		}
+		out.Write([]byte{tlsRecordApplicationData, 3, 3, byte(n >> 8), byte(n)})
+		out.Write(rest[:n])
+		rest = rest[n:]
+	}
+	if _, err := c.Conn.Write(out.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *fakeTLSConn) Read(b []byte) (int, error) {
+	for len(c.unread) == 0 {
+		record, err := readTLSRecord(c.Conn)
+		if err != nil {
+			return 0, err
+		}
+		if record[0] != tlsRecordApplicationData {
+			return 0, fmt.Errorf("fake-TLS: unexpected record type 0x%x", record[0])
+		}
+		c.unread = record[5:]
+	}
+	n := copy(b, c.unread)
+	c.unread = c.unread[n:]
+	return n, nil
+}
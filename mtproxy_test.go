@@ -0,0 +1,111 @@
+package mtproto
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+	"time"
+)
+
+func TestParseMTProxySecret(t *testing.T) {
+	key := "0123456789abcdef0123456789abcdef"
+	for _, tc := range []struct {
+		secret  string
+		padded  bool
+		fakeTLS bool
+		domain  string
+	}{
+		{key, false, false, ""},
+		{"dd" + key, true, false, ""},
+		{"ee" + key + hex.EncodeToString([]byte("example.com")), true, true, "example.com"},
+		{"7gEjRWeJq83vASNFZ4mrze9leGFtcGxlLmNvbQ", true, true, "example.com"}, // base64
+	} {
+		secret, err := parseMTProxySecret(tc.secret)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.secret, err)
+		}
+		if hex.EncodeToString(secret.key) != key || secret.padded != tc.padded || secret.fakeTLS != tc.fakeTLS || secret.domain != tc.domain {
+			t.Errorf("%s: unexpected secret %+v", tc.secret, secret)
+		}
+	}
+	for _, invalid := range []string{"", "0123", "ab" + key, "not a secret"} {
+		if _, err := parseMTProxySecret(invalid); err == nil {
+			t.Errorf("invalid secret %q is parsed", invalid)
+		}
+	}
+}
+
+func TestObfuscatedInit(t *testing.T) {
+	secret, _ := hex.DecodeString("0123456789abcdef0123456789abcdef")
+	random := make([]byte, 64)
+	for i := range random {
+		random[i] = byte(i + 1)
+	}
+	if !validObfuscatedRandom(random) {
+		t.Fatal("valid random is rejected")
+	}
+
+	init, encryptor, decryptor, err := obfuscatedInit(random, paddedIntermediate{}.protocolTag(), 2, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(init[:56], random[:56]) {
+		t.Errorf("the head of the init packet is changed")
+	}
+
+	// the proxy derives the key by sha256(key + secret), and decrypts the tail
+	key := sha256.Sum256(append(append([]byte{}, random[8:40]...), secret...))
+	block, _ := aes.NewCipher(key[:])
+	proxyDecryptor := cipher.NewCTR(block, random[40:56])
+	decrypted := make([]byte, 64)
+	proxyDecryptor.XORKeyStream(decrypted, init)
+	if tag := binary.LittleEndian.Uint32(decrypted[56:]); tag != 0xdddddddd {
+		t.Errorf("unexpected protocol tag %x", tag)
+	}
+	if dc := int16(binary.LittleEndian.Uint16(decrypted[60:])); dc != 2 {
+		t.Errorf("unexpected dc %d", dc)
+	}
+
+	// the following bytes continue the stream
+	b := []byte("payload")
+	encryptor.XORKeyStream(b, b)
+	proxyDecryptor.XORKeyStream(b, b)
+	if string(b) != "payload" {
+		t.Errorf("the stream after the init packet is broken")
+	}
+	if decryptor == nil {
+		t.Errorf("nil decryptor")
+	}
+}
+
+func TestFakeTLSClientHello(t *testing.T) {
+	secret, _ := parseMTProxySecret("ee0123456789abcdef0123456789abcdef" + hex.EncodeToString([]byte("example.com")))
+	now := time.Unix(1500000000, 0)
+	hello, err := fakeTLSClientHello(secret, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hello) != 517 || hello[0] != tlsRecordHandshake || !bytes.Contains(hello, []byte("example.com")) {
+		t.Fatalf("unexpected hello of %d bytes", len(hello))
+	}
+
+	// the proxy checks the digest, and gets the timestamp
+	random := append([]byte{}, hello[11:43]...)
+	zeroed := append([]byte{}, hello...)
+	copy(zeroed[11:43], make([]byte, 32))
+	mac := hmac.New(sha256.New, secret.key)
+	mac.Write(zeroed)
+	digest := mac.Sum(nil)
+	if !bytes.Equal(digest[:28], random[:28]) {
+		t.Errorf("wrong digest")
+	}
+	timestamp := binary.LittleEndian.Uint32(digest[28:]) ^ binary.LittleEndian.Uint32(random[28:])
+	if int64(timestamp) != now.Unix() {
+		t.Errorf("unexpected timestamp %d", timestamp)
+	}
+}
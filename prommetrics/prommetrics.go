@@ -0,0 +1,65 @@
+// Package prommetrics collects the metrics of mtproto with Prometheus.
+//
+//	collector, err := prommetrics.New(prometheus.DefaultRegisterer)
+//	...
+//	config.MetricsCollector = collector
+package prommetrics
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/cjongseok/mtproto"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var _ mtproto.MetricsCollector = (*Collector)(nil)
+
+const namespace = "mtproto"
+
+// Collector is a mtproto.MetricsCollector of Prometheus metrics.
+type Collector struct {
+	rpcs       *prometheus.CounterVec
+	latency    *prometheus.HistogramVec
+	reconnects prometheus.Counter
+}
+
+// New registers the metrics to reg, and returns their collector.
+func New(reg prometheus.Registerer) (*Collector, error) {
+	c := &Collector{
+		rpcs: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "rpc_total",
+			Help:      "RPCs by TL method and result code; 0 is success, and -1 is timeout.",
+		}, []string{"method", "code"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "rpc_latency_seconds",
+			Help:      "Time from the send of an RPC to its reply.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method"}),
+		reconnects: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "reconnects_total",
+			Help:      "Renewals and refreshes of the sessions.",
+		}),
+	}
+	for _, collector := range []prometheus.Collector{c.rpcs, c.latency, c.reconnects} {
+		if err := reg.Register(collector); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (c *Collector) IncRPC(method string, code int) {
+	c.rpcs.WithLabelValues(method, strconv.Itoa(code)).Inc()
+}
+
+func (c *Collector) ObserveRPCLatency(method string, d time.Duration) {
+	c.latency.WithLabelValues(method).Observe(d.Seconds())
+}
+
+func (c *Collector) IncReconnect() {
+	c.reconnects.Inc()
+}
@@ -0,0 +1,116 @@
+package mtproto
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+)
+
+// randSource is RandSource, or crypto/rand if it is not set
+func (appConfig Configuration) randSource() io.Reader {
+	if appConfig.RandSource == nil {
+		return crand.Reader
+	}
+	return appConfig.RandSource
+}
+
+// randBytes reads n bytes from the source. If the source fails, the bytes are read from crypto/rand.
+func randBytes(source io.Reader, n int) []byte {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(source, b); err != nil {
+		errorf("random", "random source failure: %v. fall back to crypto/rand", err)
+		io.ReadFull(crand.Reader, b)
+	}
+	return b
+}
+
+// randInt63 is a non-negative random int64 of the source
+func randInt63(source io.Reader) int64 {
+	return int64(binary.LittleEndian.Uint64(randBytes(source, 8)) >> 1)
+}
+
+// randInt31 is a non-negative random int32 of the source
+func randInt31(source io.Reader) int32 {
+	return int32(binary.LittleEndian.Uint32(randBytes(source, 4)) >> 1)
+}
+
+// rpcRandSource is the random source of the connection of the RPC, or crypto/rand.
+func rpcRandSource(rpc RemoteProcedureCall) io.Reader {
+	if x, ok := rpc.(interface{ randSource() io.Reader }); ok {
+		return x.randSource()
+	}
+	return crand.Reader
+}
+
+func (mconn *Conn) randSource() io.Reader {
+	session, err := mconn.Session()
+	if err != nil {
+		return crand.Reader
+	}
+	return session.appConfig.randSource()
+}
+
+func (x timeoutRPC) randSource() io.Reader {
+	return x.mconn.randSource()
+}
+
+// messageIdAt is the message id of the time; the unix time in the upper 32 bits,
+// and the fraction of the second in the lower 32 bits, divisible by 4 as the client message ids are.
+func messageIdAt(t time.Time) int64 {
+	const nano = 1000 * 1000 * 1000
+	unixnano := t.UnixNano()
+	return ((unixnano / nano) << 32) | ((unixnano % nano) & -4)
+}
+
+// msgIdGenerator generates the message ids of a session, which increase strictly even in the same nanosecond.
+type msgIdGenerator struct {
+	mutex  sync.Mutex
+	now    func() time.Time // time.Now if nil
+	offset time.Duration    // of the server clock from the local one
+	last   int64
+}
+
+func (g *msgIdGenerator) next() int64 {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	now := time.Now
+	if g.now != nil {
+		now = g.now
+	}
+	id := messageIdAt(now().Add(g.offset))
+	if id <= g.last {
+		id = g.last + 4
+	}
+	g.last = id
+	return id
+}
+
+// syncServerTime sets the offset of the server clock by the time in serverMsgId, a message id of the server,
+// and restarts the ids from the server time, so that the ids too high are not continued.
+func (g *msgIdGenerator) syncServerTime(serverMsgId int64) time.Duration {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	now := time.Now
+	if g.now != nil {
+		now = g.now
+	}
+	g.offset = time.Unix(serverMsgId>>32, 0).Sub(now())
+	g.last = 0
+	return g.offset
+}
+
+// state returns the last id and the offset of the server clock
+func (g *msgIdGenerator) state() (int64, time.Duration) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.last, g.offset
+}
+
+// setOffset sets the offset of the server clock, e.g., the one persisted with the key
+func (g *msgIdGenerator) setOffset(offset time.Duration) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.offset = offset
+}
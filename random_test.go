@@ -0,0 +1,65 @@
+package mtproto
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// seededRPC is recordRPC with a fixed random source
+type seededRPC struct {
+	recordRPC
+	seed int64
+}
+
+func (r *seededRPC) randSource() io.Reader {
+	return rand.New(rand.NewSource(r.seed))
+}
+
+func TestFixedRandSource(t *testing.T) {
+	appConfig := Configuration{RandSource: rand.New(rand.NewSource(1))}
+	first := []interface{}{randInt63(appConfig.randSource()), randBytes(appConfig.randSource(), 16)}
+	appConfig.RandSource = rand.New(rand.NewSource(1))
+	second := []interface{}{randInt63(appConfig.randSource()), randBytes(appConfig.randSource(), 16)}
+	if fmt.Sprint(first) != fmt.Sprint(second) {
+		t.Errorf("random values are not reproducible, %v and %v", first, second)
+	}
+
+	// the random ids of the messages
+	var ids []int64
+	for i := 0; i < 2; i++ {
+		rpc := &seededRPC{recordRPC{resp: &PredUpdateShortSentMessage{}}, 1}
+		if _, err := sendMessage(rpc, &TypeInputPeer{&TypeInputPeer_InputPeerSelf{&PredInputPeerSelf{}}}, "hi"); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, rpc.reqs[0].(*ReqMessagesSendMessage).RandomId)
+	}
+	if ids[0] != ids[1] || ids[0] < 0 {
+		t.Errorf("random ids are not reproducible, %v", ids)
+	}
+}
+
+func TestMessageIds(t *testing.T) {
+	clock := time.Unix(1500000000, 123456789)
+	generate := func() []int64 {
+		g := &msgIdGenerator{now: func() time.Time { return clock }}
+		return []int64{g.next(), g.next(), g.next()}
+	}
+	ids := generate()
+	if fmt.Sprint(ids) != fmt.Sprint(generate()) {
+		t.Errorf("message ids are not reproducible")
+	}
+	for i, id := range ids {
+		if id>>32 != clock.Unix() || id%4 != 0 {
+			t.Errorf("message id %x is not of the time", id)
+		}
+		if i > 0 && id <= ids[i-1] {
+			t.Errorf("message ids do not increase, %v", ids)
+		}
+	}
+	if ids[0] != messageIdAt(clock) {
+		t.Errorf("unexpected message id %x", ids[0])
+	}
+}
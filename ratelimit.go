@@ -0,0 +1,70 @@
+package mtproto
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// rateLimiter is a token bucket, which paces the RPCs of a connection.
+// The bucket holds a token at most, so the bursts are spread evenly over the second.
+// A request heavier than the tokens takes them in advance, and the next request waits for the debt.
+type rateLimiter struct {
+	mutex  sync.Mutex
+	rate   float64 // tokens per second
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64) *rateLimiter {
+	return &rateLimiter{rate: rate, tokens: 1, last: time.Now()}
+}
+
+// reserve takes weight tokens, and returns how long the caller should wait before sending.
+func (l *rateLimiter) reserve(weight int, now time.Time) time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if now.After(l.last) {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > 1 {
+			l.tokens = 1
+		}
+		l.last = now
+	}
+	l.tokens -= float64(weight)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// wait waits for weight tokens. It gives up on ctx done, and gives the tokens back.
+func (l *rateLimiter) wait(ctx context.Context, weight int) error {
+	d := l.reserve(weight, time.Now())
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		l.mutex.Lock()
+		l.tokens += float64(weight)
+		l.mutex.Unlock()
+		return ctx.Err()
+	}
+}
+
+// rateLimiter is the limiter of the connection, or nil if MaxRequestsPerSecond is not set
+func (mconn *Conn) rateLimiter(appConfig Configuration) *rateLimiter {
+	if appConfig.MaxRequestsPerSecond <= 0 {
+		return nil
+	}
+	mconn.limiterOnce.Do(func() {
+		mconn.limiter = newRateLimiter(appConfig.MaxRequestsPerSecond)
+	})
+	return mconn.limiter
+}
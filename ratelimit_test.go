@@ -0,0 +1,76 @@
+package mtproto
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestRateLimit(t *testing.T) {
+	const n, rate = 20, 50.0
+	l := newRateLimiter(rate)
+	start := time.Now()
+	for i := 0; i < n; i++ {
+		l.wait(context.Background(), 1)
+	}
+	// the first request goes at once
+	expected := time.Duration(float64(n-1) / rate * float64(time.Second))
+	if elapsed := time.Since(start); elapsed < expected || elapsed > expected+200*time.Millisecond {
+		t.Errorf("%d requests at %v/s took %v, expected about %v", n, rate, elapsed, expected)
+	}
+}
+
+func TestRateLimitWeight(t *testing.T) {
+	now := time.Now()
+	l := &rateLimiter{rate: 10, tokens: 1, last: now}
+	if d := l.reserve(3, now); d != 200*time.Millisecond {
+		t.Errorf("a heavy request waits %v", d)
+	}
+	// the next request pays the debt of the heavy one
+	if d := l.reserve(1, now); d != 300*time.Millisecond {
+		t.Errorf("the next request waits %v", d)
+	}
+	// the idle time does not save more than a token
+	if d := l.reserve(1, now.Add(time.Minute)); d != 0 {
+		t.Errorf("the request after the idle time waits %v", d)
+	}
+	if d := l.reserve(1, now.Add(time.Minute)); d != 100*time.Millisecond {
+		t.Errorf("the burst after the idle time waits %v", d)
+	}
+}
+
+func TestRateLimitCanceled(t *testing.T) {
+	now := time.Now()
+	l := &rateLimiter{rate: 1, tokens: 0, last: now}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := l.wait(ctx, 1); err != context.DeadlineExceeded {
+		t.Errorf("unexpected error %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("the canceled wait took %v", elapsed)
+	}
+	// the tokens of the canceled wait are given back
+	if d := l.reserve(1, now); d > time.Second || d < time.Second-100*time.Millisecond {
+		t.Errorf("the next request waits %v", d)
+	}
+}
+
+func TestRequestWeight(t *testing.T) {
+	appConfig := Configuration{RequestWeights: map[string]int{"messages.sendMessage": 5}}
+	if w := appConfig.requestWeight(&ReqMessagesSendMessage{}); w != 5 {
+		t.Errorf("unexpected weight %d", w)
+	}
+	if w := appConfig.requestWeight(&ReqMessagesGetDialogs{}); w != 1 {
+		t.Errorf("unexpected default weight %d", w)
+	}
+}
+
+func BenchmarkRateLimiter(b *testing.B) {
+	l := newRateLimiter(1e9)
+	for i := 0; i < b.N; i++ {
+		l.wait(context.Background(), 1)
+	}
+}
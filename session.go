@@ -2,19 +2,22 @@ package mtproto
 
 import (
 	"bytes"
+	crand "crypto/rand"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/cjongseok/slog"
+	"golang.org/x/net/context"
 	"io"
-	"math/rand"
 	"net"
 	"os"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -37,12 +40,25 @@ const (
 
 type handshakingFailure struct {
 	msg string
+	err error
 }
 
 func (h handshakingFailure) Error() string {
 	return h.msg
 }
 
+func (h handshakingFailure) Unwrap() error {
+	return h.err
+}
+
+// dialError is DialTimeoutError if the dial or the handshake failed at its deadline, or else err
+func dialError(addr string, timeout time.Duration, deadline time.Time, err error) error {
+	if !time.Now().Before(deadline) {
+		return DialTimeoutError{addr, timeout}
+	}
+	return err
+}
+
 type Session struct {
 	connId      int32
 	sessionId   int64
@@ -50,7 +66,8 @@ type Session struct {
 	addr        string
 	useIPv6     bool
 	listeners   []chan Event
-	tcpconn     *net.TCPConn
+	tcpconn     net.Conn
+	transport   transport
 	f           *os.File
 	queueSend   chan packetToSend
 
@@ -66,30 +83,92 @@ type Session struct {
 	sendWaitGroup sync.WaitGroup
 	pingWaitGroup sync.WaitGroup
 
+	// sendMutex guards queueSend against its close by stopSend, for the senders of send
+	sendMutex  sync.RWMutex
+	sendClosed bool
+
 	authKey     []byte
 	authKeyHash []byte
-	serverSalt  []byte
+	serverSalt  []byte // guarded by saltMutex once the session is open
 	encrypted   bool
+	dcKeys      map[int32]dcAuthKey // the auth keys of the other DCs, by DC id
+
+	dialDeadline time.Time // bounds the reads of the handshake in open
 
 	mutex        *sync.Mutex
+	seqMutex     sync.Mutex // guards lastSeqNo and the generation of msgIds by nextMessage
 	lastSeqNo    int32
+	msgIds       msgIdGenerator
 	msgsIdToAck  map[int64]packetToSend
 	msgsIdToResp map[int64]chan response
+	msgsIdToSent map[int64]sentRPC // for the metrics of the RPCs in msgsIdToResp
 	seqNo        int32
 	msgId        int64
 
 	appConfig Configuration
+
+	lastActivity int64 // unix nano of the last sent or received message, accessed atomically
+	lastRPC      int64 // unix nano of the last RPC sent or replied, accessed atomically; the pings do not count
+	lastPong     int64 // unix nano, accessed atomically
+	latency      int64 // round-trip time of the last ping of Conn.Ping, accessed atomically
+	discarded    int32 // set atomically by the first discardSession, so that the session is closed once
+	revoked      int32 // set atomically by revoke, so that the key file is removed once
+
+	// the pongs waited for by Conn.Ping, by ping id
+	pongMutex sync.Mutex
+	pongs     map[int64]chan struct{}
+
+	// the salts of get_future_salts, rotated to serverSalt as they become valid
+	saltMutex   sync.Mutex
+	futureSalts []TL_future_salt
+
 	//user         *TL_user
 	//updatesState *TL_updates_state
 	user         *PredUser
-	updatesState *PredUpdatesState
+	updatesState *PredUpdatesState // guarded by updatesMutex, as the RPC callers advance its pts
+	updatesMutex sync.Mutex
+	// the updates state of the key file, from which the missed updates are caught up
+	persistedUpdatesState *PredUpdatesState
+
+	peers  peerCache // resolved usernames
+
+	// the pts of the channels by their ids, which are saved in the key file,
+	// and the access hashes to get the differences of the channels on gaps
+	channelMutex      sync.Mutex
+	channelPts        map[int32]int32
+	channelHashes     map[int32]int64
+	channelRecovering map[int32]bool
+
+	// the ids of the received messages to acknowledge, flushed by Configuration.AckThreshold or AckInterval
+	ackMutex       sync.Mutex
+	pendingAcks    []int64
+	ackInterrupter chan struct{}
+	ackWaitGroup   sync.WaitGroup
+
+	// the last sent code, and when it can be resent
+	codeMutex     sync.Mutex
+	phoneCodeHash string
+	nextCodeType  CodeType
+	resendAfter   time.Time
+	signUpCode    string // the code confirmed by SignIn for an unregistered number
+}
 
-	dclist map[int32]string
+// dcAuthKey is the auth key of a DC, kept while the session is on another DC
+type dcAuthKey struct {
+	authKey     []byte
+	authKeyHash []byte
+	serverSalt  []byte
 }
 
 type packetToSend struct {
 	msg  TL
 	resp chan response
+	// timeout of the reply to resp, Configuration.RequestTimeout if it is zero
+	timeout time.Duration
+	// the context of the call, whose cancellation abandons the reply. It may be nil
+	ctx context.Context
+	// the packets sent in a msg_container instead of msg
+	batch []packetToSend
 }
 
 type response struct {
@@ -100,21 +179,40 @@ type response struct {
 
 // CHECK: Only mmanager call this method?
 func (session *Session) close() {
+	// the acks are flushed while the send routine is running
+	session.stopAck()
+	session.ackWaitGroup.Wait()
+
 	session.stopPing()
 	session.stopSend()
 	session.pingWaitGroup.Wait()
 	session.sendWaitGroup.Wait()
 
-	session.tcpconn.Close()
+	if session.tcpconn != nil {
+		session.tcpconn.Close()
+	}
 
 	session.stopRead()
 	session.readWaitGroup.Wait()
 
+	// flush the session file with the last updates state
+	if session.f != nil {
+		if session.encrypted && session.authKey != nil {
+			if err := session.saveSession(); err != nil {
+				logln(session, "session file save failure:", err)
+			}
+		}
+		if err := session.f.Sync(); err != nil {
+			logln(session, "session file sync failure:", err)
+		}
+		session.f.Close()
+	}
+
 	// notify that the connection is gracefully closed
-	if session.updatesState == nil {
+	if state := session.copyUpdatesState(); state == nil {
 		session.notify(SessionDiscarded{session.connId, session.sessionId, &PredUpdatesState{}})
 	} else {
-		session.notify(SessionDiscarded{session.connId, session.sessionId, session.updatesState})
+		session.notify(SessionDiscarded{session.connId, session.sessionId, state})
 	}
 	session.listeners = nil
 }
@@ -123,7 +221,7 @@ func (session *Session) close() {
 //	return sessionFileHome + "/.telegram_" + phonenumber
 //}
 
-func newSession(phonenumber string, addr string, useIPv6 bool, appConfig Configuration /*sendQueue chan packetToSend,*/, sessionListener chan Event) (*Session, error) {
+func newSession(phonenumber string, addr string, useIPv6 bool, dcKeys map[int32]dcAuthKey, appConfig Configuration /*sendQueue chan packetToSend,*/, sessionListener chan Event) (*Session, error) {
 	var err error
 
 	session := new(Session)
@@ -132,16 +230,70 @@ func newSession(phonenumber string, addr string, useIPv6 bool, appConfig Configu
 	if err == nil {
 		session.addr = addr
 		session.useIPv6 = useIPv6
-		session.encrypted = false
+		reused := session.useDCKey(dcKeys)
+		session.encrypted = reused
 		err = session.open(appConfig /*sendQueue,*/, sessionListener, false)
 		if err != nil {
 			return nil, err
 		}
+		if reused {
+			// a new key is saved on the handshake, and a reused one is saved here
+			_ = session.saveSession()
+		}
 		return session, nil
 	}
 	return nil, err
 }
 
+// useDCKey keeps the keys of the DCs, and takes the one of the DC of the session.
+// It reports whether the session has the key of its DC, so that no handshake is needed.
+func (session *Session) useDCKey(dcKeys map[int32]dcAuthKey) bool {
+	session.dcKeys = make(map[int32]dcAuthKey)
+	for dc, key := range dcKeys {
+		session.dcKeys[dc] = key
+	}
+	dc, err := dcIdOf(session.addr)
+	if err != nil {
+		return false
+	}
+	key, ok := session.dcKeys[int32(dc)]
+	if !ok {
+		return false
+	}
+	delete(session.dcKeys, int32(dc))
+	session.authKey = key.authKey
+	session.authKeyHash = key.authKeyHash
+	session.serverSalt = key.serverSalt
+	return true
+}
+
+// authKeys returns the keys of the DCs, with the one of the session
+func (session *Session) authKeys() map[int32]dcAuthKey {
+	keys := make(map[int32]dcAuthKey)
+	for dc, key := range session.dcKeys {
+		keys[dc] = key
+	}
+	if dc, err := dcIdOf(session.addr); err == nil && session.authKey != nil {
+		keys[int32(dc)] = dcAuthKey{session.authKey, session.authKeyHash, session.salt()}
+	}
+	return keys
+}
+
+// newMediaSession opens a session to the DC storing files.
+// Its key is kept in memory, not in the key file of the account.
+// The listener gets the refreshSession of the session on its connection drop, as a manager does.
+func newMediaSession(addr string, useIPv6 bool, appConfig Configuration, listener chan Event) (*Session, error) {
+	session := new(Session)
+	session.addr = addr
+	session.useIPv6 = useIPv6
+	err := session.open(appConfig, listener, false)
+	if err != nil {
+		session.close()
+		return nil, err
+	}
+	return session, nil
+}
+
 // byte array string is bracketed space separated numbers in a string
 func byteArrayString2byteArray(str string) []byte {
 	runes := []rune(str)
@@ -160,7 +312,7 @@ func byteArrayString2byteArray(str string) []byte {
 // Build a connection from the session file
 // returned session contains the same session with the file but session id,
 // since the session file does not have session id
-func loadSession(phonenumber string, appConfig Configuration /*sendQueue chan packetToSend,*/, sessionListener chan Event) (*Session, error) {
+func loadSession(phonenumber string, preferredAddr string, appConfig Configuration /*sendQueue chan packetToSend,*/, sessionListener chan Event) (*Session, error) {
 	// load session info from either session file or env
 	// its precedence is; preferredAddr > sessionFile > env
 	session := new(Session)
@@ -180,7 +332,8 @@ func loadSession(phonenumber string, appConfig Configuration /*sendQueue chan pa
 			session.f, err = os.OpenFile(appConfig.KeyPath, os.O_WRONLY|os.O_CREATE, 0600)
 		}
 	} else {
-		session.f, err = os.OpenFile(appConfig.KeyPath, os.O_RDONLY, 0600)
+		session.appConfig = appConfig
+		session.f, err = os.OpenFile(appConfig.KeyPath, os.O_RDWR, 0600)
 		if err == nil {
 			err = session.readSessionFile(session.f)
 		}
@@ -189,62 +342,62 @@ func loadSession(phonenumber string, appConfig Configuration /*sendQueue chan pa
 		}
 	}
 
-	// Deprecate preferred server address
-	//if preferredAddr != "" {
-	//	tcpAddr, err := net.ResolveTCPAddr("tcp", preferredAddr)
-	//	if err != nil {
-	//		return nil, fmt.Errorf("resolve the telegram server address failure: %v", err)
-	//	}
-	//	if tcpAddr.IP.To4() != nil {
-	//		session.useIPv6 = false
-	//		session.addr = preferredAddr
-	//	} else if tcpAddr.IP.To16() != nil {
-	//		session.useIPv6 = true
-	//		session.addr = preferredAddr
-	//	} else {
-	//		// Invalid IP address. Ignore the preferred ip address
-	//		slog.Logln(session, "invalid preferred preferred Telegram server address. ignore it.")
-	//	}
-	//}
+	if preferredAddr != "" {
+		tcpAddr, err := net.ResolveTCPAddr("tcp", preferredAddr)
+		if err != nil {
+			return nil, fmt.Errorf("resolve the telegram server address failure: %v", err)
+		}
+		if tcpAddr.IP.To4() != nil {
+			session.useIPv6 = false
+			session.addr = preferredAddr
+		} else if tcpAddr.IP.To16() != nil {
+			session.useIPv6 = true
+			session.addr = preferredAddr
+		} else {
+			// Invalid IP address. Ignore the preferred ip address
+			logln(session, "invalid preferred Telegram server address. ignore it.")
+		}
+	}
 	err = session.open(appConfig /*sendQueue,*/, sessionListener, true)
 	if err != nil {
-		return session, handshakingFailure{fmt.Sprintf("Handshaking Failure: %v", err)}
+		return session, handshakingFailure{fmt.Sprintf("Handshaking Failure: %v", err), err}
 	}
 	return session, nil
 }
 
 func (session *Session) open(appConfig Configuration /*sendQueue chan packetToSend,*/, sessionListener chan Event, getUpdateStates bool) error {
 	var err error
-	var tcpAddr *net.TCPAddr
 
 	// set up rest of session
 	session.appConfig = appConfig
-	rand.Seed(time.Now().UnixNano())
-	session.sessionId = rand.Int63()
+	session.sessionId = randInt63(appConfig.randSource())
 	session.AddSessionListener(sessionListener)
 
 	// connect
-	tcpAddr, err = net.ResolveTCPAddr("tcp", session.addr)
-	if err != nil {
-		return err
-	}
-	slog.Logf(session, "dial TCP to %s\n", session.addr)
-	session.tcpconn, err = net.DialTCP("tcp", nil, tcpAddr)
-	if err != nil {
-		return err
-	}
-	// Packet Length is encoded by a single byte (see: https://core.telegram.org/mtproto)
-	_, err = session.tcpconn.Write([]byte{0xef})
-	if err != nil {
-		return err
-	}
-	// get new authKey if need
-	if !session.encrypted {
-		err = session.makeAuthKey()
-		if err != nil {
-			return err
+	timeout := appConfig.dialTimeout()
+	deadline := time.Now().Add(timeout)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	session.transport = newTransport(appConfig)
+	session.dialDeadline = deadline
+	for attempt := 0; ; attempt++ {
+		err = session.connect(ctx, appConfig)
+		if err == nil {
+			break
 		}
+		if attempt >= appConfig.ConnectRetries || !isNetworkError(err) {
+			return dialError(session.addr, timeout, deadline, err)
+		}
+		delay := connectRetryDelay(attempt)
+		if !time.Now().Add(delay).Before(deadline) {
+			return dialError(session.addr, timeout, deadline, err)
+		}
+		logf(session, "connect to %s failure: %v. retry in %v\n", session.addr, err, delay)
+		time.Sleep(delay)
 	}
+	// the deadline of the dial is over, and the RPCs have their own timeouts
+	session.dialDeadline = time.Time{}
+	session.tcpconn.SetDeadline(time.Time{})
 
 	// start goroutines
 	session.queueSend = make(chan packetToSend, 64)
@@ -259,6 +412,7 @@ func (session *Session) open(appConfig Configuration /*sendQueue chan packetToSe
 
 	session.msgsIdToAck = make(map[int64]packetToSend)
 	session.msgsIdToResp = make(map[int64]chan response)
+	session.msgsIdToSent = make(map[int64]sentRPC)
 	session.mutex = &sync.Mutex{}
 	session.sendWaitGroup.Add(1)
 	session.readWaitGroup.Add(1)
@@ -272,7 +426,7 @@ func (session *Session) open(appConfig Configuration /*sendQueue chan packetToSe
 	resp := make(chan response, 1)
 	session.queueSend <- packetToSend{
 		msg: &ReqInvokeWithLayer{
-			Layer: int32(layer),
+			Layer: session.appConfig.layer(),
 			Query: Pack(&ReqInitConnection{
 				ApiId:          session.appConfig.Id,
 				DeviceModel:    session.appConfig.DeviceModel,
@@ -288,46 +442,29 @@ func (session *Session) open(appConfig Configuration /*sendQueue chan packetToSe
 	select {
 	case x = <-resp:
 		if x.err != nil {
-			return fmt.Errorf("TL_invokeWithLayer Failure:", x.err)
+			return fmt.Errorf("TL_invokeWithLayer Failure: %v", x.err)
 		}
 	case <-time.After(TIMEOUT_INVOKE_WITH_LAYER):
 		return fmt.Errorf("TL_invokeWithLayer Timeout(%f s)", TIMEOUT_INVOKE_WITH_LAYER.Seconds())
-		//slog.Logf(session, "TL_invokeWithLayer Timeout(%f s)\n", TIMEOUT_INVOKE_WITH_LAYER.Seconds())
+		//logf(session, "TL_invokeWithLayer Timeout(%f s)\n", TIMEOUT_INVOKE_WITH_LAYER.Seconds())
 	}
 
 	switch x.data.(type) {
 	case *PredConfig:
-		session.dclist = make(map[int32]string, 5)
-		for _, v := range x.data.(*PredConfig).DcOptions {
-			isIPv6 := true
-			dcOption := v.GetValue()
-			tcpAddr, err := net.ResolveIPAddr("ip", dcOption.GetIpAddress())
-			if err == nil {
-				ip := tcpAddr.IP.To4()
-				if ip != nil {
-					isIPv6 = false
-				}
-				if session.useIPv6 {
-					if isIPv6 {
-						session.dclist[dcOption.GetId()] = fmt.Sprintf("[%s]:%d", dcOption.GetIpAddress(), dcOption.GetPort())
-					}
-				} else {
-					if !isIPv6 {
-						session.dclist[dcOption.GetId()] = fmt.Sprintf("%s:%d", dcOption.GetIpAddress(), dcOption.GetPort())
-					}
-				}
-			}
+		if session.appConfig.dcs == nil {
+			session.appConfig.dcs = newDCConfig()
 		}
+		session.appConfig.dcs.update(x.data.(*PredConfig))
 		marshaled, err := json.Marshal(x.data)
 		if err == nil {
-			slog.Logf(session, "config: %s\n", marshaled)
+			logf(session, "config: %s\n", marshaled)
 		}
 	default:
 		return fmt.Errorf("Connection error: Failed to get config. got: %T", x)
 	}
 
 	// get updates state
-	session.updatesState = new(PredUpdatesState)
+	session.setUpdatesState(new(PredUpdatesState))
 	if getUpdateStates {
 		//TODO: From second session, query getUpdatesState with invokeWithLayer and initConnection
 		resp = make(chan response, 1)
@@ -351,6 +488,10 @@ func (session *Session) open(appConfig Configuration /*sendQueue chan packetToSe
 	session.pingWaitGroup.Add(1)
 	go session.pingRoutine()
 
+	session.ackInterrupter = make(chan struct{})
+	session.ackWaitGroup.Add(1)
+	go session.ackRoutine()
+
 	// notify the connection established
 	session.notify(SessionEstablished{session})
 
@@ -363,7 +504,42 @@ func (session *Session) open(appConfig Configuration /*sendQueue chan packetToSe
 	return nil
 }
 
+// connect dials the server, and makes the auth key if the session has none.
+// The connection is closed on a failure, so that it can be retried.
+func (session *Session) connect(ctx context.Context, appConfig Configuration) error {
+	logf(session, "dial TCP to %s\n", session.addr)
+	conn, err := dial(ctx, appConfig, session.addr, session.transport)
+	if err != nil {
+		return err
+	}
+	session.tcpconn = conn
+	if !session.encrypted {
+		if err := session.makeAuthKey(); err != nil {
+			conn.Close()
+			return err
+		}
+	}
+	return nil
+}
+
+// connectRetryBackoff is the delay before the first retry of connect, doubled on every retry
+const connectRetryBackoff = 100 * time.Millisecond
+
+func connectRetryDelay(attempt int) time.Duration {
+	return connectRetryBackoff << uint(attempt)
+}
+
+// isNetworkError reports whether err is of the network, which is worth retrying,
+// rather than of the handshake, e.g., a server key of an unknown fingerprint.
+func isNetworkError(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) || err == io.EOF || err == io.ErrUnexpectedEOF
+}
+
 func (session *Session) AddSessionListener(listener chan Event) {
+	if listener == nil {
+		return
+	}
 	session.listeners = append(session.listeners, listener)
 }
 
@@ -383,11 +559,21 @@ func (session *Session) RemoveSessionListener(toremove chan Event) error {
 
 func (session *Session) readSessionFile(f *os.File) error {
 	// Decode session file
-	b := make([]byte, 1024*4)
+	// the key file grows with the keys of the DCs and the pts of the channels
+	b := make([]byte, 1024*64)
 	n, err := f.ReadAt(b, 0)
 	if n <= 0 || (err != nil && err.Error() != "EOF") {
 		return errors.New("New session")
 	}
+	b = b[:n]
+
+	// Legacy plaintext files are encrypted on the next save
+	if isEncryptedKeyFile(b) {
+		b, err = decryptKeyFile(session.appConfig.SessionEncryptionKey, b)
+		if err != nil {
+			return err
+		}
+	}
 
 	d := NewDecodeBuf(b)
 	session.authKey = d.StringBytes()
@@ -404,12 +590,201 @@ func (session *Session) readSessionFile(f *os.File) error {
 		return d.err
 	}
 
+	// the updates state is appended to the key file, and the legacy files do not have it
+	if d.off < d.size && d.UInt() == 1 {
+		state := &PredUpdatesState{
+			Pts:  d.Int(),
+			Qts:  d.Int(),
+			Date: d.Int(),
+			Seq:  d.Int(),
+		}
+		if d.err == nil {
+			session.persistedUpdatesState = state
+		}
+	}
+	// the keys of the other DCs follow
+	if d.off < d.size {
+		keys := make(map[int32]dcAuthKey)
+		for n := d.UInt(); n > 0 && d.err == nil; n-- {
+			dc := d.Int()
+			keys[dc] = dcAuthKey{d.StringBytes(), d.StringBytes(), d.StringBytes()}
+		}
+		if d.err == nil {
+			session.dcKeys = keys
+		}
+	}
+	// and the pts of the channels
+	if d.off < d.size {
+		channelPts := make(map[int32]int32)
+		for n := d.UInt(); n > 0 && d.err == nil; n-- {
+			channelId := d.Int()
+			channelPts[channelId] = d.Int()
+		}
+		if d.err == nil {
+			session.channelPts = channelPts
+		}
+	}
+	// and the server time offset and the future salts
+	if d.off < d.size {
+		offset := time.Duration(d.Long())
+		savedAt := time.Unix(d.Long(), 0)
+		var salts []TL_future_salt
+		for n := d.UInt(); n > 0 && d.err == nil; n-- {
+			salts = append(salts, TL_future_salt{d.Int(), d.Int(), d.StringBytes()})
+		}
+		if d.err == nil {
+			session.restoreServerTime(offset, savedAt, salts, time.Now())
+		}
+	}
+
 	session.encrypted = true
 	return nil
 }
 
+// maxServerTimeAge is the age of a persisted server time offset, after which the clocks may have drifted
+// and it is derived again by bad_msg_notification
+const maxServerTimeAge = 24 * time.Hour
+
+// restoreServerTime restores the server time offset and the future salts saved at savedAt.
+// The salt saved with the key is replaced by the future salt valid at now, if any.
+// If all of them have expired, the stale salt is kept, and the server corrects it by bad_server_salt.
+func (session *Session) restoreServerTime(offset time.Duration, savedAt time.Time, salts []TL_future_salt, now time.Time) {
+	if now.Sub(savedAt) < maxServerTimeAge {
+		session.msgIds.setOffset(offset)
+	}
+	session.addFutureSalts(salts)
+	if rotated, _ := session.rotateSalt(now); rotated {
+		logln(session, "the saved salt has expired. use the future salt")
+	}
+}
+
+// trackChannelPts advances the pts of the channels by their updates, and returns the channels with gaps.
+// The first update of a channel sets its pts, and the updates arriving already are skipped.
+func (session *Session) trackChannelPts(updates []*TypeUpdate, chats []*TypeChat) []int32 {
+	session.channelMutex.Lock()
+	defer session.channelMutex.Unlock()
+	if session.channelPts == nil {
+		session.channelPts = make(map[int32]int32)
+	}
+	if session.channelHashes == nil {
+		session.channelHashes = make(map[int32]int64)
+		session.channelRecovering = make(map[int32]bool)
+	}
+	for _, chat := range chats {
+		if channel := chat.GetChannel(); channel != nil && channel.AccessHash != 0 {
+			session.channelHashes[channel.Id] = channel.AccessHash
+		}
+	}
+
+	var gaps []int32
+	for _, update := range updates {
+		channelId, pts, ptsCount, ok := channelPtsOf(update)
+		if !ok {
+			continue
+		}
+		known, ok := session.channelPts[channelId]
+		switch {
+		case !ok || known+ptsCount == pts:
+			session.channelPts[channelId] = pts
+		case known+ptsCount > pts:
+			// arrived already
+		case !session.channelRecovering[channelId]:
+			logf(session, "channel %d pts gap, pts %d, pts count %d, known %d\n", channelId, pts, ptsCount, known)
+			session.channelRecovering[channelId] = true
+			gaps = append(gaps, channelId)
+		}
+	}
+	return gaps
+}
+
+// channelPtsOf returns the channel and the pts of the update, if it is of a channel
+func channelPtsOf(update *TypeUpdate) (channelId, pts, ptsCount int32, ok bool) {
+	switch x := update.GetValue().(type) {
+	case *TypeUpdate_UpdateNewChannelMessage:
+		u := x.UpdateNewChannelMessage
+		channelId = messageChannelId(u.Message)
+		return channelId, u.Pts, u.PtsCount, channelId != 0
+	case *TypeUpdate_UpdateEditChannelMessage:
+		u := x.UpdateEditChannelMessage
+		channelId = messageChannelId(u.Message)
+		return channelId, u.Pts, u.PtsCount, channelId != 0
+	case *TypeUpdate_UpdateDeleteChannelMessages:
+		u := x.UpdateDeleteChannelMessages
+		return u.ChannelId, u.Pts, u.PtsCount, true
+	case *TypeUpdate_UpdateChannelWebPage:
+		u := x.UpdateChannelWebPage
+		return u.ChannelId, u.Pts, u.PtsCount, true
+	}
+	return 0, 0, 0, false
+}
+
+func messageChannelId(m *TypeMessage) int32 {
+	var to *TypePeer
+	switch x := m.GetValue().(type) {
+	case *TypeMessage_Message:
+		to = x.Message.ToId
+	case *TypeMessage_MessageService:
+		to = x.MessageService.ToId
+	}
+	return to.GetPeerChannel().GetChannelId()
+}
+
+// recoverChannels fills the gaps of the channels in the background, not to block the read routine
+// waiting for the differences
+func (session *Session) recoverChannels(channelIds []int32) {
+	for _, channelId := range channelIds {
+		go session.recoverChannel(sessionRPC{session: session}, channelId)
+	}
+}
+
+// recoverChannel propagates the difference of the channel since its known pts, and advances the pts.
+// If the gap is too long, Configuration.OnChannelResync is called instead.
+func (session *Session) recoverChannel(rpc RemoteProcedureCall, channelId int32) {
+	session.channelMutex.Lock()
+	pts := session.channelPts[channelId]
+	channel := &TypeInputChannel{&TypeInputChannel_InputChannel{&PredInputChannel{
+		ChannelId:  channelId,
+		AccessHash: session.channelHashes[channelId],
+	}}}
+	session.channelMutex.Unlock()
+
+	next, err := getChannelDifference(rpc, channel, pts, func(u Update) {
+		session.notify(updateReceived{u})
+	}, func(diff *PredUpdatesChannelDifferenceTooLong) {
+		logf(session, "channel %d difference too long. resync to pts %d\n", channelId, diff.Pts)
+		if resync := session.appConfig.OnChannelResync; resync != nil {
+			resync(channelId, diff)
+		}
+	})
+
+	session.channelMutex.Lock()
+	defer session.channelMutex.Unlock()
+	delete(session.channelRecovering, channelId)
+	if err != nil {
+		errorf(session, "channel %d getChannelDifference failure: %v", channelId, err)
+		return
+	}
+	if next > session.channelPts[channelId] {
+		session.channelPts[channelId] = next
+	}
+}
+
+// revoke removes the key file of the key revoked by the server, and notifies SessionRevoked
+func (session *Session) revoke() {
+	if !atomic.CompareAndSwapInt32(&session.revoked, 0, 1) {
+		return
+	}
+	infof(session, "the key of session %d is revoked", session.sessionId)
+	if keyPath := session.appConfig.KeyPath; keyPath != "" {
+		if err := os.Remove(keyPath); err != nil && !os.IsNotExist(err) {
+			errorf(session, "cannot remove the revoked key %s: %v", keyPath, err)
+		}
+	}
+	session.notify(SessionRevoked{session.connId, session.sessionId})
+}
+
 func (session *Session) notify(e Event) {
-	slog.Logf(session, "notify Event, %s, to %v\n", slog.Stringify(e), session.listeners)
+	logf(session, "notify Event, %s, to %v\n", stringified{e}, session.listeners)
 	for _, listener := range session.listeners {
 		// TODO: it doesn't work. think of another solution to handle a deadlock on channel
 		//go func(){listener <- e}()
@@ -428,28 +803,55 @@ func (session *Session) process(msgId int64, seqNo int32, data interface{}) inte
 
 		case TL_bad_server_salt:
 			data := data.(TL_bad_server_salt)
-			session.serverSalt = data.new_server_salt
+			session.setSalt(data.new_server_salt)
 			// save the session on sign in
 			_ = session.saveSession()
-			session.mutex.Lock()
-			defer session.mutex.Unlock()
-			for k, v := range session.msgsIdToAck {
-				delete(session.msgsIdToAck, k)
-				session.queueSend <- v
+			session.resend(data.bad_msg_id)
+
+		case TL_future_salts:
+			session.addFutureSalts(data.(TL_future_salts).salts)
+
+		case TL_crc_bad_msg_notification:
+			data := data.(TL_crc_bad_msg_notification)
+			switch data.error_code {
+			case badMsgIdTooLow, badMsgIdTooHigh:
+				// the clock is off, so the ids follow the server time of this message from now on
+				offset := session.msgIds.syncServerTime(msgId)
+				logf(session, "bad_msg_notification %d: the server time is off by %v\n", data.error_code, offset)
+				_ = session.saveSession()
+				session.resend(data.bad_msg_id)
+			case badMsgIdNotDivisible, badMsgIdDuplicate:
+				session.resend(data.bad_msg_id)
+			case badMsgIdTooOld:
+				// the server may have processed the message already, so it is not resent,
+				// but its reply is still waited for until the timeout
+				session.mutex.Lock()
+				delete(session.msgsIdToAck, data.bad_msg_id)
+				session.mutex.Unlock()
+			default:
+				errorf(session, "bad_msg_notification %d of message %d\n", data.error_code, data.bad_msg_id)
 			}
 
 		case TL_new_session_created:
 			data := data.(TL_new_session_created)
-			session.serverSalt = data.server_salt
+			session.setSalt(data.server_salt)
 			// save the session on sign in
 			_ = session.saveSession()
 
 		case TL_ping:
 			data := data.(TL_ping)
-			session.queueSend <- packetToSend{TL_pong{msgId, data.ping_id}, nil}
+			session.queueSend <- packetToSend{msg: TL_pong{msgId, data.ping_id}}
 
 		case TL_pong:
-			// ignore
+			atomic.StoreInt64(&session.lastPong, time.Now().UnixNano())
+			session.pongMutex.Lock()
+			if pong, ok := session.pongs[data.(TL_pong).ping_id]; ok {
+				select {
+				case pong <- struct{}{}:
+				default:
+				}
+			}
+			session.pongMutex.Unlock()
 
 		case TL_msgs_ack:
 			data := data.(TL_msgs_ack)
@@ -460,35 +862,52 @@ func (session *Session) process(msgId int64, seqNo int32, data interface{}) inte
 			}
 
 		case TL_rpc_result:
-			//slog.Logf(session, "rpc_result before casting: %v\n", data)
+			//logf(session, "rpc_result before casting: %v\n", data)
 			data := data.(TL_rpc_result)
-			//slog.Logln(session, "stringify(rpc_result.Obj):", slog.Stringify(data.Obj))
-			//slog.Logf(session, "rpc_result.Obj: %T: %v\n", data.Obj, data.Obj)
+			//logln(session, "stringify(rpc_result.Obj):", slog.Stringify(data.Obj))
+			//logf(session, "rpc_result.Obj: %T: %v\n", data.Obj, data.Obj)
 			//if rpcerr, ok := data.Obj.(TL_rpc_error); ok {
-			//slog.Logln(session, "ok stringify(rpcerror):", rpcerr)
-			//slog.Logf(session, "ok rpcerror: %v\n", rpcerr)
-			//slog.Logf(session, "ok rpcerror.code: %d, rpcerror.msg: %s\n", rpcerr.error_code, rpcerr.error_message)
+			//logln(session, "ok stringify(rpcerror):", rpcerr)
+			//logf(session, "ok rpcerror: %v\n", rpcerr)
+			//logf(session, "ok rpcerror.code: %d, rpcerror.msg: %s\n", rpcerr.error_code, rpcerr.error_message)
 			//}
-			x := session.process(msgId, seqNo, data.Obj)
+			// the result is acked with its rpc_result, so it is processed as not content-related
+			x := session.process(msgId, seqNo&^1, data.Obj)
 			session.mutex.Lock()
 			defer session.mutex.Unlock()
+			// a reply arriving after the timeout has no resp channel, so it is discarded
 			v, ok := session.msgsIdToResp[data.req_msg_id]
 			if ok {
-				go func() {
-					var resp response
-					rpcError, ok := x.(TL_rpc_error)
-					if ok {
-						//resp.err = session.handleRPCError(rpcError)
-						resp.err = rpcError
-					} else {
-						resp.data = x
+				session.touchRPC()
+				var resp response
+				var code int
+				rpcError, ok := x.(TL_rpc_error)
+				if ok {
+					//resp.err = session.handleRPCError(rpcError)
+					resp.err = toError(rpcError)
+					code = int(rpcError.error_code)
+					if _, ok := resp.err.(AuthKeyUnregisteredError); ok {
+						// notified without the mutex held
+						go session.revoke()
 					}
-					//resp.data = x.(TL)
-					//resp.data = x
-					v <- resp
-					close(v)
-				}()
+				} else {
+					resp.data = x
+				}
+				if sent, ok := session.msgsIdToSent[data.req_msg_id]; ok {
+					metrics := session.appConfig.metrics()
+					metrics.IncRPC(sent.method, code)
+					metrics.ObserveRPCLatency(sent.method, time.Since(sent.sentAt))
+				}
+				//resp.data = x.(TL)
+				//resp.data = x
+				// resp channels are buffered, and receive only one response
+				select {
+				case v <- resp:
+				default:
+				}
 			}
+			delete(session.msgsIdToResp, data.req_msg_id)
+			delete(session.msgsIdToSent, data.req_msg_id)
 			delete(session.msgsIdToAck, data.req_msg_id)
 
 		case TL_rpc_error:
@@ -500,73 +919,98 @@ func (session *Session) process(msgId int64, seqNo int32, data interface{}) inte
 			// Date, Pts, Qts updates
 		case *PredUpdatesState:
 			data := data.(*PredUpdatesState)
-			session.updatesState.Pts = data.Pts
-			session.updatesState.Qts = data.Qts
-			session.updatesState.Date = data.Date
-			session.updatesState.Seq = data.Seq
+			session.withUpdatesState(func(state *PredUpdatesState) {
+				state.Pts = data.Pts
+				state.Qts = data.Qts
+				state.Date = data.Date
+				state.Seq = data.Seq
+			})
 			marshaled, err := json.Marshal(data)
 			if err == nil {
-				slog.Logf(session, "updatesState: %s\n", marshaled)
+				logf(session, "updatesState: %s\n", marshaled)
 			} else {
-				slog.Logf(session, "updatesState: %v\n", data)
+				logf(session, "updatesState: %v\n", data)
 			}
 			return data
 
 			// Date updates
 		case *PredUpdates:
 			data := data.(*PredUpdates)
-			session.updatesState.Date = data.Date
-			session.updatesState.Seq = data.Seq
+			session.withUpdatesState(func(state *PredUpdatesState) {
+				state.Date = data.Date
+				state.Seq = data.Seq
+			})
+			session.notify(updateReceived{data})
+			session.recoverChannels(session.trackChannelPts(data.Updates, data.Chats))
+			return data
+		case *PredUpdatesCombined:
+			data := data.(*PredUpdatesCombined)
+			session.withUpdatesState(func(state *PredUpdatesState) {
+				state.Date = data.Date
+				state.Seq = data.Seq
+			})
+			session.notify(updateReceived{data})
+			session.recoverChannels(session.trackChannelPts(data.Updates, data.Chats))
+			return data
+		case *PredUpdatesTooLong:
+			// the updates are to be got by getDifference
+			data := data.(*PredUpdatesTooLong)
 			session.notify(updateReceived{data})
 			return data
 		case *PredUpdateShort:
 			data := data.(*PredUpdateShort)
 			//session.updatesState.Pts ++	//TODO: need to comment in it?
-			session.updatesState.Date = data.Date
+			session.withUpdatesState(func(state *PredUpdatesState) { state.Date = data.Date })
 			session.notify(updateReceived{data})
 			return data
 
 			// Pts updates
 		case *PredUpdateNewMessage:
 			data := data.(*PredUpdateNewMessage)
-			session.updatesState.Pts = data.Pts
+			session.withUpdatesState(func(state *PredUpdatesState) { state.Pts = data.Pts })
 			session.notify(updateReceived{data})
 			return data
 		case *PredUpdateReadMessagesContents:
 			data := data.(*PredUpdateReadMessagesContents)
-			session.updatesState.Pts = data.Pts
+			session.withUpdatesState(func(state *PredUpdatesState) { state.Pts = data.Pts })
 			session.notify(updateReceived{data})
 			return data
 		case *PredUpdateDeleteMessages:
 			data := data.(*PredUpdateDeleteMessages)
-			session.updatesState.Pts = data.Pts
+			session.withUpdatesState(func(state *PredUpdatesState) { state.Pts = data.Pts })
 			session.notify(updateReceived{data})
 			return data
 
 			// Pts and Date updates
 		case *PredUpdateShortMessage:
 			data := data.(*PredUpdateShortMessage)
-			session.updatesState.Pts = data.Pts
-			session.updatesState.Date = data.Date
+			session.withUpdatesState(func(state *PredUpdatesState) {
+				state.Pts = data.Pts
+				state.Date = data.Date
+			})
 			session.notify(updateReceived{data})
 			return data
 		case *PredUpdateShortChatMessage:
 			data := data.(*PredUpdateShortChatMessage)
-			session.updatesState.Pts = data.Pts
-			session.updatesState.Date = data.Date
+			session.withUpdatesState(func(state *PredUpdatesState) {
+				state.Pts = data.Pts
+				state.Date = data.Date
+			})
 			session.notify(updateReceived{data})
 			return data
 		case *PredUpdateShortSentMessage:
 			data := data.(*PredUpdateShortSentMessage)
-			session.updatesState.Pts = data.Pts
-			session.updatesState.Date = data.Date
+			session.withUpdatesState(func(state *PredUpdatesState) {
+				state.Pts = data.Pts
+				state.Date = data.Date
+			})
 			session.notify(updateReceived{data})
 			return data
 
 			// Qts updates
 		case *PredUpdateNewEncryptedMessage:
 			data := data.(*PredUpdateNewEncryptedMessage)
-			session.updatesState.Qts = data.Qts
+			session.withUpdatesState(func(state *PredUpdatesState) { state.Qts = data.Qts })
 			session.notify(updateReceived{data})
 			return data
 
@@ -581,7 +1025,7 @@ func (session *Session) process(msgId int64, seqNo int32, data interface{}) inte
 			return data
 		case *PredUpdateChannelTooLong:
 			data := data.(*PredUpdateChannelTooLong)
-			session.updatesState.Pts = data.Pts
+			session.withUpdatesState(func(state *PredUpdatesState) { state.Pts = data.Pts })
 			session.notify(updateReceived{data})
 			return data
 		case *PredUpdateReadChannelInbox:
@@ -594,56 +1038,219 @@ func (session *Session) process(msgId int64, seqNo int32, data interface{}) inte
 			return data
 		case *PredUpdateNewChannelMessage:
 			data := data.(*PredUpdateNewChannelMessage)
-			session.updatesState.Pts = data.Pts
+			session.withUpdatesState(func(state *PredUpdatesState) { state.Pts = data.Pts })
 			session.notify(updateReceived{data})
 			return data
 
 		default:
 			marshaled, err := json.Marshal(data)
 			if err == nil {
-				slog.Logf(session, "process: unknown data type %T {%s}\n", data, marshaled)
+				logf(session, "process: unknown data type %T {%s}\n", data, marshaled)
 			} else {
-				slog.Logf(session, "process: unknown data type %T {%v}\n", data, data)
+				logf(session, "process: unknown data type %T {%v}\n", data, data)
 			}
 			return data
 		}
 		return nil
 	}()
 
-	if returned != nil {
-		return returned
+	// acknowledge the content-related messages, the updates and the results as well,
+	// otherwise the server delivers them again
+	if (seqNo & 1) == 1 {
+		session.ack(msgId)
 	}
+	return returned
+}
 
-	// TODO: Check why I should do this
-	if (seqNo & 1) == 1 {
-		session.queueSend <- packetToSend{TL_msgs_ack{[]int64{msgId}}, nil}
+// ack acknowledges the message of msgId, with the pending ones when Configuration.AckThreshold are pending
+func (session *Session) ack(msgId int64) {
+	session.ackMutex.Lock()
+	session.pendingAcks = append(session.pendingAcks, msgId)
+	full := len(session.pendingAcks) >= session.appConfig.ackThreshold()
+	session.ackMutex.Unlock()
+	if full {
+		session.flushAcks()
+	}
+}
+
+// flushAcks sends msgs_ack of the pending acks
+func (session *Session) flushAcks() {
+	session.ackMutex.Lock()
+	msgIds := session.pendingAcks
+	session.pendingAcks = nil
+	session.ackMutex.Unlock()
+	if len(msgIds) > 0 {
+		session.queueSend <- packetToSend{msg: TL_msgs_ack{msgIds}}
 	}
+}
 
-	return nil
+// ackRoutine flushes the pending acks every Configuration.AckInterval.
+// A reconnection makes a session with its own message ids, so the acks are flushed on closing rather than
+// acked again on the next session.
+func (session *Session) ackRoutine() {
+	defer session.ackWaitGroup.Done()
+	ticker := time.NewTicker(session.appConfig.ackInterval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-session.ackInterrupter:
+			session.flushAcks()
+			return
+		case <-ticker.C:
+			session.flushAcks()
+		}
+	}
+}
+
+func (session *Session) stopAck() {
+	if session.ackInterrupter != nil {
+		close(session.ackInterrupter)
+		session.ackInterrupter = nil
+	}
+}
+
+func (session *Session) setSentCode(sentCode *PredAuthSentCode) {
+	session.codeMutex.Lock()
+	defer session.codeMutex.Unlock()
+	session.phoneCodeHash = sentCode.PhoneCodeHash
+	session.nextCodeType = nextCodeType(sentCode)
+	session.resendAfter = time.Now().Add(time.Duration(sentCode.Timeout) * time.Second)
+}
+
+func (session *Session) getPhoneCodeHash() string {
+	session.codeMutex.Lock()
+	defer session.codeMutex.Unlock()
+	return session.phoneCodeHash
+}
+
+func (session *Session) touch() {
+	atomic.StoreInt64(&session.lastActivity, time.Now().UnixNano())
+}
+
+// lastActive is when the session sent or received a message last
+func (session *Session) lastActive() time.Time {
+	if t := atomic.LoadInt64(&session.lastActivity); t != 0 {
+		return time.Unix(0, t)
+	}
+	return time.Time{}
+}
+
+func (session *Session) touchRPC() {
+	atomic.StoreInt64(&session.lastRPC, time.Now().UnixNano())
+}
+
+// idle is how long the session has neither sent an RPC nor received a reply
+func (session *Session) idle(now time.Time) time.Duration {
+	return now.Sub(time.Unix(0, atomic.LoadInt64(&session.lastRPC)))
+}
+
+// pendingRPCs is the number of the RPCs waiting for their replies
+func (session *Session) pendingRPCs() int {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	return len(session.msgsIdToResp)
+}
+
+// pingLatency is the round-trip time of the last ping of Conn.Ping
+func (session *Session) pingLatency() time.Duration {
+	return time.Duration(atomic.LoadInt64(&session.latency))
+}
+
+// expire fails the RPC of msgId with TimeoutError, if its reply has not arrived yet
+func (session *Session) expire(msgId int64, timeout time.Duration) {
+	session.abandon(msgId, TimeoutError{timeout}, rpcCodeTimeout)
+}
+
+// abandon fails the RPC of msgId with err, if its reply has not arrived yet.
+// The reply arriving later has no resp channel, so it is discarded.
+func (session *Session) abandon(msgId int64, err error, code int) {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	resp, ok := session.msgsIdToResp[msgId]
+	if !ok {
+		return
+	}
+	delete(session.msgsIdToResp, msgId)
+	if sent, ok := session.msgsIdToSent[msgId]; ok {
+		session.appConfig.metrics().IncRPC(sent.method, code)
+		delete(session.msgsIdToSent, msgId)
+	}
+	delete(session.msgsIdToAck, msgId)
+	select {
+	case resp <- response{nil, err}:
+	default:
+	}
 }
 
 // Save session
 //TODO: save channel and datacenter information
 func (session *Session) saveSession() (err error) {
 	session.encrypted = true
+	if session.f == nil {
+		// media session
+		return nil
+	}
 
 	b := NewEncodeBuf(1024)
 	b.StringBytes(session.authKey)
 	b.StringBytes(session.authKeyHash)
-	b.StringBytes(session.serverSalt)
+	b.StringBytes(session.salt())
 	b.String(session.addr)
 	var useIPv6UInt uint32
 	if session.useIPv6 {
 		useIPv6UInt = 1
 	}
 	b.UInt(useIPv6UInt)
+	if state := session.copyUpdatesState(); state != nil && state.Pts != 0 {
+		b.UInt(1)
+		b.Int(state.Pts)
+		b.Int(state.Qts)
+		b.Int(state.Date)
+		b.Int(state.Seq)
+	} else {
+		b.UInt(0)
+	}
+	b.UInt(uint32(len(session.dcKeys)))
+	for dc, key := range session.dcKeys {
+		b.Int(dc)
+		b.StringBytes(key.authKey)
+		b.StringBytes(key.authKeyHash)
+		b.StringBytes(key.serverSalt)
+	}
+	session.channelMutex.Lock()
+	b.UInt(uint32(len(session.channelPts)))
+	for channelId, pts := range session.channelPts {
+		b.Int(channelId)
+		b.Int(pts)
+	}
+	session.channelMutex.Unlock()
+	// the server time and the future salts, so that a reloaded session needs no bad_msg_notification or bad_server_salt
+	_, offset := session.msgIds.state()
+	b.Long(int64(offset))
+	b.Long(time.Now().Unix())
+	session.saltMutex.Lock()
+	b.UInt(uint32(len(session.futureSalts)))
+	for _, salt := range session.futureSalts {
+		b.Int(salt.valid_since)
+		b.Int(salt.valid_until)
+		b.StringBytes(salt.salt)
+	}
+	session.saltMutex.Unlock()
+
+	data := b.buf
+	if len(session.appConfig.SessionEncryptionKey) > 0 {
+		data, err = encryptKeyFile(session.appConfig.SessionEncryptionKey, data)
+		if err != nil {
+			return err
+		}
+	}
 
 	err = session.f.Truncate(0)
 	if err != nil {
 		return err
 	}
 
-	_, err = session.f.WriteAt(b.buf, 0)
+	_, err = session.f.WriteAt(data, 0)
 	if err != nil {
 		return err
 	}
@@ -658,37 +1265,147 @@ func (session *Session) stopRead() {
 }
 
 func (session *Session) stopSend() {
+	session.sendMutex.Lock()
+	defer session.sendMutex.Unlock()
+	session.sendClosed = true
 	if session.isSending {
 		close(session.sendInterrupter)
 		close(session.queueSend)
 	}
 }
 
+// withUpdatesState runs f on the updates state, unless it is nil.
+// The state is advanced by the read routine and by the RPC callers, e.g., MessagesReadHistory.
+func (session *Session) withUpdatesState(f func(state *PredUpdatesState)) {
+	session.updatesMutex.Lock()
+	defer session.updatesMutex.Unlock()
+	if session.updatesState != nil {
+		f(session.updatesState)
+	}
+}
+
+// copyUpdatesState returns a copy of the updates state, or nil if it is nil
+func (session *Session) copyUpdatesState() *PredUpdatesState {
+	session.updatesMutex.Lock()
+	defer session.updatesMutex.Unlock()
+	if session.updatesState == nil {
+		return nil
+	}
+	copied := *session.updatesState
+	return &copied
+}
+
+func (session *Session) setUpdatesState(state *PredUpdatesState) {
+	session.updatesMutex.Lock()
+	defer session.updatesMutex.Unlock()
+	session.updatesState = state
+}
+
+// send queues the packet, or fails with ErrConnClosed once stopSend has closed the queue
+func (session *Session) send(packet packetToSend) error {
+	session.sendMutex.RLock()
+	defer session.sendMutex.RUnlock()
+	if session.sendClosed {
+		return ErrConnClosed
+	}
+	session.queueSend <- packet
+	return nil
+}
+
 func (session *Session) stopPing() {
 	if session.isPing {
 		close(session.pingInterrupter)
 	}
 }
 
+// The server closes the connection, if no ping arrives in pingDisconnectMultiple ping intervals
+const pingDisconnectMultiple = 2
+
+// pingRoutine keeps the connection alive with ping_delay_disconnect.
+// If the pong of a ping does not arrive until the next ping, the connection is dead and is refreshed.
+// ping sends a ping, and returns the round-trip time to its pong.
+func (session *Session) ping(timeout time.Duration) (time.Duration, error) {
+	pingId := randInt63(session.appConfig.randSource())
+	pong := make(chan struct{}, 1)
+	session.pongMutex.Lock()
+	if session.pongs == nil {
+		session.pongs = make(map[int64]chan struct{})
+	}
+	session.pongs[pingId] = pong
+	session.pongMutex.Unlock()
+	defer func() {
+		session.pongMutex.Lock()
+		delete(session.pongs, pingId)
+		session.pongMutex.Unlock()
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	start := time.Now()
+	select {
+	case session.queueSend <- packetToSend{msg: TL_ping{pingId}}:
+	case <-timer.C:
+		return 0, TimeoutError{timeout}
+	}
+	select {
+	case <-pong:
+		latency := time.Since(start)
+		atomic.StoreInt64(&session.latency, int64(latency))
+		return latency, nil
+	case <-timer.C:
+		return 0, TimeoutError{timeout}
+	}
+}
+
 func (session *Session) pingRoutine() {
-	slog.Logln(session, "ping: start")
+	logln(session, "ping: start")
 	defer func() {
 		session.isPing = false
 		session.pingWaitGroup.Done()
 	}()
+	interval := session.appConfig.PingInterval
+	if interval <= 0 {
+		interval = defaultPingInterval
+	}
+	var pingedAt time.Time
 	for {
 		select {
 		case <-session.pingInterrupter:
 			session.isPing = false
 			return
-		case <-time.After(session.appConfig.PingInterval):
-			session.queueSend <- packetToSend{TL_ping{0xCADACADA}, nil}
+		case <-time.After(interval):
+			if !pingedAt.IsZero() && atomic.LoadInt64(&session.lastPong) < pingedAt.UnixNano() {
+				errorf(session, "ping: no pong in %v, the connection to %s is dead", interval, session.addr)
+				session.notify(refreshSession{
+					session.sessionId,
+					session.phonenumber,
+					untilSuccess,
+					nil,
+					CloseNetworkError,
+				})
+				return
+			}
+			pingedAt = time.Now()
+			if session.encrypted {
+				// the salt is changed before it expires, rather than after bad_server_salt
+				rotated, low := session.rotateSalt(pingedAt)
+				if rotated {
+					_ = session.saveSession()
+				}
+				if low {
+					session.queueSend <- packetToSend{msg: TL_get_future_salts{futureSaltsToGet}}
+				}
+			}
+			session.queueSend <- packetToSend{msg: TL_ping_delay_disconnect{
+				ping_id:          randInt63(session.appConfig.randSource()),
+				disconnect_delay: int32(pingDisconnectMultiple * interval / time.Second),
+			}}
 		}
 	}
 }
 
 func (session *Session) sendRoutine(interval time.Duration) {
-	slog.Logln(session, "send: start")
+	logln(session, "send: start")
 	defer func() {
 		session.isSending = false
 		session.sendWaitGroup.Done()
@@ -709,30 +1426,42 @@ func (session *Session) sendRoutine(interval time.Duration) {
 	for {
 		select {
 		case <-session.sendInterrupter:
-			slog.Logln(session, "send: stop")
+			logln(session, "send: stop")
 			session.isSending = false
 			close(timerInterrupter)
 			return
 		case x := <-session.queueSend:
-			if _, ok := x.msg.(TL_ping); !ok {
-				slog.Logf(session, "send %s\n", slog.Stringify(x.msg))
+			if _, ok := x.msg.(TL_ping_delay_disconnect); !ok {
+				logf(session, "send %s\n", stringified{x.msg})
 			}
 			if x.msg != nil {
 				//TODO: alternate interval based scheduler with frequency scheduler
 				wg.Wait()
-				err := session.sendPacket(x.msg, x.resp)
+				err := session.sendPacket(x)
 				wg.Add(1)
 				t.Reset(interval)
 				if err != nil {
-					slog.Logln(session, "send err:", err)
+					logln(session, "send err:", err)
 				}
 			}
 		}
 	}
 }
 
+// closeReason tells why the read of the connection failed by err.
+// The server closes the connection by EOF, and the other failures are of the network.
+func (session *Session) closeReason(err error) CloseReason {
+	switch {
+	case atomic.LoadInt32(&session.revoked) != 0:
+		return CloseAuthRevoked
+	case err == io.EOF:
+		return CloseServerClose
+	}
+	return CloseNetworkError
+}
+
 func (session *Session) readRoutine() {
-	slog.Logln(session, "read: start")
+	logln(session, "read: start")
 	defer func() {
 		session.isReading = false
 		session.readWaitGroup.Done()
@@ -744,7 +1473,7 @@ func (session *Session) readRoutine() {
 		// Run async wait for data from server
 		ch := make(chan interface{}, 1)
 		go func(ch chan<- interface{}) {
-			refreshUntilSuccess := func(session *Session) {
+			refreshUntilSuccess := func(session *Session, reason CloseReason) {
 				//respChan := make(chan sessionResponse)
 				//for {
 				session.notify(refreshSession{
@@ -752,6 +1481,7 @@ func (session *Session) readRoutine() {
 					session.phonenumber,
 					untilSuccess,
 					nil,
+					reason,
 				})
 				//resp := <-respChan
 				//if resp.err == nil {
@@ -764,16 +1494,20 @@ func (session *Session) readRoutine() {
 
 			data, err := session.read()
 			if _, ok := data.(TL_pong); !ok {
-				slog.Logf(session, "read: type: %v, data: %v, err: %v\n", reflect.TypeOf(data), data, err)
+				logf(session, "read: type: %v, data: %v, err: %v\n", reflect.TypeOf(data), data, err)
 			}
-			//slog.Logf(session, "read: %s\n", slog.Stringify(data))
-			if err == io.EOF {
+			//logf(session, "read: %s\n", slog.Stringify(data))
+			reason := session.closeReason(err)
+			if err != nil && !reason.reconnects() {
+				// the manager closes the connection
+				logf(session, "read: connection closed (%s), %v\n", reason, err)
+			} else if err == io.EOF {
 				// Connection closed by server, trying to reconnect
-				slog.Logf(session, "read: lost connection (captured EOF). reconnect to %s\n", session.addr)
-				refreshUntilSuccess(session)
+				logf(session, "read: lost connection (captured EOF). reconnect to %s\n", session.addr)
+				refreshUntilSuccess(session, reason)
 			} else if err != nil {
 				if strings.Contains(err.Error(), "use of closed network connection") {
-					slog.Logf(session, "read: TCP connection closed (%s)\n", err)
+					logf(session, "read: TCP connection closed (%s)\n", err)
 					// Two cases
 					// 1. on new authentication, 303 PHONE_MIGRATE can require to make a new connection with different
 					//   server by closing the connection. -> do nothing, because session will be renewed by MM
@@ -783,17 +1517,17 @@ func (session *Session) readRoutine() {
 						// do nothing
 					} else {
 						// case 2
-						refreshUntilSuccess(session)
+						refreshUntilSuccess(session, reason)
 					}
 				} else if strings.Contains(err.Error(), "connection reset by peer") {
-					slog.Logf(session, "read: lost connection (%s). reconnect to %s\n", err, session.addr)
-					refreshUntilSuccess(session)
+					logf(session, "read: lost connection (%s). reconnect to %s\n", err, session.addr)
+					refreshUntilSuccess(session, reason)
 				} else if strings.Contains(err.Error(), "i/o timeout") {
-					slog.Logf(session, "read: lost connection (%s). reconnect to %s\n", err, session.addr)
-					refreshUntilSuccess(session)
+					logf(session, "read: lost connection (%s). reconnect to %s\n", err, session.addr)
+					refreshUntilSuccess(session, reason)
 				} else {
-					slog.Logf(session, "read: unknown error, %s. reconnect to %s\n", err, session.addr)
-					refreshUntilSuccess(session)
+					logf(session, "read: unknown error, %s. reconnect to %s\n", err, session.addr)
+					refreshUntilSuccess(session, reason)
 				}
 			} else {
 				ch <- data
@@ -802,10 +1536,10 @@ func (session *Session) readRoutine() {
 
 		select {
 		case <-session.readInterrupter:
-			slog.Logln(session, "read: wait for inner routine ...")
+			logln(session, "read: wait for inner routine ...")
 			session.isReading = false
 			innerRoutineWG.Wait()
-			slog.Logln(session, "read: stop")
+			logln(session, "read: stop")
 			return
 		case data := <-ch:
 			if data == nil {
@@ -815,128 +1549,292 @@ func (session *Session) readRoutine() {
 		}
 	}
 }
-func (session *Session) sendPacket(msg TL, resp chan response) error {
+func (session *Session) sendPacket(packet packetToSend) error {
+	if len(packet.batch) > 0 {
+		return session.sendContainer(packet.batch)
+	}
+	msg := packet.msg
 	obj := msg.encode()
 
 	x := NewEncodeBuf(256)
 
-	// padding for tcpsize
-	x.Int(0)
-
 	if session.encrypted {
 		needAck := true
 		switch msg.(type) {
-		case TL_ping, TL_msgs_ack:
+		case TL_ping, TL_ping_delay_disconnect, TL_msgs_ack:
 			needAck = false
 		}
-		z := NewEncodeBuf(256)
-		newMsgId := GenerateMessageId()
-		z.Bytes(session.serverSalt)
-		z.Long(session.sessionId)
-		z.Long(newMsgId)
-		if needAck {
-			z.Int(session.lastSeqNo | 1)
-		} else {
-			z.Int(session.lastSeqNo)
-		}
-		z.Int(int32(len(obj)))
-		z.Bytes(obj)
-
-		msgKey := sha1(z.buf)[4:20]
-		aesKey, aesIV := generateAES(msgKey, session.authKey, false)
-
-		y := make([]byte, len(z.buf)+((16-(len(obj)%16))&15))
-		copy(y, z.buf)
-		encryptedData, err := doAES256IGEencrypt(y, aesKey, aesIV)
+		// acks are the only messages here which are not content-related
+		_, isAck := msg.(TL_msgs_ack)
+		newMsgId, seqNo := session.nextMessage(!isAck)
+		encrypted, err := session.encrypt(newMsgId, seqNo, obj)
 		if err != nil {
 			return err
 		}
-
-		session.lastSeqNo += 2
-		if needAck {
-			session.mutex.Lock()
-			session.msgsIdToAck[newMsgId] = packetToSend{msg, resp}
-			session.mutex.Unlock()
-		}
-
-		x.Bytes(session.authKeyHash)
-		x.Bytes(msgKey)
-		x.Bytes(encryptedData)
-
-		if resp != nil {
-			session.mutex.Lock()
-			session.msgsIdToResp[newMsgId] = resp
-			session.mutex.Unlock()
-		}
+		session.track(newMsgId, packet, needAck)
+		x.Bytes(encrypted)
 
 	} else {
 		x.Long(0)
-		x.Long(GenerateMessageId())
+		x.Long(session.msgIds.next())
 		x.Int(int32(len(obj)))
 		x.Bytes(obj)
 
 	}
 
-	// minus padding
-	size := len(x.buf)/4 - 1
-
-	if size < 127 {
-		x.buf[3] = byte(size)
-		x.buf = x.buf[3:]
-	} else {
-		binary.LittleEndian.PutUint32(x.buf, uint32(size<<8|127))
-	}
-	_, err := session.tcpconn.Write(x.buf)
+	_, err := session.tcpconn.Write(session.transport.encode(x.buf))
 	if err != nil {
 		return err
 	}
+	session.touch()
 
 	return nil
 }
 
-func (session *Session) read() (interface{}, error) {
-	var err error
-	var n int
-	var size int
-	var data interface{}
-	tcpconn := session.tcpconn
+// maxContainerMessages is the number of messages a msg_container takes at most
+const maxContainerMessages = 1020
 
-	err = tcpconn.SetReadDeadline(time.Now().Add(300 * time.Second))
+// sendContainer sends the packets in a msg_container, and tracks their replies as sendPacket does.
+func (session *Session) sendContainer(packets []packetToSend) error {
+	if !session.encrypted {
+		return fmt.Errorf("msg_container on an unencrypted session")
+	}
+	body := NewEncodeBuf(512)
+	body.UInt(crc_msg_container)
+	body.Int(int32(len(packets)))
+	for _, packet := range packets {
+		obj := packet.msg.encode()
+		msgId, seqNo := session.nextMessage(true)
+		body.Long(msgId)
+		body.Int(seqNo)
+		body.Int(int32(len(obj)))
+		body.Bytes(obj)
+		session.track(msgId, packet, true)
+	}
+
+	// the container is after its messages, and it is not content-related
+	containerId, seqNo := session.nextMessage(false)
+	encrypted, err := session.encrypt(containerId, seqNo, body.buf)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	if _, err := session.tcpconn.Write(session.transport.encode(encrypted)); err != nil {
+		return err
+	}
+	session.touch()
+	return nil
+}
+
+// nextMessage returns the id and the seqno of the next message to send.
+// The seqno is twice the number of the content-related messages sent before, plus 1 if the message is content-related.
+func (session *Session) nextMessage(contentRelated bool) (int64, int32) {
+	session.seqMutex.Lock()
+	defer session.seqMutex.Unlock()
+	seqNo := session.lastSeqNo
+	if contentRelated {
+		seqNo |= 1
+		session.lastSeqNo += 2
 	}
+	return session.msgIds.next(), seqNo
+}
 
-	// Read packet size
-	b := make([]byte, 1)
-	n, err = tcpconn.Read(b) // Wait for an incoming byte
+// SessionCounters are the message id and the seqno counters of a session, for debugging bad_msg_notification.
+type SessionCounters struct {
+	SeqNo            int32         // of the next message which is not content-related; the content-related one has SeqNo + 1
+	LastMsgId        int64         // the last message id generated, 0 after the server time is synced
+	ServerTimeOffset time.Duration // of the server clock from the local one, by bad_msg_notification
+}
+
+// DebugCounters returns the counters of the session, at once.
+// It is only for debugging; the counters are not to be relied on otherwise.
+func (session *Session) DebugCounters() SessionCounters {
+	session.seqMutex.Lock()
+	defer session.seqMutex.Unlock()
+	lastMsgId, offset := session.msgIds.state()
+	return SessionCounters{session.lastSeqNo, lastMsgId, offset}
+}
+
+// encrypt makes the encrypted message of obj
+func (session *Session) encrypt(msgId int64, seqNo int32, obj []byte) ([]byte, error) {
+	z := NewEncodeBuf(256)
+	z.Bytes(session.salt())
+	z.Long(session.sessionId)
+	z.Long(msgId)
+	z.Int(seqNo)
+	z.Int(int32(len(obj)))
+	z.Bytes(obj)
+
+	msgKey := sha1(z.buf)[4:20]
+	aesKey, aesIV := generateAES(msgKey, session.authKey, false)
+
+	y := make([]byte, len(z.buf)+((16-(len(obj)%16))&15))
+	copy(y, z.buf)
+	encryptedData, err := doAES256IGEencrypt(y, aesKey, aesIV)
 	if err != nil {
 		return nil, err
 	}
-	slog.Record(b)
 
-	if b[0] < 127 {
-		size = int(b[0]) << 2
+	x := NewEncodeBuf(256)
+	x.Bytes(session.authKeyHash)
+	x.Bytes(msgKey)
+	x.Bytes(encryptedData)
+	return x.buf, nil
+}
+
+// track keeps the packet of msgId until it is acked, and its resp until the reply or the timeout
+func (session *Session) track(msgId int64, packet packetToSend, needAck bool) {
+	if needAck {
+		session.mutex.Lock()
+		session.msgsIdToAck[msgId] = packet
+		session.mutex.Unlock()
+	}
+	if packet.resp != nil {
+		session.touchRPC()
+		session.mutex.Lock()
+		session.msgsIdToResp[msgId] = packet.resp
+		session.msgsIdToSent[msgId] = sentRPC{rpcMethodName(packet.msg), time.Now()}
+		session.mutex.Unlock()
+		timeout := packet.timeout
+		if timeout == 0 {
+			timeout = session.appConfig.requestTimeout()
+		}
+		if packet.ctx == nil || packet.ctx.Done() == nil {
+			time.AfterFunc(timeout, func() { session.expire(msgId, timeout) })
+			return
+		}
+		go func() {
+			timer := time.NewTimer(timeout)
+			defer timer.Stop()
+			select {
+			case <-timer.C:
+				session.expire(msgId, timeout)
+			case <-packet.ctx.Done():
+				session.abandon(msgId, packet.ctx.Err(), rpcCodeCanceled)
+			}
+		}()
+	}
+}
+
+// the error codes of bad_msg_notification on the message ids
+const (
+	badMsgIdTooLow       = 16
+	badMsgIdTooHigh      = 17
+	badMsgIdNotDivisible = 18 // the lower 2 bits are not 0
+	badMsgIdDuplicate    = 19 // the id of a container is the same as of a message before
+	badMsgIdTooOld       = 20
+)
+
+// resend sends the message of msgId, rejected by the server, again with a new message id.
+// A rejected msg_container is not tracked, so all the messages not acked yet are sent again.
+func (session *Session) resend(msgId int64) {
+	session.mutex.Lock()
+	var packets []packetToSend
+	if packet, ok := session.msgsIdToAck[msgId]; ok {
+		packets = append(packets, packet)
+		session.untrack(msgId)
 	} else {
-		b := make([]byte, 3)
-		n, err = tcpconn.Read(b)
-		slog.Record(b)
-		if err != nil {
-			return nil, err
+		ids := make([]int64, 0, len(session.msgsIdToAck))
+		for id := range session.msgsIdToAck {
+			ids = append(ids, id)
+		}
+		// in the order they were sent
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		for _, id := range ids {
+			packets = append(packets, session.msgsIdToAck[id])
+			session.untrack(id)
 		}
-		size = (int(b[0]) | int(b[1])<<8 | int(b[2])<<16) << 2
 	}
+	session.mutex.Unlock()
+	for _, packet := range packets {
+		session.queueSend <- packet
+	}
+}
 
-	// Read packet
-	left := size
-	buf := make([]byte, size)
-	for left > 0 {
-		n, err = tcpconn.Read(buf[size-left:])
-		if err != nil {
-			return nil, err
+// untrack forgets msgId, so that its expiry does not time out the resent packet.
+// The caller holds session.mutex.
+func (session *Session) untrack(msgId int64) {
+	delete(session.msgsIdToAck, msgId)
+	delete(session.msgsIdToResp, msgId)
+	delete(session.msgsIdToSent, msgId)
+}
+
+func (session *Session) salt() []byte {
+	session.saltMutex.Lock()
+	defer session.saltMutex.Unlock()
+	return session.serverSalt
+}
+
+func (session *Session) setSalt(salt []byte) {
+	session.saltMutex.Lock()
+	session.serverSalt = salt
+	session.saltMutex.Unlock()
+}
+
+const (
+	// futureSaltsToGet is the number of the salts requested by get_future_salts
+	futureSaltsToGet = 32
+	// minFutureSalts is the number of the salts not valid yet, under which more are requested
+	minFutureSalts = 2
+)
+
+func (session *Session) addFutureSalts(salts []TL_future_salt) {
+	session.saltMutex.Lock()
+	defer session.saltMutex.Unlock()
+	session.futureSalts = append(session.futureSalts[:0:0], salts...)
+	sort.Slice(session.futureSalts, func(i, j int) bool {
+		return session.futureSalts[i].valid_since < session.futureSalts[j].valid_since
+	})
+}
+
+// rotateSalt switches to the latest future salt valid at now, before the current one expires,
+// and drops the expired ones.
+// It reports whether the salt is rotated, and whether few future salts are left, so that more are requested.
+func (session *Session) rotateSalt(now time.Time) (rotated, low bool) {
+	session.saltMutex.Lock()
+	defer session.saltMutex.Unlock()
+	unix := int32(now.Unix())
+	var salts []TL_future_salt
+	var next int
+	for _, salt := range session.futureSalts {
+		if salt.valid_until <= unix {
+			continue
 		}
-		left -= n
+		if salt.valid_since <= unix {
+			if !bytes.Equal(session.serverSalt, salt.salt) {
+				session.serverSalt = salt.salt
+				rotated = true
+			}
+		} else {
+			next++
+		}
+		salts = append(salts, salt)
+	}
+	session.futureSalts = salts
+	return rotated, next < minFutureSalts
+}
+
+func (session *Session) read() (interface{}, error) {
+	var err error
+	var size int
+	var data interface{}
+	tcpconn := session.tcpconn
+
+	deadline := time.Now().Add(300 * time.Second)
+	if !session.dialDeadline.IsZero() && session.dialDeadline.Before(deadline) {
+		deadline = session.dialDeadline
+	}
+	err = tcpconn.SetReadDeadline(deadline)
+	if err != nil {
+		return nil, err
+	}
+
+	// Read packet
+	buf, err := session.transport.decode(tcpconn)
+	if err != nil {
+		return nil, err
 	}
 	slog.Record(buf)
+	size = len(buf)
 
 	if size == 4 {
 		return nil, fmt.Errorf("Server response error: %d", int32(binary.LittleEndian.Uint32(buf)))
@@ -947,6 +1845,7 @@ func (session *Session) read() (interface{}, error) {
 	if err != nil {
 		return nil, err
 	}
+	session.touch()
 	return data, nil
 
 }
@@ -957,8 +1856,10 @@ func (session *Session) makeAuthKey() error {
 	var data interface{}
 
 	// (send) req_pq
-	nonceFirst := GenerateNonce(16)
-	err = session.sendPacket(TL_req_pq{nonceFirst}, nil)
+	// the nonces and the DH exponent are of crypto/rand, never of Configuration.RandSource,
+	// otherwise a fixed source makes the auth key predictable
+	nonceFirst := randBytes(crand.Reader, 16)
+	err = session.sendPacket(packetToSend{msg: TL_req_pq{nonceFirst}})
 	if err != nil {
 		return err
 	}
@@ -988,7 +1889,7 @@ func (session *Session) makeAuthKey() error {
 
 	// (encoding) p_q_inner_data
 	p, q := splitPQ(res.pq)
-	nonceSecond := GenerateNonce(32)
+	nonceSecond := randBytes(crand.Reader, 32)
 	nonceServer := res.server_nonce
 	innerData1 := (TL_p_q_inner_data{res.pq, p, q, nonceFirst, nonceServer, nonceSecond}).encode()
 
@@ -997,7 +1898,7 @@ func (session *Session) makeAuthKey() error {
 	copy(x[20:], innerData1)
 	encryptedData1 := doRSAencrypt(x)
 	// (send) req_DH_params
-	err = session.sendPacket(TL_req_DH_params{nonceFirst, nonceServer, p, q, telegramPublicKey_FP, encryptedData1}, nil)
+	err = session.sendPacket(packetToSend{msg: TL_req_DH_params{nonceFirst, nonceServer, p, q, telegramPublicKey_FP, encryptedData1}})
 	if err != nil {
 		return err
 	}
@@ -1086,7 +1987,7 @@ func (session *Session) makeAuthKey() error {
 	encryptedData2, err := doAES256IGEencrypt(x, tmpAESKey, tmpAESIV)
 
 	// (send) set_client_DH_params
-	err = session.sendPacket(TL_set_client_DH_params{nonceFirst, nonceServer, encryptedData2}, nil)
+	err = session.sendPacket(packetToSend{msg: TL_set_client_DH_params{nonceFirst, nonceServer, encryptedData2}})
 	if err != nil {
 		return err
 	}
@@ -1119,6 +2020,10 @@ func (session *Session) makeAuthKey() error {
 	return nil
 }
 
+func (x *Session) logger() Logger {
+	return x.appConfig.Logger
+}
+
 func (x *Session) LogPrefix() string {
 	return fmt.Sprintf("[%d-%d]", x.connId, x.sessionId)
 }
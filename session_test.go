@@ -0,0 +1,857 @@
+package mtproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestEncryptedKeyFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "mtproto_key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	key := bytes.Repeat([]byte{7}, 32)
+	saved := &Session{
+		f:           f,
+		authKey:     bytes.Repeat([]byte{1}, 256),
+		authKeyHash: []byte{2, 2, 2, 2, 2, 2, 2, 2},
+		serverSalt:  []byte{3, 3, 3, 3, 3, 3, 3, 3},
+		addr:        "149.154.167.50:443",
+	}
+
+	// a legacy plaintext file is loaded with the key, and encrypted on the next save
+	if err := saved.saveSession(); err != nil {
+		t.Fatal(err)
+	}
+	legacy := &Session{appConfig: Configuration{SessionEncryptionKey: key}}
+	if err := legacy.readSessionFile(f); err != nil || !bytes.Equal(legacy.authKey, saved.authKey) {
+		t.Fatalf("legacy key file is not loaded: %v", err)
+	}
+	saved.appConfig.SessionEncryptionKey = key
+	if err := saved.saveSession(); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadFile(f.Name())
+	if !isEncryptedKeyFile(b) || bytes.Contains(b, saved.authKey) {
+		t.Fatalf("key file is not encrypted")
+	}
+
+	loaded := &Session{appConfig: Configuration{SessionEncryptionKey: key}}
+	if err := loaded.readSessionFile(f); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(loaded.authKey, saved.authKey) || !bytes.Equal(loaded.serverSalt, saved.serverSalt) || loaded.addr != saved.addr {
+		t.Errorf("loaded session is different")
+	}
+
+	wrongKey := &Session{appConfig: Configuration{SessionEncryptionKey: bytes.Repeat([]byte{8}, 32)}}
+	if err := wrongKey.readSessionFile(f); err == nil {
+		t.Errorf("key file is decrypted by a wrong key")
+	}
+	noKey := &Session{}
+	if err := noKey.readSessionFile(f); err == nil {
+		t.Errorf("encrypted key file is loaded without a key")
+	}
+}
+
+func TestUpdatesStateKeyFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "mtproto_key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	saved := &Session{
+		f:            f,
+		authKey:      bytes.Repeat([]byte{1}, 256),
+		authKeyHash:  []byte{2, 2, 2, 2, 2, 2, 2, 2},
+		serverSalt:   []byte{3, 3, 3, 3, 3, 3, 3, 3},
+		addr:         "149.154.167.50:443",
+		updatesState: &PredUpdatesState{Pts: 10, Qts: 2, Date: 100, Seq: 3},
+	}
+	if err := saved.saveSession(); err != nil {
+		t.Fatal(err)
+	}
+	loaded := &Session{}
+	if err := loaded.readSessionFile(f); err != nil {
+		t.Fatal(err)
+	}
+	if state := loaded.persistedUpdatesState; state == nil || *state != *saved.updatesState {
+		t.Errorf("unexpected updates state %v", state)
+	}
+
+	// a session without the state does not leave the old one
+	saved.updatesState = nil
+	if err := saved.saveSession(); err != nil {
+		t.Fatal(err)
+	}
+	loaded = &Session{}
+	if err := loaded.readSessionFile(f); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.persistedUpdatesState != nil || !bytes.Equal(loaded.authKey, saved.authKey) {
+		t.Errorf("unexpected session %v", loaded.persistedUpdatesState)
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	// the server never answers
+	client, server := net.Pipe()
+	defer client.Close()
+	go ioutil.ReadAll(server)
+	session := &Session{
+		tcpconn:      client,
+		transport:    abridged{},
+		encrypted:    true,
+		authKey:      bytes.Repeat([]byte{1}, 256),
+		authKeyHash:  []byte{2, 2, 2, 2, 2, 2, 2, 2},
+		serverSalt:   []byte{3, 3, 3, 3, 3, 3, 3, 3},
+		mutex:        &sync.Mutex{},
+		msgsIdToAck:  make(map[int64]packetToSend),
+		msgsIdToResp: make(map[int64]chan response),
+		msgsIdToSent: make(map[int64]sentRPC),
+		appConfig:    Configuration{RequestTimeout: time.Hour},
+	}
+
+	resp := make(chan response, 1)
+	if err := session.sendPacket(packetToSend{msg: &ReqHelpGetConfig{}, resp: resp, timeout: 10 * time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+	var msgId int64
+	session.mutex.Lock()
+	for id := range session.msgsIdToResp {
+		msgId = id
+	}
+	session.mutex.Unlock()
+
+	select {
+	case x := <-resp:
+		if _, ok := x.err.(TimeoutError); !ok {
+			t.Fatalf("%T: %v, expected TimeoutError", x.err, x.err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the call is not timed out")
+	}
+	session.mutex.Lock()
+	if len(session.msgsIdToResp) != 0 || len(session.msgsIdToAck) != 0 {
+		t.Errorf("timed-out message %d is not cleaned up", msgId)
+	}
+	session.mutex.Unlock()
+
+	// the late reply is discarded
+	session.process(GenerateMessageId(), 2, TL_rpc_result{msgId, &PredBoolTrue{}})
+	select {
+	case x := <-resp:
+		t.Errorf("late reply is delivered: %v", x)
+	default:
+	}
+}
+
+func TestRequestCanceled(t *testing.T) {
+	// the server never answers
+	client, server := net.Pipe()
+	defer client.Close()
+	go ioutil.ReadAll(server)
+	session := &Session{
+		tcpconn:      client,
+		transport:    abridged{},
+		encrypted:    true,
+		authKey:      bytes.Repeat([]byte{1}, 256),
+		authKeyHash:  []byte{2, 2, 2, 2, 2, 2, 2, 2},
+		serverSalt:   []byte{3, 3, 3, 3, 3, 3, 3, 3},
+		mutex:        &sync.Mutex{},
+		msgsIdToAck:  make(map[int64]packetToSend),
+		msgsIdToResp: make(map[int64]chan response),
+		msgsIdToSent: make(map[int64]sentRPC),
+		appConfig:    Configuration{RequestTimeout: time.Hour},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	resp := make(chan response, 1)
+	if err := session.sendPacket(packetToSend{msg: &ReqHelpGetConfig{}, resp: resp, ctx: ctx}); err != nil {
+		t.Fatal(err)
+	}
+	var msgId int64
+	session.mutex.Lock()
+	for id := range session.msgsIdToResp {
+		msgId = id
+	}
+	session.mutex.Unlock()
+
+	// cancelled while waiting for the reply
+	cancel()
+	select {
+	case x := <-resp:
+		if x.err != context.Canceled {
+			t.Fatalf("%T: %v, expected context.Canceled", x.err, x.err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the call is not abandoned")
+	}
+	session.mutex.Lock()
+	if len(session.msgsIdToResp) != 0 || len(session.msgsIdToAck) != 0 || len(session.msgsIdToSent) != 0 {
+		t.Errorf("abandoned message %d is not cleaned up", msgId)
+	}
+	session.mutex.Unlock()
+
+	// the late reply is discarded
+	session.process(GenerateMessageId(), 2, TL_rpc_result{msgId, &PredBoolTrue{}})
+	select {
+	case x := <-resp:
+		t.Errorf("late reply is delivered: %v", x)
+	default:
+	}
+}
+
+func TestPingWithoutPong(t *testing.T) {
+	events := make(chan Event, 1)
+	session := &Session{
+		queueSend:       make(chan packetToSend, 8),
+		pingInterrupter: make(chan struct{}),
+		appConfig:       Configuration{PingInterval: 10 * time.Millisecond},
+	}
+	session.AddSessionListener(events)
+	session.isPing = true
+	session.pingWaitGroup.Add(1)
+	go session.pingRoutine()
+	defer func() {
+		close(session.pingInterrupter)
+		session.pingWaitGroup.Wait()
+	}()
+
+	// the first ping is answered
+	x := <-session.queueSend
+	if _, ok := x.msg.(TL_ping_delay_disconnect); !ok {
+		t.Fatalf("unexpected ping %T", x.msg)
+	}
+	session.process(GenerateMessageId(), 2, TL_pong{})
+
+	// the second is not
+	<-session.queueSend
+	select {
+	case e := <-events:
+		if _, ok := e.(refreshSession); !ok {
+			t.Fatalf("unexpected event %T", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the session is not declared dead")
+	}
+	select {
+	case x := <-session.queueSend:
+		t.Errorf("ping %v after the dead connection", x.msg)
+	default:
+	}
+}
+
+func TestPingLatency(t *testing.T) {
+	loopback := make(chan packetToSend)
+	session := &Session{queueSend: loopback}
+	// echo the pings with pongs
+	go func() {
+		for x := range loopback {
+			if ping, ok := x.msg.(TL_ping); ok {
+				time.Sleep(10 * time.Millisecond)
+				session.process(GenerateMessageId(), 0, TL_pong{0, ping.ping_id})
+			}
+		}
+	}()
+	defer close(loopback)
+
+	latency, err := session.ping(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latency < 10*time.Millisecond || session.pingLatency() != latency {
+		t.Errorf("unexpected latency %v, last %v", latency, session.pingLatency())
+	}
+	if len(session.pongs) != 0 {
+		t.Errorf("the pong is still waited for")
+	}
+
+	// an unanswered ping times out
+	session.queueSend = make(chan packetToSend, 1)
+	if _, err := session.ping(20 * time.Millisecond); err == nil {
+		t.Errorf("unanswered ping succeeds")
+	} else if _, ok := err.(TimeoutError); !ok {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestAcksAfterThreshold(t *testing.T) {
+	session := &Session{
+		queueSend:    make(chan packetToSend, 8),
+		updatesState: &PredUpdatesState{},
+		mutex:        &sync.Mutex{},
+		msgsIdToResp: make(map[int64]chan response),
+		appConfig:    Configuration{AckThreshold: 3},
+	}
+	msgIds := []int64{GenerateMessageId(), GenerateMessageId(), GenerateMessageId()}
+	session.process(msgIds[0], 1, &PredUpdateShort{Date: 1})
+	session.process(msgIds[1], 3, &PredUpdateShort{Date: 2})
+	// not content-related
+	session.process(GenerateMessageId(), 4, TL_pong{})
+	select {
+	case x := <-session.queueSend:
+		t.Fatalf("%v is sent before the threshold", x.msg)
+	default:
+	}
+
+	// the result is acked once with its rpc_result
+	session.process(msgIds[2], 5, TL_rpc_result{GenerateMessageId(), &PredBoolTrue{}})
+	select {
+	case x := <-session.queueSend:
+		acks, ok := x.msg.(TL_msgs_ack)
+		if !ok || fmt.Sprint(acks.msgIds) != fmt.Sprint(msgIds) {
+			t.Errorf("unexpected acks %v, expected %v", x.msg, msgIds)
+		}
+	default:
+		t.Fatal("no acks after the threshold")
+	}
+	if len(session.pendingAcks) != 0 {
+		t.Errorf("%d acks are still pending", len(session.pendingAcks))
+	}
+}
+
+func TestResendOnBadServerSalt(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	frames := make(chan []byte, 2)
+	go func() {
+		for {
+			frame, err := abridged{}.decode(server)
+			if err != nil {
+				return
+			}
+			frames <- frame
+		}
+	}()
+	authKey := bytes.Repeat([]byte{1}, 256)
+	session := &Session{
+		tcpconn:      client,
+		transport:    abridged{},
+		encrypted:    true,
+		authKey:      authKey,
+		authKeyHash:  []byte{2, 2, 2, 2, 2, 2, 2, 2},
+		serverSalt:   []byte{3, 3, 3, 3, 3, 3, 3, 3},
+		queueSend:    make(chan packetToSend, 8),
+		mutex:        &sync.Mutex{},
+		msgsIdToAck:  make(map[int64]packetToSend),
+		msgsIdToResp: make(map[int64]chan response),
+		msgsIdToSent: make(map[int64]sentRPC),
+		appConfig:    Configuration{RequestTimeout: time.Hour},
+	}
+	// saltOf decrypts the salt and the message id of a sent frame
+	saltOf := func(frame []byte) ([]byte, int64) {
+		aesKey, aesIV := generateAES(frame[8:24], authKey, false)
+		plain, err := doAES256IGEdecrypt(frame[24:], aesKey, aesIV)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return plain[:8], int64(binary.LittleEndian.Uint64(plain[16:24]))
+	}
+
+	resp := make(chan response, 1)
+	if err := session.sendPacket(packetToSend{msg: &ReqHelpGetConfig{}, resp: resp}); err != nil {
+		t.Fatal(err)
+	}
+	_, badMsgId := saltOf(<-frames)
+
+	newSalt := []byte{4, 4, 4, 4, 4, 4, 4, 4}
+	session.process(GenerateMessageId(), 2, TL_bad_server_salt{badMsgId, 1, 48, newSalt})
+	var retry packetToSend
+	select {
+	case retry = <-session.queueSend:
+	default:
+		t.Fatal("the rejected request is not resent")
+	}
+	if len(session.queueSend) != 0 {
+		t.Errorf("%d packets are resent, expected 1", len(session.queueSend)+1)
+	}
+	session.mutex.Lock()
+	if _, ok := session.msgsIdToResp[badMsgId]; ok {
+		t.Errorf("the rejected message %d is still tracked", badMsgId)
+	}
+	session.mutex.Unlock()
+
+	if err := session.sendPacket(retry); err != nil {
+		t.Fatal(err)
+	}
+	salt, msgId := saltOf(<-frames)
+	if !bytes.Equal(salt, newSalt) {
+		t.Errorf("the request is resent with salt %x, expected %x", salt, newSalt)
+	}
+	if msgId == badMsgId {
+		t.Errorf("the request is resent with the rejected message id")
+	}
+	session.process(GenerateMessageId(), 2, TL_rpc_result{msgId, &PredBoolTrue{}})
+	select {
+	case x := <-resp:
+		if x.err != nil {
+			t.Errorf("unexpected error %v", x.err)
+		}
+	default:
+		t.Error("the reply of the resent request is not delivered")
+	}
+}
+
+func TestRotateSalt(t *testing.T) {
+	now := time.Unix(1000, 0)
+	session := &Session{serverSalt: []byte{1}}
+	session.addFutureSalts([]TL_future_salt{
+		{1100, 1200, []byte{3}},
+		{900, 1000, []byte{0}},
+		{1000, 1100, []byte{2}},
+	})
+
+	rotated, low := session.rotateSalt(now)
+	if !rotated || !bytes.Equal(session.salt(), []byte{2}) {
+		t.Errorf("salt %x, expected 02", session.salt())
+	}
+	if !low {
+		t.Error("one future salt is not low")
+	}
+	if len(session.futureSalts) != 2 {
+		t.Errorf("the expired salt is kept: %v", session.futureSalts)
+	}
+	if rotated, _ := session.rotateSalt(now); rotated {
+		t.Error("the salt is rotated twice")
+	}
+}
+
+func TestBadMsgNotification(t *testing.T) {
+	skew := time.Hour
+	for _, test := range []struct {
+		code   int32
+		resent bool
+		offset time.Duration
+	}{
+		{badMsgIdTooLow, true, skew},
+		{badMsgIdTooHigh, true, -skew},
+		{badMsgIdNotDivisible, true, 0},
+		{badMsgIdDuplicate, true, 0},
+		{badMsgIdTooOld, false, 0},
+	} {
+		now := time.Unix(1500000000, 0)
+		session := &Session{
+			queueSend:    make(chan packetToSend, 8),
+			mutex:        &sync.Mutex{},
+			msgIds:       msgIdGenerator{now: func() time.Time { return now }},
+			msgsIdToAck:  make(map[int64]packetToSend),
+			msgsIdToResp: make(map[int64]chan response),
+			msgsIdToSent: make(map[int64]sentRPC),
+		}
+		badMsgId := session.msgIds.next()
+		resp := make(chan response, 1)
+		session.msgsIdToAck[badMsgId] = packetToSend{msg: &ReqHelpGetConfig{}, resp: resp}
+		session.msgsIdToResp[badMsgId] = resp
+
+		serverMsgId := messageIdAt(now.Add(test.offset)) | 1
+		session.process(serverMsgId, 2, TL_crc_bad_msg_notification{badMsgId, 1, test.code})
+
+		if resent := len(session.queueSend) == 1; resent != test.resent {
+			t.Errorf("%d: resent %v, expected %v", test.code, resent, test.resent)
+		}
+		if _, ok := session.msgsIdToAck[badMsgId]; ok {
+			t.Errorf("%d: message %d is still to be acked", test.code, badMsgId)
+		}
+		if _, ok := session.msgsIdToResp[badMsgId]; ok == test.resent {
+			t.Errorf("%d: the reply of message %d is waited for %v", test.code, badMsgId, ok)
+		}
+		if session.msgIds.offset != test.offset {
+			t.Errorf("%d: offset %v, expected %v", test.code, session.msgIds.offset, test.offset)
+		}
+		if id := session.msgIds.next(); id>>32 != now.Add(test.offset).Unix() {
+			t.Errorf("%d: message id %x is not of the server time", test.code, id)
+		}
+	}
+}
+
+func TestDCKeysKeyFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "mtproto_key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	// migrate from DC2 to DC4
+	dc2 := &Session{
+		addr:        "149.154.167.50:443",
+		authKey:     bytes.Repeat([]byte{2}, 256),
+		authKeyHash: []byte{2, 2, 2, 2, 2, 2, 2, 2},
+		serverSalt:  []byte{2, 2, 2, 2, 2, 2, 2, 2},
+	}
+	dc4 := &Session{f: f, addr: "149.154.167.91:443"}
+	if dc4.useDCKey(dc2.authKeys()) {
+		t.Fatal("DC4 has no key to use")
+	}
+	dc4.authKey = bytes.Repeat([]byte{4}, 256)
+	dc4.authKeyHash = []byte{4, 4, 4, 4, 4, 4, 4, 4}
+	dc4.serverSalt = []byte{4, 4, 4, 4, 4, 4, 4, 4}
+	if err := dc4.saveSession(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := &Session{}
+	if err := loaded.readSessionFile(f); err != nil {
+		t.Fatal(err)
+	}
+	if key, ok := loaded.dcKeys[2]; !ok || !bytes.Equal(key.authKey, dc2.authKey) || !bytes.Equal(key.serverSalt, dc2.serverSalt) {
+		t.Errorf("unexpected keys %v", loaded.dcKeys)
+	}
+
+	// back to DC2 with its key
+	back := &Session{addr: "149.154.167.50:443"}
+	if !back.useDCKey(loaded.authKeys()) || !bytes.Equal(back.authKey, dc2.authKey) {
+		t.Errorf("the key of DC2 is not used")
+	}
+	if _, ok := back.dcKeys[4]; !ok || len(back.dcKeys) != 1 {
+		t.Errorf("unexpected keys %v", back.dcKeys)
+	}
+}
+
+// channelDifferenceRPC responds with the channel differences in order
+type channelDifferenceRPC struct {
+	diffs []interface{}
+	reqs  []*ReqUpdatesGetChannelDifference
+}
+
+func (r *channelDifferenceRPC) InvokeBlocked(msg TL) (interface{}, error) {
+	r.reqs = append(r.reqs, msg.(*ReqUpdatesGetChannelDifference))
+	diff := r.diffs[0]
+	r.diffs = r.diffs[1:]
+	return diff, nil
+}
+
+func TestChannelPtsGap(t *testing.T) {
+	var resynced int32
+	session := &Session{appConfig: Configuration{OnChannelResync: func(channelId int32, diff *PredUpdatesChannelDifferenceTooLong) {
+		resynced = channelId
+	}}}
+	listener := make(chan Event, 8)
+	session.AddSessionListener(listener)
+	chats := []*TypeChat{{&TypeChat_Channel{&PredChannel{Id: 7, AccessHash: 70}}}}
+	deleted := func(pts int32) []*TypeUpdate {
+		return []*TypeUpdate{{&TypeUpdate_UpdateDeleteChannelMessages{&PredUpdateDeleteChannelMessages{
+			ChannelId: 7,
+			Pts:       pts,
+			PtsCount:  1,
+		}}}}
+	}
+
+	if gaps := session.trackChannelPts(deleted(10), chats); len(gaps) != 0 || session.channelPts[7] != 10 {
+		t.Fatalf("gaps %v, pts %d on the first update", gaps, session.channelPts[7])
+	}
+	// pts 13 skips 11 and 12
+	if gaps := session.trackChannelPts(deleted(13), nil); fmt.Sprint(gaps) != "[7]" {
+		t.Fatalf("unexpected gaps %v", gaps)
+	}
+	if gaps := session.trackChannelPts(deleted(14), nil); len(gaps) != 0 {
+		t.Errorf("the gap being recovered is reported again, %v", gaps)
+	}
+
+	rpc := &channelDifferenceRPC{diffs: []interface{}{
+		&PredUpdatesChannelDifference{Pts: 12},
+		&PredUpdatesChannelDifference{Flags: 1 << 0, Pts: 14},
+	}}
+	session.recoverChannel(rpc, 7)
+	if len(rpc.reqs) != 2 || rpc.reqs[0].Pts != 10 || rpc.reqs[1].Pts != 12 ||
+		rpc.reqs[0].Channel.GetInputChannel().GetAccessHash() != 70 {
+		t.Errorf("unexpected requests %v", rpc.reqs)
+	}
+	if len(listener) != 2 {
+		t.Errorf("%d differences are propagated, expected 2", len(listener))
+	}
+	if session.channelPts[7] != 14 || session.channelRecovering[7] {
+		t.Errorf("pts %d, recovering %v after the recovery", session.channelPts[7], session.channelRecovering[7])
+	}
+
+	// a gap too long is resynced
+	session.trackChannelPts(deleted(100), nil)
+	session.recoverChannel(&channelDifferenceRPC{diffs: []interface{}{
+		&PredUpdatesChannelDifferenceTooLong{Pts: 100},
+	}}, 7)
+	if resynced != 7 || session.channelPts[7] != 100 {
+		t.Errorf("resynced %d, pts %d", resynced, session.channelPts[7])
+	}
+}
+
+func TestChannelPtsKeyFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "mtproto_key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	session := &Session{
+		f:           f,
+		addr:        "149.154.167.50:443",
+		authKey:     bytes.Repeat([]byte{2}, 256),
+		authKeyHash: []byte{2, 2, 2, 2, 2, 2, 2, 2},
+		serverSalt:  []byte{2, 2, 2, 2, 2, 2, 2, 2},
+		channelPts:  map[int32]int32{7: 14, 8: 3},
+	}
+	if err := session.saveSession(); err != nil {
+		t.Fatal(err)
+	}
+	loaded := &Session{}
+	if err := loaded.readSessionFile(f); err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.channelPts) != 2 || loaded.channelPts[7] != 14 || loaded.channelPts[8] != 3 {
+		t.Errorf("unexpected channel pts %v", loaded.channelPts)
+	}
+}
+
+func TestSeqNo(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go ioutil.ReadAll(server)
+	session := &Session{
+		tcpconn:      client,
+		transport:    abridged{},
+		encrypted:    true,
+		authKey:      bytes.Repeat([]byte{1}, 256),
+		authKeyHash:  []byte{2, 2, 2, 2, 2, 2, 2, 2},
+		serverSalt:   []byte{3, 3, 3, 3, 3, 3, 3, 3},
+		mutex:        &sync.Mutex{},
+		msgsIdToAck:  make(map[int64]packetToSend),
+		msgsIdToResp: make(map[int64]chan response),
+		msgsIdToSent: make(map[int64]sentRPC),
+	}
+
+	var lastMsgId int64
+	for _, test := range []struct {
+		msg   TL
+		seqNo int32
+	}{
+		{&ReqHelpGetConfig{}, 2},
+		{TL_msgs_ack{[]int64{1}}, 2}, // an ack is not content-related
+		{TL_ping{1}, 4},
+		{TL_msgs_ack{[]int64{2}}, 4},
+	} {
+		if err := session.sendPacket(packetToSend{msg: test.msg, resp: make(chan response, 1)}); err != nil {
+			t.Fatal(err)
+		}
+		counters := session.DebugCounters()
+		if counters.SeqNo != test.seqNo {
+			t.Errorf("%T: seqno %d, expected %d", test.msg, counters.SeqNo, test.seqNo)
+		}
+		if counters.LastMsgId <= lastMsgId {
+			t.Errorf("%T: message id %x is not after %x", test.msg, counters.LastMsgId, lastMsgId)
+		}
+		lastMsgId = counters.LastMsgId
+	}
+
+	// a content-related message takes the odd seqno
+	if _, seqNo := session.nextMessage(true); seqNo != 5 {
+		t.Errorf("content-related seqno %d, expected 5", seqNo)
+	}
+	if _, seqNo := session.nextMessage(false); seqNo != 6 {
+		t.Errorf("seqno %d, expected 6", seqNo)
+	}
+}
+
+func TestServerTimeKeyFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "mtproto_key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	now := time.Now()
+	unix := int32(now.Unix())
+	authKey := bytes.Repeat([]byte{1}, 256)
+	saved := &Session{
+		f:           f,
+		authKey:     authKey,
+		authKeyHash: []byte{2, 2, 2, 2, 2, 2, 2, 2},
+		serverSalt:  []byte{3, 3, 3, 3, 3, 3, 3, 3},
+		addr:        "149.154.167.50:443",
+	}
+	saved.msgIds.setOffset(90 * time.Second)
+	// the saved salt expires while the session is offline, and the next one is valid on load
+	saved.addFutureSalts([]TL_future_salt{
+		{unix - 3600, unix - 60, []byte{3, 3, 3, 3, 3, 3, 3, 3}},
+		{unix - 60, unix + 1800, []byte{4, 4, 4, 4, 4, 4, 4, 4}},
+		{unix + 1800, unix + 3600, []byte{5, 5, 5, 5, 5, 5, 5, 5}},
+	})
+	if err := saved.saveSession(); err != nil {
+		t.Fatal(err)
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	frames := make(chan []byte, 1)
+	go func() {
+		frame, err := abridged{}.decode(server)
+		if err == nil {
+			frames <- frame
+		}
+	}()
+	loaded := &Session{
+		tcpconn:      client,
+		transport:    abridged{},
+		mutex:        &sync.Mutex{},
+		msgsIdToAck:  make(map[int64]packetToSend),
+		msgsIdToResp: make(map[int64]chan response),
+		msgsIdToSent: make(map[int64]sentRPC),
+	}
+	if err := loaded.readSessionFile(f); err != nil {
+		t.Fatal(err)
+	}
+	if _, offset := loaded.msgIds.state(); offset != 90*time.Second {
+		t.Errorf("offset %v, expected 90s", offset)
+	}
+	if len(loaded.futureSalts) != 2 {
+		t.Errorf("%d future salts, expected 2", len(loaded.futureSalts))
+	}
+
+	// the first request has the valid salt and the server time, so it needs no bad_server_salt to retry
+	if err := loaded.sendPacket(packetToSend{msg: &ReqHelpGetConfig{}, resp: make(chan response, 1)}); err != nil {
+		t.Fatal(err)
+	}
+	frame := <-frames
+	aesKey, aesIV := generateAES(frame[8:24], authKey, false)
+	plain, err := doAES256IGEdecrypt(frame[24:], aesKey, aesIV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if salt := plain[:8]; !bytes.Equal(salt, []byte{4, 4, 4, 4, 4, 4, 4, 4}) {
+		t.Errorf("sent salt %x, expected the future salt", salt)
+	}
+	if msgId := int64(binary.LittleEndian.Uint64(plain[16:24])); msgId>>32 < now.Add(90*time.Second).Unix() {
+		t.Errorf("message id %x is not of the server time", msgId)
+	}
+
+	// a stale offset is derived again
+	stale := &Session{}
+	stale.restoreServerTime(time.Minute, now.Add(-2*maxServerTimeAge), nil, now)
+	if _, offset := stale.msgIds.state(); offset != 0 {
+		t.Errorf("stale offset %v is restored", offset)
+	}
+}
+
+// failingConn fails to read by err
+type failingConn struct {
+	net.Conn
+	err error
+}
+
+func (c failingConn) Read(b []byte) (int, error) { return 0, c.err }
+
+func TestReadErrorCloseReason(t *testing.T) {
+	reset := &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}
+	for _, tc := range []struct {
+		err     error
+		revoked bool
+		reason  CloseReason
+	}{
+		{io.EOF, false, CloseServerClose},
+		{reset, false, CloseNetworkError},
+		{io.EOF, true, CloseAuthRevoked},
+	} {
+		client, _ := net.Pipe()
+		events := make(chan Event, 1)
+		session := &Session{
+			sessionId:       6,
+			tcpconn:         failingConn{client, tc.err},
+			transport:       abridged{},
+			readInterrupter: make(chan struct{}),
+		}
+		if tc.revoked {
+			session.revoked = 1
+		}
+		session.AddSessionListener(events)
+		session.isReading = true
+		session.readWaitGroup.Add(1)
+		go session.readRoutine()
+
+		if reason := session.closeReason(tc.err); reason != tc.reason {
+			t.Errorf("%v: reason %s, expected %s", tc.err, reason, tc.reason)
+		}
+		select {
+		case e := <-events:
+			refresh, ok := e.(refreshSession)
+			if !ok || refresh.sessionId != 6 || refresh.reason != tc.reason || tc.reason == CloseAuthRevoked {
+				t.Errorf("%v: unexpected event %#v", tc.err, e)
+			}
+		case <-time.After(100 * time.Millisecond):
+			if tc.reason.reconnects() {
+				t.Errorf("%v: the session is not refreshed", tc.err)
+			}
+		}
+		close(session.readInterrupter)
+		session.readWaitGroup.Wait()
+		client.Close()
+	}
+}
+
+func TestAuthKeyUnregistered(t *testing.T) {
+	f, err := ioutil.TempFile("", "mtproto_key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	events := make(chan Event, 1)
+	session := &Session{
+		connId:       5,
+		sessionId:    6,
+		mutex:        &sync.Mutex{},
+		msgsIdToAck:  make(map[int64]packetToSend),
+		msgsIdToResp: make(map[int64]chan response),
+		msgsIdToSent: make(map[int64]sentRPC),
+		appConfig:    Configuration{KeyPath: f.Name()},
+	}
+	session.AddSessionListener(events)
+
+	// the server revokes the key while the RPCs are waited for
+	resps := make([]chan response, 2)
+	for i := range resps {
+		resps[i] = make(chan response, 1)
+		session.msgsIdToResp[int64(i+1)] = resps[i]
+	}
+	for i := range resps {
+		session.process(GenerateMessageId(), 2, TL_rpc_result{int64(i + 1), TL_rpc_error{errorUnauthorized, "AUTH_KEY_UNREGISTERED"}})
+		x := <-resps[i]
+		if _, ok := x.err.(AuthKeyUnregisteredError); !ok || !IsUnauthorized(x.err) {
+			t.Fatalf("%T: %v, expected AuthKeyUnregisteredError", x.err, x.err)
+		}
+	}
+
+	select {
+	case e := <-events:
+		if revoked, ok := e.(SessionRevoked); !ok || revoked.ConnId != 5 || revoked.SessionId != 6 {
+			t.Fatalf("unexpected event %#v", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("SessionRevoked is not notified")
+	}
+	if _, err := os.Stat(f.Name()); !os.IsNotExist(err) {
+		t.Errorf("the revoked key file is not removed: %v", err)
+	}
+	// notified once
+	select {
+	case e := <-events:
+		t.Errorf("unexpected event %#v", e)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
@@ -8,7 +8,6 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
-	"github.com/cjongseok/slog"
 	"math"
 	"math/big"
 	"reflect"
@@ -199,33 +198,50 @@ type TL_ping struct {
 	ping_id int64
 }
 
+type TL_ping_delay_disconnect struct {
+	ping_id          int64
+	disconnect_delay int32 // seconds
+}
+
 type TL_pong struct {
 	msg_id  int64
 	ping_id int64
 }
 
+type TL_get_future_salts struct {
+	num int32
+}
+
+type TL_future_salts struct {
+	req_msg_id int64
+	now        int32
+	salts      []TL_future_salt
+}
+
+// TL_future_salt is bare in the salts of future_salts, without its constructor
+type TL_future_salt struct {
+	valid_since int32 // unix time
+	valid_until int32 // unix time
+	salt        []byte
+}
+
 // Encoders
 func GenerateNonce(size int) []byte {
-	b := make([]byte, size)
-	_, _ = rand.Read(b)
-	return b
+	return randBytes(rand.Reader, size)
 }
 
 func GenerateMessageId() int64 {
-	const nano = 1000 * 1000 * 1000
 	//FIXME: Windows system clock has time resolution issue. https://github.com/golang/go/issues/17696
 	//Remove the sleep when the issue is resolved.
 	if strings.Contains(runtime.GOOS, "windows") {
 		time.Sleep(2 * time.Millisecond)
 	}
-	unixnano := time.Now().UnixNano()
-
-	return ((unixnano / nano) << 32) | ((unixnano % nano) & -4)
+	return messageIdAt(time.Now())
 }
 
 func NewEncodeBuf(cap int) *EncodeBuf {
 	if __debug&DEBUG_LEVEL_ENCODE_DETAILS != 0 {
-		slog.Logln("Encode::NewBuf::", "cap=", cap)
+		logln("Encode::NewBuf::", "cap=", cap)
 	}
 	return &EncodeBuf{make([]byte, 0, cap)}
 }
@@ -234,7 +250,7 @@ func (e *EncodeBuf) Int(s int32) {
 	e.buf = append(e.buf, 0, 0, 0, 0)
 	binary.LittleEndian.PutUint32(e.buf[len(e.buf)-4:], uint32(s))
 	if __debug&DEBUG_LEVEL_ENCODE_DETAILS != 0 {
-		slog.Logln("Encode::Int::", s)
+		logln("Encode::Int::", s)
 	}
 }
 
@@ -242,7 +258,7 @@ func (e *EncodeBuf) UInt(s uint32) {
 	e.buf = append(e.buf, 0, 0, 0, 0)
 	binary.LittleEndian.PutUint32(e.buf[len(e.buf)-4:], s)
 	if __debug&DEBUG_LEVEL_ENCODE_DETAILS != 0 {
-		slog.Logf("Encode::UInt::", "%d(0x%x)", s, s)
+		logf("Encode::UInt::", "%d(0x%x)", s, s)
 	}
 }
 
@@ -250,7 +266,7 @@ func (e *EncodeBuf) Long(s int64) {
 	e.buf = append(e.buf, 0, 0, 0, 0, 0, 0, 0, 0)
 	binary.LittleEndian.PutUint64(e.buf[len(e.buf)-8:], uint64(s))
 	if __debug&DEBUG_LEVEL_ENCODE_DETAILS != 0 {
-		slog.Logln("Encode::Long::", s)
+		logln("Encode::Long::", s)
 	}
 }
 
@@ -258,21 +274,21 @@ func (e *EncodeBuf) Double(s float64) {
 	e.buf = append(e.buf, 0, 0, 0, 0, 0, 0, 0, 0)
 	binary.LittleEndian.PutUint64(e.buf[len(e.buf)-8:], math.Float64bits(s))
 	if __debug&DEBUG_LEVEL_ENCODE_DETAILS != 0 {
-		slog.Logln("Encode::Double::", s)
+		logln("Encode::Double::", s)
 	}
 }
 
 func (e *EncodeBuf) String(s string) {
 	e.StringBytes([]byte(s))
 	if __debug&DEBUG_LEVEL_ENCODE_DETAILS != 0 {
-		slog.Logln("Encode::String::", s)
+		logln("Encode::String::", s)
 	}
 }
 
 func (e *EncodeBuf) BigInt(s *big.Int) {
 	e.StringBytes(s.Bytes())
 	if __debug&DEBUG_LEVEL_ENCODE_DETAILS != 0 {
-		slog.Logln("Encode::BigInt::", s)
+		logln("Encode::BigInt::", s)
 	}
 }
 
@@ -294,14 +310,14 @@ func (e *EncodeBuf) StringBytes(s []byte) {
 	}
 	e.buf = append(e.buf, res...)
 	if __debug&DEBUG_LEVEL_ENCODE_DETAILS != 0 {
-		slog.Logln("Encode::StringBytes::", s)
+		logln("Encode::StringBytes::", s)
 	}
 }
 
 func (e *EncodeBuf) Bytes(s []byte) {
 	e.buf = append(e.buf, s...)
 	if __debug&DEBUG_LEVEL_ENCODE_DETAILS != 0 {
-		slog.Logln("Encode::Bytes::", s)
+		logln("Encode::Bytes::", s)
 	}
 }
 
@@ -316,7 +332,7 @@ func (e *EncodeBuf) VectorInt(v []int32) {
 	}
 	e.buf = append(e.buf, x...)
 	if __debug&DEBUG_LEVEL_ENCODE_DETAILS != 0 {
-		slog.Logln("Encode::VectorInt::", v)
+		logln("Encode::VectorInt::", v)
 	}
 }
 
@@ -331,7 +347,7 @@ func (e *EncodeBuf) VectorLong(v []int64) {
 	}
 	e.buf = append(e.buf, x...)
 	if __debug&DEBUG_LEVEL_ENCODE_DETAILS != 0 {
-		slog.Logln("Encode::VectorLong::", v)
+		logln("Encode::VectorLong::", v)
 	}
 }
 
@@ -344,7 +360,7 @@ func (e *EncodeBuf) VectorString(v []string) {
 		e.String(v)
 	}
 	if __debug&DEBUG_LEVEL_ENCODE_DETAILS != 0 {
-		slog.Logln("Encode::VectorString::", v)
+		logln("Encode::VectorString::", v)
 	}
 }
 
@@ -357,7 +373,7 @@ func (e *EncodeBuf) Vector(v []TL) {
 		e.buf = append(e.buf, v.encode()...)
 	}
 	if __debug&DEBUG_LEVEL_ENCODE_DETAILS != 0 {
-		slog.Logln("Encode::Vector::", v)
+		logln("Encode::Vector::", v)
 	}
 }
 
@@ -371,6 +387,7 @@ func (e TL_rpc_error) encode() []byte                { return nil }
 func (e TL_new_session_created) encode() []byte      { return nil }
 func (e TL_bad_server_salt) encode() []byte          { return nil }
 func (e TL_crc_bad_msg_notification) encode() []byte { return nil }
+func (e TL_future_salts) encode() []byte             { return nil }
 
 func (e TL_req_pq) encode() []byte {
 	x := NewEncodeBuf(20)
@@ -429,6 +446,14 @@ func (e TL_ping) encode() []byte {
 	return x.buf
 }
 
+func (e TL_ping_delay_disconnect) encode() []byte {
+	x := NewEncodeBuf(32)
+	x.UInt(crc_ping_delay_disconnect)
+	x.Long(e.ping_id)
+	x.Int(e.disconnect_delay)
+	return x.buf
+}
+
 func (e TL_pong) encode() []byte {
 	x := NewEncodeBuf(32)
 	x.UInt(crc_pong)
@@ -437,6 +462,13 @@ func (e TL_pong) encode() []byte {
 	return x.buf
 }
 
+func (e TL_get_future_salts) encode() []byte {
+	x := NewEncodeBuf(8)
+	x.UInt(crc_get_future_salts)
+	x.Int(e.num)
+	return x.buf
+}
+
 func (e TL_msgs_ack) encode() []byte {
 	x := NewEncodeBuf(64)
 	x.UInt(crc_msgs_ack)
@@ -538,7 +570,7 @@ func toTLslice(slice interface{}) []TL {
 // Decoders
 func NewDecodeBuf(b []byte) *DecodeBuf {
 	if __debug&DEBUG_LEVEL_DECODE_DETAILS != 0 {
-		slog.Logln("Decode::NewBuf::", "bytes = ", b)
+		logln("Decode::NewBuf::", "bytes = ", b)
 	}
 	return &DecodeBuf{b, 0, len(b), nil}
 }
@@ -554,7 +586,7 @@ func (m *DecodeBuf) Long() int64 {
 	x := int64(binary.LittleEndian.Uint64(m.buf[m.off : m.off+8]))
 	m.off += 8
 	if __debug&DEBUG_LEVEL_DECODE_DETAILS != 0 {
-		slog.Logln("Decode::Long::", x)
+		logln("Decode::Long::", x)
 	}
 	return x
 }
@@ -570,7 +602,7 @@ func (m *DecodeBuf) Double() float64 {
 	x := math.Float64frombits(binary.LittleEndian.Uint64(m.buf[m.off : m.off+8]))
 	m.off += 8
 	if __debug&DEBUG_LEVEL_DECODE_DETAILS != 0 {
-		slog.Logln("Decode::Double::", x)
+		logln("Decode::Double::", x)
 	}
 	return x
 }
@@ -586,7 +618,7 @@ func (m *DecodeBuf) Int() int32 {
 	x := binary.LittleEndian.Uint32(m.buf[m.off : m.off+4])
 	m.off += 4
 	if __debug&DEBUG_LEVEL_DECODE_DETAILS != 0 {
-		slog.Logln("Decode::Int::", x)
+		logln("Decode::Int::", x)
 	}
 	return int32(x)
 }
@@ -602,7 +634,7 @@ func (m *DecodeBuf) UInt() uint32 {
 	x := binary.LittleEndian.Uint32(m.buf[m.off : m.off+4])
 	m.off += 4
 	if __debug&DEBUG_LEVEL_DECODE_DETAILS != 0 {
-		slog.Logf("Decode::UInt::", "%d(0x%x)", x, x)
+		logf("Decode::UInt::", "%d(0x%x)", x, x)
 	}
 	return x
 }
@@ -620,9 +652,9 @@ func (m *DecodeBuf) Bytes(size int) []byte {
 	m.off += size
 	if __debug&DEBUG_LEVEL_DECODE_DETAILS != 0 {
 		if len(x) > 10 {
-			slog.Logln("Decode::Bytes::", len(x), x[:10], " ...")
+			logln("Decode::Bytes::", len(x), x[:10], " ...")
 		} else {
-			slog.Logln("Decode::Bytes::", len(x), x)
+			logln("Decode::Bytes::", len(x), x)
 		}
 
 	}
@@ -667,9 +699,9 @@ func (m *DecodeBuf) StringBytes() []byte {
 	m.off += padding
 	if __debug&DEBUG_LEVEL_DECODE_DETAILS != 0 {
 		if len(x) > 10 {
-			slog.Logln("Decode::StringBytes::", len(x), x[:10], " ...")
+			logln("Decode::StringBytes::", len(x), x[:10], " ...")
 		} else {
-			slog.Logln("Decode::StringBytes::", len(x), x)
+			logln("Decode::StringBytes::", len(x), x)
 		}
 
 	}
@@ -683,7 +715,7 @@ func (m *DecodeBuf) String() string {
 	}
 	x := string(b)
 	if __debug&DEBUG_LEVEL_DECODE_DETAILS != 0 {
-		slog.Logln("Decode::String::", x)
+		logln("Decode::String::", x)
 	}
 	return x
 }
@@ -698,7 +730,7 @@ func (m *DecodeBuf) BigInt() *big.Int {
 	copy(y[1:], b)
 	x := new(big.Int).SetBytes(y)
 	if __debug&DEBUG_LEVEL_DECODE_DETAILS != 0 {
-		slog.Logln("Decode::BigInt::", x)
+		logln("Decode::BigInt::", x)
 	}
 	return x
 }
@@ -731,7 +763,7 @@ func (m *DecodeBuf) VectorInt() []int32 {
 		i++
 	}
 	if __debug&DEBUG_LEVEL_DECODE_DETAILS != 0 {
-		slog.Logln("Decode::VectorInt::", x)
+		logln("Decode::VectorInt::", x)
 	}
 	return x
 }
@@ -764,7 +796,7 @@ func (m *DecodeBuf) VectorLong() []int64 {
 		i++
 	}
 	if __debug&DEBUG_LEVEL_DECODE_DETAILS != 0 {
-		slog.Logln("Decode::VectorLong::", x)
+		logln("Decode::VectorLong::", x)
 	}
 	return x
 }
@@ -797,7 +829,7 @@ func (m *DecodeBuf) VectorString() []string {
 		i++
 	}
 	if __debug&DEBUG_LEVEL_DECODE_DETAILS != 0 {
-		slog.Logln("Decode::VectorString::", x)
+		logln("Decode::VectorString::", x)
 	}
 	return x
 }
@@ -810,12 +842,12 @@ func (m *DecodeBuf) Bool() bool {
 	switch constructor {
 	case crc_boolFalse:
 		if __debug&DEBUG_LEVEL_DECODE_DETAILS != 0 {
-			slog.Logln("Decode::Bool::", false)
+			logln("Decode::Bool::", false)
 		}
 		return false
 	case crc_boolTrue:
 		if __debug&DEBUG_LEVEL_DECODE_DETAILS != 0 {
-			slog.Logln("Decode::Bool::", true)
+			logln("Decode::Bool::", true)
 		}
 		return true
 	}
@@ -831,13 +863,13 @@ func (m *DecodeBuf) TL_Vector() []TL {
 	//	m.err = fmt.Errorf("DecodeTL_Vector: Wrong constructor (0x%08x)", constructor)
 	//	return nil
 	//}
-	//slog.Logln("byte len=", len(m.buf))
-	//slog.Logln("m.size=", m.size)
-	//slog.Logln(hex.EncodeToString(m.buf))
+	//logln("byte len=", len(m.buf))
+	//logln("m.size=", m.size)
+	//logln(hex.EncodeToString(m.buf))
 	//xx := m.UInt()
-	//slog.Logln("x=", xx)
+	//logln("x=", xx)
 	//size := m.Int()
-	//slog.Logln("size=", size)
+	//logln("size=", size)
 	//if m.err != nil {
 	//	return nil
 	//}
@@ -856,7 +888,7 @@ func (m *DecodeBuf) TL_Vector() []TL {
 	//	i++
 	//}
 	//if __debug&DEBUG_LEVEL_DECODE_DETAILS != 0 {
-	//	slog.Logln("Decode::Vector::", x)
+	//	logln("Decode::Vector::", x)
 	//}
 	//return x
 	m.err = fmt.Errorf("DecodeTL_Vector: NOT SUPPORTED YET")
@@ -891,7 +923,7 @@ func (m *DecodeBuf) Vector() []TL {
 		i++
 	}
 	if __debug&DEBUG_LEVEL_DECODE_DETAILS != 0 {
-		slog.Logln("Decode::Vector::", x)
+		logln("Decode::Vector::", x)
 	}
 	return x
 }
@@ -905,19 +937,19 @@ func (m *DecodeBuf) Object() (r TL) {
 
 	case crc_resPQ:
 		if __debug&DEBUG_LEVEL_DECODE_DETAILS != 0 {
-			slog.Logln("reqPQ", constructor)
+			logln("reqPQ", constructor)
 		}
 		r = TL_resPQ{m.Bytes(16), m.Bytes(16), m.BigInt(), m.VectorLong()}
 
 	case crc_server_DH_params_ok:
 		if __debug&DEBUG_LEVEL_DECODE_DETAILS != 0 {
-			slog.Logln("server_DH_params_ok", constructor)
+			logln("server_DH_params_ok", constructor)
 		}
 		r = TL_server_DH_params_ok{m.Bytes(16), m.Bytes(16), m.StringBytes()}
 
 	case crc_server_DH_inner_data:
 		if __debug&DEBUG_LEVEL_DECODE_DETAILS != 0 {
-			slog.Logln("server_DH_inner_data", constructor)
+			logln("server_DH_inner_data", constructor)
 		}
 		r = TL_server_DH_inner_data{
 			m.Bytes(16), m.Bytes(16), m.Int(),
@@ -926,33 +958,33 @@ func (m *DecodeBuf) Object() (r TL) {
 
 	case crc_dh_gen_ok:
 		if __debug&DEBUG_LEVEL_DECODE_DETAILS != 0 {
-			slog.Logln("dh_gen_ok", constructor)
+			logln("dh_gen_ok", constructor)
 		}
 		r = TL_dh_gen_ok{m.Bytes(16), m.Bytes(16), m.Bytes(16)}
 
 	case crc_ping:
 		if __debug&DEBUG_LEVEL_DECODE_DETAILS != 0 {
-			slog.Logln("ping", constructor)
+			logln("ping", constructor)
 		}
 		r = TL_ping{m.Long()}
 
 	case crc_pong:
 		if __debug&DEBUG_LEVEL_DECODE_DETAILS != 0 {
-			slog.Logln("pong", constructor)
+			logln("pong", constructor)
 		}
 		r = TL_pong{m.Long(), m.Long()}
 
 	case crc_msg_container:
 		if __debug&DEBUG_LEVEL_DECODE_DETAILS != 0 {
-			slog.Logln("msg_container", constructor)
+			logln("msg_container", constructor)
 		}
 		size := m.Int()
 		arr := make([]TL_MT_message, size)
 		for i := int32(0); i < size; i++ {
 			arr[i] = TL_MT_message{m.Long(), m.Int(), m.Int(), m.Object()}
-			//slog.Logln(constructor, arr[i])
+			//logln(constructor, arr[i])
 			if m.err != nil {
-				slog.Logln(m.err.Error())
+				logln(m.err.Error())
 				return nil
 			}
 		}
@@ -960,43 +992,54 @@ func (m *DecodeBuf) Object() (r TL) {
 
 	case crc_rpc_result:
 		if __debug&DEBUG_LEVEL_DECODE_DETAILS != 0 {
-			slog.Logln("rpc_result", constructor)
+			logln("rpc_result", constructor)
 		}
 		r = TL_rpc_result{m.Long(), m.Object()}
 
 	case crc_rpc_error:
 		if __debug&DEBUG_LEVEL_DECODE_DETAILS != 0 {
-			slog.Logln("rpc_error", constructor)
+			logln("rpc_error", constructor)
 		}
 		r = TL_rpc_error{m.Int(), m.String()}
 
 	case crc_new_session_created:
 		if __debug&DEBUG_LEVEL_DECODE_DETAILS != 0 {
-			slog.Logln("new_session_created", constructor)
+			logln("new_session_created", constructor)
 		}
 		r = TL_new_session_created{m.Long(), m.Long(), m.Bytes(8)}
 
 	case crc_bad_server_salt:
 		if __debug&DEBUG_LEVEL_DECODE_DETAILS != 0 {
-			slog.Logln("bad_server_salt", constructor)
+			logln("bad_server_salt", constructor)
 		}
 		r = TL_bad_server_salt{m.Long(), m.Int(), m.Int(), m.Bytes(8)}
 
 	case crc_bad_msg_notification:
 		if __debug&DEBUG_LEVEL_DECODE_DETAILS != 0 {
-			slog.Logln("bad_msg_notification", constructor)
+			logln("bad_msg_notification", constructor)
 		}
 		r = TL_crc_bad_msg_notification{m.Long(), m.Int(), m.Int()}
 
+	case crc_future_salts:
+		if __debug&DEBUG_LEVEL_DECODE_DETAILS != 0 {
+			logln("future_salts", constructor)
+		}
+		reqMsgId, now, size := m.Long(), m.Int(), m.Int()
+		var salts []TL_future_salt
+		for i := int32(0); i < size && m.err == nil; i++ {
+			salts = append(salts, TL_future_salt{m.Int(), m.Int(), m.Bytes(8)})
+		}
+		r = TL_future_salts{reqMsgId, now, salts}
+
 	case crc_msgs_ack:
 		if __debug&DEBUG_LEVEL_DECODE_DETAILS != 0 {
-			slog.Logln("msgs_ack", constructor)
+			logln("msgs_ack", constructor)
 		}
 		r = TL_msgs_ack{m.VectorLong()}
 
 	case crc_gzip_packed:
 		if __debug&DEBUG_LEVEL_DECODE_DETAILS != 0 {
-			slog.Logln("gzip_packed", constructor)
+			logln("gzip_packed", constructor)
 		}
 		obj := make([]byte, 0, 4096)
 
@@ -1016,14 +1059,14 @@ func (m *DecodeBuf) Object() (r TL) {
 
 	default:
 		if __debug&DEBUG_LEVEL_DECODE_DETAILS != 0 {
-			slog.Logln(fmt.Sprintf("default %x", constructor))
+			logln(fmt.Sprintf("default %x", constructor))
 		}
 		r = m.ObjectGenerated(constructor)
 
 	}
 
 	if m.err != nil {
-		slog.Logln(m.err.Error())
+		logln(m.err.Error())
 		return nil
 	}
 	return
@@ -1040,7 +1083,7 @@ func (m *DecodeBuf) Flags() int32 {
 	x := binary.LittleEndian.Uint32(m.buf[m.off : m.off+4])
 	m.off += 4
 	if __debug&DEBUG_LEVEL_DECODE_DETAILS != 0 {
-		slog.Logln("Decode::Flags::", x)
+		logln("Decode::Flags::", x)
 	}
 	return int32(x)
 }
@@ -1105,7 +1148,7 @@ func (m *DecodeBuf) FlaggedStringBytes(flags, f int32) []byte {
 }
 
 func (d *DecodeBuf) dump() {
-	slog.Logln(hex.Dump(d.buf[d.off:d.size]))
+	logln("Decode::dump::", hex.Dump(d.buf[d.off:d.size]))
 }
 
 func toBool(x TL) bool {
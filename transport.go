@@ -0,0 +1,220 @@
+package mtproto
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math/rand"
+	"sync/atomic"
+)
+
+// transport frames MTProto packets on a TCP connection.
+// See https://core.telegram.org/mtproto/mtproto-transports
+type transport interface {
+	// header is the first bytes of a plain connection
+	header() []byte
+	// protocolTag is the tag in the obfuscated2 init packet
+	protocolTag() uint32
+	encode(packet []byte) []byte
+	decode(r io.Reader) ([]byte, error)
+}
+
+// TransportMode is the framing of MTProto packets on TCP.
+type TransportMode int
+
+const (
+	TransportAbridged TransportMode = iota
+	TransportIntermediate
+	TransportPaddedIntermediate
+	TransportFull
+)
+
+func (mode TransportMode) String() string {
+	switch mode {
+	case TransportAbridged:
+		return "abridged"
+	case TransportIntermediate:
+		return "intermediate"
+	case TransportPaddedIntermediate:
+		return "padded intermediate"
+	case TransportFull:
+		return "full"
+	}
+	return fmt.Sprintf("TransportMode(%d)", int(mode))
+}
+
+func newTransport(appConfig Configuration) transport {
+	// MTProxy secure mode requires the padding
+	if secret, err := parseMTProxySecret(appConfig.MTProxy.Secret); err == nil && secret.padded {
+		return paddedIntermediate{}
+	}
+	switch appConfig.TransportMode {
+	case TransportIntermediate:
+		return intermediate{}
+	case TransportPaddedIntermediate:
+		return paddedIntermediate{}
+	case TransportFull:
+		return new(full)
+	}
+	return abridged{}
+}
+
+type abridged struct{}
+
+func (abridged) header() []byte      { return []byte{0xef} }
+func (abridged) protocolTag() uint32 { return 0xefefefef }
+
+func (abridged) encode(packet []byte) []byte {
+	size := len(packet) / 4
+	var b []byte
+	if size < 127 {
+		b = append(b, byte(size))
+	} else {
+		b = make([]byte, 4)
+		binary.LittleEndian.PutUint32(b, uint32(size<<8|127))
+	}
+	return append(b, packet...)
+}
+
+func (abridged) decode(r io.Reader) ([]byte, error) {
+	b := make([]byte, 1)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	size := int(b[0]) << 2
+	if b[0] >= 127 {
+		b = make([]byte, 3)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		size = (int(b[0]) | int(b[1])<<8 | int(b[2])<<16) << 2
+	}
+	return readPacket(r, size)
+}
+
+type intermediate struct{}
+
+func (intermediate) header() []byte      { return []byte{0xee, 0xee, 0xee, 0xee} }
+func (intermediate) protocolTag() uint32 { return 0xeeeeeeee }
+
+func (intermediate) encode(packet []byte) []byte {
+	b := make([]byte, 4, 4+len(packet))
+	binary.LittleEndian.PutUint32(b, uint32(len(packet)))
+	return append(b, packet...)
+}
+
+func (intermediate) decode(r io.Reader) ([]byte, error) {
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return readPacket(r, int(binary.LittleEndian.Uint32(b)))
+}
+
+// paddedIntermediate pads packets with random bytes, which MTProxy secure mode requires.
+type paddedIntermediate struct{}
+
+func (paddedIntermediate) header() []byte      { return []byte{0xdd, 0xdd, 0xdd, 0xdd} }
+func (paddedIntermediate) protocolTag() uint32 { return 0xdddddddd }
+
+func (paddedIntermediate) encode(packet []byte) []byte {
+	padding := make([]byte, rand.Intn(16))
+	rand.Read(padding)
+	b := make([]byte, 4, 4+len(packet)+len(padding))
+	binary.LittleEndian.PutUint32(b, uint32(len(packet)+len(padding)))
+	b = append(b, packet...)
+	return append(b, padding...)
+}
+
+func (paddedIntermediate) decode(r io.Reader) ([]byte, error) {
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	packet, err := readPacket(r, int(binary.LittleEndian.Uint32(b)))
+	if err != nil {
+		return nil, err
+	}
+	return unpad(packet), nil
+}
+
+// unpad cuts the padding by the length of the MTProto packet
+func unpad(packet []byte) []byte {
+	switch {
+	case len(packet) < 8:
+		// error code
+		return packet[:len(packet)&^3]
+	case binary.LittleEndian.Uint64(packet) == 0:
+		// unencrypted message: auth_key_id, message_id, message_data_length, message_data
+		if len(packet) >= 20 {
+			if n := 20 + int(binary.LittleEndian.Uint32(packet[16:])); n <= len(packet) {
+				return packet[:n]
+			}
+		}
+		return packet
+	default:
+		// encrypted message: auth_key_id, msg_key, AES blocks
+		if len(packet) < 24 {
+			return packet
+		}
+		return packet[:24+(len(packet)-24)&^15]
+	}
+}
+
+const maxPacketSize = 16 * 1024 * 1024
+
+func readPacket(r io.Reader, size int) ([]byte, error) {
+	if size < 0 || size > maxPacketSize {
+		return nil, fmt.Errorf("invalid packet size %d", size)
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// full has the sequence numbers and the CRC32 of the packets. It cannot be obfuscated.
+type full struct {
+	sendSeq int32
+	recvSeq int32
+}
+
+func (*full) header() []byte      { return nil }
+func (*full) protocolTag() uint32 { return 0 }
+
+func (t *full) encode(packet []byte) []byte {
+	b := make([]byte, 8, 12+len(packet))
+	binary.LittleEndian.PutUint32(b, uint32(12+len(packet)))
+	binary.LittleEndian.PutUint32(b[4:], uint32(atomic.AddInt32(&t.sendSeq, 1)-1))
+	b = append(b, packet...)
+	crc := make([]byte, 4)
+	binary.LittleEndian.PutUint32(crc, crc32.ChecksumIEEE(b))
+	return append(b, crc...)
+}
+
+func (t *full) decode(r io.Reader) ([]byte, error) {
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	size := int(binary.LittleEndian.Uint32(b))
+	if size < 12 {
+		return nil, fmt.Errorf("invalid packet size %d", size)
+	}
+	rest, err := readPacket(r, size-4)
+	if err != nil {
+		return nil, err
+	}
+	packet := append(b, rest...)
+	crc := binary.LittleEndian.Uint32(packet[size-4:])
+	if crc32.ChecksumIEEE(packet[:size-4]) != crc {
+		return nil, fmt.Errorf("wrong CRC32 of the packet")
+	}
+	seq := int32(binary.LittleEndian.Uint32(packet[4:]))
+	if expected := atomic.AddInt32(&t.recvSeq, 1) - 1; seq != expected {
+		return nil, fmt.Errorf("wrong packet sequence number %d, expected %d", seq, expected)
+	}
+	return packet[8 : size-4], nil
+}
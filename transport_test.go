@@ -0,0 +1,38 @@
+package mtproto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestTransportRoundTrip(t *testing.T) {
+	// an unencrypted message of 8 bytes, and an encrypted message of 2 AES blocks
+	unencrypted := []byte{0, 0, 0, 0, 0, 0, 0, 0, 1, 2, 3, 4, 5, 6, 7, 8, 8, 0, 0, 0, 1, 2, 3, 4, 5, 6, 7, 8}
+	encrypted := append(bytes.Repeat([]byte{9}, 24), bytes.Repeat([]byte{7}, 32)...)
+
+	for _, mode := range []TransportMode{TransportAbridged, TransportIntermediate, TransportPaddedIntermediate, TransportFull} {
+		sender := newTransport(Configuration{TransportMode: mode})
+		receiver := newTransport(Configuration{TransportMode: mode})
+		var stream bytes.Buffer
+		for _, packet := range [][]byte{unencrypted, encrypted, unencrypted} {
+			stream.Write(sender.encode(packet))
+		}
+		for _, packet := range [][]byte{unencrypted, encrypted, unencrypted} {
+			decoded, err := receiver.decode(&stream)
+			if err != nil {
+				t.Fatalf("%v: %v", mode, err)
+			}
+			if !bytes.Equal(decoded, packet) {
+				t.Errorf("%v: expected %x, but %x", mode, packet, decoded)
+			}
+		}
+	}
+}
+
+func TestFullTransportCRC(t *testing.T) {
+	b := new(full).encode([]byte{1, 2, 3, 4})
+	b[9]++
+	if _, err := new(full).decode(bytes.NewReader(b)); err == nil {
+		t.Errorf("corrupted packet is decoded")
+	}
+}
@@ -1,5 +1,10 @@
 package mtproto
 
+import (
+	"fmt"
+	"time"
+)
+
 const (
 	SESSION EventType = "session"
 	MCONN   EventType = "mconn"
@@ -10,6 +15,20 @@ type Event interface {
 	Type() EventType
 }
 
+// managedEvent is an event the manager handles on its own goroutine, spawned by the manage routine.
+// Adding an event to the manager is to implement handle on it.
+type managedEvent interface {
+	Event
+	handle(mm *Manager)
+}
+
+// inlineEvent is an event the manager handles on the manage routine, without spawning a goroutine.
+// Its handling should not block.
+type inlineEvent interface {
+	Event
+	handleInline(mm *Manager)
+}
+
 // Session Events
 type newsession struct {
 	// If connId is zero, Manager makes new connection and assigns it the new session.
@@ -19,21 +38,44 @@ type newsession struct {
 	addr        string
 	useIPv6     bool
 	resp        chan sessionResponse
+	// the auth keys of the DCs the connection has been on, by DC id.
+	// The key of the DC of addr is used without a handshake.
+	dcKeys map[int32]dcAuthKey
+	// the key file of the account, overriding Configuration.KeyPath if it is not empty
+	keyPath string
 }
 
 type loadsession struct {
 	// If connId is zero, Manager makes new connection and assigns it the loaded session.
 	// Otherwise, the loaded session is allocated to the connection of connId.
-	connId      int32
-	phonenumber string
-	//preferredAddr string
-	resp chan sessionResponse
+	connId        int32
+	phonenumber   string
+	preferredAddr string
+	resp          chan sessionResponse
+	// the key file of the account, overriding Configuration.KeyPath if it is not empty
+	keyPath string
 }
 
 type sessionResponse struct {
 	connId  int32
 	session *Session
 	err     error
+	// the updates missed while reconnecting, which are got on binding the new session
+	missed []Update
+}
+
+// respond sends the response to the channel of an event, which is optional
+func respond(resp chan sessionResponse, r sessionResponse) {
+	if resp != nil {
+		resp <- r
+	}
+}
+
+// respondErr sends the error to the channel of an event, which is optional
+func respondErr(resp chan error, err error) {
+	if resp != nil {
+		resp <- err
+	}
 }
 
 // Established = made + bound
@@ -41,6 +83,8 @@ type SessionEstablished struct {
 	session *Session
 }
 
+func (e SessionEstablished) SessionId() int64 { return e.session.sessionId }
+
 type discardSession struct {
 	connId    int32
 	sessionId int64
@@ -53,6 +97,9 @@ type SessionDiscarded struct {
 	discardedSessionUpdatesState *PredUpdatesState
 }
 
+func (e SessionDiscarded) ConnId() int32    { return e.boundConnId }
+func (e SessionDiscarded) SessionId() int64 { return e.discardedSessionId }
+
 // discardSession + newsession
 type renewSession struct {
 	sessionId   int64
@@ -68,6 +115,7 @@ type refreshSession struct {
 	phonenumber string
 	policy      retryPolicy
 	resp        chan sessionResponse
+	reason      CloseReason // of the drop, for the connection closed after ReconnectFailed
 }
 type retryPolicy string
 
@@ -78,8 +126,12 @@ const untilSuccess retryPolicy = "untilSuccess"
 type ConnectionOpened struct {
 	mconn *Conn
 }
+
+func (e ConnectionOpened) ConnId() int32 { return e.mconn.connId }
+
 type sessionBound struct {
-	mconn *Conn
+	mconn          *Conn
+	boundSessionId int64
 }
 type sessionUnbound struct {
 	mconn            *Conn
@@ -88,9 +140,75 @@ type sessionUnbound struct {
 type closeConnection struct {
 	connId int32
 	resp   chan error
+	reason CloseReason
+}
+
+// ConnectionClosed is notified when the connection is closed, either by Manager or after ReconnectFailed.
+// Reason is CloseGraceful on a close by Manager, or the reason of the drop after ReconnectFailed.
+type ConnectionClosed struct {
+	ConnId int32
+	Reason CloseReason
+}
+
+// CloseReason tells why a connection is closed, or why its session is dropped and refreshed.
+type CloseReason int
+
+const (
+	// CloseGraceful is of Conn.Close, Manager.Finish, AuthLogOut, or a connection closed by the manager, e.g., idle.
+	CloseGraceful CloseReason = iota
+	// CloseNetworkError is of a read failure or a dead connection, which is reconnected.
+	CloseNetworkError
+	// CloseServerClose is of the server closing the connection, which is reconnected.
+	CloseServerClose
+	// CloseAuthRevoked is of the key revoked by the server, which cannot reconnect.
+	CloseAuthRevoked
+)
+
+func (reason CloseReason) String() string {
+	switch reason {
+	case CloseGraceful:
+		return "graceful"
+	case CloseNetworkError:
+		return "network error"
+	case CloseServerClose:
+		return "server close"
+	case CloseAuthRevoked:
+		return "auth revoked"
+	}
+	return fmt.Sprintf("CloseReason(%d)", int(reason))
+}
+
+// reconnects reports whether the session dropped by the reason is refreshed rather than closed
+func (reason CloseReason) reconnects() bool {
+	return reason == CloseNetworkError || reason == CloseServerClose
 }
-type connectionClosed struct {
-	closedConnId int32
+
+// Reconnecting is notified to the connection listeners before a reconnection attempt after a connection drop.
+type Reconnecting struct {
+	ConnId  int32
+	Attempt int
+	Delay   time.Duration // before the attempt
+}
+
+// Reconnected is notified when the connection has a new session after a connection drop.
+// The missed updates are caught up by updates.getDifference.
+type Reconnected struct {
+	ConnId   int32
+	Attempts int
+}
+
+// ReconnectFailed is notified when the connection gives up reconnecting after MaxReconnectAttempts failures.
+// The connection is closed after it.
+type ReconnectFailed struct {
+	ConnId int32
+	Err    error
+}
+
+// SessionRevoked is notified when the server revokes the key of the session with AUTH_KEY_UNREGISTERED.
+// The key file is removed, and the connection is closed after it.
+type SessionRevoked struct {
+	ConnId    int32
+	SessionId int64
 }
 
 // Update Event
@@ -98,6 +216,11 @@ type updateReceived struct {
 	update Update
 }
 
+// Query Event, answered on the manage routine
+type statsQuery struct {
+	resp chan Stats
+}
+
 func (e newsession) Type() EventType         { return SESSION }
 func (e loadsession) Type() EventType        { return SESSION }
 func (e SessionEstablished) Type() EventType { return SESSION }
@@ -109,8 +232,13 @@ func (e ConnectionOpened) Type() EventType   { return MCONN }
 func (e sessionBound) Type() EventType       { return MCONN }
 func (e sessionUnbound) Type() EventType     { return MCONN }
 func (e closeConnection) Type() EventType    { return MCONN }
-func (e connectionClosed) Type() EventType   { return MCONN }
+func (e ConnectionClosed) Type() EventType   { return MCONN }
+func (e Reconnecting) Type() EventType       { return MCONN }
+func (e Reconnected) Type() EventType        { return MCONN }
+func (e ReconnectFailed) Type() EventType    { return MCONN }
+func (e SessionRevoked) Type() EventType     { return SESSION }
 func (e updateReceived) Type() EventType     { return SESSION }
+func (e statsQuery) Type() EventType         { return MCONN }
 
 //func (e newsession) SessionId() (int64)          {return 0}
 //func (e loadsession) SessionId() (int64)         {return 0}
@@ -129,7 +257,7 @@ func (e updateReceived) Type() EventType     { return SESSION }
 //}
 //func (e sessionUnbound) SessionId() (int64) 		{return e.unboundSessionId}
 //func (e closeConnection) SessionId() (int64) 	{return 0}
-//func (e connectionClosed) SessionId() (int64) 	{return 0}
+//func (e ConnectionClosed) SessionId() (int64) 	{return 0}
 //
 //func (e newsession) ConnectionId() (int32)         {return 0}
 //func (e loadsession) ConnectionId() (int32)        {return 0}
@@ -142,7 +270,7 @@ func (e updateReceived) Type() EventType     { return SESSION }
 //func (e sessionBound) ConnectionId() (int32)       {return e.mconn.connId}
 //func (e sessionUnbound) ConnectionId() (int32)     {return e.mconn.connId}
 //func (e closeConnection) ConnectionId() (int32)    {return e.connId}
-//func (e connectionClosed) ConnectionId() (int32)   {return e.closedConnId}
+//func (e ConnectionClosed) ConnectionId() (int32)   {return e.ConnId}
 
 type Update interface {
 	Predicate
@@ -169,10 +297,13 @@ func (u *PredUpdateShortMessage) UpdateDate() int32     { return u.Date }
 func (u *PredUpdateShortChatMessage) UpdateDate() int32 { return u.Date }
 func (u *PredUpdateShort) UpdateDate() int32            { return u.Date }
 func (u *PredUpdates) UpdateDate() int32                { return u.Date }
+func (u *PredUpdatesCombined) UpdateDate() int32        { return u.Date }
+func (u *PredUpdatesTooLong) UpdateDate() int32         { return 0 }
 func (u *PredUpdateShortSentMessage) UpdateDate() int32 { return u.Date }
 
-func (u *PredUpdatesDifference) UpdateDate() int32      { return 0 }
-func (u *PredUpdatesDifferenceSlice) UpdateDate() int32 { return 0 }
+func (u *PredUpdatesDifference) UpdateDate() int32        { return 0 }
+func (u *PredUpdatesDifferenceSlice) UpdateDate() int32   { return 0 }
+func (u *PredUpdatesChannelDifference) UpdateDate() int32 { return 0 }
 
 //func (u US_updates_difference) UpdateDate() int32         { return 0 }
 func (u *PredUpdateNewMessage) UpdateDate() int32           { return 0 }
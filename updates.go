@@ -0,0 +1,229 @@
+package mtproto
+
+import (
+	"fmt"
+
+	"golang.org/x/net/context"
+)
+
+// UpdatesGetDifference propagates the updates missed since the last known state to the update callbacks,
+// and advances the state of the session.
+// The last known state is the state persisted in the key file, the state of the discarded session on reconnect,
+// or the state of the current session, in the order.
+// If the known state is too old, the updates are skipped to the current state of updates.getState.
+func (mconn *Conn) UpdatesGetDifference() error {
+	_, err := mconn.updatesGetDifference(context.Background())
+	return err
+}
+
+// UpdatesGetDifferenceContext is UpdatesGetDifference which gives up on ctx done.
+func (mconn *Conn) UpdatesGetDifferenceContext(ctx context.Context) error {
+	_, err := mconn.updatesGetDifference(ctx)
+	return err
+}
+
+// updatesGetDifference is UpdatesGetDifferenceContext returning the propagated updates as well
+func (mconn *Conn) updatesGetDifference(ctx context.Context) ([]Update, error) {
+	session, err := mconn.Session()
+	if err != nil {
+		return nil, err
+	}
+	state := session.persistedUpdatesState
+	if state == nil {
+		state = mconn.discardedUpdatesState
+	}
+	if state == nil {
+		state = session.copyUpdatesState()
+	}
+	if state == nil {
+		return nil, fmt.Errorf("no updates state")
+	}
+
+	missed, state, err := catchUpMissed(mconn.contextRPC(ctx), state, mconn.propagate)
+	if err != nil {
+		return nil, err
+	}
+	session.setUpdatesState(state)
+	session.persistedUpdatesState = nil
+	mconn.discardedUpdatesState = nil
+	return missed, nil
+}
+
+// UpdatesGetState returns the current updates state of the account.
+// It returns an error with IsUnauthorized if the connection is not signed in.
+func (mconn *Conn) UpdatesGetState() (*PredUpdatesState, error) {
+	return getState(mconn)
+}
+
+// UpdatesGetStateContext is UpdatesGetState which gives up on ctx done.
+func (mconn *Conn) UpdatesGetStateContext(ctx context.Context) (*PredUpdatesState, error) {
+	return getState(mconn.contextRPC(ctx))
+}
+
+// loadUpdatesState sets the current updates state on the loaded session
+func loadUpdatesState(rpc RemoteProcedureCall, session *Session) error {
+	state, err := getState(rpc)
+	if err != nil {
+		return err
+	}
+	session.setUpdatesState(state)
+	return nil
+}
+
+// catchUpPersisted returns the updates missed since the state persisted in the key file,
+// and advances the state of the session.
+func (mconn *Conn) catchUpPersisted() ([]Update, error) {
+	session, err := mconn.Session()
+	if err != nil {
+		return nil, err
+	}
+	if session.persistedUpdatesState == nil {
+		return nil, nil
+	}
+	missed, state, err := catchUpOnLoad(mconn, session.persistedUpdatesState)
+	if err != nil {
+		return nil, err
+	}
+	session.setUpdatesState(state)
+	session.persistedUpdatesState = nil
+	return missed, nil
+}
+
+// catchUpOnLoad collects the differences from the persisted state, if updates.getState is ahead of it.
+func catchUpOnLoad(rpc RemoteProcedureCall, persisted *PredUpdatesState) ([]Update, *PredUpdatesState, error) {
+	current, err := getState(rpc)
+	if err != nil {
+		return nil, nil, err
+	}
+	if current.Pts == persisted.Pts && current.Qts == persisted.Qts {
+		return nil, current, nil
+	}
+	var missed []Update
+	state, err := catchUp(rpc, persisted, func(u Update) {
+		missed = append(missed, u)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return missed, state, nil
+}
+
+// catchUpMissed propagates the difference from the state, and returns it as well.
+func catchUpMissed(rpc RemoteProcedureCall, state *PredUpdatesState, propagate func(Update)) ([]Update, *PredUpdatesState, error) {
+	var missed []Update
+	next, err := catchUp(rpc, state, func(u Update) {
+		missed = append(missed, u)
+		propagate(u)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return missed, next, nil
+}
+
+// catchUp gets the difference from the state, or the current state if the state is too old to get the difference.
+func catchUp(rpc RemoteProcedureCall, state *PredUpdatesState, propagate func(Update)) (*PredUpdatesState, error) {
+	next, err := getDifference(rpc, state, propagate)
+	if rpcErr, ok := err.(RPCError); ok && rpcErr.Message == "PERSISTENT_TIMESTAMP_INVALID" {
+		logln(rpc, "the updates state is stale. skip to the current state")
+		return getState(rpc)
+	}
+	return next, err
+}
+
+func getState(rpc RemoteProcedureCall) (*PredUpdatesState, error) {
+	data, err := rpc.InvokeBlocked(&ReqUpdatesGetState{})
+	if err != nil {
+		return nil, err
+	}
+	state, ok := data.(*PredUpdatesState)
+	if !ok {
+		return nil, fmt.Errorf("RPC: %#v", data)
+	}
+	return state, nil
+}
+
+// advancePts advances the state by the pts of an affected-messages result.
+// It returns false on a gap, which the next getDifference fills.
+func advancePts(state *PredUpdatesState, pts, ptsCount int32) bool {
+	if state.Pts+ptsCount != pts {
+		return state.Pts >= pts
+	}
+	state.Pts = pts
+	return true
+}
+
+// getDifference calls updates.getDifference until differenceEmpty, and returns the last state.
+func getDifference(rpc RemoteProcedureCall, state *PredUpdatesState, propagate func(Update)) (*PredUpdatesState, error) {
+	next := *state
+	for {
+		data, err := rpc.InvokeBlocked(&ReqUpdatesGetDifference{
+			Pts:  next.Pts,
+			Date: next.Date,
+			Qts:  next.Qts,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		switch x := data.(type) {
+		case *PredUpdatesDifferenceEmpty:
+			next.Date = x.Date
+			next.Seq = x.Seq
+			return &next, nil
+		case *PredUpdatesDifference:
+			propagate(x)
+			if s := x.GetState().GetValue(); s != nil {
+				next = *s
+			}
+		case *PredUpdatesDifferenceSlice:
+			propagate(x)
+			if s := x.GetIntermediateState().GetValue(); s != nil {
+				next = *s
+			}
+		case *PredUpdatesDifferenceTooLong:
+			// too many updates to get. skip to the pts
+			logf("getDifference", "difference too long. skip to pts %d\n", x.Pts)
+			next.Pts = x.Pts
+			return &next, nil
+		default:
+			return nil, fmt.Errorf("RPC: %#v", data)
+		}
+	}
+}
+
+// channelDifferenceLimit is the most messages of a channel difference
+const channelDifferenceLimit = 100
+
+// getChannelDifference calls updates.getChannelDifference until the final difference, and returns the last pts.
+// The difference too long to get is passed to tooLong rather than propagate, for the channel needs a resync.
+func getChannelDifference(rpc RemoteProcedureCall, channel *TypeInputChannel, pts int32, propagate func(Update), tooLong func(*PredUpdatesChannelDifferenceTooLong)) (int32, error) {
+	for {
+		data, err := rpc.InvokeBlocked(&ReqUpdatesGetChannelDifference{
+			Channel: channel,
+			Filter:  &TypeChannelMessagesFilter{&TypeChannelMessagesFilter_ChannelMessagesFilterEmpty{&PredChannelMessagesFilterEmpty{}}},
+			Pts:     pts,
+			Limit:   channelDifferenceLimit,
+		})
+		if err != nil {
+			return 0, err
+		}
+
+		switch x := data.(type) {
+		case *PredUpdatesChannelDifferenceEmpty:
+			return x.Pts, nil
+		case *PredUpdatesChannelDifference:
+			propagate(x)
+			pts = x.Pts
+			if x.Flags&(1<<0) != 0 {
+				// final
+				return pts, nil
+			}
+		case *PredUpdatesChannelDifferenceTooLong:
+			tooLong(x)
+			return x.Pts, nil
+		default:
+			return 0, fmt.Errorf("RPC: %#v", data)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package mtproto
+
+import (
+	"fmt"
+	"testing"
+)
+
+// differenceRPC responds with the differences in order
+type differenceRPC struct {
+	diffs []interface{}
+	reqs  []*ReqUpdatesGetDifference
+}
+
+func (r *differenceRPC) InvokeBlocked(msg TL) (interface{}, error) {
+	r.reqs = append(r.reqs, msg.(*ReqUpdatesGetDifference))
+	diff := r.diffs[0]
+	r.diffs = r.diffs[1:]
+	return diff, nil
+}
+
+func TestGetDifferenceUntilEmpty(t *testing.T) {
+	rpc := &differenceRPC{diffs: []interface{}{
+		&PredUpdatesDifferenceSlice{IntermediateState: &TypeUpdatesState{&PredUpdatesState{Pts: 20, Qts: 1, Date: 200, Seq: 2}}},
+		&PredUpdatesDifference{State: &TypeUpdatesState{&PredUpdatesState{Pts: 30, Qts: 2, Date: 300, Seq: 3}}},
+		&PredUpdatesDifferenceEmpty{Date: 310, Seq: 4},
+	}}
+	var propagated []Update
+	state, err := getDifference(rpc, &PredUpdatesState{Pts: 10, Date: 100, Seq: 1}, func(u Update) {
+		propagated = append(propagated, u)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(propagated) != 2 {
+		t.Errorf("expected 2 propagated differences, but %d", len(propagated))
+	}
+	var pts []int32
+	for _, req := range rpc.reqs {
+		pts = append(pts, req.Pts)
+	}
+	if fmt.Sprint(pts) != "[10 20 30]" {
+		t.Errorf("unexpected requested pts %v", pts)
+	}
+	if state.Pts != 30 || state.Qts != 2 || state.Date != 310 || state.Seq != 4 {
+		t.Errorf("unexpected state %v", state)
+	}
+}
+
+// staleStateRPC rejects the difference of the stale state, and responds with the current state
+type staleStateRPC struct {
+	reqs []TL
+}
+
+func (r *staleStateRPC) InvokeBlocked(msg TL) (interface{}, error) {
+	r.reqs = append(r.reqs, msg)
+	if _, ok := msg.(*ReqUpdatesGetDifference); ok {
+		return nil, RPCError{400, "PERSISTENT_TIMESTAMP_INVALID"}
+	}
+	return &PredUpdatesState{Pts: 50, Qts: 5, Date: 500, Seq: 5}, nil
+}
+
+func TestCatchUpStaleState(t *testing.T) {
+	rpc := &staleStateRPC{}
+	state, err := catchUp(rpc, &PredUpdatesState{Pts: 10, Date: 100, Seq: 1}, func(Update) {
+		t.Error("no update is expected")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rpc.reqs) != 2 {
+		t.Fatalf("expected getDifference and getState, but %v", rpc.reqs)
+	}
+	if _, ok := rpc.reqs[1].(*ReqUpdatesGetState); !ok {
+		t.Errorf("unexpected fallback %#v", rpc.reqs[1])
+	}
+	if state.Pts != 50 || state.Seq != 5 {
+		t.Errorf("unexpected state %v", state)
+	}
+}
+
+func TestAdvancePts(t *testing.T) {
+	state := &PredUpdatesState{Pts: 10}
+	if !advancePts(state, 12, 2) || state.Pts != 12 {
+		t.Errorf("pts is not advanced, %d", state.Pts)
+	}
+	if !advancePts(state, 12, 2) || state.Pts != 12 {
+		t.Errorf("pts is advanced by an applied result, %d", state.Pts)
+	}
+	if advancePts(state, 20, 1) || state.Pts != 12 {
+		t.Errorf("pts is advanced over a gap, %d", state.Pts)
+	}
+}
+
+// loadRPC responds to updates.getState with the current state, and to updates.getDifference with the differences in order
+type loadRPC struct {
+	current *PredUpdatesState
+	differenceRPC
+}
+
+func (r *loadRPC) InvokeBlocked(msg TL) (interface{}, error) {
+	if _, ok := msg.(*ReqUpdatesGetState); ok {
+		return r.current, nil
+	}
+	return r.differenceRPC.InvokeBlocked(msg)
+}
+
+func TestCatchUpOnLoadBehind(t *testing.T) {
+	rpc := &loadRPC{current: &PredUpdatesState{Pts: 30, Qts: 2, Date: 300, Seq: 3}}
+	rpc.diffs = []interface{}{
+		&PredUpdatesDifference{State: &TypeUpdatesState{&PredUpdatesState{Pts: 30, Qts: 2, Date: 300, Seq: 3}}},
+		&PredUpdatesDifferenceEmpty{Date: 310, Seq: 4},
+	}
+	missed, state, err := catchUpOnLoad(rpc, &PredUpdatesState{Pts: 10, Date: 100, Seq: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(missed) != 1 {
+		t.Errorf("expected 1 missed difference, but %d", len(missed))
+	}
+	if len(rpc.reqs) == 0 || rpc.reqs[0].Pts != 10 {
+		t.Errorf("the difference is not from the persisted pts")
+	}
+	if state.Pts != 30 || state.Date != 310 || state.Seq != 4 {
+		t.Errorf("unexpected state %v", state)
+	}
+
+	// up to date
+	rpc.reqs = nil
+	missed, state, err = catchUpOnLoad(rpc, &PredUpdatesState{Pts: 30, Qts: 2, Date: 250, Seq: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(missed) != 0 || len(rpc.reqs) != 0 || state.Pts != 30 {
+		t.Errorf("%d missed, %d differences, state %v", len(missed), len(rpc.reqs), state)
+	}
+}
+
+// unregisteredRPC fails as the key of a logged out account
+type unregisteredRPC struct{}
+
+func (unregisteredRPC) InvokeBlocked(msg TL) (interface{}, error) {
+	return nil, toError(TL_rpc_error{errorUnauthorized, "AUTH_KEY_UNREGISTERED"})
+}
+
+func TestLoadUpdatesState(t *testing.T) {
+	session := &Session{updatesState: &PredUpdatesState{}}
+	rpc := &recordRPC{resp: &PredUpdatesState{Pts: 10, Qts: 2, Date: 100, Seq: 3}}
+	if err := loadUpdatesState(rpc, session); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := rpc.reqs[0].(*ReqUpdatesGetState); !ok {
+		t.Errorf("unexpected request %T", rpc.reqs[0])
+	}
+	if state := session.updatesState; state.Pts != 10 || state.Qts != 2 || state.Date != 100 || state.Seq != 3 {
+		t.Errorf("unexpected updates state %v", state)
+	}
+
+	// the state of an unauthorized key is left
+	session = &Session{}
+	if err := loadUpdatesState(unregisteredRPC{}, session); !IsUnauthorized(err) {
+		t.Errorf("unexpected error %v", err)
+	}
+	if session.updatesState != nil {
+		t.Errorf("unexpected updates state %v", session.updatesState)
+	}
+}
+
+func TestCatchUpMissedWhileReconnecting(t *testing.T) {
+	// the state kept on discarding the session
+	discarded := &PredUpdatesState{Pts: 10, Date: 100, Seq: 1}
+	// a message arrived before the reloaded session is bound
+	arrived := &PredUpdatesDifference{
+		NewMessages: []*TypeMessage{{&TypeMessage_Message{&PredMessage{Id: 7, Message: "in the gap"}}}},
+		State:       &TypeUpdatesState{&PredUpdatesState{Pts: 11, Date: 110, Seq: 1}},
+	}
+	rpc := &differenceRPC{diffs: []interface{}{arrived, &PredUpdatesDifferenceEmpty{Date: 120, Seq: 2}}}
+	var propagated []Update
+	missed, state, err := catchUpMissed(rpc, discarded, func(u Update) {
+		propagated = append(propagated, u)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(missed) != 1 || missed[0] != arrived || len(propagated) != 1 || propagated[0] != arrived {
+		t.Errorf("missed %v, propagated %v", missed, propagated)
+	}
+	if rpc.reqs[0].Pts != 10 || state.Pts != 11 || state.Seq != 2 {
+		t.Errorf("unexpected getDifference %v, state %v", rpc.reqs, state)
+	}
+	if discarded.Pts != 10 {
+		t.Errorf("the discarded state is changed")
+	}
+}
@@ -0,0 +1,289 @@
+package mtproto
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	UploadPartSize = 512 * 1024
+
+	// Files larger than this are uploaded by upload.saveBigFilePart
+	BigFileSize = 10 * 1024 * 1024
+)
+
+// UploadOption sets an option of UploadFile.
+type UploadOption func(u *uploader)
+
+// WithUploadSize gives the file size, when the reader cannot tell it.
+// Without the size, UploadFile reads the whole file into memory to know it.
+func WithUploadSize(size int64) UploadOption {
+	return func(u *uploader) {
+		u.size = size
+	}
+}
+
+// WithUploadProgress calls progress after every uploaded part.
+func WithUploadProgress(progress func(uploaded, total int64)) UploadOption {
+	return func(u *uploader) {
+		u.progress = progress
+	}
+}
+
+// WithUploadResume continues the upload interrupted by err.
+// The reader should read the file from the beginning again. The parts uploaded already are skipped.
+func WithUploadResume(err *UploadInterruptedError) UploadOption {
+	return func(u *uploader) {
+		u.fileId = err.FileId
+		u.resumePart = err.Part
+	}
+}
+
+// UploadInterruptedError is returned when UploadFile fails. Part is the first part not uploaded,
+// and Err is the first error of the parts. Pass it to WithUploadResume to continue the upload.
+type UploadInterruptedError struct {
+	FileId int64
+	Part   int32
+	Err    error
+}
+
+func (e *UploadInterruptedError) Error() string {
+	return fmt.Sprintf("upload of file %d is interrupted at part %d: %v", e.FileId, e.Part, e.Err)
+}
+
+type uploader struct {
+	rpc         RemoteProcedureCall
+	size        int64
+	progress    func(uploaded, total int64)
+	fileId      int64
+	resumePart  int32
+	concurrency int
+}
+
+// UploadFile uploads the file read from r, and returns the InputFile to attach to messages.
+// The file is split into UploadPartSize parts, and a file larger than BigFileSize is uploaded as a big file.
+// Configuration.UploadConcurrency parts are uploaded at once.
+func (mconn *Conn) UploadFile(r io.Reader, filename string, opts ...UploadOption) (*TypeInputFile, error) {
+	return uploadFile(mconn, r, filename, opts...)
+}
+
+// UploadFileContext is UploadFile which gives up on ctx done.
+// The parts uploaded already are kept, so UploadInterruptedError resumes the upload.
+func (mconn *Conn) UploadFileContext(ctx context.Context, r io.Reader, filename string, opts ...UploadOption) (*TypeInputFile, error) {
+	return uploadFile(mconn.contextRPC(ctx), r, filename, opts...)
+}
+
+func uploadFile(rpc RemoteProcedureCall, r io.Reader, filename string, opts ...UploadOption) (*TypeInputFile, error) {
+	u := &uploader{rpc: rpc, concurrency: rpcUploadConcurrency(rpc)}
+	for _, opt := range opts {
+		opt(u)
+	}
+	if u.concurrency < 1 {
+		u.concurrency = defaultUploadConcurrency
+	}
+	if u.fileId == 0 {
+		u.fileId = randInt63(rpcRandSource(rpc))
+	}
+	if u.size == 0 {
+		var err error
+		r, u.size, err = readerSize(r)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if u.size == 0 {
+		return nil, fmt.Errorf("empty file, %s", filename)
+	}
+	return u.upload(r, filename)
+}
+
+// readerSize tells the size of the rest of r.
+// If r does not know it, r is read into memory.
+func readerSize(r io.Reader) (io.Reader, int64, error) {
+	switch x := r.(type) {
+	case interface{ Len() int }:
+		return r, int64(x.Len()), nil
+	case interface{ Stat() (os.FileInfo, error) }:
+		if fi, err := x.Stat(); err == nil && fi.Mode().IsRegular() {
+			if seeker, ok := r.(io.Seeker); ok {
+				if off, err := seeker.Seek(0, io.SeekCurrent); err == nil {
+					return r, fi.Size() - off, nil
+				}
+			}
+		}
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, 0, err
+	}
+	return bytes.NewReader(b), int64(len(b)), nil
+}
+
+// uploadPart is a part read from the file, to be saved by a worker of the upload
+type uploadPart struct {
+	part  int32
+	bytes []byte
+}
+
+func (u *uploader) upload(r io.Reader, filename string) (*TypeInputFile, error) {
+	big := u.size > BigFileSize
+	totalParts := int32((u.size + UploadPartSize - 1) / UploadPartSize)
+	var md5sum hash.Hash
+	if !big {
+		md5sum = md5.New()
+	}
+
+	var (
+		mutex    sync.Mutex
+		uploaded int64
+		saved    = make([]bool, totalParts)
+		failure  error
+		stop     = make(chan struct{})
+	)
+	// fail stops the upload on the first error; the parts being saved are still waited for
+	fail := func(err error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if failure == nil {
+			failure = err
+			close(stop)
+		}
+	}
+	done := func(part int32, n int, report bool) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		saved[part] = true
+		uploaded += int64(n)
+		// the parts are saved out of order, but the total of the saved bytes only grows
+		if report && u.progress != nil {
+			u.progress(uploaded, u.size)
+		}
+	}
+
+	// the workers save distinct parts at once over the same session
+	parts := make(chan uploadPart)
+	var workers sync.WaitGroup
+	for i := 0; i < u.concurrency; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for p := range parts {
+				select {
+				case <-stop:
+					continue
+				default:
+				}
+				if err := u.savePart(p, big, totalParts); err != nil {
+					fail(err)
+					continue
+				}
+				done(p.part, len(p.bytes), true)
+			}
+		}()
+	}
+
+	// the parts are read in order, as the MD5 checksum needs them so
+read:
+	for part := int32(0); part < totalParts; part++ {
+		// a part buffer is not reused, because a timed-out request can be still in the send queue
+		buf := make([]byte, UploadPartSize)
+		n, err := io.ReadFull(r, buf)
+		if err == io.ErrUnexpectedEOF && part == totalParts-1 {
+			err = nil
+		}
+		if err != nil {
+			fail(err)
+			break
+		}
+		if md5sum != nil {
+			md5sum.Write(buf[:n])
+		}
+
+		// skip the parts uploaded before the interruption
+		if part < u.resumePart {
+			done(part, n, false)
+			continue
+		}
+
+		select {
+		case parts <- uploadPart{part, buf[:n]}:
+		case <-stop:
+			break read
+		}
+	}
+	close(parts)
+	workers.Wait()
+
+	if failure != nil {
+		// the upload resumes from the first part not saved, though some of the later ones may be saved
+		part := int32(0)
+		for part < totalParts && saved[part] {
+			part++
+		}
+		return nil, &UploadInterruptedError{u.fileId, part, failure}
+	}
+
+	if big {
+		return &TypeInputFile{&TypeInputFile_InputFileBig{&PredInputFileBig{
+			Id:    u.fileId,
+			Parts: totalParts,
+			Name:  filename,
+		}}}, nil
+	}
+	return &TypeInputFile{&TypeInputFile_InputFile{&PredInputFile{
+		Id:          u.fileId,
+		Parts:       totalParts,
+		Name:        filename,
+		Md5Checksum: fmt.Sprintf("%x", md5sum.Sum(nil)),
+	}}}, nil
+}
+
+func (u *uploader) savePart(p uploadPart, big bool, totalParts int32) error {
+	var req TL
+	if big {
+		req = &ReqUploadSaveBigFilePart{
+			FileId:         u.fileId,
+			FilePart:       p.part,
+			FileTotalParts: totalParts,
+			Bytes:          p.bytes,
+		}
+	} else {
+		req = &ReqUploadSaveFilePart{
+			FileId:   u.fileId,
+			FilePart: p.part,
+			Bytes:    p.bytes,
+		}
+	}
+	data, err := u.rpc.InvokeBlocked(req)
+	if err != nil {
+		return err
+	}
+	if tl, ok := data.(TL); !ok || !toBool(tl) {
+		return fmt.Errorf("RPC: %#v", data)
+	}
+	return nil
+}
+
+// rpcUploadConcurrency is the upload concurrency of the connection of the RPC, or 1.
+func rpcUploadConcurrency(rpc RemoteProcedureCall) int {
+	if x, ok := rpc.(interface{ uploadConcurrency() int }); ok {
+		return x.uploadConcurrency()
+	}
+	return defaultUploadConcurrency
+}
+
+func (mconn *Conn) uploadConcurrency() int {
+	session, err := mconn.Session()
+	if err != nil {
+		return defaultUploadConcurrency
+	}
+	return session.appConfig.uploadConcurrency()
+}
@@ -0,0 +1,185 @@
+package mtproto
+
+import (
+	"bytes"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// partRPC keeps the uploaded parts, and fails on the part of failAt.
+// It saves concurrency parts at once, each taking latency.
+type partRPC struct {
+	mutex       sync.Mutex
+	parts       map[int32][]byte
+	big         bool
+	total       int32
+	failAt      int32
+	concurrency int
+	latency     time.Duration
+}
+
+func (r *partRPC) uploadConcurrency() int {
+	return r.concurrency
+}
+
+func (r *partRPC) InvokeBlocked(msg TL) (interface{}, error) {
+	time.Sleep(r.latency)
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var part int32
+	var b []byte
+	switch x := msg.(type) {
+	case *ReqUploadSaveFilePart:
+		part, b = x.FilePart, x.Bytes
+	case *ReqUploadSaveBigFilePart:
+		part, b, r.big, r.total = x.FilePart, x.Bytes, true, x.FileTotalParts
+	default:
+		return nil, fmt.Errorf("unexpected request %T", msg)
+	}
+	if part == r.failAt {
+		r.failAt = -1
+		return nil, errors.New("connection lost")
+	}
+	r.parts[part] = b
+	return &PredBoolTrue{}, nil
+}
+
+func (r *partRPC) file() []byte {
+	var file []byte
+	for i := int32(0); i < int32(len(r.parts)); i++ {
+		file = append(file, r.parts[i]...)
+	}
+	return file
+}
+
+func testFile(size int) []byte {
+	b := make([]byte, size)
+	for i := range b {
+		b[i] = byte(i * 7)
+	}
+	return b
+}
+
+func TestUploadBigFileBoundary(t *testing.T) {
+	for _, tc := range []struct {
+		size  int
+		big   bool
+		parts int32
+	}{
+		{BigFileSize, false, 20},
+		{BigFileSize + 1, true, 21},
+	} {
+		file := testFile(tc.size)
+		rpc := &partRPC{parts: map[int32][]byte{}, failAt: -1}
+		inputFile, err := uploadFile(rpc, bytes.NewReader(file), "file.bin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rpc.big != tc.big || len(rpc.parts) != int(tc.parts) || !bytes.Equal(rpc.file(), file) {
+			t.Errorf("size %d: big %v, %d parts", tc.size, rpc.big, len(rpc.parts))
+		}
+		if tc.big {
+			if x := inputFile.GetInputFileBig(); x == nil || x.Parts != tc.parts || rpc.total != tc.parts {
+				t.Errorf("size %d: unexpected input file %v", tc.size, inputFile)
+			}
+		} else {
+			x := inputFile.GetInputFile()
+			if x == nil || x.Parts != tc.parts || x.Md5Checksum != fmt.Sprintf("%x", md5.Sum(file)) {
+				t.Errorf("size %d: unexpected input file %v", tc.size, inputFile)
+			}
+		}
+	}
+}
+
+func TestUploadResume(t *testing.T) {
+	file := testFile(3*UploadPartSize + 10)
+	rpc := &partRPC{parts: map[int32][]byte{}, failAt: 2}
+	var progress []int64
+	onProgress := func(uploaded, total int64) { progress = append(progress, uploaded) }
+
+	_, err := uploadFile(rpc, bytes.NewReader(file), "file.bin", WithUploadProgress(onProgress))
+	interrupted, ok := err.(*UploadInterruptedError)
+	if !ok || interrupted.Part != 2 {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	inputFile, err := uploadFile(rpc, bytes.NewReader(file), "file.bin",
+		WithUploadProgress(onProgress), WithUploadResume(interrupted))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inputFile.GetInputFile().Id != interrupted.FileId || !bytes.Equal(rpc.file(), file) {
+		t.Errorf("resumed upload is different: %v", inputFile)
+	}
+	expected := []int64{UploadPartSize, 2 * UploadPartSize, 3 * UploadPartSize, int64(len(file))}
+	if fmt.Sprint(progress) != fmt.Sprint(expected) {
+		t.Errorf("expected progress %v, but %v", expected, progress)
+	}
+}
+
+func TestUploadParallel(t *testing.T) {
+	file := testFile(BigFileSize + 5*UploadPartSize + 10)
+	rpc := &partRPC{parts: map[int32][]byte{}, failAt: 7, concurrency: 4}
+	var mutex sync.Mutex
+	var progress []int64
+	onProgress := func(uploaded, total int64) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if len(progress) > 0 && uploaded <= progress[len(progress)-1] {
+			t.Errorf("progress %d after %d", uploaded, progress[len(progress)-1])
+		}
+		progress = append(progress, uploaded)
+	}
+
+	_, err := uploadFile(rpc, bytes.NewReader(file), "file.bin", WithUploadProgress(onProgress))
+	interrupted, ok := err.(*UploadInterruptedError)
+	if !ok || interrupted.Part > 7 {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for part := int32(0); part < interrupted.Part; part++ {
+		if _, ok := rpc.parts[part]; !ok {
+			t.Errorf("part %d before part %d is not uploaded", part, interrupted.Part)
+		}
+	}
+	progress = nil
+
+	inputFile, err := uploadFile(rpc, bytes.NewReader(file), "file.bin",
+		WithUploadProgress(onProgress), WithUploadResume(interrupted))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if x := inputFile.GetInputFileBig(); x == nil || x.Parts != 26 || rpc.total != 26 || !bytes.Equal(rpc.file(), file) {
+		t.Errorf("unexpected input file %v, total parts %d", inputFile, rpc.total)
+	}
+	if progress[len(progress)-1] != int64(len(file)) {
+		t.Errorf("progress ends at %d", progress[len(progress)-1])
+	}
+}
+
+func benchmarkUpload(b *testing.B, concurrency int) {
+	file := testFile(50 * 1024 * 1024)
+	b.SetBytes(int64(len(file)))
+	for i := 0; i < b.N; i++ {
+		rpc := &partRPC{parts: map[int32][]byte{}, failAt: -1, concurrency: concurrency, latency: time.Millisecond}
+		if _, err := uploadFile(rpc, bytes.NewReader(file), "file.bin"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkUploadSerial(b *testing.B)   { benchmarkUpload(b, 1) }
+func BenchmarkUploadParallel(b *testing.B) { benchmarkUpload(b, 8) }
+
+// The upload with ctx keeps the concurrency of the connection.
+func TestUploadContextConcurrency(t *testing.T) {
+	mconn := &Conn{session: &Session{appConfig: Configuration{UploadConcurrency: 4}}}
+	if n := rpcUploadConcurrency(mconn.contextRPC(context.Background())); n != 4 {
+		t.Errorf("upload concurrency %d, expected 4", n)
+	}
+}